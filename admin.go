@@ -0,0 +1,102 @@
+package segment
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Authorizer returns the admin actor for a request, or false if unauthorized
+type Authorizer func(r *http.Request) (string, bool)
+
+// BasicAuthorizer authorizes admin requests with basic auth user and password
+func BasicAuthorizer(user, password string) Authorizer {
+	return func(r *http.Request) (string, bool) {
+		u, p, ok := r.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(u), []byte(user)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(p), []byte(password)) != 1 {
+			return u, false
+		}
+		return u, true
+	}
+}
+
+// adminHandler guards h with auth, recording failures to the audit log
+func (s *Segment) adminHandler(auth Authorizer, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		actor, ok := auth(r)
+		if !ok {
+			s.Logger.Printf("Admin unauthorized for %s\n", r.URL.Path)
+			s.audit.Record(AuditAuthFailure, actor, s.clientIP(r), map[string]string{"reason": "admin", "path": r.URL.Path})
+			w.Header().Set("WWW-Authenticate", `Basic realm="admin"`)
+			writeError(w, http.StatusUnauthorized, "unauthorized", "Admin authorization required")
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+var publishRuntime sync.Once
+
+// MountDebug adds pprof profiles at /debug/pprof/ and expvar runtime stats at /debug/vars to an admin router
+func (s *Segment) MountDebug(router *mux.Router, auth Authorizer) *Segment {
+	publishRuntime.Do(func() {
+		expvar.Publish("goroutines", expvar.Func(func() interface{} { return runtime.NumGoroutine() }))
+		expvar.Publish("cpus", expvar.Func(func() interface{} { return runtime.NumCPU() }))
+	})
+
+	s.Logger.Println("Adding debug handlers")
+	router.Handle("/debug/vars", s.adminHandler(auth, expvar.Handler()))
+	router.Handle("/debug/pprof/", s.adminHandler(auth, http.HandlerFunc(pprof.Index)))
+	router.Handle("/debug/pprof/cmdline", s.adminHandler(auth, http.HandlerFunc(pprof.Cmdline)))
+	router.Handle("/debug/pprof/profile", s.adminHandler(auth, http.HandlerFunc(pprof.Profile)))
+	router.Handle("/debug/pprof/symbol", s.adminHandler(auth, http.HandlerFunc(pprof.Symbol)))
+	router.Handle("/debug/pprof/trace", s.adminHandler(auth, http.HandlerFunc(pprof.Trace)))
+	router.Handle("/debug/pprof/{profile}", s.adminHandler(auth, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pprof.Handler(mux.Vars(r)["profile"]).ServeHTTP(w, r) // Named profiles eg heap, goroutine
+	})))
+	return s
+}
+
+// MountReplay adds a POST /replay endpoint to an admin router, replaying archived events
+// for `from` and `to` RFC3339 times and optional `projectId` through the live pipeline
+func (s *Segment) MountReplay(router *mux.Router, auth Authorizer, archiver *Archiver) *Segment {
+	s.Logger.Println("Adding replay handler")
+	router.Handle("/replay", s.adminHandler(auth, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		from, err1 := time.Parse(time.RFC3339, r.FormValue("from"))
+		to, err2 := time.Parse(time.RFC3339, r.FormValue("to"))
+		if err1 != nil || err2 != nil || !from.Before(to) {
+			writeError(w, http.StatusBadRequest, "invalid_request", "Expected RFC3339 from before to")
+			return
+		}
+		projectId := r.FormValue("projectId")
+
+		actor, _ := auth(r)
+		n, err := archiver.Replay(r.Context(), from, to, projectId, func(m SegmentEvent) error {
+			return s.sendExcept(r.Context(), m, archiver) // Don't archive again
+		})
+		s.audit.Record(AuditReplay, actor, s.clientIP(r), map[string]string{
+			"from":      from.Format(time.RFC3339),
+			"to":        to.Format(time.RFC3339),
+			"projectId": projectId,
+			"replayed":  strconv.Itoa(n),
+		})
+		if err != nil {
+			s.Logger.Printf("Replay error after %d events -- %v\n", n, err)
+			writeError(w, http.StatusInternalServerError, "replay_error", fmt.Sprintf("Replay failed after %d events", n))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "replayed": n})
+	}))).Methods("POST")
+	return s
+}
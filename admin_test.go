@@ -0,0 +1,25 @@
+package segment
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestMountDebugAuth(t *testing.T) {
+	router := mux.NewRouter()
+	admin := router.PathPrefix("/admin").Subrouter()
+	NewSegment(nil, nil, nil).MountDebug(admin, BasicAuthorizer("admin", "secret"))
+
+	for password, expected := range map[string]int{"secret": http.StatusOK, "wrong": http.StatusUnauthorized} {
+		req := httptest.NewRequest("GET", "/admin/debug/pprof/heap", nil)
+		req.SetBasicAuth("admin", password)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != expected {
+			t.Errorf("Expected %d for password %q, got %d", expected, password, w.Code)
+		}
+	}
+}
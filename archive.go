@@ -0,0 +1,497 @@
+package segment
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/xtgo/uuid"
+)
+
+// ArchiveStore is storage for immutable archive objects
+type ArchiveStore interface {
+	Put(ctx context.Context, key string, data []byte) error
+	Get(ctx context.Context, key string) ([]byte, error)
+	List(ctx context.Context, prefix string) ([]string, error)
+}
+
+// LocalArchiveStore stores objects as files under a directory
+type LocalArchiveStore struct {
+	dir string
+}
+
+// NewLocalArchiveStore creates a store under dir
+func NewLocalArchiveStore(dir string) *LocalArchiveStore {
+	return &LocalArchiveStore{dir: dir}
+}
+
+// Put writes the object, failing if it already exists
+func (s *LocalArchiveStore) Put(ctx context.Context, key string, data []byte) error {
+	name := filepath.Join(s.dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0444)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Get reads the object
+func (s *LocalArchiveStore) Get(ctx context.Context, key string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(s.dir, filepath.FromSlash(key)))
+}
+
+// List returns keys with prefix in order
+func (s *LocalArchiveStore) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	root := filepath.Join(s.dir, filepath.FromSlash(prefix))
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return filepath.SkipDir
+		}
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(s.dir, path)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, filepath.ToSlash(rel))
+		return nil
+	})
+	sort.Strings(keys)
+	return keys, err
+}
+
+// S3ArchiveStore stores objects in an S3 bucket under a prefix
+type S3ArchiveStore struct {
+	s3     *s3.S3
+	bucket string
+	prefix string
+}
+
+// NewS3ArchiveStore creates a store in region bucket under prefix
+func NewS3ArchiveStore(region, bucket, prefix string) *S3ArchiveStore {
+	cfg := aws.NewConfig().WithRegion(region)
+	sess := session.Must(session.NewSession(cfg))
+	return &S3ArchiveStore{
+		s3:     s3.New(sess, cfg),
+		bucket: bucket,
+		prefix: strings.TrimSuffix(prefix, "/"),
+	}
+}
+
+func (s *S3ArchiveStore) key(key string) string {
+	if s.prefix == "" {
+		return key
+	}
+	return s.prefix + "/" + key
+}
+
+// Put writes the object
+func (s *S3ArchiveStore) Put(ctx context.Context, key string, data []byte) error {
+	_, err := s.s3.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(key)),
+		Body:   bytes.NewReader(data),
+	})
+	return err
+}
+
+// Get reads the object
+func (s *S3ArchiveStore) Get(ctx context.Context, key string) ([]byte, error) {
+	out, err := s.s3.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(key)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+	return io.ReadAll(out.Body)
+}
+
+// List returns keys with prefix in order
+func (s *S3ArchiveStore) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	err := s.s3.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(s.key(prefix)),
+	}, func(page *s3.ListObjectsV2Output, last bool) bool {
+		for _, obj := range page.Contents {
+			keys = append(keys, strings.TrimPrefix(*obj.Key, s.prefix+"/"))
+		}
+		return true
+	})
+	return keys, err
+}
+
+// ArchiveConfig contains configuration parameters for the archiver
+type ArchiveConfig struct {
+	Name          string        `json:"name,omitempty"`          // Destination label of metrics, defaults to "archive"
+	BatchSize     int           `json:"batchSize,omitempty"`     // Defaults to 1000
+	FlushInterval time.Duration `json:"flushInterval,omitempty"` // Defaults to 1 minute
+	Retry         BackoffConfig `json:"retry,omitempty"`         // Retries for failed writes, defaults to 5 attempts
+	// Registerer for metrics, defaults to the prometheus default registerer
+	Registerer prometheus.Registerer `json:"-"`
+	// Clock for flush intervals and retry backoff, defaults to the system clock
+	Clock Clock `json:"-"`
+}
+
+// ArchiveManifest indexes an archive object for replay
+type ArchiveManifest struct {
+	Key          string         `json:"key"`
+	Count        int            `json:"count"`
+	ProjectIds   map[string]int `json:"projectIds"`
+	MinTimestamp time.Time      `json:"minTimestamp"`
+	MaxTimestamp time.Time      `json:"maxTimestamp"`
+}
+
+// Archiver is a destination writing an immutable hour partitioned copy of every event, with a manifest per object
+type Archiver struct {
+	Logger        *log.Logger // Public logger that caller can override
+	name          string      // Destination name for metrics
+	named         bool
+	store         ArchiveStore
+	size          int
+	flushInterval time.Duration
+	retry         BackoffConfig
+	messages      chan interface{}
+	dropped       *prometheus.CounterVec
+	clock         Clock
+}
+
+// NewArchiver creates a new archiver given store and configuration
+func NewArchiver(store ArchiveStore, config *ArchiveConfig) *Archiver {
+	if config.BatchSize <= 0 {
+		config.BatchSize = 1000
+	}
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = time.Minute
+	}
+	if config.Retry == (BackoffConfig{}) {
+		config.Retry = DefaultBackoff()
+		config.Retry.MaxAttempts = 5
+	}
+	a := &Archiver{
+		Logger:        log.New(os.Stderr, "", log.LstdFlags),
+		name:          "archive",
+		named:         config.Name != "",
+		store:         store,
+		size:          config.BatchSize,
+		flushInterval: config.FlushInterval,
+		retry:         config.Retry,
+		messages:      make(chan interface{}, config.BatchSize*2),
+		dropped:       newDroppedCounter(config.Registerer),
+		clock:         clockOrSystem(config.Clock),
+	}
+	if a.named {
+		a.name = config.Name
+	}
+	return a
+}
+
+// Name returns the configured destination name
+func (a *Archiver) Name() string {
+	if a.named {
+		return a.name
+	}
+	return ""
+}
+
+// WithLogger adds optional logging
+func (a *Archiver) WithLogger(logger *log.Logger) Destination {
+	if logger != nil {
+		a.Logger = logger
+	}
+	return a
+}
+
+// archivePartition returns the hour partition for a time eg "2006-01-02/15"
+func archivePartition(t time.Time) string {
+	return t.UTC().Format("2006-01-02/15")
+}
+
+// Process archives batches of messages when full or the flush interval after the first event of the batch,
+// until ctx is done
+func (a *Archiver) Process(ctx context.Context) error {
+	a.Logger.Println("Starting archive processing")
+	var batch []SegmentEvent
+	var flushAt <-chan time.Time
+	for {
+		flush := false
+		select {
+		case message := <-a.messages:
+			if m, ok := message.(SegmentEvent); ok {
+				batch = append(batch, m)
+			}
+		case <-ctx.Done():
+			return a.drain(ctx, batch)
+		case <-flushAt:
+			flush = true
+		}
+		if len(batch) >= a.size || flush {
+			if err := a.archive(ctx, batch); err != nil {
+				a.Logger.Println(err)
+			}
+			batch = nil
+			flushAt = nil
+		} else if flushAt == nil && len(batch) > 0 {
+			flushAt = a.clock.After(a.flushInterval)
+		}
+	}
+}
+
+// drain archives the batch and buffered messages within a timeout, so shutdown doesn't hang or lose messages
+func (a *Archiver) drain(ctx context.Context, batch []SegmentEvent) error {
+	a.Logger.Println("Ending archive processing")
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), finalFlushTimeout)
+	defer cancel()
+	var errs []error
+	for drained := false; !drained; {
+		select {
+		case message := <-a.messages:
+			if m, ok := message.(SegmentEvent); ok {
+				batch = append(batch, m)
+			}
+		default:
+			drained = true
+		}
+		if len(batch) >= a.size || (drained && len(batch) > 0) {
+			if err := a.archive(ctx, batch); err != nil {
+				errs = append(errs, err)
+			}
+			batch = nil
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// archive flushes the batch, retrying the partitions that failed with backoff, and counting the events dropped once
+// the attempts are exhausted or ctx is done
+func (a *Archiver) archive(ctx context.Context, batch []SegmentEvent) error {
+	backo := a.retry.backo()
+	for i := 0; ; i++ {
+		err := a.flush(ctx, batch)
+		if err == nil {
+			return nil
+		}
+		if partial, ok := err.(*partialError); ok {
+			batch = partial.failed
+		}
+		if i >= a.retry.MaxAttempts {
+			a.dropped.WithLabelValues(DropArchiveFailed, a.name).Add(float64(len(batch)))
+			return fmt.Errorf("Archive dropped %d events after %d attempts -- %v", len(batch), i+1, err)
+		}
+		select {
+		case <-a.clock.After(backo.Duration(i)):
+		case <-ctx.Done():
+			a.dropped.WithLabelValues(DropArchiveFailed, a.name).Add(float64(len(batch)))
+			return fmt.Errorf("Archive dropped %d events -- %v", len(batch), err)
+		}
+	}
+}
+
+// flush writes an object and manifest for each hour partition in the batch, returning a partial error with the
+// events of the partitions that failed
+func (a *Archiver) flush(ctx context.Context, batch []SegmentEvent) error {
+	partitions := make(map[string][]SegmentEvent)
+	for _, m := range batch {
+		p := archivePartition(m.Timestamp)
+		partitions[p] = append(partitions[p], m)
+	}
+
+	var failed []SegmentEvent
+	var errs []error
+	for p, events := range partitions {
+		if err := a.flushPartition(ctx, p, events); err != nil {
+			failed = append(failed, events...)
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return &partialError{failed: failed, err: errors.Join(errs...)}
+	}
+	return nil
+}
+
+// flushPartition writes the object and manifest for the events of an hour partition
+func (a *Archiver) flushPartition(ctx context.Context, p string, events []SegmentEvent) error {
+	id := fmt.Sprintf("%020d-%s", a.clock.Now().UnixNano(), uuid.NewRandom().String())
+	manifest := ArchiveManifest{
+		Key:        "events/" + p + "/" + id + ".jsonl",
+		Count:      len(events),
+		ProjectIds: make(map[string]int),
+	}
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, m := range events {
+		if err := encoder.Encode(m); err != nil {
+			return fmt.Errorf("Archive marshal error -- %v", err)
+		}
+		manifest.ProjectIds[m.ProjectId]++
+		if manifest.MinTimestamp.IsZero() || m.Timestamp.Before(manifest.MinTimestamp) {
+			manifest.MinTimestamp = m.Timestamp
+		}
+		if m.Timestamp.After(manifest.MaxTimestamp) {
+			manifest.MaxTimestamp = m.Timestamp
+		}
+	}
+	if err := a.store.Put(ctx, manifest.Key, buf.Bytes()); err != nil {
+		return fmt.Errorf("Archive error writing %s -- %v", manifest.Key, err)
+	}
+	b, _ := json.Marshal(manifest)
+	if err := a.store.Put(ctx, "manifests/"+p+"/"+id+".json", b); err != nil {
+		return fmt.Errorf("Archive error writing manifest %s -- %v", id, err)
+	}
+	a.Logger.Printf("Archived %d to %s\n", len(events), manifest.Key)
+	return nil
+}
+
+// Send pushes the message onto the queue
+func (a *Archiver) Send(ctx context.Context, message interface{}) error {
+	return enqueue(ctx, a.messages, message)
+}
+
+// Replay reads archived events with timestamp in [from, to) for projectId, or all if empty,
+// calling fn for each and returning the number replayed
+func (a *Archiver) Replay(ctx context.Context, from, to time.Time, projectId string, fn func(SegmentEvent) error) (int, error) {
+	return a.walk(ctx, from, to, projectId, "", func(m SegmentEvent, offset Offset) error {
+		return fn(m)
+	})
+}
+
+// archiveOffset is the manifest key and line of an archived event
+func archiveOffset(key string, line int) Offset {
+	return Offset(fmt.Sprintf("%s#%d", key, line))
+}
+
+func parseArchiveOffset(offset Offset) (string, int) {
+	i := strings.LastIndex(string(offset), "#")
+	if i < 0 {
+		return "", -1
+	}
+	line, err := strconv.Atoi(string(offset[i+1:]))
+	if err != nil {
+		return "", -1
+	}
+	return string(offset[:i]), line
+}
+
+// walk calls fn for archived events in manifest key order, after offset if not empty
+func (a *Archiver) walk(ctx context.Context, from, to time.Time, projectId string, after Offset, fn func(SegmentEvent, Offset) error) (int, error) {
+	afterKey, afterLine := parseArchiveOffset(after)
+	n := 0
+	for hour := from.UTC().Truncate(time.Hour); hour.Before(to); hour = hour.Add(time.Hour) {
+		manifests, err := a.store.List(ctx, "manifests/"+archivePartition(hour)+"/")
+		if err != nil {
+			return n, err
+		}
+		for _, key := range manifests {
+			if key < afterKey {
+				continue // Already consumed
+			}
+			b, err := a.store.Get(ctx, key)
+			if err != nil {
+				return n, err
+			}
+			var manifest ArchiveManifest
+			if err := json.Unmarshal(b, &manifest); err != nil {
+				return n, fmt.Errorf("Archive error decoding manifest %s -- %v", key, err)
+			}
+			if (projectId != "" && manifest.ProjectIds[projectId] == 0) ||
+				manifest.MaxTimestamp.Before(from) || !manifest.MinTimestamp.Before(to) {
+				continue // Skip using the index
+			}
+			skip := -1
+			if key == afterKey {
+				skip = afterLine
+			}
+			count, err := a.walkObject(ctx, manifest.Key, from, to, projectId, skip, func(m SegmentEvent, line int) error {
+				return fn(m, archiveOffset(key, line))
+			})
+			n += count
+			if err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// walkObject calls fn for matching events in an object after the skip line
+func (a *Archiver) walkObject(ctx context.Context, key string, from, to time.Time, projectId string, skip int, fn func(SegmentEvent, int) error) (int, error) {
+	b, err := a.store.Get(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	scanner.Buffer(make([]byte, 64*1024), 32*1024*1024)
+	for line := 0; scanner.Scan(); line++ {
+		if line <= skip {
+			continue
+		}
+		m, err := DecodeEnvelope(scanner.Bytes())
+		if err != nil {
+			return n, fmt.Errorf("Archive error decoding %s -- %v", key, err)
+		}
+		if (projectId != "" && m.ProjectId != projectId) || m.Timestamp.Before(from) || !m.Timestamp.Before(to) {
+			continue
+		}
+		if err := fn(m, line); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, scanner.Err()
+}
+
+// ArchiveSource is a source reading archived events, resuming after the last committed offset
+type ArchiveSource struct {
+	archiver  *Archiver
+	from, to  time.Time
+	projectId string
+}
+
+// NewArchiveSource creates a source for archived events in [from, to) for projectId, or all if empty
+func NewArchiveSource(archiver *Archiver, from, to time.Time, projectId string) *ArchiveSource {
+	return &ArchiveSource{archiver: archiver, from: from, to: to, projectId: projectId}
+}
+
+// Start reads archived events after offset until exhausted
+func (s *ArchiveSource) Start(ctx context.Context, from Offset, handle func(SegmentEvent, Offset) error) error {
+	_, err := s.archiver.walk(ctx, s.from, s.to, s.projectId, from, handle)
+	return err
+}
+
+// Commit is a no-op as archived objects are immutable
+func (s *ArchiveSource) Commit(ctx context.Context, offset Offset) error {
+	return nil
+}
+
+// Close is a no-op
+func (s *ArchiveSource) Close() error {
+	return nil
+}
@@ -0,0 +1,134 @@
+package segment
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestArchiveReplay(t *testing.T) {
+	a := NewArchiver(NewLocalArchiveStore(t.TempDir()), &ArchiveConfig{})
+	t0 := time.Date(2024, 1, 2, 3, 30, 0, 0, time.UTC)
+	batch := []SegmentEvent{
+		{SegmentMessage: SegmentMessage{MessageId: "1", ProjectId: "a", Timestamp: t0}},
+		{SegmentMessage: SegmentMessage{MessageId: "2", ProjectId: "b", Timestamp: t0}},
+		{SegmentMessage: SegmentMessage{MessageId: "3", ProjectId: "a", Timestamp: t0.Add(time.Hour)}},
+	}
+	if err := a.flush(context.Background(), batch); err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []string
+	n, err := a.Replay(context.Background(), t0.Add(-time.Hour), t0.Add(2*time.Hour), "a", func(m SegmentEvent) error {
+		ids = append(ids, m.MessageId)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 || ids[0] != "1" || ids[1] != "3" {
+		t.Errorf("Expected project a events replayed, got %v", ids)
+	}
+
+	// Consume all events, then resume from the checkpoint with nothing left
+	dest := &testDestination{}
+	s := NewSegment(nil, []Destination{dest}, nil)
+	checkpoints := NewFileCheckpointStore(t.TempDir())
+	src := NewArchiveSource(a, t0.Add(-time.Hour), t0.Add(2*time.Hour), "")
+	if err := s.Consume(context.Background(), "archive", src, checkpoints); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Consume(context.Background(), "archive", src, checkpoints); err != nil {
+		t.Fatal(err)
+	}
+	if len(dest.sent()) != 3 {
+		t.Errorf("Expected 3 events consumed once, got %d", len(dest.sent()))
+	}
+}
+
+// failingArchiveStore fails the first n puts
+type failingArchiveStore struct {
+	ArchiveStore
+	n int
+}
+
+func (s *failingArchiveStore) Put(ctx context.Context, key string, data []byte) error {
+	if s.n > 0 {
+		s.n--
+		return fmt.Errorf("Store unavailable")
+	}
+	return s.ArchiveStore.Put(ctx, key, data)
+}
+
+func TestArchiveRetry(t *testing.T) {
+	store := &failingArchiveStore{ArchiveStore: NewLocalArchiveStore(t.TempDir()), n: 2}
+	a := NewArchiver(store, &ArchiveConfig{
+		Name:       "cold",
+		Retry:      BackoffConfig{Min: time.Millisecond, Max: time.Millisecond, MaxAttempts: 2},
+		Registerer: prometheus.NewRegistry(),
+	})
+	t0 := time.Date(2024, 1, 2, 3, 30, 0, 0, time.UTC)
+	batch := []SegmentEvent{{SegmentMessage: SegmentMessage{MessageId: "1", Timestamp: t0}}}
+	if err := a.archive(context.Background(), batch); err != nil {
+		t.Fatal(err)
+	}
+	n, _ := a.Replay(context.Background(), t0, t0.Add(time.Hour), "", func(m SegmentEvent) error { return nil })
+	if n != 1 {
+		t.Errorf("Expected event archived after retries, got %d", n)
+	}
+
+	// Events are counted as dropped once the attempts are exhausted
+	store.n = 3
+	if err := a.archive(context.Background(), batch); err == nil {
+		t.Error("Expected archive error")
+	}
+	if n := testutil.ToFloat64(a.dropped.WithLabelValues(DropArchiveFailed, "cold")); n != 1 {
+		t.Errorf("Expected 1 event dropped, got %v", n)
+	}
+}
+
+func TestArchiveProcess(t *testing.T) {
+	t0 := time.Date(2024, 1, 2, 3, 30, 0, 0, time.UTC)
+	clock := newTestClock(t0)
+	a := NewArchiver(NewLocalArchiveStore(t.TempDir()), &ArchiveConfig{Registerer: prometheus.NewRegistry(), Clock: clock})
+	archived := func() int {
+		n, _ := a.Replay(context.Background(), t0, t0.Add(time.Hour), "", func(m SegmentEvent) error { return nil })
+		return n
+	}
+
+	// A batch is flushed the interval after its first event
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- a.Process(ctx) }()
+	a.Send(ctx, SegmentEvent{SegmentMessage: SegmentMessage{MessageId: "1", Timestamp: t0}})
+	clock.waitTimers(t, 1)
+	if n := archived(); n != 0 {
+		t.Errorf("Expected event buffered until the flush interval, got %d", n)
+	}
+	clock.Advance(time.Minute)
+	for deadline := time.Now().Add(time.Second); archived() == 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if n := archived(); n != 1 {
+		t.Errorf("Expected event archived after the flush interval, got %d", n)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// Messages buffered on shutdown are drained
+	for _, id := range []string{"2", "3"} {
+		a.Send(context.Background(), SegmentEvent{SegmentMessage: SegmentMessage{MessageId: id, Timestamp: t0}})
+	}
+	if err := a.Process(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := archived(); n != 3 {
+		t.Errorf("Expected buffered events archived on shutdown, got %d", n)
+	}
+}
@@ -0,0 +1,25 @@
+package segment
+
+// eventAttributes returns the event, type and projectId of the event, and the values of configured attribute names to
+// dotted paths that are present, for queue destinations to set as message attributes or headers so consumers can
+// filter without decoding the body
+func eventAttributes(m *SegmentEvent, paths map[string]string) map[string]interface{} {
+	attributes := make(map[string]interface{})
+	add := func(name string, value interface{}) {
+		switch v := value.(type) {
+		case string:
+			if v != "" {
+				attributes[name] = v
+			}
+		case float64, bool:
+			attributes[name] = v
+		}
+	}
+	add("event", eventName(m.SegmentMessage))
+	add("type", m.Type)
+	add("projectId", m.ProjectId)
+	for name, path := range paths {
+		add(name, lookupEventPath(m, path))
+	}
+	return attributes
+}
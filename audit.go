@@ -0,0 +1,135 @@
+package segment
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Audit event types
+const (
+	AuditAuthFailure       = "auth.failure"
+	AuditDestinationChange = "destination.change"
+	AuditReplay            = "replay"
+	AuditRepair            = "repair"
+	AuditTrackingPlan      = "tracking_plan.change"
+)
+
+// AuditEvent records an administrative or auth action, chained by hash to the previous event
+type AuditEvent struct {
+	Sequence uint64            `json:"sequence"`
+	Time     time.Time         `json:"time"`
+	Type     string            `json:"type"`
+	Actor    string            `json:"actor,omitempty"`
+	Remote   string            `json:"remote,omitempty"`
+	Details  map[string]string `json:"details,omitempty"`
+	PrevHash string            `json:"prevHash"`
+	Hash     string            `json:"hash"`
+}
+
+// AuditSink is the pluggable storage for audit events
+type AuditSink interface {
+	Write(event AuditEvent) error
+}
+
+// AuditLog writes tamper-evident audit events to a sink
+type AuditLog struct {
+	Logger   *log.Logger // Public logger that caller can override
+	sink     AuditSink
+	mu       sync.Mutex
+	sequence uint64
+	prevHash string
+}
+
+// NewAuditLog creates a new audit log given sink
+func NewAuditLog(sink AuditSink) *AuditLog {
+	return &AuditLog{
+		Logger: log.New(os.Stderr, "", log.LstdFlags),
+		sink:   sink,
+	}
+}
+
+// Record appends an event to the audit log, it is safe to call on a nil log
+func (a *AuditLog) Record(eventType, actor, remote string, details map[string]string) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.sequence++
+	event := AuditEvent{
+		Sequence: a.sequence,
+		Time:     time.Now().UTC(),
+		Type:     eventType,
+		Actor:    actor,
+		Remote:   remote,
+		Details:  details,
+		PrevHash: a.prevHash,
+	}
+	event.Hash = auditHash(event)
+	if err := a.sink.Write(event); err != nil {
+		a.Logger.Printf("Audit sink error writing %s -- %v\n", eventType, err)
+		a.sequence-- // Reuse the sequence, so a gap in the chain is only from events removed from the sink
+		return
+	}
+	a.prevHash = event.Hash
+}
+
+// auditKey returns a prefix of the hash of a writeKey for the actor, so unknown writeKeys aren't stored in the log
+func auditKey(writeKey string) string {
+	if writeKey == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(writeKey))
+	return "sha256:" + hex.EncodeToString(sum[:])[:12]
+}
+
+// VerifyAuditChain checks the hash chain and sequence of events read back from a sink
+func VerifyAuditChain(events []AuditEvent) error {
+	prevHash := ""
+	for i, event := range events {
+		if i > 0 && event.Sequence != events[i-1].Sequence+1 {
+			return fmt.Errorf("Audit sequence gap at sequence %d after %d", event.Sequence, events[i-1].Sequence)
+		}
+		if i > 0 && event.PrevHash != prevHash {
+			return fmt.Errorf("Audit chain broken at sequence %d", event.Sequence)
+		}
+		if auditHash(event) != event.Hash {
+			return fmt.Errorf("Audit hash mismatch at sequence %d", event.Sequence)
+		}
+		prevHash = event.Hash
+	}
+	return nil
+}
+
+func auditHash(event AuditEvent) string {
+	event.Hash = ""
+	b, _ := json.Marshal(event) // Map keys are sorted so encoding is stable
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// WriterAuditSink writes audit events as json lines
+type WriterAuditSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewWriterAuditSink creates a sink writing to w
+func NewWriterAuditSink(w io.Writer) *WriterAuditSink {
+	return &WriterAuditSink{w: w}
+}
+
+// Write encodes the event as a single line
+func (s *WriterAuditSink) Write(event AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return json.NewEncoder(s.w).Encode(event)
+}
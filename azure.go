@@ -0,0 +1,172 @@
+package segment
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// azureVersion is the blob service api version
+const azureVersion = "2021-08-06"
+
+// AzureBlobConfig contains configuration parameters for an azure blob container, with a SAS token for authorization
+type AzureBlobConfig struct {
+	Account   string `json:"account"`
+	Container string `json:"container"`
+	Prefix    string `json:"prefix,omitempty"`
+	SASToken  string `json:"sasToken"`           // Requires read, write and list permissions
+	Endpoint  string `json:"endpoint,omitempty"` // Overrides the account url eg for azurite
+}
+
+// AzureBlobArchiveStore stores objects as block blobs in an azure storage container under a prefix
+type AzureBlobArchiveStore struct {
+	client    *http.Client
+	endpoint  string
+	container string
+	prefix    string
+	sas       url.Values
+}
+
+// Validate checks the account and container are set and the SAS token parses
+func (config *AzureBlobConfig) Validate() error {
+	if config.Container == "" || (config.Account == "" && config.Endpoint == "") {
+		return fmt.Errorf("Require azure account and container")
+	}
+	if _, err := url.ParseQuery(strings.TrimPrefix(config.SASToken, "?")); err != nil {
+		return fmt.Errorf("Invalid azure SAS token -- %v", err)
+	}
+	if config.Endpoint != "" {
+		return validateEndpoint(config.Endpoint)
+	}
+	return nil
+}
+
+// NewAzureBlobArchiveStore creates a store in the container given configuration
+func NewAzureBlobArchiveStore(config *AzureBlobConfig) *AzureBlobArchiveStore {
+	if err := config.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	if config.Endpoint == "" {
+		config.Endpoint = "https://" + config.Account + ".blob.core.windows.net"
+	}
+	sas, _ := url.ParseQuery(strings.TrimPrefix(config.SASToken, "?"))
+	return &AzureBlobArchiveStore{
+		client:    http.DefaultClient,
+		endpoint:  strings.TrimSuffix(config.Endpoint, "/"),
+		container: config.Container,
+		prefix:    strings.Trim(config.Prefix, "/"),
+		sas:       sas,
+	}
+}
+
+func (s *AzureBlobArchiveStore) key(key string) string {
+	if s.prefix == "" {
+		return key
+	}
+	return s.prefix + "/" + key
+}
+
+// url returns the container or blob url with the SAS token and query
+func (s *AzureBlobArchiveStore) url(blob string, query url.Values) string {
+	u := s.endpoint + "/" + url.PathEscape(s.container)
+	if blob != "" {
+		segments := strings.Split(blob, "/")
+		for i, segment := range segments {
+			segments[i] = url.PathEscape(segment)
+		}
+		u += "/" + strings.Join(segments, "/")
+	}
+	values := url.Values{}
+	for k, v := range s.sas {
+		values[k] = v
+	}
+	for k, v := range query {
+		values[k] = v
+	}
+	return u + "?" + values.Encode()
+}
+
+// do sends the request, returning the body or an httpStatusError if unsuccessful
+func (s *AzureBlobArchiveStore) do(ctx context.Context, method, u string, header http.Header, body []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("x-ms-version", azureVersion)
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= 300 {
+		if len(data) > 4096 {
+			data = data[:4096]
+		}
+		return nil, &httpStatusError{StatusCode: res.StatusCode, Body: string(data)}
+	}
+	return data, nil
+}
+
+// Put writes the object as a block blob
+func (s *AzureBlobArchiveStore) Put(ctx context.Context, key string, data []byte) error {
+	header := http.Header{}
+	header.Set("x-ms-blob-type", "BlockBlob")
+	header.Set("Content-Type", "application/x-ndjson")
+	if strings.HasSuffix(key, ".json") {
+		header.Set("Content-Type", "application/json")
+	}
+	_, err := s.do(ctx, http.MethodPut, s.url(s.key(key), nil), header, data)
+	return err
+}
+
+// Get reads the object
+func (s *AzureBlobArchiveStore) Get(ctx context.Context, key string) ([]byte, error) {
+	return s.do(ctx, http.MethodGet, s.url(s.key(key), nil), nil, nil)
+}
+
+// azureBlobList is a page of the list blobs response
+type azureBlobList struct {
+	Blobs []struct {
+		Name string `xml:"Name"`
+	} `xml:"Blobs>Blob"`
+	NextMarker string `xml:"NextMarker"`
+}
+
+// List returns keys with prefix in order
+func (s *AzureBlobArchiveStore) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	marker := ""
+	for {
+		query := url.Values{"restype": {"container"}, "comp": {"list"}, "prefix": {s.key(prefix)}}
+		if marker != "" {
+			query.Set("marker", marker)
+		}
+		data, err := s.do(ctx, http.MethodGet, s.url("", query), nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var page azureBlobList
+		if err := xml.Unmarshal(data, &page); err != nil {
+			return nil, err
+		}
+		for _, blob := range page.Blobs {
+			keys = append(keys, strings.TrimPrefix(blob.Name, s.prefix+"/"))
+		}
+		if marker = page.NextMarker; marker == "" {
+			return keys, nil
+		}
+	}
+}
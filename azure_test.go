@@ -0,0 +1,100 @@
+package segment
+
+import (
+	"context"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newFakeAzureBlob serves put, get and paged list blob requests for a container, requiring the SAS signature
+func newFakeAzureBlob(t *testing.T) (*httptest.Server, map[string]string) {
+	var mu sync.Mutex
+	blobs := make(map[string]string)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.URL.Query().Get("sig") != "secret" || r.Header.Get("x-ms-version") == "" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		name := strings.TrimPrefix(r.URL.Path, "/archive/")
+		switch {
+		case r.Method == "PUT" && r.Header.Get("x-ms-blob-type") == "BlockBlob":
+			body, _ := io.ReadAll(r.Body)
+			blobs[name] = string(body)
+			w.WriteHeader(http.StatusCreated)
+		case r.Method == "GET" && r.URL.Query().Get("comp") == "list":
+			var names []string
+			for name := range blobs {
+				if strings.HasPrefix(name, r.URL.Query().Get("prefix")) && name > r.URL.Query().Get("marker") {
+					names = append(names, name)
+				}
+			}
+			sort.Strings(names)
+			var page azureBlobList
+			if len(names) > 1 {
+				names = names[:1] // One blob per page
+				page.NextMarker = names[0]
+			}
+			for _, name := range names {
+				page.Blobs = append(page.Blobs, struct {
+					Name string `xml:"Name"`
+				}{name})
+			}
+			xml.NewEncoder(w).Encode(page)
+		case r.Method == "GET":
+			if body, ok := blobs[name]; ok {
+				io.WriteString(w, body)
+				return
+			}
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, blobs
+}
+
+func TestAzureBlobArchive(t *testing.T) {
+	server, blobs := newFakeAzureBlob(t)
+	store := NewAzureBlobArchiveStore(&AzureBlobConfig{
+		Endpoint: server.URL, Container: "archive", Prefix: "segment/", SASToken: "?sv=2021-08-06&sig=secret",
+	})
+	a := NewArchiver(store, &ArchiveConfig{})
+	t0 := time.Date(2024, 1, 2, 3, 30, 0, 0, time.UTC)
+	batch := []SegmentEvent{
+		{SegmentMessage: SegmentMessage{MessageId: "1", ProjectId: "a", Timestamp: t0}},
+		{SegmentMessage: SegmentMessage{MessageId: "2", ProjectId: "a", Timestamp: t0.Add(time.Hour)}},
+	}
+	if err := a.flush(context.Background(), batch); err != nil {
+		t.Fatal(err)
+	}
+	if len(blobs) != 4 {
+		t.Fatalf("Expected an object and manifest per hour, got %d blobs", len(blobs))
+	}
+	for name := range blobs {
+		if !strings.HasPrefix(name, "segment/events/2024-01-02/") && !strings.HasPrefix(name, "segment/manifests/2024-01-02/") {
+			t.Errorf("Expected partitioned blob under prefix, got %s", name)
+		}
+	}
+
+	var ids []string
+	n, err := a.Replay(context.Background(), t0.Add(-time.Hour), t0.Add(2*time.Hour), "a", func(m SegmentEvent) error {
+		ids = append(ids, m.MessageId)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 || strings.Join(ids, ",") != "1,2" {
+		t.Errorf("Expected events replayed across list pages, got %v", ids)
+	}
+}
@@ -0,0 +1,41 @@
+package segment
+
+import (
+	"time"
+
+	"github.com/segmentio/backo-go"
+)
+
+// BackoffConfig contains jittered exponential backoff parameters, zero values use defaults
+type BackoffConfig struct {
+	Min         time.Duration `json:"min,omitempty"`         // Defaults to 100 milliseconds
+	Max         time.Duration `json:"max,omitempty"`         // Defaults to 10 seconds
+	Factor      uint8         `json:"factor,omitempty"`      // Defaults to 2
+	Jitter      float64       `json:"jitter,omitempty"`      // Fraction of interval to randomize eg 0.25
+	MaxAttempts int           `json:"maxAttempts,omitempty"` // Zero for none on send, or forever on process
+}
+
+// DefaultBackoff returns the default backoff of 100 milliseconds, up to 10 seconds with 25% jitter
+func DefaultBackoff() BackoffConfig {
+	return BackoffConfig{
+		Min:    time.Millisecond * 100,
+		Max:    time.Second * 10,
+		Factor: 2,
+		Jitter: 0.25,
+	}
+}
+
+// backo returns the backoff for the configuration, filling in defaults
+func (c BackoffConfig) backo() *backo.Backo {
+	d := DefaultBackoff()
+	if c.Min <= 0 {
+		c.Min = d.Min
+	}
+	if c.Max <= 0 {
+		c.Max = d.Max
+	}
+	if c.Factor == 0 {
+		c.Factor = d.Factor
+	}
+	return backo.NewBacko(c.Min, c.Factor, c.Jitter, c.Max)
+}
@@ -0,0 +1,314 @@
+package segment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// BatchConfig contains batching parameters common to batch destinations eg http apis and databases
+type BatchConfig struct {
+	// Name is the destination label of all metrics, defaults to the destination type eg "datadog"
+	Name          string        `json:"name,omitempty"`
+	BatchSize     int           `json:"batchSize,omitempty"`     // Defaults to 100
+	FlushInterval time.Duration `json:"flushInterval,omitempty"` // Defaults to 5 seconds
+	Timeout       time.Duration `json:"timeout,omitempty"`       // Write timeout, defaults to 30 seconds
+	Retry         BackoffConfig `json:"retry,omitempty"`         // Retries for errors, and 429 and 5xx responses, defaults to 3 attempts
+	// Registerer for metrics, defaults to the prometheus default registerer
+	Registerer prometheus.Registerer `json:"-"`
+	// Tracer starts a span for each batch write, with the trace id as an exemplar of the latency metric, optional
+	Tracer Tracer `json:"-"`
+	// Monitor emits a batch flushed event for each write, optional
+	Monitor *Monitor `json:"-"`
+	// Clock for flush intervals and retry backoff, defaults to the system clock
+	Clock Clock `json:"-"`
+}
+
+// batchMetrics track batch destination success, failures and latency
+type batchMetrics struct {
+	success *prometheus.CounterVec
+	failure *prometheus.CounterVec
+	latency *prometheus.HistogramVec
+	dropped *prometheus.CounterVec
+}
+
+func newBatchMetrics(reg prometheus.Registerer) *batchMetrics {
+	return &batchMetrics{
+		success: newCounterVec(reg, prometheus.CounterOpts{
+			Name: "batch_destination_success_total",
+			Help: "Batch destination events success total",
+		}, "destination"),
+		failure: newCounterVec(reg, prometheus.CounterOpts{
+			Name: "batch_destination_failure_total",
+			Help: "Batch destination events failure total",
+		}, "destination"),
+		latency: newHistogramVec(reg, prometheus.HistogramOpts{
+			Name:    "batch_destination_latency_seconds",
+			Help:    "Batch destination write latency distributions",
+			Buckets: latencyBuckets,
+		}, "destination"),
+		dropped: newDroppedCounter(reg),
+	}
+}
+
+// batcher buffers events, and writes batches with a func provided by the destination
+type batcher struct {
+	name     string // Destination name for metrics eg "datadog"
+	named    bool
+	size     int
+	interval time.Duration
+	timeout  time.Duration
+	retry    BackoffConfig
+	messages chan SegmentEvent
+	write    func(ctx context.Context, batch []SegmentEvent) error
+	metrics  *batchMetrics
+	tracer   Tracer
+	monitor  *Monitor
+	clock    Clock
+	// partition returns the key to group events into separate writes, nil for one write per batch
+	partition func(m SegmentEvent) string
+}
+
+// newBatcher creates a batcher given config defaults and a func to write a batch
+func newBatcher(name string, config BatchConfig, maxSize int, write func(ctx context.Context, batch []SegmentEvent) error) *batcher {
+	if config.BatchSize <= 0 || config.BatchSize > maxSize {
+		config.BatchSize = min(100, maxSize)
+	}
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = time.Second * 5
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = time.Second * 30
+	}
+	if config.Retry == (BackoffConfig{}) {
+		config.Retry = DefaultBackoff()
+		config.Retry.MaxAttempts = 3
+	}
+	if config.Name != "" {
+		name = config.Name
+	}
+	return &batcher{
+		name:     name,
+		named:    config.Name != "",
+		size:     config.BatchSize,
+		interval: config.FlushInterval,
+		timeout:  config.Timeout,
+		retry:    config.Retry,
+		messages: make(chan SegmentEvent, config.BatchSize*2), // Buffer messages sent before processing
+		write:    write,
+		metrics:  newBatchMetrics(config.Registerer),
+		tracer:   config.Tracer,
+		monitor:  config.Monitor,
+		clock:    clockOrSystem(config.Clock),
+	}
+}
+
+// newHTTPBatcher creates a batcher that posts requests built by the destination for each batch
+func newHTTPBatcher(name string, config BatchConfig, maxSize int, request func(ctx context.Context, batch []SegmentEvent) (*http.Request, error)) *batcher {
+	return newBatcher(name, config, maxSize, func(ctx context.Context, batch []SegmentEvent) error {
+		return httpWrite(ctx, request, batch)
+	})
+}
+
+// configuredName returns the name if configured, otherwise empty so segment names the destination by index
+func (b *batcher) configuredName() string {
+	if b.named {
+		return b.name
+	}
+	return ""
+}
+
+// send pushes the event onto the queue
+func (b *batcher) send(ctx context.Context, message interface{}) error {
+	m, ok := message.(SegmentEvent)
+	if !ok {
+		return fmt.Errorf("Expected Segment Event")
+	}
+	return enqueue(ctx, b.messages, m)
+}
+
+// process posts batches when full or the flush interval after the first event of the batch, until ctx is done
+func (b *batcher) process(ctx context.Context, logger *log.Logger) error {
+	logger.Printf("Starting %s processing\n", b.name)
+	var batch []SegmentEvent
+	var flushAt <-chan time.Time
+	for {
+		flush := false
+		select {
+		case m := <-b.messages:
+			batch = append(batch, m)
+		case <-ctx.Done():
+			b.drain(ctx, batch, logger)
+			return nil
+		case <-flushAt:
+			flush = true
+			// Include messages buffered since the last receive, up to the batch size
+			for buffered := true; buffered && len(batch) < b.size; {
+				select {
+				case m := <-b.messages:
+					batch = append(batch, m)
+				default:
+					buffered = false
+				}
+			}
+		}
+		if ctx.Err() != nil {
+			b.drain(ctx, batch, logger)
+			return nil
+		}
+		if len(batch) >= b.size || flush {
+			b.flush(ctx, batch, logger)
+			batch = nil
+			flushAt = nil
+		} else if flushAt == nil && len(batch) > 0 {
+			flushAt = b.clock.After(b.interval)
+		}
+	}
+}
+
+// drain flushes the batch and buffered messages within a timeout, so shutdown doesn't hang or lose messages
+func (b *batcher) drain(ctx context.Context, batch []SegmentEvent, logger *log.Logger) {
+	logger.Printf("Ending %s processing\n", b.name)
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), finalFlushTimeout)
+	defer cancel()
+	for {
+		if len(batch) >= b.size {
+			b.flush(ctx, batch, logger)
+			batch = nil
+		}
+		select {
+		case m := <-b.messages:
+			batch = append(batch, m)
+		default:
+			b.flush(ctx, batch, logger)
+			return
+		}
+	}
+}
+
+// flush posts the batch in a request per partition
+func (b *batcher) flush(ctx context.Context, batch []SegmentEvent, logger *log.Logger) {
+	if b.partition == nil {
+		b.flushPartition(ctx, batch, logger)
+		return
+	}
+	partitions := make(map[string][]SegmentEvent)
+	var keys []string
+	for _, m := range batch {
+		key := b.partition(m)
+		if _, ok := partitions[key]; !ok {
+			keys = append(keys, key)
+		}
+		partitions[key] = append(partitions[key], m)
+	}
+	for _, key := range keys {
+		b.flushPartition(ctx, partitions[key], logger)
+	}
+}
+
+// flushPartition posts the batch, counting events dropped on failure
+func (b *batcher) flushPartition(ctx context.Context, batch []SegmentEvent, logger *log.Logger) {
+	if len(batch) == 0 {
+		return
+	}
+	t0 := b.clock.Now()
+	ctx, traceId, end := startSpan(b.tracer, ctx, b.name+" write")
+	failed, err := b.post(ctx, batch)
+	end(err)
+	duration := b.clock.Now().Sub(t0)
+	b.monitor.batchFlushed(b.name, len(batch), duration, err)
+	if err != nil {
+		b.metrics.success.WithLabelValues(b.name).Add(float64(len(batch) - len(failed)))
+		b.metrics.failure.WithLabelValues(b.name).Add(float64(len(failed)))
+		b.metrics.dropped.WithLabelValues(DropBatchFailed, b.name).Add(float64(len(failed)))
+		logger.Printf("Destination %s error sending %d of %d -- %v\n", b.name, len(failed), len(batch), err)
+		return
+	}
+	b.metrics.success.WithLabelValues(b.name).Add(float64(len(batch)))
+	observeLatency(b.metrics.latency.WithLabelValues(b.name), duration, traceId)
+	logger.Printf("Destination %s sent %d in: %s\n", b.name, len(batch), duration)
+}
+
+// post writes the batch within the timeout, retrying errors, and 429 and 5xx responses with backoff, returning the
+// events that failed.  Only the failed events of a partial error are retried.
+func (b *batcher) post(ctx context.Context, batch []SegmentEvent) ([]SegmentEvent, error) {
+	backo := b.retry.backo()
+	for i := 0; ; i++ {
+		writeCtx, cancel := context.WithTimeout(ctx, b.timeout)
+		err := b.write(writeCtx, batch)
+		cancel()
+		if partial, ok := err.(*partialError); ok {
+			batch = partial.failed
+		}
+		if err == nil || i >= b.retry.MaxAttempts || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return batch, err
+		}
+		if status, ok := err.(*httpStatusError); ok && !status.retryable() {
+			return batch, err
+		}
+		select {
+		case <-b.clock.After(backo.Duration(i)):
+		case <-ctx.Done():
+			return batch, err
+		}
+	}
+}
+
+// partialError is returned by a write when only some events of the batch failed
+type partialError struct {
+	failed []SegmentEvent
+	err    error
+}
+
+func (e *partialError) Error() string {
+	return e.err.Error()
+}
+
+// httpWrite posts the request built for the batch, returning an httpStatusError if unsuccessful
+func httpWrite(ctx context.Context, request func(ctx context.Context, batch []SegmentEvent) (*http.Request, error), batch []SegmentEvent) error {
+	_, err := httpResponse(ctx, request, batch)
+	return err
+}
+
+// httpResponse posts the request built for the batch, returning the response body or an httpStatusError if
+// unsuccessful
+func httpResponse(ctx context.Context, request func(ctx context.Context, batch []SegmentEvent) (*http.Request, error), batch []SegmentEvent) ([]byte, error) {
+	req, err := request(ctx, batch)
+	if err != nil {
+		return nil, err
+	}
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if res.StatusCode >= 300 {
+		if len(body) > 4096 {
+			body = body[:4096]
+		}
+		return nil, &httpStatusError{StatusCode: res.StatusCode, Body: string(body)}
+	}
+	return body, nil
+}
+
+// httpStatusError is an unsuccessful http response
+type httpStatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("response %d %s -- %s", e.StatusCode, http.StatusText(e.StatusCode), e.Body)
+}
+
+// retryable returns true for throttled or server error responses
+func (e *httpStatusError) retryable() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
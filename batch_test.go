@@ -0,0 +1,279 @@
+package segment
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// fakeIntake records request bodies, failing the first with 503, and writes the response for the body if set
+type fakeIntake struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests []*http.Request
+	bodies   [][]byte
+	response func(body []byte) string
+}
+
+func newFakeIntake(t *testing.T, failures int) *fakeIntake {
+	f := &fakeIntake{}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		f.requests = append(f.requests, r)
+		f.bodies = append(f.bodies, body)
+		w.WriteHeader(http.StatusAccepted)
+		if f.response != nil {
+			io.WriteString(w, f.response(body))
+		}
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeIntake) received() ([]*http.Request, [][]byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*http.Request{}, f.requests...), append([][]byte{}, f.bodies...)
+}
+
+// testBatchConfig retries quickly with metrics on a private registry
+func testBatchConfig() BatchConfig {
+	return BatchConfig{
+		FlushInterval: time.Hour,
+		Retry:         BackoffConfig{Min: time.Millisecond, Max: time.Millisecond, Factor: 2, MaxAttempts: 3},
+		Registerer:    prometheus.NewRegistry(),
+	}
+}
+
+// processBatch sends events through the destination, and stops it to flush
+func processBatch(t *testing.T, dest Destination, events ...SegmentEvent) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- dest.Process(ctx) }()
+	for _, m := range events {
+		if err := dest.Send(ctx, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDatadog(t *testing.T) {
+	intake := newFakeIntake(t, 1)
+	d := NewDatadog(&DatadogConfig{
+		APIKey:      "key",
+		Endpoint:    intake.URL,
+		Tags:        []string{"env:test"},
+		BatchConfig: testBatchConfig(),
+	})
+	processBatch(t, d, SegmentEvent{SegmentMessage: SegmentMessage{Type: "track", Event: "Signed Up", ProjectId: "p",
+		Context: map[string]interface{}{"traceId": "123"}}})
+
+	requests, bodies := intake.received()
+	if len(requests) != 1 || requests[0].Header.Get("DD-API-KEY") != "key" {
+		t.Fatalf("Expected one request with api key after retry, got %d", len(requests))
+	}
+	var logs []map[string]interface{}
+	json.Unmarshal(bodies[0], &logs)
+	if len(logs) != 1 || logs[0]["ddtags"] != "projectId:p,type:track,env:test" || logs[0]["dd.trace_id"] != "123" {
+		t.Errorf("Expected tagged log with trace id, got %v", logs)
+	}
+}
+
+func TestLoki(t *testing.T) {
+	intake := newFakeIntake(t, 0)
+	l := NewLoki(&LokiConfig{Endpoint: intake.URL, TenantId: "tenant", BatchConfig: testBatchConfig()})
+	t0 := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	processBatch(t, l,
+		SegmentEvent{SegmentMessage: SegmentMessage{Type: "track", ProjectId: "p", Timestamp: t0.Add(time.Second)}},
+		SegmentEvent{SegmentMessage: SegmentMessage{Type: "page", ProjectId: "p", Timestamp: t0}},
+		SegmentEvent{SegmentMessage: SegmentMessage{Type: "track", ProjectId: "p", Timestamp: t0}},
+	)
+
+	requests, bodies := intake.received()
+	if len(requests) != 1 || requests[0].URL.Path != "/loki/api/v1/push" || requests[0].Header.Get("X-Scope-OrgID") != "tenant" {
+		t.Fatalf("Expected one push request for tenant, got %d", len(requests))
+	}
+	var push struct{ Streams []lokiStream }
+	json.Unmarshal(bodies[0], &push)
+	if len(push.Streams) != 2 || push.Streams[0].Stream["type"] != "track" || len(push.Streams[0].Values) != 2 {
+		t.Fatalf("Expected track and page streams, got %+v", push.Streams)
+	}
+	if push.Streams[0].Values[0][0] != "1704164645000000000" {
+		t.Errorf("Expected values ordered by timestamp, got %v", push.Streams[0].Values[0][0])
+	}
+}
+
+// honeycombResponse accepts every event of the batch, except those with a failing messageId which fail once
+func honeycombResponse(failing map[string]bool) func(body []byte) string {
+	return func(body []byte) string {
+		var events []struct{ Data map[string]interface{} }
+		json.Unmarshal(body, &events)
+		statuses := make([]string, len(events))
+		for i, event := range events {
+			statuses[i] = `{"status":202}`
+			if id, _ := event.Data["messageId"].(string); failing[id] {
+				statuses[i] = `{"status":400,"error":"invalid"}`
+				delete(failing, id)
+			}
+		}
+		return "[" + strings.Join(statuses, ",") + "]"
+	}
+}
+
+func TestHoneycomb(t *testing.T) {
+	intake := newFakeIntake(t, 0)
+	intake.response = honeycombResponse(nil)
+	h := NewHoneycomb(&HoneycombConfig{APIKey: "key", Endpoint: intake.URL,
+		Datasets: map[string]string{"a": "web"}, BatchConfig: testBatchConfig()})
+	processBatch(t, h,
+		SegmentEvent{SegmentMessage: SegmentMessage{Type: "track", ProjectId: "a",
+			Properties: map[string]interface{}{"cart": map[string]interface{}{"total": 10.0}}}},
+		SegmentEvent{SegmentMessage: SegmentMessage{Type: "track", ProjectId: "b"}},
+	)
+
+	requests, bodies := intake.received()
+	if len(requests) != 2 || requests[0].URL.Path != "/1/batch/web" || requests[1].URL.Path != "/1/batch/b" {
+		t.Fatalf("Expected a request per dataset, got %d", len(requests))
+	}
+	var events []struct{ Data map[string]interface{} }
+	json.Unmarshal(bodies[0], &events)
+	if len(events) != 1 || events[0].Data["properties.cart.total"] != 10.0 {
+		t.Errorf("Expected flattened properties, got %v", events)
+	}
+}
+
+func TestHoneycombEventStatus(t *testing.T) {
+	intake := newFakeIntake(t, 0)
+	intake.response = honeycombResponse(map[string]bool{"2": true})
+	h := NewHoneycomb(&HoneycombConfig{APIKey: "key", Endpoint: intake.URL, Dataset: "web", BatchConfig: testBatchConfig()})
+	processBatch(t, h,
+		SegmentEvent{SegmentMessage: SegmentMessage{Type: "track", MessageId: "1"}},
+		SegmentEvent{SegmentMessage: SegmentMessage{Type: "track", MessageId: "2"}},
+	)
+
+	// Only the event that failed is sent again
+	_, bodies := intake.received()
+	if len(bodies) != 2 {
+		t.Fatalf("Expected failed event retried, got %d requests", len(bodies))
+	}
+	var events []struct{ Data map[string]interface{} }
+	json.Unmarshal(bodies[1], &events)
+	if len(events) != 1 || events[0].Data["messageId"] != "2" {
+		t.Errorf("Expected only the failed event retried, got %v", events)
+	}
+
+	// Events without a status are failed
+	intake.mu.Lock()
+	intake.response = func(body []byte) string { return "[]" }
+	intake.mu.Unlock()
+	err := h.write(context.Background(), []SegmentEvent{{SegmentMessage: SegmentMessage{Type: "track", MessageId: "3"}}})
+	if partial, ok := err.(*partialError); !ok || len(partial.failed) != 1 {
+		t.Errorf("Expected event without status failed, got %v", err)
+	}
+}
+
+func TestBatchFlushCadence(t *testing.T) {
+	clock := newTestClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	config := testBatchConfig()
+	config.FlushInterval = time.Minute
+	config.Clock = clock
+	written := make(chan []SegmentEvent, 1)
+	b := newBatcher("test", config, 100, func(ctx context.Context, batch []SegmentEvent) error {
+		written <- batch
+		return nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go b.process(ctx, log.New(io.Discard, "", 0))
+
+	// Steady events don't reset the timer, which starts with the first event of the batch
+	for i := 0; i < 3; i++ {
+		b.send(ctx, SegmentEvent{SegmentMessage: SegmentMessage{Event: "A"}})
+		clock.waitTimers(t, 1)
+		clock.Advance(20 * time.Second)
+	}
+	select {
+	case batch := <-written:
+		if len(batch) != 3 {
+			t.Errorf("Expected 3 events, got %d", len(batch))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected flush a minute after the first event")
+	}
+}
+
+func TestBatchDrainOnShutdown(t *testing.T) {
+	checkLeaks(t)
+	config := testBatchConfig()
+	config.BatchSize = 2
+	var batches [][]SegmentEvent
+	b := newBatcher("test", config, 100, func(ctx context.Context, batch []SegmentEvent) error {
+		batches = append(batches, batch)
+		return nil
+	})
+
+	// Messages buffered before processing are written once cancelled
+	for i := 0; i < 3; i++ {
+		b.send(context.Background(), SegmentEvent{SegmentMessage: SegmentMessage{Event: "A"}})
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	b.process(ctx, log.New(io.Discard, "", 0))
+	if len(batches) != 2 || len(batches[0])+len(batches[1]) != 3 {
+		t.Errorf("Expected 3 events drained in 2 batches, got %v", batches)
+	}
+}
+
+func TestBatchTracerExemplar(t *testing.T) {
+	intake := newFakeIntake(t, 0)
+	config := testBatchConfig()
+	var spans []string
+	config.Tracer = func(ctx context.Context, name string) (context.Context, string, func(error)) {
+		return ctx, "4bf92f3577b34da6a3ce929d0e0e4736", func(err error) { spans = append(spans, name) }
+	}
+	d := NewDatadog(&DatadogConfig{APIKey: "key", Endpoint: intake.URL, BatchConfig: config})
+	processBatch(t, d, SegmentEvent{SegmentMessage: SegmentMessage{Type: "track", Event: "Signed Up"}})
+
+	if len(spans) != 1 || spans[0] != "datadog write" {
+		t.Errorf("Expected write span, got %v", spans)
+	}
+	families, err := config.Registerer.(*prometheus.Registry).Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != "batch_destination_latency_seconds" {
+			continue
+		}
+		for _, bucket := range family.GetMetric()[0].GetHistogram().GetBucket() {
+			if exemplar := bucket.GetExemplar(); exemplar != nil {
+				if label := exemplar.GetLabel()[0]; label.GetName() != "trace_id" || label.GetValue() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+					t.Errorf("Unexpected exemplar %v", exemplar)
+				}
+				return
+			}
+		}
+	}
+	t.Error("Expected latency exemplar")
+}
@@ -0,0 +1,136 @@
+package segment
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// discardDestination accepts and discards messages, so benchmarks measure the handler alone
+type discardDestination struct{}
+
+func (discardDestination) Process(ctx context.Context) error {
+	<-ctx.Done()
+	return nil
+}
+
+func (discardDestination) Send(ctx context.Context, message interface{}) error {
+	return nil
+}
+
+func (d discardDestination) WithLogger(logger *log.Logger) Destination {
+	return d
+}
+
+const benchEvent = `{"type":"track","event":"Order Completed","userId":"user-1","messageId":"%d",` +
+	`"timestamp":"2024-01-01T00:00:00Z","properties":{"orderId":"order-1","total":42.5,"currency":"USD"},` +
+	`"context":{"library":{"name":"analytics.js","version":"4.1.0"},"page":{"path":"/checkout"}}}`
+
+func benchRouter(b *testing.B) *mux.Router {
+	router := mux.NewRouter()
+	NewSegment(func(writeKey string) string { return writeKey }, []Destination{discardDestination{}}, router).
+		WithRegisterer(prometheus.NewRegistry()).
+		WithLogger(log.New(io.Discard, "", 0))
+	return router
+}
+
+func BenchmarkHandleEvent(b *testing.B) {
+	router := benchRouter(b)
+	body := `{"writeKey":"web",` + strings.TrimPrefix(fmt.Sprintf(benchEvent, 1), "{")
+	b.SetBytes(int64(len(body)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/track", strings.NewReader(body)))
+		if w.Code != http.StatusOK {
+			b.Fatalf("Unexpected status %d", w.Code)
+		}
+	}
+}
+
+func BenchmarkHandleBatch(b *testing.B) {
+	router := benchRouter(b)
+	events := make([]string, 100)
+	for i := range events {
+		events[i] = fmt.Sprintf(benchEvent, i)
+	}
+	body := `{"writeKey":"web","batch":[` + strings.Join(events, ",") + `]}`
+	b.SetBytes(int64(len(body)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/batch", strings.NewReader(body)))
+		if w.Code != http.StatusOK {
+			b.Fatalf("Unexpected status %d", w.Code)
+		}
+	}
+}
+
+func BenchmarkDeliveryBatch(b *testing.B) {
+	fh := newFakeFirehose(b)
+	d := NewDelivery(&DeliveryConfig{
+		StreamEndpoint: fh.URL,
+		StreamRegion:   "us-west-2",
+		StreamName:     "test",
+		FlushInterval:  10 * time.Millisecond,
+		Registerer:     prometheus.NewRegistry(),
+	})
+	d.WithLogger(log.New(io.Discard, "", 0))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- d.Process(ctx) }()
+	event := SegmentEvent{SegmentMessage: SegmentMessage{Type: "track", Event: "Order Completed", UserId: "user-1"}}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		d.messages <- event // Block rather than skip, to measure throughput
+	}
+	for len(fh.put()) < b.N {
+		time.Sleep(time.Millisecond)
+	}
+	b.StopTimer()
+	cancel()
+	if err := <-done; err != nil {
+		b.Fatal(err)
+	}
+}
+
+func benchForwarder(b *testing.B, batchSize int) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+	}))
+	defer server.Close()
+	f := NewForwarderWithConfig(&ForwarderConfig{Endpoint: server.URL, Registerer: prometheus.NewRegistry()})
+	events := make([]SegmentEvent, batchSize)
+	for i := range events {
+		events[i] = SegmentEvent{WriteKey: "web", SegmentMessage: SegmentMessage{Type: "track", Event: "Order Completed", UserId: "user-1"}}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := f.send(context.Background(), events...); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkForwarderSend(b *testing.B) {
+	benchForwarder(b, 1)
+}
+
+func BenchmarkForwarderSendBatch(b *testing.B) {
+	benchForwarder(b, 100)
+}
@@ -0,0 +1,60 @@
+package segment
+
+import (
+	"context"
+	"net/url"
+	"strings"
+)
+
+// campaignClickIds are the ad click id parameters copied to the campaign
+var campaignClickIds = map[string]bool{"gclid": true, "fbclid": true, "msclkid": true, "ttclid": true, "dclid": true}
+
+// campaignNames maps utm parameters to campaign fields where they differ, as analytics.js does
+var campaignNames = map[string]string{"campaign": "name"}
+
+// ExtractCampaign is a transform that parses the utm parameters and ad click ids of the page url, falling back to the
+// referrer, into context.campaign, matching what analytics.js does client-side for server sent events.  Campaign
+// fields already set by the client are kept.
+func ExtractCampaign(ctx context.Context, m *SegmentEvent) error {
+	campaign, _ := lookupPath(m.Context, "campaign").(map[string]interface{})
+	found := make(map[string]interface{})
+	for _, path := range []string{"page.url", "page.referrer"} {
+		raw, _ := lookupPath(m.Context, path).(string)
+		if path == "page.url" && raw == "" {
+			raw, _ = m.Properties["url"].(string) // Page event properties
+		}
+		u, err := url.Parse(raw)
+		if raw == "" || err != nil {
+			continue
+		}
+		for key, values := range u.Query() {
+			name := ""
+			switch {
+			case strings.HasPrefix(key, "utm_") && len(key) > len("utm_"):
+				name = strings.TrimPrefix(key, "utm_")
+				if renamed, ok := campaignNames[name]; ok {
+					name = renamed
+				}
+			case campaignClickIds[key]:
+				name = key
+			default:
+				continue
+			}
+			if _, ok := found[name]; ok || values[0] == "" {
+				continue // The url takes precedence over the referrer
+			}
+			if _, ok := campaign[name]; !ok {
+				found[name] = values[0]
+			}
+		}
+	}
+	if len(found) == 0 {
+		return nil
+	}
+	campaign = cloneMap(campaign)
+	for name, value := range found {
+		campaign[name] = value
+	}
+	m.Context = setPath(m.Context, []string{"campaign"}, campaign)
+	return nil
+}
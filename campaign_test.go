@@ -0,0 +1,37 @@
+package segment
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestExtractCampaign(t *testing.T) {
+	shared := map[string]interface{}{
+		"page": map[string]interface{}{
+			"url":      "https://example.com/pricing?utm_source=google&utm_campaign=spring&utm_medium=&gclid=abc&ref=nav",
+			"referrer": "https://example.com/?utm_medium=cpc&utm_source=bing&fbclid=xyz",
+		},
+		"campaign": map[string]interface{}{"content": "banner"},
+	}
+	m := &SegmentEvent{SegmentMessage: SegmentMessage{Type: "page", Context: shared}}
+	ExtractCampaign(context.Background(), m)
+
+	// The url takes precedence over the referrer, and campaign fields set by the client are kept
+	expected := map[string]interface{}{
+		"source": "google", "name": "spring", "medium": "cpc", "gclid": "abc", "fbclid": "xyz", "content": "banner",
+	}
+	if campaign := m.Context["campaign"]; !reflect.DeepEqual(campaign, expected) {
+		t.Errorf("Expected campaign %v, got %v", expected, campaign)
+	}
+	if len(shared["campaign"].(map[string]interface{})) != 1 {
+		t.Errorf("Expected shared context unchanged, got %v", shared)
+	}
+
+	// Page event properties are parsed without a context page
+	m = &SegmentEvent{SegmentMessage: SegmentMessage{Type: "page", Properties: map[string]interface{}{"url": "/?utm_term=shoes"}}}
+	ExtractCampaign(context.Background(), m)
+	if term := lookupPath(m.Context, "campaign.term"); term != "shoes" {
+		t.Errorf("Expected campaign term from properties url, got %v", m.Context)
+	}
+}
@@ -0,0 +1,80 @@
+package segment
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// responseSnippetSize limits the response body captured on error
+const responseSnippetSize = 512
+
+// ResponseRecord is the downstream response to a forwarded message
+type ResponseRecord struct {
+	MessageId string        `json:"messageId"`
+	Time      time.Time     `json:"time"`
+	Endpoint  string        `json:"endpoint"`
+	Status    int           `json:"status,omitempty"` // Zero if no response was received
+	Latency   time.Duration `json:"latency"`
+	Body      string        `json:"body,omitempty"` // Snippet of the response body on error
+	Error     string        `json:"error,omitempty"`
+}
+
+// ResponseStore is the pluggable storage for forwarder responses keyed by messageId
+type ResponseStore interface {
+	Put(ctx context.Context, records []ResponseRecord) error
+}
+
+// WriterResponseStore writes response records as json lines
+type WriterResponseStore struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewWriterResponseStore creates a store writing to w
+func NewWriterResponseStore(w io.Writer) *WriterResponseStore {
+	return &WriterResponseStore{w: w}
+}
+
+// Put encodes each record as a single line
+func (s *WriterResponseStore) Put(ctx context.Context, records []ResponseRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	enc := json.NewEncoder(s.w)
+	for _, record := range records {
+		if err := enc.Encode(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// captureResponse puts a record of the response for each event, logging store errors as the forward has completed
+func (f *Forwarder) captureResponse(ctx context.Context, endpoint string, events []SegmentEvent, status int, latency time.Duration, body []byte, err error) {
+	if f.responses == nil {
+		return
+	}
+	if len(body) > responseSnippetSize {
+		body = body[:responseSnippetSize]
+	}
+	now := time.Now().UTC()
+	records := make([]ResponseRecord, len(events))
+	for i, m := range events {
+		records[i] = ResponseRecord{
+			MessageId: m.MessageId,
+			Time:      now,
+			Endpoint:  endpoint,
+			Status:    status,
+			Latency:   latency,
+			Body:      string(body),
+		}
+		if err != nil {
+			records[i].Error = err.Error()
+		}
+	}
+	if err := f.responses.Put(context.WithoutCancel(ctx), records); err != nil {
+		f.Logger.Printf("Response store error -- %v\n", err)
+	}
+}
@@ -0,0 +1,53 @@
+package segment
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestForwarderResponseCapture(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var batch SegmentBatch
+		json.NewDecoder(r.Body).Decode(&batch)
+		if batch.Messages[0].Event == "Rejected" {
+			http.Error(w, strings.Repeat("x", 2*responseSnippetSize), http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	var buf bytes.Buffer
+	f := NewForwarderWithConfig(&ForwarderConfig{
+		Endpoint:   server.URL,
+		Responses:  NewWriterResponseStore(&buf),
+		Registerer: prometheus.NewRegistry(),
+	})
+	f.send(context.Background(), SegmentEvent{SegmentMessage: SegmentMessage{MessageId: "m1", Type: "track", Event: "Accepted"}})
+	f.send(context.Background(), SegmentEvent{SegmentMessage: SegmentMessage{MessageId: "m2", Type: "track", Event: "Rejected"}})
+
+	var records []ResponseRecord
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var record ResponseRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+	if len(records) != 2 {
+		t.Fatalf("Expected 2 records, got %v", records)
+	}
+	if r := records[0]; r.MessageId != "m1" || r.Status != http.StatusOK || r.Body != "" || r.Error != "" || r.Latency <= 0 {
+		t.Errorf("Unexpected success record %+v", r)
+	}
+	if r := records[1]; r.MessageId != "m2" || r.Status != http.StatusBadRequest || len(r.Body) != responseSnippetSize || r.Error == "" {
+		t.Errorf("Unexpected error record %+v", r)
+	}
+}
@@ -0,0 +1,44 @@
+package segment
+
+import "strings"
+
+// Channels for the message channel field
+const (
+	ChannelServer = "server"
+	ChannelClient = "client"
+	ChannelMobile = "mobile"
+)
+
+// libraryChannels maps segment library names to channels, other libraries are server
+var libraryChannels = map[string]string{
+	"analytics.js":           ChannelClient,
+	"analytics-next":         ChannelClient,
+	"analytics-ios":          ChannelMobile,
+	"analytics-swift":        ChannelMobile,
+	"analytics-android":      ChannelMobile,
+	"analytics-kotlin":       ChannelMobile,
+	"analytics-react-native": ChannelMobile,
+	"analytics-flutter":      ChannelMobile,
+}
+
+// InferChannel returns the channel from the library name, device or user agent in the context
+func InferChannel(m SegmentMessage) string {
+	if name, ok := lookupPath(m.Context, "library.name").(string); ok && name != "" {
+		if channel, ok := libraryChannels[name]; ok {
+			return channel
+		}
+		return ChannelServer
+	}
+	for _, path := range []string{"device.type", "os.name"} {
+		if value, ok := lookupPath(m.Context, path).(string); ok {
+			switch strings.ToLower(value) {
+			case "ios", "android", "ipados":
+				return ChannelMobile
+			}
+		}
+	}
+	if ua, ok := m.Context["userAgent"].(string); ok && ua != "" {
+		return ChannelClient
+	}
+	return ChannelServer
+}
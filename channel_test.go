@@ -0,0 +1,21 @@
+package segment
+
+import "testing"
+
+func TestInferChannel(t *testing.T) {
+	for _, tc := range []struct {
+		context  map[string]interface{}
+		expected string
+	}{
+		{map[string]interface{}{"library": map[string]interface{}{"name": "analytics.js"}}, ChannelClient},
+		{map[string]interface{}{"library": map[string]interface{}{"name": "analytics-ios"}}, ChannelMobile},
+		{map[string]interface{}{"library": map[string]interface{}{"name": "analytics-go"}}, ChannelServer},
+		{map[string]interface{}{"os": map[string]interface{}{"name": "Android"}}, ChannelMobile},
+		{map[string]interface{}{"userAgent": "Mozilla/5.0"}, ChannelClient},
+		{nil, ChannelServer},
+	} {
+		if channel := InferChannel(SegmentMessage{Context: tc.context}); channel != tc.expected {
+			t.Errorf("Expected %s for %v, got %s", tc.expected, tc.context, channel)
+		}
+	}
+}
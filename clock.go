@@ -0,0 +1,25 @@
+package segment
+
+import "time"
+
+// Clock provides the current time and timers, so flush intervals and timestamps can be tested without sleeping
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// SystemClock is the default clock using the time package
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// clockOrSystem returns the clock, or the system clock if nil
+func clockOrSystem(clock Clock) Clock {
+	if clock == nil {
+		return SystemClock
+	}
+	return clock
+}
@@ -0,0 +1,176 @@
+package segment
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// testClock is a clock advanced by the test, firing timers that are due
+type testClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []testTimer
+}
+
+type testTimer struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func newTestClock(now time.Time) *testClock {
+	return &testClock{now: now}
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	timer := testTimer{at: c.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		timer.c <- c.now
+	} else {
+		c.timers = append(c.timers, timer)
+	}
+	return timer.c
+}
+
+// Advance moves the clock forward by d, firing due timers
+func (c *testClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.timers[:0]
+	for _, timer := range c.timers {
+		if timer.at.After(c.now) {
+			pending = append(pending, timer)
+		} else {
+			timer.c <- c.now
+		}
+	}
+	c.timers = pending
+}
+
+// waitTimers waits until at least n timers are pending
+func (c *testClock) waitTimers(t *testing.T, n int) {
+	deadline := time.Now().Add(time.Second)
+	for {
+		c.mu.Lock()
+		pending := len(c.timers)
+		c.mu.Unlock()
+		if pending >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d timers, got %d", n, pending)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestClockFlushInterval(t *testing.T) {
+	clock := newTestClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	config := testBatchConfig()
+	config.FlushInterval = time.Minute
+	config.Clock = clock
+	written := make(chan []SegmentEvent, 1)
+	b := newBatcher("test", config, 100, func(ctx context.Context, batch []SegmentEvent) error {
+		written <- batch
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go b.process(ctx, log.New(&strings.Builder{}, "", 0))
+	b.send(ctx, SegmentEvent{SegmentMessage: SegmentMessage{Type: "track", Event: "Clicked"}})
+	clock.waitTimers(t, 1)
+
+	// Not flushed until the interval elapses
+	clock.Advance(59 * time.Second)
+	select {
+	case <-written:
+		t.Fatal("Expected no flush before interval")
+	case <-time.After(10 * time.Millisecond):
+	}
+	clock.Advance(time.Second)
+	select {
+	case batch := <-written:
+		if len(batch) != 1 {
+			t.Errorf("Expected 1 event, got %d", len(batch))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected flush after interval")
+	}
+}
+
+func TestClockForwarderFlushInterval(t *testing.T) {
+	requests := make(chan int, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var batch SegmentBatch
+		json.NewDecoder(r.Body).Decode(&batch)
+		requests <- len(batch.Messages)
+	}))
+	defer server.Close()
+
+	clock := newTestClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	f := NewForwarderWithConfig(&ForwarderConfig{Endpoint: server.URL, BatchSize: 10, Registerer: prometheus.NewRegistry(), Clock: clock})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- f.Process(ctx) }()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	f.messages <- SegmentEvent{WriteKey: "web", SegmentMessage: SegmentMessage{Type: "track", Event: "Clicked"}}
+	clock.waitTimers(t, 1)
+
+	// The partial batch is forwarded once the interval elapses
+	select {
+	case <-requests:
+		t.Fatal("Expected no request before interval")
+	case <-time.After(10 * time.Millisecond):
+	}
+	clock.Advance(time.Second)
+	select {
+	case n := <-requests:
+		if n != 1 {
+			t.Errorf("Expected 1 event, got %d", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected request after interval")
+	}
+}
+
+func TestClockReceivedAt(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	dest := &testDestination{}
+	router := mux.NewRouter()
+	NewSegment(func(writeKey string) string { return writeKey }, []Destination{dest}, router).
+		WithClock(newTestClock(now))
+
+	// Device clock is an hour fast, so the timestamp is corrected by the received time
+	body := `{"writeKey":"web","event":"Clicked","timestamp":"2024-01-01T12:59:50Z","sentAt":"2024-01-01T13:00:00Z"}`
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/track", strings.NewReader(body)))
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, got %d %s", w.Code, w.Body)
+	}
+	m := dest.sent()[0].(SegmentEvent)
+	if !m.ReceivedAt.Equal(now) || !m.Timestamp.Equal(now.Add(-10*time.Second)) {
+		t.Errorf("Unexpected receivedAt %s timestamp %s", m.ReceivedAt, m.Timestamp)
+	}
+}
@@ -0,0 +1,33 @@
+// Command segment-replay sends requests captured by a segment Recorder to another collector instance
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+
+	"github.com/brightsparc/segment"
+)
+
+func main() {
+	target := flag.String("target", "http://localhost:8080", "Collector url, including any mount prefix")
+	writeKey := flag.String("writeKey", "", "Write key to authenticate with, as recorded credentials are redacted")
+	flag.Parse()
+	if flag.NArg() == 0 {
+		log.Fatal("Usage: segment-replay [-target url] [-writeKey key] requests.ndjson...")
+	}
+
+	for _, name := range flag.Args() {
+		f, err := os.Open(name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		n, err := segment.ReplayRecording(context.Background(), f, *target, *writeKey, nil)
+		f.Close()
+		if err != nil {
+			log.Fatalf("Replay %s error after %d requests -- %v", name, n, err)
+		}
+		log.Printf("Replayed %d requests from %s\n", n, name)
+	}
+}
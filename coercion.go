@@ -0,0 +1,128 @@
+package segment
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// coercionNumber matches json numbers, so strings with leading zeros eg zip codes are not coerced
+var coercionNumber = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][+-]?[0-9]+)?$`)
+
+// coercionLayouts are the ISO 8601 date time layouts coerced to timestamps, dates without a time are not coerced
+var coercionLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999Z0700",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999Z0700",
+	"2006-01-02 15:04:05.999999999",
+}
+
+// CoercionConfig enables coercion of string values that look like other types, applied to every field within the
+// roots, so warehouse schema inference doesn't create VARCHAR columns for numeric fields
+type CoercionConfig struct {
+	Numbers    bool     `json:"numbers,omitempty"`    // "123" to 123 and "9.99" to 9.99
+	Booleans   bool     `json:"booleans,omitempty"`   // "true" and "false" to booleans
+	Timestamps bool     `json:"timestamps,omitempty"` // ISO 8601 date times to RFC3339 in UTC
+	Roots      []string `json:"roots,omitempty"`      // Any of context, properties or traits, defaults to properties and traits
+	Exclude    []string `json:"exclude,omitempty"`    // Paths kept as strings eg "properties.orderId"
+}
+
+// Coercion returns a transform that coerces string values by the config
+func Coercion(config CoercionConfig) (Transform, error) {
+	if len(config.Roots) == 0 {
+		config.Roots = []string{"properties", "traits"}
+	}
+	for _, root := range config.Roots {
+		if _, ok := eventMaps(&SegmentEvent{})[root]; !ok {
+			return nil, fmt.Errorf("Coercion root %q must be context, properties or traits", root)
+		}
+	}
+	exclude := make(map[string]bool, len(config.Exclude))
+	for _, path := range config.Exclude {
+		if !validPath(path) {
+			return nil, fmt.Errorf("Coercion exclude %q must be within context, properties or traits", path)
+		}
+		exclude[path] = true
+	}
+
+	c := &coercion{config: config, exclude: exclude}
+	return func(ctx context.Context, m *SegmentEvent) error {
+		maps := eventMaps(m)
+		for _, root := range config.Roots {
+			if value, ok := c.value(root, *maps[root]); ok {
+				*maps[root] = value.(map[string]interface{})
+			}
+		}
+		return nil
+	}, nil
+}
+
+// coercion applies the config to values by path
+type coercion struct {
+	config  CoercionConfig
+	exclude map[string]bool
+}
+
+// value returns the coerced value at path and true if changed, copying maps and arrays rather than modifying them
+func (c *coercion) value(path string, value interface{}) (interface{}, bool) {
+	if c.exclude[path] {
+		return value, false
+	}
+	switch v := value.(type) {
+	case string:
+		return c.coerce(v)
+	case map[string]interface{}:
+		var copied map[string]interface{}
+		for k, item := range v {
+			if coerced, ok := c.value(path+"."+k, item); ok {
+				if copied == nil {
+					copied = cloneMap(v)
+				}
+				copied[k] = coerced
+			}
+		}
+		return copied, copied != nil
+	case []interface{}:
+		var copied []interface{}
+		for i, item := range v {
+			if coerced, ok := c.value(path, item); ok {
+				if copied == nil {
+					copied = append([]interface{}(nil), v...)
+				}
+				copied[i] = coerced
+			}
+		}
+		return copied, copied != nil
+	}
+	return value, false
+}
+
+// coerce returns the string as a number, boolean or RFC3339 timestamp and true if enabled and it looks like one
+func (c *coercion) coerce(s string) (interface{}, bool) {
+	if c.config.Numbers && coercionNumber.MatchString(s) {
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return i, true
+		}
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return f, true
+		}
+	}
+	if c.config.Booleans && (s == "true" || s == "false") {
+		return s == "true", true
+	}
+	if c.config.Timestamps {
+		for _, layout := range coercionLayouts {
+			if t, err := time.Parse(layout, s); err == nil {
+				if formatted := t.UTC().Format(time.RFC3339Nano); formatted != s {
+					return formatted, true
+				}
+				return s, false
+			}
+		}
+	}
+	return s, false
+}
@@ -0,0 +1,55 @@
+package segment
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestCoercion(t *testing.T) {
+	coercion, err := Coercion(CoercionConfig{Numbers: true, Booleans: true, Timestamps: true, Exclude: []string{"properties.orderId"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shared := map[string]interface{}{
+		"quantity": "3",
+		"price":    "9.99",
+		"zip":      "02134",
+		"orderId":  "123",
+		"gift":     "true",
+		"label":    "True",
+		"shipped":  "2024-06-01T10:00:00+02:00",
+		"day":      "2024-06-01",
+		"items":    []interface{}{map[string]interface{}{"sku": "42"}},
+	}
+	m := &SegmentEvent{SegmentMessage: SegmentMessage{Type: "track", Event: "Order Completed",
+		Properties: shared,
+		Context:    map[string]interface{}{"version": "2"},
+	}}
+	coercion(context.Background(), m)
+	expected := map[string]interface{}{
+		"quantity": int64(3),
+		"price":    9.99,
+		"zip":      "02134",
+		"orderId":  "123",
+		"gift":     true,
+		"label":    "True",
+		"shipped":  "2024-06-01T08:00:00Z",
+		"day":      "2024-06-01",
+		"items":    []interface{}{map[string]interface{}{"sku": int64(42)}},
+	}
+	if !reflect.DeepEqual(m.Properties, expected) {
+		t.Errorf("Expected coerced properties %v, got %v", expected, m.Properties)
+	}
+	if shared["quantity"] != "3" || shared["items"].([]interface{})[0].(map[string]interface{})["sku"] != "42" {
+		t.Errorf("Expected shared properties unchanged, got %v", shared)
+	}
+	if m.Context["version"] != "2" {
+		t.Errorf("Expected context not coerced by default, got %v", m.Context)
+	}
+
+	if _, err := Coercion(CoercionConfig{Roots: []string{"userId"}}); err == nil {
+		t.Error("Expected invalid root error")
+	}
+}
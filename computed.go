@@ -0,0 +1,107 @@
+package segment
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"text/template"
+)
+
+// ComputedConfig declares fields derived from each event, so lightweight derivations don't need a downstream job
+type ComputedConfig struct {
+	Fields []ComputedField `json:"fields"` // Evaluated in order, so later fields can use earlier ones
+}
+
+// ComputedField sets a value at a dotted path within context, properties or traits, from the bucket of a numeric
+// value, or a go template over the event with the request template functions
+type ComputedField struct {
+	Event    string   `json:"event,omitempty"`    // Only for this event name, empty for all
+	To       string   `json:"to"`                 // Path of the computed value eg "properties.order_size_bucket"
+	From     string   `json:"from,omitempty"`     // Path of the numeric value bucketed eg "properties.total"
+	Buckets  []Bucket `json:"buckets,omitempty"`  // Labels by lower bound, values below the lowest are not set
+	Template string   `json:"template,omitempty"` // Template eg "{{.Properties.plan}}-{{.Context.locale}}"
+	Type     string   `json:"type,omitempty"`     // Coerce to "string", "number", "integer" or "boolean"
+}
+
+// Bucket labels numeric values from Min up to the Min of the next bucket
+type Bucket struct {
+	Min   float64 `json:"min"`
+	Label string  `json:"label"`
+}
+
+// computedField is a field with its buckets sorted and template parsed
+type computedField struct {
+	ComputedField
+	template *template.Template
+}
+
+// Computed returns a transform that sets the computed fields, fields without a value are not set
+func Computed(config ComputedConfig) (Transform, error) {
+	fields := make([]computedField, len(config.Fields))
+	for i, f := range config.Fields {
+		if !validPath(f.To) || (f.From != "" && !validPath(f.From)) {
+			return nil, fmt.Errorf("Computed paths %q and %q must be within context, properties or traits", f.From, f.To)
+		}
+		if (f.From == "") == (f.Template == "") || (f.From != "") != (len(f.Buckets) > 0) {
+			return nil, fmt.Errorf("Computed %s requires either from with buckets, or a template", f.To)
+		}
+		switch f.Type {
+		case "", "string", "number", "integer", "boolean":
+		default:
+			return nil, fmt.Errorf("Computed type %q unknown", f.Type)
+		}
+		fields[i].ComputedField = f
+		fields[i].Buckets = append([]Bucket(nil), f.Buckets...)
+		sort.SliceStable(fields[i].Buckets, func(a, b int) bool { return fields[i].Buckets[a].Min < fields[i].Buckets[b].Min })
+		if f.Template != "" {
+			t, err := template.New(f.To).Funcs(templateFuncs).Parse(f.Template)
+			if err != nil {
+				return nil, fmt.Errorf("Computed %s template error -- %v", f.To, err)
+			}
+			fields[i].template = t
+		}
+	}
+
+	return func(ctx context.Context, m *SegmentEvent) error {
+		maps := eventMaps(m)
+		for _, f := range fields {
+			if f.Event != "" && f.Event != eventName(m.SegmentMessage) {
+				continue
+			}
+			value, ok := f.value(m)
+			if ok && f.Type != "" {
+				value, ok = coerce(value, f.Type)
+			}
+			if !ok {
+				continue
+			}
+			to := splitPath(f.To)
+			*maps[to[0]] = setPath(*maps[to[0]], to[1:], value)
+		}
+		return nil
+	}, nil
+}
+
+// value returns the computed value for the event, or false if it has none
+func (f *computedField) value(m *SegmentEvent) (interface{}, bool) {
+	if f.template != nil {
+		var buf bytes.Buffer
+		if err := f.template.Execute(&buf, m); err != nil || buf.Len() == 0 || buf.String() == "<no value>" {
+			return nil, false
+		}
+		return buf.String(), true
+	}
+	amount, ok := coerce(lookupEventPath(m, f.From), "number")
+	if !ok {
+		return nil, false
+	}
+	label := ""
+	for _, b := range f.Buckets {
+		if amount.(float64) < b.Min {
+			break
+		}
+		label = b.Label
+	}
+	return label, label != ""
+}
@@ -0,0 +1,50 @@
+package segment
+
+import (
+	"context"
+	"testing"
+)
+
+func TestComputed(t *testing.T) {
+	computed, err := Computed(ComputedConfig{Fields: []ComputedField{
+		{Event: "Order Completed", To: "properties.order_size_bucket", From: "properties.total", Buckets: []Bucket{
+			{Min: 100, Label: "large"}, {Min: 0, Label: "small"}, {Min: 20, Label: "medium"},
+		}},
+		{To: "properties.segment", Template: "{{.Properties.order_size_bucket}}-{{.Context.locale}}"},
+		{To: "traits.vip", Template: `{{if eq .Properties.order_size_bucket "large"}}true{{end}}`, Type: "boolean"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for total, expected := range map[interface{}]string{"25": "medium", 150.0: "large", 5.0: "small", -1.0: "", "free": ""} {
+		shared := map[string]interface{}{"total": total}
+		m := &SegmentEvent{SegmentMessage: SegmentMessage{Type: "track", Event: "Order Completed",
+			Properties: shared,
+			Context:    map[string]interface{}{"locale": "en-AU"},
+		}}
+		computed(context.Background(), m)
+		if bucket, _ := m.Properties["order_size_bucket"].(string); bucket != expected {
+			t.Errorf("Expected %v bucket %q, got %q", total, expected, bucket)
+		}
+		if _, ok := shared["order_size_bucket"]; ok {
+			t.Errorf("Expected shared properties unchanged, got %v", shared)
+		}
+		if expected != "" && m.Properties["segment"] != expected+"-en-AU" {
+			t.Errorf("Expected segment from earlier field, got %v", m.Properties["segment"])
+		}
+		if vip := m.Traits["vip"]; (expected == "large") != (vip == true) {
+			t.Errorf("Expected %v vip %v, got %v", total, expected == "large", vip)
+		}
+	}
+
+	for _, f := range []ComputedField{
+		{To: "userId", Template: "x"},
+		{To: "properties.bucket", From: "properties.total"},
+		{To: "properties.x", Template: "{{"},
+	} {
+		if _, err := Computed(ComputedConfig{Fields: []ComputedField{f}}); err == nil {
+			t.Errorf("Expected %+v error", f)
+		}
+	}
+}
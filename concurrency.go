@@ -0,0 +1,123 @@
+package segment
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Concurrency rejection reasons
+const (
+	RejectQueueFull    = "queue_full"
+	RejectQueueTimeout = "queue_timeout"
+)
+
+// ConcurrencyConfig limits the event handlers in flight, queueing requests beyond the limit
+type ConcurrencyConfig struct {
+	MaxInFlight  int           `json:"maxInFlight"`
+	MaxQueue     int           `json:"maxQueue,omitempty"`     // Requests waiting beyond which 503, defaults to MaxInFlight
+	QueueTimeout time.Duration `json:"queueTimeout,omitempty"` // Max wait for a slot before 503, defaults to 5 seconds
+	// Registerer for metrics, defaults to the prometheus default registerer
+	Registerer prometheus.Registerer `json:"-"`
+}
+
+// ConcurrencyLimit is a semaphore of in flight handlers with a bounded queue, protecting destinations from a
+// thundering herd eg when a load balancer retries
+type ConcurrencyLimit struct {
+	slots    chan struct{}
+	queued   atomic.Int64
+	maxQueue int64
+	timeout  time.Duration
+	rejected *prometheus.CounterVec
+}
+
+// NewConcurrencyLimit creates a limit given config defaults
+func NewConcurrencyLimit(config ConcurrencyConfig) *ConcurrencyLimit {
+	if config.MaxInFlight <= 0 {
+		config.MaxInFlight = 1
+	}
+	if config.MaxQueue <= 0 {
+		config.MaxQueue = config.MaxInFlight
+	}
+	if config.QueueTimeout <= 0 {
+		config.QueueTimeout = time.Second * 5
+	}
+	l := &ConcurrencyLimit{
+		slots:    make(chan struct{}, config.MaxInFlight),
+		maxQueue: int64(config.MaxQueue),
+		timeout:  config.QueueTimeout,
+		rejected: newCounterVec(config.Registerer, prometheus.CounterOpts{
+			Name: "handler_rejected_total",
+			Help: "Event requests rejected over the concurrency limit total",
+		}, "reason"),
+	}
+	registerCollector(config.Registerer, prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "handler_inflight",
+		Help: "Event handlers in flight",
+	}, func() float64 { return float64(l.InFlight()) }))
+	registerCollector(config.Registerer, prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "handler_queued",
+		Help: "Event requests waiting for a handler",
+	}, func() float64 { return float64(l.queued.Load()) }))
+	return l
+}
+
+// WithConcurrencyLimit limits the event handlers in flight, responding 503 when the queue is full or times out
+func (s *Segment) WithConcurrencyLimit(limit *ConcurrencyLimit) *Segment {
+	s.concurrency = limit
+	return s
+}
+
+// InFlight returns the handlers in flight
+func (l *ConcurrencyLimit) InFlight() int {
+	return len(l.slots)
+}
+
+// acquire waits for a slot until the queue timeout or the request is done, returning the rejection reason if not
+func (l *ConcurrencyLimit) acquire(r *http.Request) string {
+	select {
+	case l.slots <- struct{}{}:
+		return ""
+	default:
+	}
+	if l.queued.Add(1) > l.maxQueue {
+		l.queued.Add(-1)
+		return RejectQueueFull
+	}
+	defer l.queued.Add(-1)
+	timer := time.NewTimer(l.timeout)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return ""
+	case <-timer.C:
+		return RejectQueueTimeout
+	case <-r.Context().Done():
+		return RejectQueueTimeout
+	}
+}
+
+func (l *ConcurrencyLimit) release() {
+	<-l.slots
+}
+
+// limit wraps the handler with the concurrency limit if set
+func (s *Segment) limit(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		l := s.concurrency
+		if l == nil {
+			h(w, r)
+			return
+		}
+		if reason := l.acquire(r); reason != "" {
+			l.rejected.WithLabelValues(reason).Inc()
+			w.Header().Set("Retry-After", "1")
+			writeError(w, http.StatusServiceUnavailable, "overloaded", "Server is overloaded")
+			return
+		}
+		defer l.release()
+		h(w, r)
+	}
+}
@@ -0,0 +1,69 @@
+package segment
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// blockingDestination blocks sends until released
+type blockingDestination struct {
+	testDestination
+	started chan struct{}
+	release chan struct{}
+}
+
+func (d *blockingDestination) Send(ctx context.Context, message interface{}) error {
+	d.started <- struct{}{}
+	<-d.release
+	return d.testDestination.Send(ctx, message)
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	dest := &blockingDestination{started: make(chan struct{}, 10), release: make(chan struct{})}
+	limit := NewConcurrencyLimit(ConcurrencyConfig{
+		MaxInFlight:  1,
+		MaxQueue:     1,
+		QueueTimeout: 50 * time.Millisecond,
+		Registerer:   prometheus.NewRegistry(),
+	})
+	router := mux.NewRouter()
+	NewSegment(func(writeKey string) string { return writeKey }, []Destination{dest}, router).
+		WithConcurrencyLimit(limit)
+
+	post := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/track", strings.NewReader(`{"writeKey":"web","event":"Clicked"}`)))
+		return w
+	}
+
+	// First request holds the slot, the second queues, and the third is rejected with the queue full
+	first := make(chan *httptest.ResponseRecorder)
+	go func() { first <- post() }()
+	<-dest.started
+	second := make(chan *httptest.ResponseRecorder)
+	go func() { second <- post() }()
+	for limit.queued.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if w := post(); w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected 503 with the queue full, got %d", w.Code)
+	}
+	if w := <-second; w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 after the queue timeout, got %d", w.Code)
+	}
+
+	close(dest.release)
+	if w := <-first; w.Code != http.StatusOK {
+		t.Errorf("Expected 200, got %d %s", w.Code, w.Body)
+	}
+	if w := post(); w.Code != http.StatusOK || limit.InFlight() != 0 {
+		t.Errorf("Expected 200 with the slot released, got %d", w.Code)
+	}
+}
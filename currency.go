@@ -0,0 +1,167 @@
+package segment
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Revenue results counted by the revenue_normalized_total metric
+const (
+	revenueConverted = "converted"
+	revenueUnparsed  = "unparsed" // Amount or currency code invalid
+	revenueNoRate    = "no_rate"  // Rates provider returned an error
+)
+
+// currencyCode matches ISO 4217 currency codes
+var currencyCode = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// RatesProvider returns the rate to multiply an amount in currency by to convert it to the base currency at a time
+type RatesProvider interface {
+	Rate(ctx context.Context, currency, base string, at time.Time) (float64, error)
+}
+
+// StaticRates is a rates provider with fixed rates to the base currency by currency code
+type StaticRates map[string]float64
+
+// Rate returns the fixed rate for the currency, or 1 for the base currency
+func (r StaticRates) Rate(ctx context.Context, currency, base string, at time.Time) (float64, error) {
+	if currency == base {
+		return 1, nil
+	}
+	if rate, ok := r[currency]; ok {
+		return rate, nil
+	}
+	return 0, fmt.Errorf("No rate for %s to %s", currency, base)
+}
+
+// RevenueConfig contains the base currency and properties of e-commerce events normalized
+type RevenueConfig struct {
+	Base     string   `json:"base,omitempty"`     // Currency code converted to, defaults to USD
+	Currency string   `json:"currency,omitempty"` // Currency code of events without a currency property, defaults to USD
+	Fields   []string `json:"fields,omitempty"`   // Amount properties, defaults to revenue, total and value
+	Suffix   string   `json:"suffix,omitempty"`   // Appended to fields for the base amount, defaults to "_" and the base eg "_usd"
+	// Rates converts amounts to the base currency
+	Rates RatesProvider `json:"-"`
+	// Registerer for metrics, defaults to the prometheus default registerer
+	Registerer prometheus.Registerer `json:"-"`
+}
+
+// Validate checks the currency codes and rates provider
+func (config *RevenueConfig) Validate() error {
+	for _, code := range []string{config.Base, config.Currency} {
+		if code != "" && !currencyCode.MatchString(code) {
+			return fmt.Errorf("Revenue currency %q must be an ISO 4217 code", code)
+		}
+	}
+	if config.Rates == nil {
+		return fmt.Errorf("Revenue requires a rates provider")
+	}
+	return nil
+}
+
+// RevenueNormalizer parses the amounts and currency of e-commerce events, and stamps the amounts converted to a base
+// currency, so events are ready for analytics when they land
+type RevenueNormalizer struct {
+	config     RevenueConfig
+	normalized *prometheus.CounterVec
+}
+
+// NewRevenueNormalizer creates a revenue normalizer given config defaults
+func NewRevenueNormalizer(config RevenueConfig) *RevenueNormalizer {
+	if err := config.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	if config.Base == "" {
+		config.Base = "USD"
+	}
+	if config.Currency == "" {
+		config.Currency = "USD"
+	}
+	if len(config.Fields) == 0 {
+		config.Fields = []string{"revenue", "total", "value"}
+	}
+	if config.Suffix == "" {
+		config.Suffix = "_" + strings.ToLower(config.Base)
+	}
+	return &RevenueNormalizer{
+		config: config,
+		normalized: newCounterVec(config.Registerer, prometheus.CounterOpts{
+			Name: "revenue_normalized_total",
+			Help: "Events with revenue normalized total by currency and result, converted, unparsed or no_rate",
+		}, "currency", "result"),
+	}
+}
+
+// Transform parses the amount fields and currency in place, and sets the amounts in the base currency with the
+// suffix, leaving the event unchanged if the amounts can't be parsed or converted
+func (n *RevenueNormalizer) Transform(ctx context.Context, m *SegmentEvent) error {
+	amounts := make(map[string]float64)
+	for _, field := range n.config.Fields {
+		if value, ok := m.Properties[field]; ok && value != nil {
+			amount, ok := parseAmount(value)
+			if !ok {
+				n.normalized.WithLabelValues("", revenueUnparsed).Inc()
+				return nil
+			}
+			amounts[field] = amount
+		}
+	}
+	if len(amounts) == 0 {
+		return nil
+	}
+	currency := n.config.Currency
+	if value, ok := m.Properties["currency"].(string); ok && value != "" {
+		currency = strings.ToUpper(strings.TrimSpace(value))
+	}
+	if !currencyCode.MatchString(currency) {
+		n.normalized.WithLabelValues("", revenueUnparsed).Inc()
+		return nil
+	}
+	rate, err := n.config.Rates.Rate(ctx, currency, n.config.Base, m.Timestamp)
+	if err != nil {
+		n.normalized.WithLabelValues(currency, revenueNoRate).Inc()
+		return nil
+	}
+
+	m.Properties = cloneMap(m.Properties) // Shared between events in a batch
+	m.Properties["currency"] = currency
+	for field, amount := range amounts {
+		m.Properties[field] = amount
+		m.Properties[field+n.config.Suffix] = amount * rate
+	}
+	n.normalized.WithLabelValues(currency, revenueConverted).Inc()
+	return nil
+}
+
+// parseAmount returns a json number, or a string with an optional currency symbol and locale separators eg "$1,234.50"
+// or "1.234,50 €", as a float. With both separators the last is the decimal separator, a single "." is decimal, and a
+// single "," is decimal unless followed by exactly 3 digits.
+func parseAmount(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case int64:
+		return float64(v), true
+	case string:
+		s := strings.TrimFunc(v, func(r rune) bool { return !(r >= '0' && r <= '9') && r != '-' })
+		s = strings.ReplaceAll(s, " ", "")
+		dot, comma := strings.LastIndex(s, "."), strings.LastIndex(s, ",")
+		switch {
+		case dot >= 0 && comma >= 0 && comma > dot, dot < 0 && strings.Count(s, ",") == 1 && len(s)-comma-1 != 3:
+			s = strings.ReplaceAll(s, ".", "")
+			s = strings.Replace(s, ",", ".", 1)
+		default:
+			s = strings.ReplaceAll(s, ",", "")
+		}
+		f, err := strconv.ParseFloat(s, 64)
+		return f, err == nil && coercionNumber.MatchString(s)
+	}
+	return 0, false
+}
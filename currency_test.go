@@ -0,0 +1,62 @@
+package segment
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParseAmount(t *testing.T) {
+	for value, expected := range map[interface{}]float64{
+		9.99:         9.99,
+		"$1,234.50":  1234.5,
+		"1.234,50 €": 1234.5,
+		"12,50":      12.5,
+		"1,234":      1234,
+		"-5":         -5,
+		"EUR 20":     20,
+	} {
+		if amount, ok := parseAmount(value); !ok || amount != expected {
+			t.Errorf("Expected %v parsed %v, got %v %v", value, expected, amount, ok)
+		}
+	}
+	for _, value := range []interface{}{"free", "1.234.567", true} {
+		if amount, ok := parseAmount(value); ok {
+			t.Errorf("Expected %v unparsed, got %v", value, amount)
+		}
+	}
+}
+
+func TestRevenueNormalizer(t *testing.T) {
+	n := NewRevenueNormalizer(RevenueConfig{
+		Rates:      StaticRates{"EUR": 1.5},
+		Registerer: prometheus.NewRegistry(),
+	})
+	shared := map[string]interface{}{"revenue": "€10,00", "total": 12.5, "currency": "eur"}
+	m := &SegmentEvent{SegmentMessage: SegmentMessage{Type: "track", Event: "Order Completed", Properties: shared}}
+	n.Transform(context.Background(), m)
+
+	// Amounts are parsed in place and stamped in the base currency, without modifying the shared properties
+	if m.Properties["revenue"] != 10.0 || m.Properties["revenue_usd"] != 15.0 || m.Properties["total_usd"] != 18.75 || m.Properties["currency"] != "EUR" {
+		t.Errorf("Expected normalized revenue, got %v", m.Properties)
+	}
+	if shared["revenue"] != "€10,00" {
+		t.Errorf("Expected shared properties unchanged, got %v", shared)
+	}
+
+	// Events without a rate are left unchanged
+	m = &SegmentEvent{SegmentMessage: SegmentMessage{Type: "track", Properties: map[string]interface{}{"revenue": "5", "currency": "JPY"}}}
+	n.Transform(context.Background(), m)
+	if m.Properties["revenue"] != "5" || m.Properties["revenue_usd"] != nil {
+		t.Errorf("Expected unchanged without rate, got %v", m.Properties)
+	}
+	if testutil.ToFloat64(n.normalized.WithLabelValues("EUR", revenueConverted)) != 1 || testutil.ToFloat64(n.normalized.WithLabelValues("JPY", revenueNoRate)) != 1 {
+		t.Error("Expected converted and no rate counted")
+	}
+
+	if err := (&RevenueConfig{Base: "usd", Rates: StaticRates{}}).Validate(); err == nil {
+		t.Error("Expected invalid currency code error")
+	}
+}
@@ -0,0 +1,134 @@
+package segment
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// datadogMaxBatch is the maximum number of logs per intake request
+const datadogMaxBatch = 1000
+
+// DatadogConfig contains configuration parameters for the datadog logs destination
+type DatadogConfig struct {
+	APIKey   string   `json:"apiKey"`
+	Site     string   `json:"site,omitempty"`     // Defaults to "datadoghq.com"
+	Endpoint string   `json:"endpoint,omitempty"` // Overrides the site logs intake url
+	Service  string   `json:"service,omitempty"`  // Defaults to "segment"
+	Source   string   `json:"source,omitempty"`   // Defaults to "segment"
+	Hostname string   `json:"hostname,omitempty"`
+	Tags     []string `json:"tags,omitempty"` // Additional tags eg "env:prod"
+	// TraceField is the dotted path of an APM trace id to correlate, defaults to "context.traceId"
+	TraceField string `json:"traceField,omitempty"`
+	BatchConfig
+}
+
+// Datadog is a destination shipping events to the datadog logs intake api
+type Datadog struct {
+	Logger  *log.Logger // Public logger that caller can override
+	config  DatadogConfig
+	batcher *batcher
+}
+
+// NewDatadog creates a new datadog destination given configuration
+func NewDatadog(config *DatadogConfig) *Datadog {
+	if err := config.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	if config.Site == "" {
+		config.Site = "datadoghq.com"
+	}
+	if config.Endpoint == "" {
+		config.Endpoint = "https://http-intake.logs." + config.Site + "/api/v2/logs"
+	}
+	if config.Service == "" {
+		config.Service = "segment"
+	}
+	if config.Source == "" {
+		config.Source = "segment"
+	}
+	if config.TraceField == "" {
+		config.TraceField = "context.traceId"
+	}
+	d := &Datadog{
+		Logger: log.New(os.Stderr, "", log.LstdFlags),
+		config: *config,
+	}
+	d.batcher = newHTTPBatcher("datadog", config.BatchConfig, datadogMaxBatch, d.request)
+	return d
+}
+
+// Validate checks the api key is set
+func (config *DatadogConfig) Validate() error {
+	if config.APIKey == "" {
+		return fmt.Errorf("Require datadog api key")
+	}
+	if config.Endpoint != "" {
+		return validateEndpoint(config.Endpoint)
+	}
+	return nil
+}
+
+// Name returns the configured destination name
+func (d *Datadog) Name() string {
+	return d.batcher.configuredName()
+}
+
+// WithLogger adds optional logging
+func (d *Datadog) WithLogger(logger *log.Logger) Destination {
+	if logger != nil {
+		d.Logger = logger
+	}
+	return d
+}
+
+// Process sends batches of logs until ctx is done
+func (d *Datadog) Process(ctx context.Context) error {
+	return d.batcher.process(ctx, d.Logger)
+}
+
+// Send pushes the message onto the queue
+func (d *Datadog) Send(ctx context.Context, message interface{}) error {
+	return d.batcher.send(ctx, message)
+}
+
+// request builds the intake request with a log per event, tagged by project and type
+func (d *Datadog) request(ctx context.Context, batch []SegmentEvent) (*http.Request, error) {
+	logs := make([]map[string]interface{}, len(batch))
+	for i, m := range batch {
+		tags := append([]string{"projectId:" + m.ProjectId, "type:" + m.Type}, d.config.Tags...)
+		entry := map[string]interface{}{
+			"ddsource": d.config.Source,
+			"service":  d.config.Service,
+			"ddtags":   strings.Join(tags, ","),
+			"message":  eventName(m.SegmentMessage),
+			"segment":  m,
+		}
+		if d.config.Hostname != "" {
+			entry["hostname"] = d.config.Hostname
+		}
+		if m.UserId != "" {
+			entry["usr"] = map[string]string{"id": m.UserId}
+		}
+		if traceId := lookupEventPath(&m, d.config.TraceField); traceId != nil {
+			entry["dd.trace_id"] = fmt.Sprint(traceId)
+		}
+		logs[i] = entry
+	}
+	b, err := json.Marshal(logs)
+	if err != nil {
+		return nil, fmt.Errorf("Marshal error -- %v", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", d.config.Endpoint, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("DD-API-KEY", d.config.APIKey)
+	return req, nil
+}
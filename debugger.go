@@ -0,0 +1,185 @@
+package segment
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Debugger event and destination outcomes
+const (
+	DebugDelivered   = "delivered"   // Sent to every destination
+	DebugDropped     = "dropped"     // Dropped by a transform
+	DebugFailed      = "failed"      // Transform or destination error returned to the client
+	DebugSent        = "sent"        // Destination accepted the event
+	DebugError       = "error"       // Destination returned an error
+	DebugQuarantined = "quarantined" // Transform failed and event was quarantined
+)
+
+// debuggerBuffer is the number of events buffered for a slow stream before they are skipped
+const debuggerBuffer = 64
+
+// DebugOutcome is the outcome of sending an event to a destination
+type DebugOutcome struct {
+	Destination string `json:"destination"`
+	Status      string `json:"status"`
+	Error       string `json:"error,omitempty"`
+}
+
+// DebugEvent is a recent event with its outcome per destination
+type DebugEvent struct {
+	Time     time.Time      `json:"time"`
+	Status   string         `json:"status"`
+	Error    string         `json:"error,omitempty"`
+	Event    SegmentEvent   `json:"event"`
+	Outcomes []DebugOutcome `json:"outcomes,omitempty"`
+}
+
+// debugRing is a ring buffer of recent events for a project
+type debugRing struct {
+	events []DebugEvent
+	next   int
+}
+
+// Debugger keeps recent events per project with their destination outcomes, and streams them as they are
+// sent, for support engineers verifying client instrumentation
+type Debugger struct {
+	mu          sync.Mutex
+	size        int
+	projects    map[string]*debugRing
+	subscribers map[string]map[chan DebugEvent]struct{}
+}
+
+// NewDebugger creates a debugger keeping the last size events per project, defaulting to 100
+func NewDebugger(size int) *Debugger {
+	if size <= 0 {
+		size = 100
+	}
+	return &Debugger{
+		size:        size,
+		projects:    make(map[string]*debugRing),
+		subscribers: make(map[string]map[chan DebugEvent]struct{}),
+	}
+}
+
+// WithDebugger records recent events and their destination outcomes to the debugger
+func (s *Segment) WithDebugger(debugger *Debugger) *Segment {
+	s.debugger = debugger
+	return s
+}
+
+// record adds the event to the project ring buffer and publishes it to streams, skipping slow streams
+func (d *Debugger) record(m SegmentEvent, outcomes []DebugOutcome, err error) {
+	event := DebugEvent{Time: time.Now().UTC(), Status: DebugDelivered, Event: m, Outcomes: outcomes}
+	switch {
+	case err != nil:
+		event.Status, event.Error = DebugFailed, err.Error()
+	case len(outcomes) == 0:
+		event.Status = DebugDropped
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	ring, ok := d.projects[m.ProjectId]
+	if !ok {
+		ring = &debugRing{}
+		d.projects[m.ProjectId] = ring
+	}
+	if len(ring.events) < d.size {
+		ring.events = append(ring.events, event)
+	} else {
+		ring.events[ring.next] = event
+	}
+	ring.next = (ring.next + 1) % d.size
+	for ch := range d.subscribers[m.ProjectId] {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// Recent returns the recent events for a project, oldest first
+func (d *Debugger) Recent(projectId string) []DebugEvent {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	ring, ok := d.projects[projectId]
+	if !ok {
+		return []DebugEvent{}
+	}
+	if len(ring.events) < d.size {
+		return append([]DebugEvent{}, ring.events...)
+	}
+	return append(append([]DebugEvent{}, ring.events[ring.next:]...), ring.events[:ring.next]...)
+}
+
+// subscribe returns a channel of events for a project, and a func to unsubscribe
+func (d *Debugger) subscribe(projectId string) (chan DebugEvent, func()) {
+	ch := make(chan DebugEvent, debuggerBuffer)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.subscribers[projectId] == nil {
+		d.subscribers[projectId] = make(map[chan DebugEvent]struct{})
+	}
+	d.subscribers[projectId][ch] = struct{}{}
+	return ch, func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		delete(d.subscribers[projectId], ch)
+	}
+}
+
+// MountDebugger adds GET /debugger/{projectId} with recent events, and GET /debugger/{projectId}/stream to stream
+// recent and then live events as server-sent events, to an admin router
+func (s *Segment) MountDebugger(router *mux.Router, auth Authorizer, debugger *Debugger) *Segment {
+	s.Logger.Println("Adding debugger handlers")
+	router.Handle("/debugger/{projectId}", s.adminHandler(auth, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(debugger.Recent(mux.Vars(r)["projectId"]))
+	}))).Methods("GET")
+	router.Handle("/debugger/{projectId}/stream", s.adminHandler(auth, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeError(w, http.StatusInternalServerError, "streaming_unsupported", "Streaming unsupported")
+			return
+		}
+		projectId := mux.Vars(r)["projectId"]
+		ch, unsubscribe := debugger.subscribe(projectId)
+		defer unsubscribe()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		write := func(event DebugEvent) error {
+			data, err := json.Marshal(event)
+			if err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+				return err
+			}
+			flusher.Flush()
+			return nil
+		}
+		for _, event := range debugger.Recent(projectId) {
+			if err := write(event); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case event := <-ch:
+				if err := write(event); err != nil {
+					return
+				}
+			}
+		}
+	}))).Methods("GET")
+	return s
+}
@@ -0,0 +1,78 @@
+package segment
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestDebugger(t *testing.T) {
+	debugger := NewDebugger(2)
+	router := mux.NewRouter()
+	s := NewSegment(func(writeKey string) string { return writeKey }, []Destination{&testDestination{}}, router).
+		WithDebugger(debugger).
+		WithTransforms(func(ctx context.Context, m *SegmentEvent) error {
+			if m.Event == "Internal" {
+				return ErrDropEvent
+			}
+			return nil
+		})
+	s.MountDebugger(router, BasicAuthorizer("admin", "secret"), debugger)
+	track := func(event string) {
+		body := fmt.Sprintf(`{"writeKey":"web","event":%q}`, event)
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/track", strings.NewReader(body)))
+	}
+
+	track("First")
+	track("Internal")
+	track("Signed Up")
+	recent := debugger.Recent("web")
+	if len(recent) != 2 || recent[0].Status != DebugDropped || recent[1].Event.Event != "Signed Up" {
+		t.Fatalf("Expected last 2 events, got %+v", recent)
+	}
+	if outcomes := recent[1].Outcomes; len(outcomes) != 1 || outcomes[0].Destination != "testdestination-0" || outcomes[0].Status != DebugSent {
+		t.Errorf("Unexpected outcomes %+v", outcomes)
+	}
+
+	// Stream recent and then live events
+	server := httptest.NewServer(router)
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", server.URL+"/debugger/web/stream", nil)
+	req.SetBasicAuth("admin", "secret")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Expected event stream, got %d %s", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+	scanner := bufio.NewScanner(res.Body)
+	var names []string
+	for len(names) < 3 && scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var event DebugEvent
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, event.Event.Event)
+		if len(names) == 2 {
+			track("Live")
+		}
+	}
+	if strings.Join(names, ",") != "Internal,Signed Up,Live" {
+		t.Errorf("Unexpected streamed events %v", names)
+	}
+}
@@ -0,0 +1,52 @@
+package segment
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+// DecodeMode controls how request payloads are decoded
+type DecodeMode int
+
+const (
+	// DecodeTolerant ignores unknown fields and trailing data
+	DecodeTolerant DecodeMode = iota
+	// DecodeStrict rejects unknown fields and trailing data
+	DecodeStrict
+)
+
+// WithDecodeMode sets strict or tolerant decoding of payloads, defaults to tolerant
+func (s *Segment) WithDecodeMode(mode DecodeMode) *Segment {
+	s.decodeMode = mode
+	return s
+}
+
+// decode reads json from body into v according to the decode mode, with flexible timestamps for events and batches
+func (s *Segment) decode(body io.Reader, v interface{}) error {
+	decoder := json.NewDecoder(body)
+	v = wire(v, s.decodeMode == DecodeStrict)
+	if s.decodeMode == DecodeTolerant {
+		return decodeError(decoder.Decode(v))
+	}
+
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return decodeError(err)
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return errors.New("unexpected data after json payload")
+	}
+	return nil
+}
+
+// decodeError replaces the io errors of an empty or truncated payload, which are confusing to clients
+func decodeError(err error) error {
+	switch err {
+	case io.EOF:
+		return errors.New("empty payload")
+	case io.ErrUnexpectedEOF:
+		return errors.New("truncated json payload")
+	}
+	return err
+}
@@ -0,0 +1,122 @@
+package segment
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestDecodeErrors(t *testing.T) {
+	s := NewSegment(nil, nil, nil)
+	for body, expected := range map[string]string{
+		"":                 "empty payload",
+		" \n":              "empty payload",
+		`{"event":"Test"`:  "truncated json payload",
+		`{"event":"Test",`: "truncated json payload",
+	} {
+		var event SegmentEvent
+		if err := s.decode(strings.NewReader(body), &event); err == nil || err.Error() != expected {
+			t.Errorf("Expected %q decoding %q, got %v", expected, body, err)
+		}
+	}
+}
+
+func TestDecodeMode(t *testing.T) {
+	s := NewSegment(nil, nil, nil)
+	for _, tc := range []struct {
+		body   string
+		strict bool
+	}{
+		{`{"event":"Test"}`, true},
+		{`{"event":"Test","unknown":1}`, false},
+		{`{"event":"Test"} trailing`, false},
+	} {
+		var event SegmentEvent
+		if err := s.WithDecodeMode(DecodeTolerant).decode(strings.NewReader(tc.body), &event); err != nil {
+			t.Errorf("Expected tolerant decode of %s, got %v", tc.body, err)
+		}
+		err := s.WithDecodeMode(DecodeStrict).decode(strings.NewReader(tc.body), &event)
+		if (err == nil) != tc.strict {
+			t.Errorf("Expected strict decode of %s to be %v, got %v", tc.body, tc.strict, err)
+		}
+	}
+}
+
+// fuzzRouter returns a router with a segment sending to a discard destination, and the default transforms that
+// enrich events
+func fuzzRouter() *mux.Router {
+	router := mux.NewRouter()
+	NewSegment(func(writeKey string) string { return writeKey }, []Destination{discardDestination{}}, router).
+		WithRegisterer(prometheus.NewRegistry()).
+		WithLogger(log.New(io.Discard, "", 0))
+	return router
+}
+
+// checkFuzzResponse fails unless the handler accepted the payload or rejected it as a client error with a json body
+func checkFuzzResponse(t *testing.T, w *httptest.ResponseRecorder) {
+	if w.Code != http.StatusOK && (w.Code < 400 || w.Code >= 500) {
+		t.Fatalf("Unexpected status %d -- %s", w.Code, w.Body)
+	}
+	if !json.Valid(w.Body.Bytes()) {
+		t.Fatalf("Expected json response, got %q", w.Body)
+	}
+}
+
+var fuzzSeeds = []string{
+	`{"writeKey":"web","event":"Order Completed","userId":"1","properties":{"total":1.5}}`,
+	`{"writeKey":"web","event":"Test","timestamp":"2024-01-01 00:00:00","context":{"ip":"1.2.3.4"}}`,
+	`{"writeKey":"web","timestamp":1704067200,"sentAt":"2024-01-01T00:00:00.000Z","traits":{"email":"a@b.c"}}`,
+	`{"writeKey":"web","context":null,"properties":[]}`,
+	`{"writeKey":"web","event":"Test"} trailing`,
+	``,
+	`null`,
+	`[]`,
+}
+
+func FuzzHandleEvent(f *testing.F) {
+	for _, seed := range fuzzSeeds {
+		f.Add(seed)
+	}
+	router := fuzzRouter()
+	f.Fuzz(func(t *testing.T, body string) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/track", strings.NewReader(body)))
+		checkFuzzResponse(t, w)
+	})
+}
+
+func FuzzHandleEventGet(f *testing.F) {
+	for _, seed := range fuzzSeeds {
+		f.Add(base64.StdEncoding.EncodeToString([]byte(seed)))
+	}
+	f.Add("not base64!")
+	router := fuzzRouter()
+	f.Fuzz(func(t *testing.T, data string) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/track?data="+url.QueryEscape(data), nil))
+		checkFuzzResponse(t, w)
+	})
+}
+
+func FuzzHandleBatch(f *testing.F) {
+	for _, seed := range fuzzSeeds {
+		f.Add(`{"writeKey":"web","context":{"library":{"name":"test"}},"batch":[` + seed + `]}`)
+	}
+	f.Add(`{"writeKey":"web","batch":null}`)
+	f.Add(`{"writeKey":"web","batch":[{"type":"track"},{"type":"identify","traits":{}}],"sentAt":"2024-01-01"}`)
+	router := fuzzRouter()
+	f.Fuzz(func(t *testing.T, body string) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/batch", strings.NewReader(body)))
+		checkFuzzResponse(t, w)
+	})
+}
@@ -3,65 +3,231 @@ package segment
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/firehose"
+	"github.com/aws/aws-sdk-go/service/kinesis"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/xtgo/uuid"
 )
 
-var (
-	// Create a summary to track delivery stream latency
-	deliverySuccessCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: "delivery_success_total",
-		Help: "Delivery success total",
-	}, []string{"stream"})
-	deliveryFailureCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: "delivery_failure_total",
-		Help: "Delivery failure total",
-	}, []string{"stream"})
-	deliveryLatency = prometheus.NewSummaryVec(prometheus.SummaryOpts{
-		Name:       "delivery_latency_seconds",
-		Help:       "Delivery latency distributions",
-		Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
-	}, []string{"stream"})
+// streamPollInterval is how often the stream status is polled until active
+const streamPollInterval = 5 * time.Second
+
+// maxThrottleRetries is the attempts to resend throttled records, paced between minPacing and maxPacing
+const (
+	maxThrottleRetries = 3
+	minPacing          = 100 * time.Millisecond
+	maxPacing          = 10 * time.Second
+)
+
+// finalFlushTimeout bounds sending the remaining records once processing is cancelled
+const finalFlushTimeout = 10 * time.Second
+
+// Reasons a batch is flushed, to tune the batch size and flush interval
+const (
+	flushReasonSize     = "size"
+	flushReasonInterval = "interval"
+	flushReasonShutdown = "shutdown"
 )
 
-func init() {
-	// Init prometheus metrics
-	prometheus.MustRegister(deliverySuccessCounter)
-	prometheus.MustRegister(deliveryFailureCounter)
-	prometheus.MustRegister(deliveryLatency)
+// firehoseBillingIncrement is the record size firehose bills in, smaller records are rounded up
+const firehoseBillingIncrement = 5 * 1024
+
+// deliveryMetrics track delivery stream success, failures and latency
+type deliveryMetrics struct {
+	success     *prometheus.CounterVec
+	failure     *prometheus.CounterVec
+	latency     *prometheus.HistogramVec
+	dropped     *prometheus.CounterVec
+	recordBytes *prometheus.SummaryVec
+	batchSize   *prometheus.HistogramVec
+	padding     *prometheus.CounterVec
+	pacing      *prometheus.GaugeVec
+	errors      *prometheus.CounterVec
+	flushes     *prometheus.CounterVec
+	flushBytes  *prometheus.HistogramVec
+	partitions  *prometheus.CounterVec
+}
+
+func newDeliveryMetrics(reg prometheus.Registerer) *deliveryMetrics {
+	return &deliveryMetrics{
+		success: newCounterVec(reg, prometheus.CounterOpts{
+			Name: "delivery_success_total",
+			Help: "Delivery success total",
+		}, "destination", "stream"),
+		failure: newCounterVec(reg, prometheus.CounterOpts{
+			Name: "delivery_failure_total",
+			Help: "Delivery failure total",
+		}, "destination", "stream"),
+		latency: newHistogramVec(reg, prometheus.HistogramOpts{
+			Name:    "delivery_latency_seconds",
+			Help:    "Delivery latency distributions",
+			Buckets: latencyBuckets,
+		}, "destination", "stream"),
+		dropped: newDroppedCounter(reg),
+		recordBytes: newSummaryVec(reg, prometheus.SummaryOpts{
+			Name:       "delivery_record_bytes",
+			Help:       "Delivery record size distributions",
+			Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
+		}, "destination", "stream"),
+		batchSize: newHistogramVec(reg, prometheus.HistogramOpts{
+			Name:    "delivery_batch_records",
+			Help:    "Delivery records per batch distributions",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 10), // Up to the 500 record batch limit
+		}, "destination", "stream"),
+		padding: newCounterVec(reg, prometheus.CounterOpts{
+			Name: "delivery_padding_bytes_total",
+			Help: "Delivery bytes billed beyond the record size, as firehose bills in 5KB increments",
+		}, "destination", "stream"),
+		pacing: newGaugeVec(reg, prometheus.GaugeOpts{
+			Name: "delivery_pacing_seconds",
+			Help: "Delivery delay between batches while the stream is throttled",
+		}, "destination", "stream"),
+		errors: newCounterVec(reg, prometheus.CounterOpts{
+			Name: "delivery_errors_total",
+			Help: "Delivery events failed or throttled by firehose error code",
+		}, "destination", "stream", "code"),
+		flushes: newCounterVec(reg, prometheus.CounterOpts{
+			Name: "delivery_flushes_total",
+			Help: "Delivery batches flushed by reason, size, interval or shutdown",
+		}, "destination", "stream", "reason"),
+		flushBytes: newHistogramVec(reg, prometheus.HistogramOpts{
+			Name:    "delivery_flush_bytes",
+			Help:    "Delivery bytes per batch distributions",
+			Buckets: prometheus.ExponentialBuckets(1024, 2, 13), // Up to the 4MB firehose batch limit
+		}, "destination", "stream"),
+		partitions: newPartitionCounter(reg),
+	}
 }
 
 // DeliveryConfig contains configuration parameters including optional endpint
 type DeliveryConfig struct {
+	// Name is the destination label of all metrics, defaults to "delivery-" and the stream name
+	Name           string        `json:"name,omitempty"`
 	StreamEndpoint string        `json:"streamEndpoint,omitempty"`
 	StreamRegion   string        `json:"streamRegion"`
 	StreamName     string        `json:"streamName"`
 	BatchSize      int           `json:"batchSize,omitempty"`
 	FlushInterval  time.Duration `json:"flushInterval,omitempty"`
+	// KinesisSourceStream writes to the kinesis stream that is the source of the firehose stream,
+	// rather than direct put which is rejected for these streams
+	KinesisSourceStream string `json:"kinesisSourceStream,omitempty"`
+	// PartitionKey is the field or dotted path of the kinesis partition key eg "userId" to order events per user,
+	// otherwise records are spread evenly across shards with a random key
+	PartitionKey string `json:"partitionKey,omitempty"`
+	// RedshiftStreaming puts a single json event per kinesis record as required by redshift streaming ingestion,
+	// creating the on-demand kinesis stream if it doesn't exist, see RedshiftStreamingSQL
+	RedshiftStreaming bool `json:"redshiftStreaming,omitempty"`
+	// PackRecords packs newline delimited events into records up to the 5KB billing increment
+	PackRecords bool `json:"packRecords,omitempty"`
+	// Tags, encryption and S3 destination applied when the stream is created
+	Tags                 map[string]string                            `json:"tags,omitempty"`
+	ServerSideEncryption bool                                         `json:"serverSideEncryption,omitempty"` // AWS owned key unless KMSKeyARN
+	KMSKeyARN            string                                       `json:"kmsKeyArn,omitempty"`
+	S3Destination        *firehose.ExtendedS3DestinationConfiguration `json:"s3Destination,omitempty"`
+	// EnvelopeVersion wraps events in the versioned envelope, defaults to bare events for existing consumers
+	EnvelopeVersion int `json:"envelopeVersion,omitempty"`
+	// ActiveTimeout waits for a created stream to become active, defaults to 5 minutes
+	ActiveTimeout time.Duration `json:"activeTimeout,omitempty"`
+	// AWS http client with custom transport, timeout per request, and SDK retries, nil for the SDK defaults.
+	// Set MaxRetries to zero to rely on destination retries alone.
+	HTTPClient  *http.Client  `json:"-"`
+	HTTPTimeout time.Duration `json:"httpTimeout,omitempty"`
+	MaxRetries  *int          `json:"maxRetries,omitempty"`
+	// Registerer for metrics, defaults to the prometheus default registerer
+	Registerer prometheus.Registerer `json:"-"`
+	// Tracer starts a span for each put, with the trace id as an exemplar of the latency metric, optional
+	Tracer Tracer `json:"-"`
+	// Monitor emits a batch flushed event for each put, optional
+	Monitor *Monitor `json:"-"`
+	// Clock for flush intervals and polling the stream status, defaults to the system clock
+	Clock Clock `json:"-"`
 }
 
 // Delivery is destination for AWS firehose
 type Delivery struct {
 	Logger        *log.Logger // Public logger that caller can override
+	name          string      // Destination name for metrics
+	named         bool
 	fh            *firehose.Firehose
+	kinesis       *kinesis.Kinesis
+	sourceStream  string
+	partitionKey  string
+	shards        *shardMap // Shards of the kinesis stream to batch by partition key, nil if keys are random
+	redshift      bool
 	streamName    string
 	size          int
 	flushInterval time.Duration
+	pack          bool
+	version       int // Envelope version
+	create        *firehose.CreateDeliveryStreamInput
+	activeTimeout time.Duration
+	pollInterval  time.Duration
 	messages      chan interface{}
+	metrics       *deliveryMetrics
+	pacer         *pacer
+	tracer        Tracer
+	monitor       *Monitor
+	clock         Clock
+	unsent        *unsentRecords // Records not put when Process last returned, resent first on restart
+}
+
+// unsentRecords is a put error with the records not put, and the count of events packed and partition key of each
+type unsentRecords struct {
+	records []*firehose.Record
+	counts  []int
+	keys    []string
+	err     error
+}
+
+func newUnsentRecords(records []*firehose.Record, counts []int, keys []string, err error) *unsentRecords {
+	u := &unsentRecords{
+		records: append([]*firehose.Record{}, records...),
+		counts:  append([]int{}, counts...),
+		err:     err,
+	}
+	if keys != nil {
+		u.keys = append([]string{}, keys...)
+	}
+	return u
+}
+
+func (u *unsentRecords) Error() string {
+	return u.err.Error()
+}
+
+func (u *unsentRecords) Unwrap() error {
+	return u.err
+}
+
+// events returns the number of events packed in the records
+func (u *unsentRecords) events() int {
+	events := 0
+	for _, n := range u.counts {
+		events += n
+	}
+	return events
 }
 
 // NewDelivery creates a new delivery stream given configuration
 func NewDelivery(config *DeliveryConfig) *Delivery {
-	if config.StreamRegion == "" || config.StreamName == "" {
-		log.Fatal("Require stream region and name")
+	if err := config.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	if config.RedshiftStreaming && config.StreamName == "" {
+		config.StreamName = config.KinesisSourceStream
 	}
 	if config.BatchSize <= 0 || config.BatchSize > 500 {
 		config.BatchSize = 500
@@ -69,24 +235,175 @@ func NewDelivery(config *DeliveryConfig) *Delivery {
 	if config.FlushInterval == 0 {
 		config.FlushInterval = time.Second * 30
 	}
+	if config.ActiveTimeout <= 0 {
+		config.ActiveTimeout = time.Minute * 5
+	}
 
 	// Block and initialize fh config on startup
-	cfg := aws.NewConfig().WithRegion(config.StreamRegion)
-	if config.StreamEndpoint != "" {
-		cfg.WithEndpoint(config.StreamEndpoint)
-	}
+	cfg := config.awsConfig()
 	sess := session.Must(session.NewSession(cfg))
 	d := &Delivery{
 		Logger:        log.New(os.Stderr, "", log.LstdFlags),
+		name:          "delivery-" + config.StreamName,
+		named:         config.Name != "",
 		fh:            firehose.New(sess, cfg),
+		kinesis:       kinesis.New(sess, cfg),
+		sourceStream:  config.KinesisSourceStream,
+		partitionKey:  config.PartitionKey,
+		redshift:      config.RedshiftStreaming,
 		streamName:    config.StreamName,
 		size:          config.BatchSize,
 		flushInterval: config.FlushInterval,
+		pack:          config.PackRecords,
+		version:       config.EnvelopeVersion,
+		create:        createStreamInput(config),
+		activeTimeout: config.ActiveTimeout,
+		pollInterval:  streamPollInterval,
+		messages:      make(chan interface{}, config.BatchSize*2), // Buffer messages sent before processing
+		metrics:       newDeliveryMetrics(config.Registerer),
+		tracer:        config.Tracer,
+		monitor:       config.Monitor,
+		clock:         clockOrSystem(config.Clock),
+	}
+	if d.named {
+		d.name = config.Name
 	}
+	if d.sourceStream != "" && d.partitionKey != "" {
+		d.shards = &shardMap{}
+	}
+	d.pacer = newPacer(minPacing, maxPacing, d.metrics.pacing.WithLabelValues(d.name, config.StreamName))
 
 	return d
 }
 
+// Validate checks the stream config without connecting, see Check to resolve credentials and describe the stream
+func (config *DeliveryConfig) Validate() error {
+	if config.RedshiftStreaming && (config.KinesisSourceStream == "" || config.PackRecords) {
+		return fmt.Errorf("Require kinesis stream without packed records for redshift streaming")
+	}
+	if config.EnvelopeVersion < EnvelopeNone || config.EnvelopeVersion > EnvelopeLatest {
+		return fmt.Errorf("Unsupported envelope version %d", config.EnvelopeVersion)
+	}
+	if config.RedshiftStreaming && config.EnvelopeVersion != EnvelopeNone {
+		return fmt.Errorf("Require bare events for redshift streaming")
+	}
+	streamName := config.StreamName
+	if config.RedshiftStreaming && streamName == "" {
+		streamName = config.KinesisSourceStream
+	}
+	if config.StreamRegion == "" || streamName == "" {
+		return fmt.Errorf("Require stream region and name")
+	}
+	if !config.RedshiftStreaming && !firehoseStreamName.MatchString(streamName) {
+		return fmt.Errorf("Invalid firehose stream name: %q", streamName)
+	}
+	if config.KinesisSourceStream != "" && !kinesisStreamName.MatchString(config.KinesisSourceStream) {
+		return fmt.Errorf("Invalid kinesis stream name: %q", config.KinesisSourceStream)
+	}
+	if config.StreamEndpoint != "" {
+		return validateEndpoint(config.StreamEndpoint)
+	}
+	return nil
+}
+
+// Check resolves AWS credentials and describes the stream, which may be missing if it is created on connect
+func (config *DeliveryConfig) Check(ctx context.Context) error {
+	cfg := config.awsConfig()
+	sess, err := session.NewSession(cfg)
+	if err != nil {
+		return fmt.Errorf("AWS session error -- %v", err)
+	}
+	if err := checkCredentials(ctx, sess); err != nil {
+		return err
+	}
+	if config.KinesisSourceStream != "" {
+		_, err = kinesis.New(sess, cfg).DescribeStreamSummaryWithContext(ctx, &kinesis.DescribeStreamSummaryInput{
+			StreamName: aws.String(config.KinesisSourceStream),
+		})
+		if resourceNotFound(err) && config.RedshiftStreaming {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Kinesis stream error -- %v", err)
+		}
+		return nil
+	}
+	_, err = firehose.New(sess, cfg).DescribeDeliveryStreamWithContext(ctx, &firehose.DescribeDeliveryStreamInput{
+		DeliveryStreamName: aws.String(config.StreamName),
+	})
+	if err != nil && !resourceNotFound(err) {
+		return fmt.Errorf("Firehose stream error -- %v", err)
+	}
+	return nil
+}
+
+// awsConfig returns the AWS config for the stream region and endpoint, and http client options
+func (config *DeliveryConfig) awsConfig() *aws.Config {
+	cfg := aws.NewConfig().WithRegion(config.StreamRegion)
+	if config.StreamEndpoint != "" {
+		cfg.WithEndpoint(config.StreamEndpoint)
+	}
+	if config.HTTPClient != nil || config.HTTPTimeout > 0 {
+		client := &http.Client{}
+		if config.HTTPClient != nil {
+			*client = *config.HTTPClient // Copy so the timeout doesn't modify the caller client
+		}
+		if config.HTTPTimeout > 0 {
+			client.Timeout = config.HTTPTimeout
+		}
+		cfg.WithHTTPClient(client)
+	}
+	if config.MaxRetries != nil {
+		cfg.WithMaxRetries(*config.MaxRetries)
+	}
+	return cfg
+}
+
+// createStreamInput returns the create request for the stream with configured tags, encryption and S3 destination
+func createStreamInput(config *DeliveryConfig) *firehose.CreateDeliveryStreamInput {
+	input := &firehose.CreateDeliveryStreamInput{
+		DeliveryStreamName:                 aws.String(config.StreamName),
+		ExtendedS3DestinationConfiguration: config.S3Destination,
+	}
+	keys := make([]string, 0, len(config.Tags))
+	for key := range config.Tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		input.Tags = append(input.Tags, &firehose.Tag{Key: aws.String(key), Value: aws.String(config.Tags[key])})
+	}
+	if config.KMSKeyARN != "" {
+		input.DeliveryStreamEncryptionConfigurationInput = &firehose.DeliveryStreamEncryptionConfigurationInput{
+			KeyType: aws.String(firehose.KeyTypeCustomerManagedCmk),
+			KeyARN:  aws.String(config.KMSKeyARN),
+		}
+	} else if config.ServerSideEncryption {
+		input.DeliveryStreamEncryptionConfigurationInput = &firehose.DeliveryStreamEncryptionConfigurationInput{
+			KeyType: aws.String(firehose.KeyTypeAwsOwnedCmk),
+		}
+	}
+	return input
+}
+
+// Name returns the configured destination name
+func (d *Delivery) Name() string {
+	if d.named {
+		return d.name
+	}
+	return ""
+}
+
+// defaultName includes the stream, so unnamed deliveries of separate segment instances have separate series
+func (d *Delivery) defaultName() string {
+	return d.name
+}
+
+// EnvelopeVersion returns the configured envelope version
+func (d *Delivery) EnvelopeVersion() int {
+	return d.version
+}
+
 // WithLogger adds optional logging
 func (d *Delivery) WithLogger(logger *log.Logger) Destination {
 	if logger != nil {
@@ -97,112 +414,548 @@ func (d *Delivery) WithLogger(logger *log.Logger) Destination {
 
 // Connect connects to firehose and describes or creates stream
 func (d *Delivery) Connect() error {
+	return d.ConnectContext(context.Background())
+}
+
+// ConnectContext connects to firehose and describes or creates stream until ctx is done
+func (d *Delivery) ConnectContext(ctx context.Context) error {
+	if d.sourceStream != "" {
+		return d.connectSource(ctx)
+	}
 	log.Printf("Delivery connecting to %s...", d.fh.Endpoint)
 
 	// Check stream exists
-	stream, err := d.fh.DescribeDeliveryStream(&firehose.DescribeDeliveryStreamInput{
+	stream, err := d.fh.DescribeDeliveryStreamWithContext(ctx, &firehose.DescribeDeliveryStreamInput{
 		DeliveryStreamName: aws.String(d.streamName),
 	})
 	if err == nil {
 		d.Logger.Printf("Found stream: %s\n", *stream.DeliveryStreamDescription.DeliveryStreamARN)
-		return nil
+		if aws.StringValue(stream.DeliveryStreamDescription.DeliveryStreamStatus) == firehose.DeliveryStreamStatusActive {
+			return nil
+		}
+		return d.waitActive(ctx)
 	}
 
 	// Create stream if it doesn't exist
 	if strings.Contains(err.Error(), "ResourceNotFoundException") {
 		var create *firehose.CreateDeliveryStreamOutput
-		if create, err = d.fh.CreateDeliveryStream(&firehose.CreateDeliveryStreamInput{
-			DeliveryStreamName: aws.String(d.streamName),
-		}); err == nil {
+		if create, err = d.fh.CreateDeliveryStreamWithContext(ctx, d.create); err == nil {
 			d.Logger.Printf("Created stream: %s\n", *create.DeliveryStreamARN)
-			return nil
+			return d.waitActive(ctx)
 		}
 	}
 
 	return fmt.Errorf("Firehose stream error -- %v", err)
 }
 
+// connectSource checks the kinesis source stream exists and is active, it is only created for redshift streaming
+func (d *Delivery) connectSource(ctx context.Context) error {
+	log.Printf("Delivery connecting to kinesis %s...", d.kinesis.Endpoint)
+	deadline := d.clock.Now().Add(d.activeTimeout)
+	for {
+		stream, err := d.kinesis.DescribeStreamSummaryWithContext(ctx, &kinesis.DescribeStreamSummaryInput{
+			StreamName: aws.String(d.sourceStream),
+		})
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == kinesis.ErrCodeResourceNotFoundException && d.redshift {
+			if _, err := d.kinesis.CreateStreamWithContext(ctx, &kinesis.CreateStreamInput{
+				StreamName:        aws.String(d.sourceStream),
+				StreamModeDetails: &kinesis.StreamModeDetails{StreamMode: aws.String(kinesis.StreamModeOnDemand)},
+			}); err != nil {
+				return fmt.Errorf("Kinesis stream error -- %v", err)
+			}
+			d.Logger.Printf("Created kinesis stream: %s\n", d.sourceStream)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("Kinesis stream error -- %v", err)
+		}
+		switch status := aws.StringValue(stream.StreamDescriptionSummary.StreamStatus); status {
+		case kinesis.StreamStatusActive, kinesis.StreamStatusUpdating:
+			d.Logger.Printf("Found kinesis stream: %s\n", aws.StringValue(stream.StreamDescriptionSummary.StreamARN))
+			if d.shards != nil {
+				d.loadShards(ctx)
+			}
+			return nil
+		case kinesis.StreamStatusCreating:
+		default:
+			return fmt.Errorf("Kinesis stream %s status %s", d.sourceStream, status)
+		}
+		if d.clock.Now().After(deadline) {
+			return fmt.Errorf("Kinesis stream %s not active after %s", d.sourceStream, d.activeTimeout)
+		}
+		select {
+		case <-d.clock.After(d.pollInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// putRecords puts records to the firehose stream, or its kinesis source stream if configured with the partition keys,
+// returning the error code of each record if any, and the kinesis shard of each record
+func (d *Delivery) putRecords(ctx context.Context, records []*firehose.Record, keys []string) ([]*string, []string, error) {
+	if d.sourceStream == "" {
+		resp, err := d.fh.PutRecordBatchWithContext(ctx, &firehose.PutRecordBatchInput{
+			DeliveryStreamName: aws.String(d.streamName),
+			Records:            records,
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		codes := make([]*string, len(resp.RequestResponses))
+		for i, r := range resp.RequestResponses {
+			codes[i] = r.ErrorCode
+		}
+		return codes, nil, nil
+	}
+
+	entries := make([]*kinesis.PutRecordsRequestEntry, len(records))
+	for i, record := range records {
+		key := uuid.NewRandom().String() // Spread evenly across shards
+		if i < len(keys) && keys[i] != "" {
+			key = keys[i]
+		}
+		entries[i] = &kinesis.PutRecordsRequestEntry{
+			Data:         record.Data,
+			PartitionKey: aws.String(key),
+		}
+	}
+	resp, err := d.kinesis.PutRecordsWithContext(ctx, &kinesis.PutRecordsInput{
+		StreamName: aws.String(d.sourceStream),
+		Records:    entries,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	codes := make([]*string, len(resp.Records))
+	shards := make([]string, len(resp.Records))
+	for i, r := range resp.Records {
+		codes[i] = r.ErrorCode
+		shards[i] = aws.StringValue(r.ShardId)
+		if shards[i] == "" && d.shards != nil && i < len(keys) {
+			shards[i] = d.shards.shard(keys[i]) // Failed records have no shard in the response
+		}
+	}
+	return codes, shards, nil
+}
+
+// loadShards lists the kinesis shards to batch records by, logging errors as records are still put in one batch
+func (d *Delivery) loadShards(ctx context.Context) {
+	if err := d.shards.load(ctx, d.kinesis, d.sourceStream, d.clock.Now()); err != nil {
+		d.Logger.Printf("Stream %s unable to batch by shard -- %v\n", d.sourceStream, err)
+	}
+}
+
+// putPartitioned puts the records of each kinesis shard in a separate batch concurrently, so records for a hot shard
+// are throttled and retried without re-sending records for the other shards
+func (d *Delivery) putPartitioned(ctx context.Context, records []*firehose.Record, counts []int, keys []string) error {
+	if d.shards.stale(d.clock.Now()) {
+		d.loadShards(ctx)
+	}
+	type partition struct {
+		records []*firehose.Record
+		counts  []int
+		keys    []string
+		events  int
+	}
+	partitions := make(map[string]*partition)
+	var shards []string
+	for j, record := range records {
+		shard := d.shards.shard(keys[j])
+		p, ok := partitions[shard]
+		if !ok {
+			p = &partition{}
+			partitions[shard] = p
+			shards = append(shards, shard)
+		}
+		p.records = append(p.records, record)
+		p.counts = append(p.counts, counts[j])
+		p.keys = append(p.keys, keys[j])
+		p.events += counts[j]
+	}
+	errs := make([]error, len(shards))
+	var wg sync.WaitGroup
+	for n, shard := range shards {
+		wg.Add(1)
+		go func(n int, p *partition) {
+			defer wg.Done()
+			errs[n] = d.putBatch(ctx, p.records, p.counts, p.keys, p.events)
+		}(n, partitions[shard])
+	}
+	wg.Wait()
+
+	// Merge the records not put by each partition, so they are resent together
+	var unsent *unsentRecords
+	for _, err := range errs {
+		var u *unsentRecords
+		if !errors.As(err, &u) {
+			continue
+		}
+		if unsent == nil {
+			unsent = &unsentRecords{keys: []string{}}
+		}
+		unsent.records = append(unsent.records, u.records...)
+		unsent.counts = append(unsent.counts, u.counts...)
+		unsent.keys = append(unsent.keys, u.keys...)
+	}
+	if unsent != nil {
+		unsent.err = errors.Join(errs...)
+		return unsent
+	}
+	return errors.Join(errs...)
+}
+
+// put puts the records, in a batch per shard if partitioned, returning unsent records on error
+func (d *Delivery) put(ctx context.Context, records []*firehose.Record, counts []int, keys []string) error {
+	if d.shards != nil {
+		return d.putPartitioned(ctx, records, counts, keys)
+	}
+	events := 0
+	for _, n := range counts {
+		events += n
+	}
+	return d.putBatch(ctx, records, counts, keys, events)
+}
+
+// retain keeps the records not put by err to resend, returning err
+func (d *Delivery) retain(err error) error {
+	var u *unsentRecords
+	if !errors.As(err, &u) {
+		return err
+	}
+	if d.unsent == nil {
+		d.unsent = u
+		return err
+	}
+	d.unsent.records = append(d.unsent.records, u.records...)
+	d.unsent.counts = append(d.unsent.counts, u.counts...)
+	if d.unsent.keys != nil {
+		d.unsent.keys = append(d.unsent.keys, u.keys...)
+	}
+	return err
+}
+
+// resend puts the records retained when Process last returned, keeping those still not put
+func (d *Delivery) resend(ctx context.Context) error {
+	if d.unsent == nil {
+		return nil
+	}
+	unsent := d.unsent
+	d.unsent = nil
+	d.Logger.Printf("Stream %s resending %d\n", d.streamName, unsent.events())
+	return d.retain(d.put(ctx, unsent.records, unsent.counts, unsent.keys))
+}
+
+// waitActive polls the stream status until active, as records put while creating fail
+func (d *Delivery) waitActive(ctx context.Context) error {
+	deadline := d.clock.Now().Add(d.activeTimeout)
+	for {
+		stream, err := d.fh.DescribeDeliveryStreamWithContext(ctx, &firehose.DescribeDeliveryStreamInput{
+			DeliveryStreamName: aws.String(d.streamName),
+		})
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			return fmt.Errorf("Firehose stream error -- %v", err)
+		}
+		status := aws.StringValue(stream.DeliveryStreamDescription.DeliveryStreamStatus)
+		switch status {
+		case firehose.DeliveryStreamStatusActive:
+			d.Logger.Printf("Stream %s active\n", d.streamName)
+			return nil
+		case firehose.DeliveryStreamStatusCreating:
+		default:
+			return fmt.Errorf("Firehose stream %s status %s", d.streamName, status)
+		}
+		if d.clock.Now().After(deadline) {
+			return fmt.Errorf("Firehose stream %s not active after %s", d.streamName, d.activeTimeout)
+		}
+		select {
+		case <-d.clock.After(d.pollInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
 // Process handles the messages
 func (d *Delivery) Process(ctx context.Context) error {
 	// Check the stream exists
-	if err := d.Connect(); err != nil {
+	if err := d.ConnectContext(ctx); err != nil {
 		return err
 	}
 
-	// Create the async channel
-	d.messages = make(chan interface{}, d.size*2)
+	// Records not put before the last error are resent first, so events are delivered in order
+	if err := d.resend(ctx); err != nil {
+		if ctx.Err() == nil {
+			return err
+		}
+	}
 
-	// Create the array to for batch of messages
+	// Create the array to for batch of messages, with the count of events packed in each record and partition keys
 	records := make([]*firehose.Record, d.size)
+	counts := make([]int, d.size)
+	var keys []string
+	if d.partitionKey != "" {
+		keys = make([]string, d.size)
+	}
 
-	send := func(i int) error {
+	send := func(ctx context.Context, i int, reason string) error {
 		if i == 0 {
 			d.Logger.Println("Nothing to send")
 			return nil
 		}
 
-		t0 := time.Now()
-		params := &firehose.PutRecordBatchInput{
-			DeliveryStreamName: aws.String(d.streamName),
-			Records:            records[:i],
+		events, bytes := 0, 0
+		for j, record := range records[:i] {
+			events += counts[j]
+			size := len(record.Data)
+			bytes += size
+			billed := (size + firehoseBillingIncrement - 1) / firehoseBillingIncrement * firehoseBillingIncrement
+			d.metrics.recordBytes.WithLabelValues(d.name, d.streamName).Observe(float64(size))
+			d.metrics.padding.WithLabelValues(d.name, d.streamName).Add(float64(billed - size))
 		}
-		resp, err := d.fh.PutRecordBatch(params)
-		if err != nil {
-			deliveryFailureCounter.WithLabelValues(d.streamName).Add(float64(i))
-			d.Logger.Printf("Stream %s error sending %d: %s\n", d.streamName, i, err)
-			return fmt.Errorf("Error sending to firehose -- %v", err)
+		d.metrics.batchSize.WithLabelValues(d.name, d.streamName).Observe(float64(i))
+		d.metrics.flushes.WithLabelValues(d.name, d.streamName, reason).Inc()
+		d.metrics.flushBytes.WithLabelValues(d.name, d.streamName).Observe(float64(bytes))
+		if keys != nil {
+			return d.retain(d.put(ctx, records[:i], counts[:i], keys[:i]))
 		}
+		return d.retain(d.put(ctx, records[:i], counts[:i], nil))
+	}
 
-		// Log the succces, failed and latency metrics
-		duration := time.Since(t0)
-		deliveryFailureCounter.WithLabelValues(d.streamName).Add(float64(*resp.FailedPutCount))
-		deliverySuccessCounter.WithLabelValues(d.streamName).Add(float64(i - int(*resp.FailedPutCount)))
-		deliveryLatency.WithLabelValues(d.streamName).Observe(duration.Seconds())
-		d.Logger.Printf("Stream %s sent %d (%d failed) in: %s\n", d.streamName, i, *resp.FailedPutCount, duration)
+	i := 0
+	add := func(message interface{}) error {
+		if event, ok := message.(SegmentEvent); ok && d.version != EnvelopeNone {
+			envelope, err := NewEnvelope(event, d.version)
+			if err != nil {
+				return err
+			}
+			message = envelope
+		}
+		data, err := json.Marshal(message)
+		if err != nil {
+			return fmt.Errorf("Marshal error -- %v", err)
+		}
+		if d.redshift && len(data) > redshiftMaxRecord {
+			d.Logger.Printf("Stream %s dropped event of %d bytes exceeding the redshift record limit\n", d.streamName, len(data))
+			d.metrics.failure.WithLabelValues(d.name, d.streamName).Inc()
+			d.metrics.dropped.WithLabelValues(DropDeliveryFailed, d.name).Inc()
+			return nil
+		}
+		if !d.redshift {
+			data = append(data, '\n') // Append newline after the json serialization
+		}
+		if d.pack && i > 0 && len(records[i-1].Data)+len(data) <= firehoseBillingIncrement {
+			records[i-1].Data = append(records[i-1].Data, data...)
+			counts[i-1]++
+		} else {
+			records[i] = &firehose.Record{Data: data}
+			counts[i] = 1
+			if keys != nil {
+				keys[i] = partitionKey(message, d.partitionKey)
+			}
+			i++
+		}
 		return nil
 	}
 
+	// drain sends the remaining and buffered messages within a timeout, so shutdown doesn't hang or lose messages
+	drain := func(ctx context.Context) error {
+		d.Logger.Println("Ending delivery processing")
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), finalFlushTimeout)
+		defer cancel()
+		sendErr := d.resend(ctx)
+		defer func() {
+			// Records still not put are lost once processing ends
+			if d.unsent != nil {
+				events := d.unsent.events()
+				d.Logger.Printf("Stream %s dropped %d not sent on shutdown\n", d.streamName, events)
+				d.metrics.dropped.WithLabelValues(DropDeliveryFailed, d.name).Add(float64(events))
+				d.unsent = nil
+			}
+		}()
+		flush := func() {
+			if err := send(ctx, i, flushReasonShutdown); err != nil && sendErr == nil {
+				sendErr = err
+			}
+			i = 0
+		}
+		for {
+			if i == d.size {
+				flush()
+			}
+			select {
+			case message := <-d.messages:
+				if err := add(message); err != nil {
+					return err
+				}
+			default:
+				flush()
+				return sendErr
+			}
+		}
+	}
+
+	// The flush timer starts with the first message of each batch, so the cadence is regular under steady load
+	var flushAt <-chan time.Time
 	d.Logger.Println("Starting delivery processing")
-	i := 0
 	for {
 		flush := false
 		select {
 		case message := <-d.messages:
-			if data, err := json.Marshal(message); err != nil {
-				return fmt.Errorf("Marshal error -- %v", err)
-			} else {
-				records[i] = &firehose.Record{
-					Data: []byte(string(data) + "\n"), // Append newline after the json serialization
-				}
-				i++
+			if err := add(message); err != nil {
+				return err
 			}
 		case <-ctx.Done():
-			// Sending remaining and return
-			d.Logger.Println("Ending delivery processing")
-			return send(i)
-		case <-time.After(d.flushInterval):
-			if i > 0 {
-				d.Logger.Printf("Flush after %s\n", d.flushInterval)
-				flush = true
+			return drain(ctx)
+		case <-flushAt:
+			d.Logger.Printf("Flush after %s\n", d.flushInterval)
+			flush = true
+			// Include messages buffered since the last receive, up to the batch size
+			for buffered := true; buffered && i < d.size; {
+				select {
+				case message := <-d.messages:
+					if err := add(message); err != nil {
+						return err
+					}
+				default:
+					buffered = false
+				}
 			}
 		}
+		if ctx.Err() != nil {
+			return drain(ctx)
+		}
 		if i == d.size || flush {
 			// Send and reset index (records will be overwritten)
-			send(i)
+			reason := flushReasonInterval
+			if i == d.size {
+				reason = flushReasonSize
+			}
+			err := send(ctx, i, reason)
 			i = 0
+			flushAt = nil
+			if ctx.Err() != nil {
+				return drain(ctx)
+			}
+			if err != nil {
+				// Unhealthy until the records are resent on restart, so the segment spools events meanwhile
+				return err
+			}
+		} else if flushAt == nil && i > 0 {
+			flushAt = d.clock.After(d.flushInterval)
 		}
 	}
 }
 
+// throttled returns true for firehose error codes that indicate the stream throughput is exceeded
+func throttled(code string) bool {
+	return code == firehose.ErrCodeServiceUnavailableException || code == "ThrottlingException" ||
+		code == kinesis.ErrCodeProvisionedThroughputExceededException
+}
+
+// errorCode returns the AWS error code of a request error, or "Unknown"
+func errorCode(err error) string {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code()
+	}
+	return "Unknown"
+}
+
+// partitionKey returns the event field or value at a dotted path, or empty if missing
+func partitionKey(message interface{}, field string) string {
+	switch m := message.(type) {
+	case SegmentEvent:
+		return eventField(&m, field)
+	case *Envelope:
+		return eventField(&m.event, field)
+	}
+	return ""
+}
+
+// putBatch puts records with the count of events in each and optional partition keys, retrying throttled records
+// after an adaptive delay
+func (d *Delivery) putBatch(ctx context.Context, records []*firehose.Record, counts []int, keys []string, events int) error {
+	for attempt := 0; ; attempt++ {
+		if err := d.pacer.wait(ctx); err != nil {
+			d.metrics.failure.WithLabelValues(d.name, d.streamName).Add(float64(events))
+			return newUnsentRecords(records, counts, keys, err)
+		}
+
+		t0 := d.clock.Now()
+		putCtx, traceId, end := startSpan(d.tracer, ctx, "PutRecordBatch")
+		codes, shards, err := d.putRecords(putCtx, records, keys)
+		end(err)
+		d.monitor.batchFlushed(d.streamName, events, d.clock.Now().Sub(t0), err)
+		if err != nil {
+			d.metrics.errors.WithLabelValues(d.name, d.streamName, errorCode(err)).Add(float64(events))
+		}
+		if aerr, ok := err.(awserr.Error); ok && throttled(aerr.Code()) && attempt < maxThrottleRetries {
+			d.Logger.Printf("Stream %s throttled, retrying %d\n", d.streamName, events)
+			d.pacer.throttled()
+			continue
+		}
+		if err != nil {
+			d.metrics.failure.WithLabelValues(d.name, d.streamName).Add(float64(events))
+			d.Logger.Printf("Stream %s error sending %d: %s\n", d.streamName, events, err)
+			return newUnsentRecords(records, counts, keys, fmt.Errorf("Error sending to firehose -- %v", err))
+		}
+
+		// Log the succces, failed and latency metrics, keeping throttled records to retry
+		duration := d.clock.Now().Sub(t0)
+		var retry []*firehose.Record
+		var retryCounts []int
+		var retryKeys []string
+		failed, retried := 0, 0
+		for j, code := range codes {
+			if j >= len(records) {
+				continue
+			}
+			result := partitionSuccess
+			switch {
+			case code == nil:
+			case throttled(*code) && attempt < maxThrottleRetries:
+				result = partitionThrottled
+				retry = append(retry, records[j])
+				retryCounts = append(retryCounts, counts[j])
+				if keys != nil {
+					retryKeys = append(retryKeys, keys[j])
+				}
+				retried += counts[j]
+			default:
+				result = partitionFailed
+				failed += counts[j]
+			}
+			if code != nil {
+				d.metrics.errors.WithLabelValues(d.name, d.streamName, *code).Add(float64(counts[j]))
+			}
+			if j < len(shards) && shards[j] != "" {
+				d.metrics.partitions.WithLabelValues(d.name, shards[j], result).Add(float64(counts[j]))
+			}
+		}
+		d.metrics.failure.WithLabelValues(d.name, d.streamName).Add(float64(failed))
+		d.metrics.dropped.WithLabelValues(DropDeliveryFailed, d.name).Add(float64(failed))
+		d.metrics.success.WithLabelValues(d.name, d.streamName).Add(float64(events - failed - retried))
+		observeLatency(d.metrics.latency.WithLabelValues(d.name, d.streamName), duration, traceId)
+		d.Logger.Printf("Stream %s sent %d in %d records (%d failed, %d throttled) in: %s\n", d.streamName, events, len(records), failed, retried, duration)
+		if len(retry) == 0 {
+			d.pacer.ok()
+			return nil
+		}
+		d.pacer.throttled()
+		records, counts, keys, events = retry, retryCounts, retryKeys, retried
+	}
+}
+
 // Send pushes the message onto the queue
 func (d *Delivery) Send(ctx context.Context, message interface{}) error {
 	if d.messages == nil {
 		return fmt.Errorf("Delivery destination not ready, check stream %q exists at %s", d.streamName, d.fh.Endpoint)
 	}
-	select {
-	case d.messages <- message:
-		return nil
-	case <-ctx.Done():
-		return ctx.Err()
-	}
+	return enqueue(ctx, d.messages, message)
 }
@@ -1,4 +1,5 @@
-// build +integration
+//go:build integration
+
 package segment
 
 import (
@@ -12,7 +13,7 @@ import (
 )
 
 func TestConnect(t *testing.T) {
-	cfg := aws.NewConfig().WithRegion("us-west-2").WithEndpoint("http://localhost:4573")
+	cfg := aws.NewConfig().WithRegion("us-west-2").WithEndpoint(localstackEndpoint())
 	sess, err := session.NewSession(cfg)
 	if err != nil {
 		t.Fatal(err)
@@ -2,7 +2,16 @@ package segment
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
+	"net"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 )
 
 // Destination interface has a blocking Process method, and Send method
@@ -11,3 +20,192 @@ type Destination interface {
 	Send(ctx context.Context, message interface{}) error
 	WithLogger(logger *log.Logger) Destination
 }
+
+// DestinationOptions are per destination settings applied by Segment send
+type DestinationOptions struct {
+	Timeout time.Duration // Send timeout within the request deadline, zero for none
+	Retry   BackoffConfig // Send retries up to MaxAttempts on transient errors
+	Spool   *SpoolConfig  // Buffer events while the destination is down, nil for none
+	// Transforms applied only to events for this destination, eg BlockPaths to strip PII
+	Transforms []Transform
+}
+
+// destination is a configured destination with its options and health
+type destination struct {
+	Destination
+	DestinationOptions
+	health
+	name     string
+	spool    *spool
+	inflight inflight // Sends in progress for the watchdog
+	version  int      // Envelope version negotiated with the destination
+}
+
+// Named is implemented by destinations with a configured name, used as the destination label of all metrics
+type Named interface {
+	Name() string
+}
+
+// ErrQueueFull is returned when a destination queue doesn't accept a message before the send deadline
+var ErrQueueFull = errors.New("Queue full")
+
+// enqueue pushes message onto queue, returning ErrQueueFull if the deadline passes first
+func enqueue[T any](ctx context.Context, queue chan<- T, message T) error {
+	select {
+	case queue <- message:
+		return nil
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return fmt.Errorf("%w -- %w", ErrQueueFull, ctx.Err())
+		}
+		return ctx.Err()
+	}
+}
+
+// defaultNamed is implemented by destinations with a default name that is distinct across instances
+type defaultNamed interface {
+	defaultName() string
+}
+
+// destinationName returns the configured name, or a name for metrics eg "delivery-mystream" or "forwarder-0"
+func destinationName(dest Destination, index int) string {
+	if named, ok := dest.(Named); ok && named.Name() != "" {
+		return named.Name()
+	}
+	if named, ok := dest.(defaultNamed); ok {
+		return named.defaultName()
+	}
+	t := reflect.TypeOf(dest)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return fmt.Sprintf("%s-%d", strings.ToLower(t.Name()), index)
+}
+
+// processAll runs Process for each destination, cancelling the others on first error
+func processAll(ctx context.Context, destinations []Destination) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errs := make(chan error, len(destinations))
+	for _, dest := range destinations {
+		go func(dest Destination) {
+			errs <- dest.Process(ctx)
+		}(dest)
+	}
+
+	var first error
+	for range destinations {
+		if err := <-errs; err != nil && first == nil {
+			first = err
+			cancel()
+		}
+	}
+	return first
+}
+
+// uniqueDestinations returns destinations in order without duplicates
+func uniqueDestinations(groups ...[]Destination) []Destination {
+	seen := make(map[Destination]bool)
+	var unique []Destination
+	for _, group := range groups {
+		for _, dest := range group {
+			if !seen[dest] {
+				seen[dest] = true
+				unique = append(unique, dest)
+			}
+		}
+	}
+	return unique
+}
+
+// send spools the event if configured and the destination is down or has events already spooled,
+// otherwise sends spooling on error
+func (d *destination) send(ctx context.Context, message interface{}) error {
+	defer d.inflight.start(time.Now())()
+	event, ok := message.(SegmentEvent)
+	if ok && len(d.Transforms) > 0 {
+		if keep, err := applyTransforms(ctx, d.Transforms, &event); err != nil || !keep {
+			return err
+		}
+		message = event
+	}
+	if d.spool == nil || !ok {
+		return d.sendRetry(ctx, message)
+	}
+	if !d.Healthy() || !d.spool.empty() {
+		return d.spool.push(event)
+	}
+	if err := d.sendRetry(ctx, message); err != nil {
+		return d.spool.push(event)
+	}
+	return nil
+}
+
+// replay drains spooled events while the destination is healthy until ctx is done
+func (d *destination) replay(ctx context.Context, logger *log.Logger) {
+	ticker := time.NewTicker(spoolDrainInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if !d.Healthy() || d.spool.empty() {
+				continue
+			}
+			if err := d.spool.drain(ctx, func(ctx context.Context, event SegmentEvent) error {
+				return d.sendRetry(ctx, event)
+			}); err != nil {
+				logger.Printf("Replay %s error -- %v\n", d.name, err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// sendRetry applies the destination timeout within the parent context, retrying transient errors
+func (d *destination) sendRetry(ctx context.Context, message interface{}) error {
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+
+	message, err := d.envelope(message)
+	if err != nil {
+		return err
+	}
+	b := d.Retry.backo()
+	for i := 0; ; i++ {
+		if err = d.Send(ctx, message); err == nil || i >= d.Retry.MaxAttempts || !retryable(err) {
+			return err
+		}
+		select {
+		case <-time.After(b.Duration(i)):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// retryable returns true for transient errors, ie a full queue, a network error, a retryable or throttled aws error,
+// or a throttled or server error response.  Other errors such as validation, marshal, spool full or a client error
+// response won't succeed on retry.
+func retryable(err error) bool {
+	if errors.Is(err, ErrQueueFull) {
+		return true
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var status *httpStatusError
+	if errors.As(err, &status) {
+		return status.retryable()
+	}
+	var aerr awserr.Error
+	if errors.As(err, &aerr) {
+		return request.IsErrorRetryable(aerr) || request.IsErrorThrottle(aerr)
+	}
+	var nerr net.Error
+	return errors.As(err, &nerr)
+}
@@ -0,0 +1,141 @@
+package segment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// testDestination records messages sent to it
+type testDestination struct {
+	mu       sync.Mutex
+	messages []interface{}
+	err      error
+}
+
+func (d *testDestination) Process(ctx context.Context) error {
+	<-ctx.Done()
+	return nil
+}
+
+func (d *testDestination) Send(ctx context.Context, message interface{}) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.err != nil {
+		return d.err
+	}
+	d.messages = append(d.messages, message)
+	return nil
+}
+
+func (d *testDestination) WithLogger(logger *log.Logger) Destination {
+	return d
+}
+
+func (d *testDestination) sent() []interface{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]interface{}{}, d.messages...)
+}
+
+// flakyDestination fails the first n sends, with a connection error unless failure is set
+type flakyDestination struct {
+	testDestination
+	failures int
+	failure  error
+}
+
+func (d *flakyDestination) Send(ctx context.Context, message interface{}) error {
+	d.mu.Lock()
+	if d.failures > 0 {
+		d.failures--
+		d.mu.Unlock()
+		if d.failure != nil {
+			return d.failure
+		}
+		return &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	}
+	d.mu.Unlock()
+	return d.testDestination.Send(ctx, message)
+}
+
+func TestDestinationRetry(t *testing.T) {
+	flaky := &flakyDestination{failures: 2}
+	d := &destination{Destination: flaky, DestinationOptions: DestinationOptions{
+		Retry: BackoffConfig{Min: time.Millisecond, Max: 10 * time.Millisecond, MaxAttempts: 2},
+	}}
+	if err := d.send(context.Background(), SegmentEvent{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(flaky.sent()) != 1 {
+		t.Errorf("Expected message sent after retries")
+	}
+
+	flaky.failures = 3
+	if err := d.send(context.Background(), SegmentEvent{}); err == nil {
+		t.Errorf("Expected error after retries exhausted")
+	}
+
+	// Permanent errors fail on the first attempt
+	for _, failure := range []error{
+		invalidEvent{errors.New("invalid")},
+		ErrSpoolFull,
+		fmt.Errorf("Marshal error -- %v", errors.New("unsupported type")),
+		&httpStatusError{StatusCode: http.StatusBadRequest},
+	} {
+		flaky.failures, flaky.failure = 2, failure
+		if err := d.send(context.Background(), SegmentEvent{}); err != failure {
+			t.Errorf("Expected %v not retried, got %v", failure, err)
+		}
+		if flaky.failures != 1 {
+			t.Errorf("Expected %v sent once, got %d attempts", failure, 2-flaky.failures)
+		}
+	}
+
+	// Server errors are retried
+	flaky.failures, flaky.failure = 2, &httpStatusError{StatusCode: http.StatusServiceUnavailable}
+	if err := d.send(context.Background(), SegmentEvent{}); err != nil {
+		t.Errorf("Expected server error retried, got %v", err)
+	}
+}
+
+// queueDestination has a queue that never accepts
+type queueDestination struct {
+	testDestination
+	messages chan interface{}
+}
+
+func (d *queueDestination) Send(ctx context.Context, message interface{}) error {
+	return enqueue(ctx, d.messages, message)
+}
+
+func TestDropQueueFull(t *testing.T) {
+	for _, tc := range []struct {
+		dest   Destination
+		name   string
+		reason string
+	}{
+		{&queueDestination{messages: make(chan interface{})}, "queuedestination-0", DropQueueFull},
+		{&testDestination{err: fmt.Errorf("Upstream error -- %w", context.DeadlineExceeded)}, "testdestination-0", DropSendError},
+	} {
+		s := NewSegment(nil, []Destination{tc.dest}, nil).WithRegisterer(prometheus.NewRegistry())
+		s.WithDestinationOptions(tc.dest, DestinationOptions{Timeout: 10 * time.Millisecond})
+
+		// Only a queue not accepting before the deadline is counted as queue full, other deadlines are send errors
+		if err := s.send(context.Background(), SegmentEvent{}); err == nil || errors.Is(err, ErrQueueFull) != (tc.reason == DropQueueFull) {
+			t.Errorf("Unexpected %s error %v", tc.name, err)
+		}
+		if n := testutil.ToFloat64(s.metrics.dropped.WithLabelValues(tc.reason, tc.name)); n != 1 {
+			t.Errorf("Expected %s dropped as %s, got %v", tc.name, tc.reason, n)
+		}
+	}
+}
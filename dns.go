@@ -0,0 +1,203 @@
+package segment
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsCache resolves hosts caching addresses until the record ttl expires, at most the refresh interval
+type dnsCache struct {
+	mu         sync.Mutex
+	refresh    time.Duration
+	lookupHost func(ctx context.Context, host string) ([]string, time.Duration, error) // Negative ttl if unknown
+	clock      Clock
+	entries    map[string]*dnsEntry
+	changed    func() // Called when the addresses of a host change, eg to close idle keep-alive connections
+}
+
+type dnsEntry struct {
+	addrs   []string
+	expires time.Time
+	next    int // Round robin offset of the first address to dial
+}
+
+// newDNSCache creates a cache using the go resolver
+func newDNSCache(refresh time.Duration) *dnsCache {
+	return &dnsCache{
+		refresh:    refresh,
+		lookupHost: ttlResolver((&net.Dialer{}).DialContext),
+		clock:      SystemClock,
+		entries:    make(map[string]*dnsEntry),
+	}
+}
+
+// lookup returns the cached addresses of host, re-resolving once the ttl or refresh interval expires.  The stale addresses are returned if
+// re-resolving fails, and changed is called if the addresses differ.
+func (c *dnsCache) lookup(ctx context.Context, host string) ([]string, error) {
+	now := c.clock.Now()
+	c.mu.Lock()
+	entry, ok := c.entries[host]
+	if ok && now.Before(entry.expires) {
+		addrs := rotate(entry.addrs, entry.next)
+		entry.next++
+		c.mu.Unlock()
+		return addrs, nil
+	}
+	c.mu.Unlock()
+
+	addrs, ttl, err := c.lookupHost(ctx, host)
+	if err != nil || len(addrs) == 0 {
+		if ok {
+			return entry.addrs, nil
+		}
+		if err == nil {
+			err = fmt.Errorf("no addresses for %s", host)
+		}
+		return nil, err
+	}
+	sort.Strings(addrs)
+	expires := c.refresh
+	if ttl >= 0 && ttl < expires {
+		expires = ttl
+	}
+	c.mu.Lock()
+	c.entries[host] = &dnsEntry{addrs: addrs, expires: now.Add(expires), next: 1}
+	c.mu.Unlock()
+	if ok && strings.Join(entry.addrs, ",") != strings.Join(addrs, ",") && c.changed != nil {
+		c.changed()
+	}
+	return addrs, nil
+}
+
+// dialContext returns a dial func connecting to the cached addresses of the host in turn
+func (c *dnsCache) dialContext(dialer *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || net.ParseIP(host) != nil {
+			return dialer.DialContext(ctx, network, addr)
+		}
+		addrs, err := c.lookup(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range addrs {
+			var conn net.Conn
+			if conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(ip, port)); err == nil {
+				return conn, nil
+			}
+		}
+		return nil, err
+	}
+}
+
+// rotate returns addrs starting at offset n
+func rotate(addrs []string, n int) []string {
+	i := n % len(addrs)
+	return append(append([]string{}, addrs[i:]...), addrs[:i]...)
+}
+
+// ttlResolver returns a lookup using the go resolver, which handles the hosts file, search domains and nameservers,
+// and the minimum ttl of the answers read from the dns responses, as the resolver doesn't expose them.  The ttl is
+// negative if no answers were read, eg for a host in the hosts file.
+func ttlResolver(dial func(ctx context.Context, network, address string) (net.Conn, error)) func(ctx context.Context, host string) ([]string, time.Duration, error) {
+	return func(ctx context.Context, host string) ([]string, time.Duration, error) {
+		ttl := &answerTTL{min: -1}
+		resolver := &net.Resolver{PreferGo: true, Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			conn, err := dial(ctx, network, address)
+			if err != nil {
+				return nil, err
+			}
+			if pc, ok := conn.(net.PacketConn); ok {
+				return &ttlPacketConn{ttlConn: &ttlConn{Conn: conn, ttl: ttl}, pc: pc}, nil
+			}
+			return &ttlConn{Conn: conn, ttl: ttl, stream: true}, nil
+		}}
+		addrs, err := resolver.LookupHost(ctx, host)
+		return addrs, ttl.get(), err
+	}
+}
+
+// answerTTL records the minimum ttl of the answers of dns responses
+type answerTTL struct {
+	mu  sync.Mutex
+	min time.Duration
+}
+
+// observe records the ttls of the answers of a dns response message
+func (t *answerTTL) observe(msg []byte) {
+	var p dnsmessage.Parser
+	if _, err := p.Start(msg); err != nil {
+		return
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return
+	}
+	for {
+		h, err := p.AnswerHeader()
+		if err != nil {
+			return
+		}
+		ttl := time.Duration(h.TTL) * time.Second
+		t.mu.Lock()
+		if t.min < 0 || ttl < t.min {
+			t.min = ttl
+		}
+		t.mu.Unlock()
+		if err := p.SkipAnswer(); err != nil {
+			return
+		}
+	}
+}
+
+func (t *answerTTL) get() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.min
+}
+
+// ttlConn observes the dns responses read by the resolver, which are prefixed by their length on a stream
+type ttlConn struct {
+	net.Conn
+	ttl    *answerTTL
+	stream bool
+	buf    []byte
+}
+
+func (c *ttlConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if !c.stream {
+		c.ttl.observe(b[:n])
+		return n, err
+	}
+	c.buf = append(c.buf, b[:n]...)
+	for len(c.buf) >= 2 {
+		l := int(c.buf[0])<<8 | int(c.buf[1])
+		if len(c.buf) < 2+l {
+			break
+		}
+		c.ttl.observe(c.buf[2 : 2+l])
+		c.buf = c.buf[2+l:]
+	}
+	return n, err
+}
+
+// ttlPacketConn is a ttlConn that remains a packet conn, so the resolver reads a response per packet
+type ttlPacketConn struct {
+	*ttlConn
+	pc net.PacketConn
+}
+
+func (c *ttlPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	return c.pc.ReadFrom(b)
+}
+
+func (c *ttlPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return c.pc.WriteTo(b, addr)
+}
@@ -0,0 +1,201 @@
+package segment
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeResolver returns the addresses and record ttl set by the test, counting lookups
+type fakeResolver struct {
+	mu      sync.Mutex
+	addrs   []string
+	ttl     time.Duration // Unknown if zero
+	err     error
+	lookups int
+}
+
+func (r *fakeResolver) lookupHost(ctx context.Context, host string) ([]string, time.Duration, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lookups++
+	ttl := r.ttl
+	if ttl == 0 {
+		ttl = -1
+	}
+	return append([]string{}, r.addrs...), ttl, r.err
+}
+
+func (r *fakeResolver) set(err error, addrs ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.addrs, r.err = addrs, err
+}
+
+func TestDNSCache(t *testing.T) {
+	resolver := &fakeResolver{addrs: []string{"10.0.0.2", "10.0.0.1"}}
+	clock := newTestClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	c := newDNSCache(time.Minute)
+	c.lookupHost = resolver.lookupHost
+	c.clock = clock
+	changed := 0
+	c.changed = func() { changed++ }
+
+	// Cached within the refresh interval, rotating the first address
+	first, _ := c.lookup(context.Background(), "collector")
+	second, _ := c.lookup(context.Background(), "collector")
+	if resolver.lookups != 1 || strings.Join(first, ",") != "10.0.0.1,10.0.0.2" || second[0] != "10.0.0.2" {
+		t.Errorf("Expected cached rotated addresses, got %v %v after %d lookups", first, second, resolver.lookups)
+	}
+
+	// Stale addresses are returned if resolving fails
+	clock.Advance(time.Minute)
+	resolver.set(errors.New("timeout"))
+	if addrs, err := c.lookup(context.Background(), "collector"); err != nil || len(addrs) != 2 {
+		t.Errorf("Expected stale addresses, got %v %v", addrs, err)
+	}
+
+	// Changed addresses after the refresh interval call changed
+	resolver.set(nil, "10.0.0.3")
+	if addrs, _ := c.lookup(context.Background(), "collector"); addrs[0] != "10.0.0.3" || changed != 1 {
+		t.Errorf("Expected re-resolved address with changed, got %v %d", addrs, changed)
+	}
+
+	// A record ttl shorter than the refresh interval expires first
+	resolver.mu.Lock()
+	resolver.ttl, resolver.lookups = 10*time.Second, 0
+	resolver.mu.Unlock()
+	clock.Advance(time.Minute)
+	c.lookup(context.Background(), "collector")
+	clock.Advance(9 * time.Second)
+	c.lookup(context.Background(), "collector")
+	clock.Advance(time.Second)
+	c.lookup(context.Background(), "collector")
+	if resolver.lookups != 2 {
+		t.Errorf("Expected re-resolved once the ttl expired, got %d lookups", resolver.lookups)
+	}
+}
+
+// fakeNameserver answers A queries with 10.0.0.1 and the ttl, and AAAA queries with no answers
+func fakeNameserver(t *testing.T, ttl uint32) net.PacketConn {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		b := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			var query dnsmessage.Message
+			if query.Unpack(b[:n]) != nil || len(query.Questions) != 1 {
+				continue
+			}
+			q := query.Questions[0]
+			res := dnsmessage.Message{Header: dnsmessage.Header{ID: query.ID, Response: true, RecursionAvailable: true}, Questions: query.Questions}
+			if q.Type == dnsmessage.TypeA {
+				res.Answers = []dnsmessage.Resource{{
+					Header: dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: ttl},
+					Body:   &dnsmessage.AResource{A: [4]byte{10, 0, 0, 1}},
+				}}
+			}
+			packed, _ := res.Pack()
+			pc.WriteTo(packed, addr)
+		}
+	}()
+	return pc
+}
+
+func TestTTLResolver(t *testing.T) {
+	ns := fakeNameserver(t, 30)
+	lookup := ttlResolver(func(ctx context.Context, network, address string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, "udp", ns.LocalAddr().String())
+	})
+	addrs, ttl, err := lookup(context.Background(), "collector.example.com.")
+	if err != nil || strings.Join(addrs, ",") != "10.0.0.1" || ttl != 30*time.Second {
+		t.Errorf("Expected address with 30s ttl, got %v %s %v", addrs, ttl, err)
+	}
+
+	// Responses over a stream are read after their length prefix, which may span reads
+	name := dnsmessage.MustNewName("collector.example.com.")
+	res := dnsmessage.Message{Header: dnsmessage.Header{Response: true}, Answers: []dnsmessage.Resource{{
+		Header: dnsmessage.ResourceHeader{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 20},
+		Body:   &dnsmessage.AResource{A: [4]byte{10, 0, 0, 1}},
+	}}}
+	packed, _ := res.Pack()
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		server.Write([]byte{byte(len(packed) >> 8), byte(len(packed))})
+		server.Write(packed)
+		server.Close()
+	}()
+	stream := &ttlConn{Conn: client, ttl: &answerTTL{min: -1}, stream: true}
+	io.ReadAll(stream)
+	if ttl := stream.ttl.get(); ttl != 20*time.Second {
+		t.Errorf("Expected 20s ttl from stream, got %s", ttl)
+	}
+}
+
+func TestForwarderDNSFailover(t *testing.T) {
+	var mu sync.Mutex
+	var served []string
+	handler := func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			served = append(served, name)
+			mu.Unlock()
+		})
+	}
+	primary := httptest.NewServer(handler("primary"))
+	defer primary.Close()
+	_, port, _ := net.SplitHostPort(primary.Listener.Addr().String())
+	listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.2", port))
+	if err != nil {
+		t.Skipf("Secondary loopback unavailable -- %v", err)
+	}
+	secondary := httptest.NewUnstartedServer(handler("secondary"))
+	secondary.Listener = listener
+	secondary.Start()
+	defer secondary.Close()
+
+	f := NewForwarderWithConfig(&ForwarderConfig{
+		Endpoint:           "http://collector.test:" + port,
+		DNSRefreshInterval: time.Minute,
+		Registerer:         prometheus.NewRegistry(),
+	})
+	resolver := &fakeResolver{addrs: []string{"127.0.0.1"}}
+	clock := newTestClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	f.dns.lookupHost = resolver.lookupHost
+	f.dns.clock = clock
+
+	send := func() {
+		if err := f.send(context.Background(), SegmentEvent{SegmentMessage: SegmentMessage{Type: "track"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	send()
+	resolver.set(nil, "127.0.0.2")
+	send() // Within the refresh interval the keep-alive connection is reused
+	clock.Advance(time.Minute)
+	send()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(served, ",") != "primary,primary,secondary" {
+		t.Errorf("Expected failover after the refresh interval, got %v", served)
+	}
+}
@@ -0,0 +1,105 @@
+package segment
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+// Dry run decisions for an event or destination
+const (
+	DecisionSend     = "send"     // Event would be sent
+	DecisionDropped  = "dropped"  // A transform dropped the event
+	DecisionInvalid  = "invalid"  // A transform returned an error, eg failed validation
+	DecisionUnrouted = "unrouted" // No route matched the event
+)
+
+// dryRunKey is the context key marking a dry run
+type dryRunKey struct{}
+
+// DryRun returns true if the event is being validated without delivery, so stateful transforms can skip updates
+func DryRun(ctx context.Context) bool {
+	dry, _ := ctx.Value(dryRunKey{}).(bool)
+	return dry
+}
+
+// DryRunDestination is the decision of a destination for the event, with the payload after its transforms
+type DryRunDestination struct {
+	Destination string        `json:"destination"`
+	Decision    string        `json:"decision"`
+	Error       string        `json:"error,omitempty"`
+	Routes      []string      `json:"routes,omitempty"` // Routed destinations of an EventRouter or Residency
+	Event       *SegmentEvent `json:"event,omitempty"`
+}
+
+// DryRunEvent is the decision for an event, with the payload after enrichment and transforms
+type DryRunEvent struct {
+	Decision     string              `json:"decision"`
+	Error        string              `json:"error,omitempty"`
+	Event        SegmentEvent        `json:"event"`
+	Destinations []DryRunDestination `json:"destinations,omitempty"`
+}
+
+// dryRunRouter is implemented by destinations that route events to other destinations
+type dryRunRouter interface {
+	route(m SegmentEvent) []string
+}
+
+// isDryRun returns true if the request has ?dryRun=1
+func isDryRun(r *http.Request) bool {
+	switch r.URL.Query().Get("dryRun") {
+	case "1", "true":
+		return true
+	}
+	return false
+}
+
+// writeDryRun runs events through enrichment, transforms and routing, writing the decisions without delivering
+func (s *Segment) writeDryRun(w http.ResponseWriter, r *http.Request, events []SegmentEvent) {
+	ctx := context.WithValue(r.Context(), dryRunKey{}, true)
+	results := make([]DryRunEvent, len(events))
+	for i, m := range events {
+		results[i] = s.dryRun(ctx, m)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Success bool          `json:"success"`
+		DryRun  bool          `json:"dryRun"`
+		Events  []DryRunEvent `json:"events"`
+	}{true, true, results})
+}
+
+// dryRun returns the decision for the event and each destination
+func (s *Segment) dryRun(ctx context.Context, m SegmentEvent) DryRunEvent {
+	s.enrich(&m)
+	result := DryRunEvent{Decision: DecisionSend}
+	ok, err := s.transform(ctx, &m)
+	result.Event = m
+	switch {
+	case err != nil:
+		result.Decision, result.Error = DecisionInvalid, err.Error()
+		return result
+	case !ok:
+		result.Decision = DecisionDropped
+		return result
+	}
+
+	for _, dest := range s.destinations {
+		decision := DryRunDestination{Destination: dest.name, Decision: DecisionSend}
+		event := m
+		if keep, err := applyTransforms(ctx, dest.Transforms, &event); err != nil {
+			decision.Decision, decision.Error = DecisionInvalid, err.Error()
+		} else if !keep {
+			decision.Decision = DecisionDropped
+		} else {
+			decision.Event = &event
+			if router, ok := dest.Destination.(dryRunRouter); ok {
+				if decision.Routes = router.route(event); len(decision.Routes) == 0 {
+					decision.Decision = DecisionUnrouted
+				}
+			}
+		}
+		result.Destinations = append(result.Destinations, decision)
+	}
+	return result
+}
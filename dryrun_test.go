@@ -0,0 +1,86 @@
+package segment
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestDryRun(t *testing.T) {
+	warehouse, crm := &testDestination{}, &testDestination{}
+	router, err := NewEventRouter(map[string]Destination{"warehouse": warehouse, "crm": crm}, []Route{
+		{Pattern: "Order *", Destinations: []string{"warehouse", "crm"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := &testDestination{}
+	mtu := NewMTUEstimator(nil)
+	routes := mux.NewRouter()
+	s := NewSegment(func(writeKey string) string { return writeKey }, []Destination{router, archive}, routes).
+		WithQuotas(NewQuotas(Quota{Daily: 1}, nil)).
+		WithTransforms(mtu.Transform, func(ctx context.Context, m *SegmentEvent) error {
+			if m.Event == "" {
+				return fmt.Errorf("Event name required")
+			}
+			return nil
+		})
+	s.WithDestinationOptions(archive, DestinationOptions{Transforms: []Transform{BlockPaths("properties.email")}})
+
+	body := `{"batch":[
+		{"type":"track","event":"Order Completed","userId":"u1","properties":{"email":"a@example.com"}},
+		{"type":"track","event":"Page Viewed","userId":"u1"},
+		{"type":"track","userId":"u1"}
+	]}`
+	req := httptest.NewRequest("POST", "/batch?dryRun=1", strings.NewReader(body))
+	req.SetBasicAuth("web", "")
+	w := httptest.NewRecorder()
+	routes.ServeHTTP(w, req)
+
+	var res struct {
+		DryRun bool          `json:"dryRun"`
+		Events []DryRunEvent `json:"events"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("Unexpected response %d %s", w.Code, w.Body.String())
+	}
+	if !res.DryRun || len(res.Events) != 3 {
+		t.Fatalf("Expected 3 dry run events, got %s", w.Body.String())
+	}
+	order := res.Events[0]
+	if order.Decision != DecisionSend || order.Event.MessageId == "" || order.Event.Channel == "" {
+		t.Errorf("Expected enriched order sent, got %+v", order)
+	}
+	if d := order.Destinations[0]; d.Decision != DecisionSend || strings.Join(d.Routes, ",") != "warehouse,crm" {
+		t.Errorf("Expected order routed, got %+v", d)
+	}
+	if d := order.Destinations[1]; d.Decision != DecisionSend || d.Event.Properties["email"] != nil {
+		t.Errorf("Expected email blocked for archive, got %+v", d)
+	}
+	if d := res.Events[1].Destinations[0]; d.Decision != DecisionUnrouted {
+		t.Errorf("Expected page unrouted, got %+v", d)
+	}
+	if e := res.Events[2]; e.Decision != DecisionInvalid || e.Error != "Event name required" {
+		t.Errorf("Expected invalid event, got %+v", e)
+	}
+
+	// Nothing delivered, counted against quota or observed by stateful transforms
+	if len(warehouse.sent())+len(crm.sent())+len(archive.sent()) != 0 {
+		t.Error("Expected no events delivered")
+	}
+	if estimates := mtu.Estimates(time.Now().UTC().Format("2006-01")); len(estimates) != 0 {
+		t.Errorf("Expected no users observed, got %v", estimates)
+	}
+	req = httptest.NewRequest("POST", "/track", strings.NewReader(`{"writeKey":"web","event":"Order Completed"}`))
+	w = httptest.NewRecorder()
+	routes.ServeHTTP(w, req)
+	if w.Code != 200 || len(warehouse.sent()) != 1 {
+		t.Errorf("Expected event within quota delivered, got %d", w.Code)
+	}
+}
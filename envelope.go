@@ -0,0 +1,92 @@
+package segment
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Envelope versions of the wire format sent to destinations
+const (
+	EnvelopeNone = 0 // Bare event json, the original wire format
+	EnvelopeV1   = 1 // Version, projectId and receivedAt with the event json as payload
+	// EnvelopeLatest is the highest version ingest writes, destinations negotiate down to the version they support
+	EnvelopeLatest = EnvelopeV1
+)
+
+// Envelope wraps an event between ingest and destinations with the fields consumers route on before decoding the
+// payload, so the payload format can evolve under a new version without breaking existing consumers
+type Envelope struct {
+	Version    int             `json:"version"`
+	ProjectId  string          `json:"projectId"`
+	ReceivedAt time.Time       `json:"receivedAt"`
+	Payload    json.RawMessage `json:"payload"`
+	event      SegmentEvent    // Decoded payload for partition keys
+}
+
+// Enveloped is implemented by destinations that accept envelopes, returning the highest version they support
+type Enveloped interface {
+	EnvelopeVersion() int
+}
+
+// negotiateVersion returns the highest envelope version supported by both ingest and the destination
+func negotiateVersion(dest Destination) int {
+	if e, ok := dest.(Enveloped); ok {
+		return max(min(e.EnvelopeVersion(), EnvelopeLatest), EnvelopeNone)
+	}
+	return EnvelopeNone
+}
+
+// NewEnvelope wraps the event in an envelope of the version
+func NewEnvelope(event SegmentEvent, version int) (*Envelope, error) {
+	if version <= EnvelopeNone || version > EnvelopeLatest {
+		return nil, fmt.Errorf("Unsupported envelope version %d", version)
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return nil, fmt.Errorf("Marshal error -- %v", err)
+	}
+	return &Envelope{
+		Version:    version,
+		ProjectId:  event.ProjectId,
+		ReceivedAt: event.ReceivedAt,
+		Payload:    payload,
+		event:      event,
+	}, nil
+}
+
+// Event returns the event in the payload
+func (e *Envelope) Event() (SegmentEvent, error) {
+	var event SegmentEvent
+	if err := json.Unmarshal(e.Payload, &event); err != nil {
+		return event, fmt.Errorf("Envelope payload error -- %v", err)
+	}
+	return event, nil
+}
+
+// DecodeEnvelope decodes an event written with any envelope version or none, so consumers read records written
+// either side of an upgrade
+func DecodeEnvelope(data []byte) (SegmentEvent, error) {
+	var envelope Envelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return SegmentEvent{}, fmt.Errorf("Envelope error -- %v", err)
+	}
+	switch {
+	case envelope.Version > EnvelopeLatest:
+		return SegmentEvent{}, fmt.Errorf("Unsupported envelope version %d", envelope.Version)
+	case envelope.Version == EnvelopeNone || envelope.Payload == nil:
+		var event SegmentEvent
+		err := json.Unmarshal(data, &event)
+		return event, err
+	}
+	return envelope.Event()
+}
+
+// envelope wraps events in the envelope version negotiated with the destination
+func (d *destination) envelope(message interface{}) (interface{}, error) {
+	event, ok := message.(SegmentEvent)
+	if !ok || d.version == EnvelopeNone {
+		return message, nil
+	}
+	return NewEnvelope(event, d.version)
+}
@@ -0,0 +1,87 @@
+package segment
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// envelopedDestination accepts envelopes up to version
+type envelopedDestination struct {
+	testDestination
+	version int
+}
+
+func (d *envelopedDestination) EnvelopeVersion() int {
+	return d.version
+}
+
+func TestEnvelopeNegotiation(t *testing.T) {
+	legacy, future := &testDestination{}, &envelopedDestination{version: EnvelopeLatest + 1}
+	s := NewSegment(func(writeKey string) string { return writeKey }, []Destination{legacy, future}, nil)
+	event := SegmentEvent{WriteKey: "web", SegmentMessage: SegmentMessage{Type: "track", Event: "Signed Up", ProjectId: "web"}}
+	if err := s.send(context.Background(), event); err != nil {
+		t.Fatal(err)
+	}
+
+	// Destinations without envelope support get the bare event, others the highest version both support
+	bare, ok := legacy.sent()[0].(SegmentEvent)
+	if !ok {
+		t.Fatalf("Expected bare event, got %T", legacy.sent()[0])
+	}
+	envelope, ok := future.sent()[0].(*Envelope)
+	if !ok || envelope.Version != EnvelopeLatest || envelope.ProjectId != "web" || envelope.ReceivedAt.IsZero() {
+		t.Fatalf("Expected envelope version %d, got %+v", EnvelopeLatest, future.sent()[0])
+	}
+
+	// Consumers decode either wire format
+	for _, message := range []interface{}{bare, envelope} {
+		data, _ := json.Marshal(message)
+		decoded, err := DecodeEnvelope(data)
+		if err != nil || decoded.Event != "Signed Up" || decoded.MessageId != bare.MessageId {
+			t.Errorf("Unexpected decoded %s: %+v %v", data, decoded, err)
+		}
+	}
+	if _, err := DecodeEnvelope([]byte(`{"version":99,"payload":{}}`)); err == nil {
+		t.Error("Expected unsupported version error")
+	}
+}
+
+func TestDeliveryEnvelope(t *testing.T) {
+	if err := (&DeliveryConfig{StreamRegion: "us-west-2", StreamName: "test", EnvelopeVersion: 99}).Validate(); err == nil {
+		t.Error("Expected unsupported version error")
+	}
+	f := newFakeFirehose(t)
+	d := NewDelivery(&DeliveryConfig{
+		StreamEndpoint:  f.URL,
+		StreamRegion:    "us-west-2",
+		StreamName:      "test",
+		EnvelopeVersion: EnvelopeV1,
+		FlushInterval:   10 * time.Millisecond,
+		Registerer:      prometheus.NewRegistry(),
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- d.Process(ctx) }()
+	d.Send(ctx, SegmentEvent{SegmentMessage: SegmentMessage{ProjectId: "web", Event: "A"}})
+	for deadline := time.Now().Add(time.Second); len(f.put()) == 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	records := f.put()
+	if len(records) != 1 {
+		t.Fatalf("Expected 1 record, got %d", len(records))
+	}
+	var envelope Envelope
+	json.Unmarshal(records[0], &envelope)
+	if event, err := envelope.Event(); envelope.Version != EnvelopeV1 || envelope.ProjectId != "web" || err != nil || event.Event != "A" {
+		t.Errorf("Expected envelope record, got %s", records[0])
+	}
+}
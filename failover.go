@@ -0,0 +1,175 @@
+package segment
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// defaultHealthCheckInterval between health checks of unhealthy forwarder endpoints
+const defaultHealthCheckInterval = 10 * time.Second
+
+// FailoverConfig contains the secondary endpoints to forward to while the primary endpoint is unhealthy
+type FailoverConfig struct {
+	// Endpoints in order of preference after the primary, optionally templated as for the primary
+	Endpoints           []string      `json:"endpoints"`
+	HealthCheckInterval time.Duration `json:"healthCheckInterval,omitempty"` // Defaults to 10 seconds
+	// HealthCheckPath is requested with GET relative to each endpoint, defaults to the endpoint itself
+	HealthCheckPath string `json:"healthCheckPath,omitempty"`
+}
+
+// Validate checks the secondary endpoints are http(s) urls
+func (config *FailoverConfig) Validate() error {
+	if len(config.Endpoints) == 0 {
+		return fmt.Errorf("Require failover endpoints")
+	}
+	for _, endpoint := range config.Endpoints {
+		base, err := baseEndpoint(endpoint)
+		if err != nil {
+			return err
+		}
+		if err := validateEndpoint(base); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forwarderEndpoint is a primary or secondary endpoint and its health
+type forwarderEndpoint struct {
+	endpoint string
+	url      *template.Template // Endpoint template, nil if not templated
+	prefix   string             // Static prefix of the endpoint template that rendered urls must start with
+	health   string             // Health check url
+	healthy  bool
+}
+
+// render returns the url for the event
+func (e *forwarderEndpoint) render(m SegmentEvent) (string, error) {
+	if e.url == nil {
+		return e.endpoint, nil
+	}
+	endpoint, err := executeTemplate(e.url, m)
+	if err != nil {
+		return "", err
+	}
+	return endpoint, checkRoute(e.prefix, endpoint)
+}
+
+// endpointPool selects the first healthy endpoint in order of preference, so requests fail back to the primary once
+// its health check passes.  It is safe for concurrent use by the forwarder and the health checker.
+type endpointPool struct {
+	mu        sync.Mutex
+	endpoints []*forwarderEndpoint
+	gauge     *prometheus.GaugeVec
+}
+
+func newEndpointPool(endpoints []string, healthCheckPath string, gauge *prometheus.GaugeVec) *endpointPool {
+	p := &endpointPool{gauge: gauge}
+	for _, endpoint := range endpoints {
+		tmpl, _ := endpointTemplate(endpoint)
+		base, _ := baseEndpoint(endpoint)
+		health := base
+		if u, err := url.Parse(base); err == nil && healthCheckPath != "" {
+			health = u.ResolveReference(&url.URL{Path: healthCheckPath}).String()
+		}
+		p.endpoints = append(p.endpoints, &forwarderEndpoint{endpoint: endpoint, url: tmpl, prefix: endpointPrefix(endpoint), health: health, healthy: true})
+		gauge.WithLabelValues(endpoint).Set(1)
+	}
+	return p
+}
+
+// primary returns the first endpoint
+func (p *endpointPool) primary() *forwarderEndpoint {
+	return p.endpoints[0]
+}
+
+// candidates returns the healthy endpoints in order of preference, or all endpoints if none are healthy
+func (p *endpointPool) candidates() []*forwarderEndpoint {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var healthy []*forwarderEndpoint
+	for _, e := range p.endpoints {
+		if e.healthy {
+			healthy = append(healthy, e)
+		}
+	}
+	if len(healthy) == 0 {
+		return p.endpoints
+	}
+	return healthy
+}
+
+// setHealthy marks the endpoint up or down, returning true if changed.  A single endpoint is never marked down.
+func (p *endpointPool) setHealthy(e *forwarderEndpoint, healthy bool) bool {
+	if len(p.endpoints) == 1 {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e.healthy == healthy {
+		return false
+	}
+	e.healthy = healthy
+	value := 0.0
+	if healthy {
+		value = 1
+	}
+	p.gauge.WithLabelValues(e.endpoint).Set(value)
+	return true
+}
+
+// unhealthy returns the endpoints marked down
+func (p *endpointPool) unhealthy() []*forwarderEndpoint {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var down []*forwarderEndpoint
+	for _, e := range p.endpoints {
+		if !e.healthy {
+			down = append(down, e)
+		}
+	}
+	return down
+}
+
+// healthCheck checks the unhealthy endpoints every interval until ctx is done
+func (p *endpointPool) healthCheck(ctx context.Context, client *http.Client, interval time.Duration, logger *log.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.check(ctx, client, logger)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// check marks unhealthy endpoints up if their health check responds without a server error
+func (p *endpointPool) check(ctx context.Context, client *http.Client, logger *log.Logger) {
+	for _, e := range p.unhealthy() {
+		checkCtx, cancel := context.WithTimeout(ctx, checkTimeout)
+		req, err := http.NewRequestWithContext(checkCtx, http.MethodGet, e.health, nil)
+		if err == nil {
+			var res *http.Response
+			if res, err = client.Do(req); err == nil {
+				res.Body.Close()
+				if res.StatusCode >= 500 {
+					err = fmt.Errorf("response %s", res.Status)
+				}
+			}
+		}
+		cancel()
+		if err == nil && p.setHealthy(e, true) {
+			logger.Printf("Forwarder endpoint %s healthy\n", e.endpoint)
+		}
+	}
+}
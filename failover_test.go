@@ -0,0 +1,68 @@
+package segment
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestForwarderFailover(t *testing.T) {
+	var down atomic.Bool
+	var primaryRequests, secondaryRequests atomic.Int32
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if r.Method == http.MethodPost {
+			primaryRequests.Add(1)
+		}
+	}))
+	defer primary.Close()
+	secondary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secondaryRequests.Add(1)
+	}))
+	defer secondary.Close()
+
+	if err := (&ForwarderConfig{Endpoint: primary.URL, Failover: &FailoverConfig{}}).Validate(); err == nil {
+		t.Error("Expected failover endpoints error")
+	}
+	f := NewForwarderWithConfig(&ForwarderConfig{
+		Endpoint:   primary.URL + "/batch",
+		Failover:   &FailoverConfig{Endpoints: []string{secondary.URL + "/batch"}, HealthCheckPath: "/health"},
+		Registerer: prometheus.NewRegistry(),
+	})
+	send := func() error {
+		return f.send(context.Background(), SegmentEvent{SegmentMessage: SegmentMessage{Type: "track"}})
+	}
+
+	// Fails over to the secondary, which is used until the primary is healthy
+	down.Store(true)
+	for i := 0; i < 2; i++ {
+		if err := send(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if primaryRequests.Load() != 0 || secondaryRequests.Load() != 2 || len(f.pool.unhealthy()) != 1 {
+		t.Errorf("Expected failover, got %d primary %d secondary", primaryRequests.Load(), secondaryRequests.Load())
+	}
+	f.pool.check(context.Background(), f.client, log.Default())
+	if len(f.pool.unhealthy()) != 1 {
+		t.Error("Expected primary to remain unhealthy")
+	}
+
+	// Fails back once the health check passes
+	down.Store(false)
+	f.pool.check(context.Background(), f.client, log.Default())
+	if err := send(); err != nil {
+		t.Fatal(err)
+	}
+	if primaryRequests.Load() != 1 || secondaryRequests.Load() != 2 {
+		t.Errorf("Expected fail back, got %d primary %d secondary", primaryRequests.Load(), secondaryRequests.Load())
+	}
+}
@@ -0,0 +1,115 @@
+package segment
+
+import (
+	"context"
+	"strings"
+)
+
+// filterRoots are the event maps that property paths select within
+var filterRoots = []string{"context", "properties", "traits"}
+
+// splitPath returns the keys of a dotted json path, with an optional "$." prefix
+func splitPath(path string) []string {
+	return strings.Split(strings.TrimPrefix(path, "$."), ".")
+}
+
+// eventMaps returns pointers to the context, properties and traits maps by root name
+func eventMaps(m *SegmentEvent) map[string]*map[string]interface{} {
+	return map[string]*map[string]interface{}{
+		"context":    &m.Context,
+		"properties": &m.Properties,
+		"traits":     &m.Traits,
+	}
+}
+
+// lookupEventPath returns the value at a dotted json path within context, properties or traits, or nil
+func lookupEventPath(m *SegmentEvent, path string) interface{} {
+	keys := splitPath(path)
+	root, ok := eventMaps(m)[keys[0]]
+	if !ok || len(keys) < 2 {
+		return nil
+	}
+	return lookupPath(*root, strings.Join(keys[1:], "."))
+}
+
+// BlockPaths returns a transform that removes fields at dotted json paths within context,
+// properties or traits eg "context.ip" or "$.traits.email"
+func BlockPaths(paths ...string) Transform {
+	return func(ctx context.Context, m *SegmentEvent) error {
+		maps := eventMaps(m)
+		for _, path := range paths {
+			keys := splitPath(path)
+			if target, ok := maps[keys[0]]; ok && len(keys) > 1 {
+				*target = deletePath(*target, keys[1:])
+			}
+		}
+		return nil
+	}
+}
+
+// AllowPaths returns a transform that keeps only fields at dotted json paths within context,
+// properties or traits, eg "properties.revenue", or a root such as "context" to keep all of it
+func AllowPaths(paths ...string) Transform {
+	return func(ctx context.Context, m *SegmentEvent) error {
+		maps := eventMaps(m)
+		whole := make(map[string]bool)
+		kept := make(map[string]map[string]interface{})
+		for _, path := range paths {
+			keys := splitPath(path)
+			if target, ok := maps[keys[0]]; !ok {
+				continue
+			} else if len(keys) == 1 {
+				whole[keys[0]] = true
+			} else {
+				kept[keys[0]] = copyPath(kept[keys[0]], *target, keys[1:])
+			}
+		}
+		for _, root := range filterRoots {
+			if target := maps[root]; !whole[root] && *target != nil {
+				*target = kept[root]
+			}
+		}
+		return nil
+	}
+}
+
+// deletePath returns m without the value at keys, copying maps along the path rather than modifying them
+func deletePath(m map[string]interface{}, keys []string) map[string]interface{} {
+	value, ok := m[keys[0]]
+	if !ok {
+		return m
+	}
+	c := cloneMap(m)
+	if len(keys) == 1 {
+		delete(c, keys[0])
+		return c
+	}
+	next, ok := value.(map[string]interface{})
+	if !ok {
+		return m
+	}
+	c[keys[0]] = deletePath(next, keys[1:])
+	return c
+}
+
+// copyPath copies the value at keys in src to dst, returning dst which is created if nil
+func copyPath(dst, src map[string]interface{}, keys []string) map[string]interface{} {
+	value, ok := src[keys[0]]
+	if !ok {
+		return dst
+	}
+	if dst == nil {
+		dst = make(map[string]interface{})
+	}
+	if len(keys) == 1 {
+		dst[keys[0]] = value
+		return dst
+	}
+	next, ok := value.(map[string]interface{})
+	if !ok {
+		return dst
+	}
+	existing, _ := dst[keys[0]].(map[string]interface{})
+	dst[keys[0]] = copyPath(existing, next, keys[1:])
+	return dst
+}
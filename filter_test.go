@@ -0,0 +1,59 @@
+package segment
+
+import (
+	"context"
+	"testing"
+)
+
+func TestBlockPaths(t *testing.T) {
+	shared := map[string]interface{}{"ip": "1.2.3.4", "library": map[string]interface{}{"name": "analytics.js"}}
+	m := &SegmentEvent{SegmentMessage: SegmentMessage{
+		Context: shared,
+		Traits:  map[string]interface{}{"email": "a@b.com", "plan": "pro"},
+	}}
+	BlockPaths("context.ip", "$.traits.email", "properties.missing")(context.Background(), m)
+	if _, ok := m.Context["ip"]; ok {
+		t.Errorf("Expected context.ip removed, got %v", m.Context)
+	}
+	if _, ok := m.Traits["email"]; ok || m.Traits["plan"] != "pro" {
+		t.Errorf("Expected only traits.email removed, got %v", m.Traits)
+	}
+	if shared["ip"] != "1.2.3.4" {
+		t.Error("Expected shared context unmodified")
+	}
+}
+
+func TestAllowPaths(t *testing.T) {
+	m := &SegmentEvent{SegmentMessage: SegmentMessage{
+		Context:    map[string]interface{}{"ip": "1.2.3.4", "page": map[string]interface{}{"path": "/", "title": "Home"}},
+		Properties: map[string]interface{}{"revenue": 10, "email": "a@b.com"},
+		Traits:     map[string]interface{}{"plan": "pro"},
+	}}
+	AllowPaths("context.page.path", "properties.revenue", "traits")(context.Background(), m)
+	if len(m.Context) != 1 || m.Context["page"].(map[string]interface{})["path"] != "/" || len(m.Context["page"].(map[string]interface{})) != 1 {
+		t.Errorf("Expected only context.page.path, got %v", m.Context)
+	}
+	if len(m.Properties) != 1 || m.Properties["revenue"] != 10 {
+		t.Errorf("Expected only properties.revenue, got %v", m.Properties)
+	}
+	if m.Traits["plan"] != "pro" {
+		t.Errorf("Expected all traits kept, got %v", m.Traits)
+	}
+}
+
+func TestDestinationTransforms(t *testing.T) {
+	warehouse, forwarder := &testDestination{}, &testDestination{}
+	s := NewSegment(func(string) string { return "p" }, []Destination{warehouse, forwarder}, nil).
+		WithDestinationOptions(forwarder, DestinationOptions{Transforms: []Transform{BlockPaths("context.ip")}})
+
+	event := SegmentEvent{SegmentMessage: SegmentMessage{Type: "track", Context: map[string]interface{}{"ip": "1.2.3.4"}}}
+	if err := s.send(context.Background(), event); err != nil {
+		t.Fatal(err)
+	}
+	if warehouse.sent()[0].(SegmentEvent).Context["ip"] != "1.2.3.4" {
+		t.Error("Expected warehouse to keep context.ip")
+	}
+	if _, ok := forwarder.sent()[0].(SegmentEvent).Context["ip"]; ok {
+		t.Error("Expected forwarder context.ip removed")
+	}
+}
@@ -0,0 +1,585 @@
+package segment
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/firehose"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeFirehose serves the firehose json api, recording records put
+type fakeFirehose struct {
+	*httptest.Server
+	mu       sync.Mutex
+	records  [][]byte
+	keys     []string        // Kinesis partition keys put
+	missing  bool            // Stream doesn't exist until created
+	kinesis  bool            // Kinesis stream doesn't exist until created
+	creating int             // Describe calls returning creating status after create
+	throttle int             // Records put returning a throttled error code
+	created  json.RawMessage // Create request body
+	shards   int             // Kinesis shards splitting the hash key range evenly, zero for none listed
+	hot      string          // Kinesis shard whose records are throttled while throttle remains
+	requests [][]string      // Kinesis shards of the records in each put
+	failing  int             // Record batch puts failing with an error
+}
+
+func newFakeFirehose(t testing.TB) *fakeFirehose {
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	t.Setenv("AWS_CA_BUNDLE", "") // Custom transports can't load a bundle
+	f := &fakeFirehose{}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		switch target := r.Header.Get("X-Amz-Target"); {
+		case strings.HasSuffix(target, "DescribeStreamSummary") && f.kinesisMissing():
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"__type":"ResourceNotFoundException","message":"not found"}`))
+		case strings.HasSuffix(target, "CreateStream"):
+			f.mu.Lock()
+			f.kinesis = false
+			f.mu.Unlock()
+			w.Write([]byte(`{}`))
+		case strings.HasSuffix(target, "DescribeStreamSummary"):
+			w.Write([]byte(`{"StreamDescriptionSummary":{"StreamARN":"arn:kinesis","StreamStatus":"ACTIVE"}}`))
+		case strings.HasSuffix(target, "ListShards"):
+			f.mu.Lock()
+			shards := make([]map[string]interface{}, f.shards)
+			for i := range shards {
+				start, end := f.shardRange(i)
+				shards[i] = map[string]interface{}{
+					"ShardId":             fmt.Sprintf("shardId-%012d", i),
+					"HashKeyRange":        map[string]string{"StartingHashKey": start.String(), "EndingHashKey": end.String()},
+					"SequenceNumberRange": map[string]string{"StartingSequenceNumber": "1"},
+				}
+			}
+			f.mu.Unlock()
+			json.NewEncoder(w).Encode(map[string]interface{}{"Shards": shards})
+		case strings.HasSuffix(target, "PutRecords"):
+			var input struct {
+				StreamName string
+				Records    []struct {
+					Data         []byte
+					PartitionKey string
+				}
+			}
+			json.NewDecoder(r.Body).Decode(&input)
+			f.mu.Lock()
+			responses := make([]map[string]string, len(input.Records))
+			var shards []string
+			failed := 0
+			for i, record := range input.Records {
+				shard := f.shard(record.PartitionKey, input.StreamName)
+				shards = append(shards, shard)
+				if shard == f.hot && f.throttle > 0 {
+					f.throttle--
+					failed++
+					responses[i] = map[string]string{"ErrorCode": "ProvisionedThroughputExceededException"}
+					continue
+				}
+				f.records = append(f.records, record.Data)
+				f.keys = append(f.keys, record.PartitionKey)
+				responses[i] = map[string]string{"SequenceNumber": "1", "ShardId": shard}
+			}
+			f.requests = append(f.requests, shards)
+			f.mu.Unlock()
+			json.NewEncoder(w).Encode(map[string]interface{}{"FailedRecordCount": failed, "Records": responses})
+		case strings.HasSuffix(target, "CreateDeliveryStream"):
+			f.mu.Lock()
+			json.NewDecoder(r.Body).Decode(&f.created)
+			f.missing = false
+			f.creating = 2
+			f.mu.Unlock()
+			w.Write([]byte(`{"DeliveryStreamARN":"arn:test"}`))
+		case strings.HasSuffix(target, "DescribeDeliveryStream") && f.isMissing():
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"__type":"ResourceNotFoundException","message":"not found"}`))
+		case strings.HasSuffix(target, "DescribeDeliveryStream"):
+			f.mu.Lock()
+			status := "ACTIVE"
+			if f.creating > 0 {
+				f.creating--
+				status = "CREATING"
+			}
+			f.mu.Unlock()
+			w.Write([]byte(`{"DeliveryStreamDescription":{"DeliveryStreamARN":"arn:test","DeliveryStreamStatus":"` + status + `"}}`))
+		case strings.HasSuffix(target, "PutRecordBatch") && f.fail():
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"__type":"InvalidKMSResourceException","message":"key unavailable"}`))
+		case strings.HasSuffix(target, "PutRecordBatch"):
+			var input struct{ Records []struct{ Data []byte } }
+			json.NewDecoder(r.Body).Decode(&input)
+			f.mu.Lock()
+			responses := make([]map[string]string, len(input.Records))
+			failed := 0
+			for i, record := range input.Records {
+				if f.throttle > 0 {
+					f.throttle--
+					failed++
+					responses[i] = map[string]string{"ErrorCode": "ServiceUnavailableException"}
+					continue
+				}
+				f.records = append(f.records, record.Data)
+				responses[i] = map[string]string{"RecordId": "id"}
+			}
+			f.mu.Unlock()
+			json.NewEncoder(w).Encode(map[string]interface{}{"FailedPutCount": failed, "RequestResponses": responses})
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"__type":"InvalidArgumentException","message":"unsupported"}`))
+		}
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+// shardRange returns the hash keys of shard i splitting the 128 bit range evenly
+func (f *fakeFirehose) shardRange(i int) (*big.Int, *big.Int) {
+	size := new(big.Int).Div(new(big.Int).Lsh(big.NewInt(1), 128), big.NewInt(int64(f.shards)))
+	start := new(big.Int).Mul(size, big.NewInt(int64(i)))
+	return start, new(big.Int).Sub(new(big.Int).Add(start, size), big.NewInt(1))
+}
+
+// shard returns the id of the shard for the partition key, or the stream if there are no shards
+func (f *fakeFirehose) shard(key, stream string) string {
+	if f.shards == 0 {
+		return stream
+	}
+	sum := md5.Sum([]byte(key))
+	hash := new(big.Int).SetBytes(sum[:])
+	for i := 0; i < f.shards; i++ {
+		if _, end := f.shardRange(i); hash.Cmp(end) <= 0 {
+			return fmt.Sprintf("shardId-%012d", i)
+		}
+	}
+	return ""
+}
+
+func (f *fakeFirehose) isMissing() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.missing
+}
+
+func (f *fakeFirehose) fail() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failing > 0 {
+		f.failing--
+		return true
+	}
+	return false
+}
+
+func (f *fakeFirehose) kinesisMissing() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.kinesis
+}
+
+func (f *fakeFirehose) put() [][]byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([][]byte{}, f.records...)
+}
+
+func TestDeliveryPackRecords(t *testing.T) {
+	f := newFakeFirehose(t)
+	d := NewDelivery(&DeliveryConfig{
+		StreamEndpoint: f.URL,
+		StreamRegion:   "us-west-2",
+		StreamName:     "test",
+		PackRecords:    true,
+		Registerer:     prometheus.NewRegistry(),
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- d.Process(ctx) }()
+	for i := 0; i < 3; i++ {
+		d.Send(ctx, SegmentEvent{SegmentMessage: SegmentMessage{Event: "A"}})
+	}
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	records := f.put()
+	if len(records) != 1 || strings.Count(string(records[0]), "\n") != 3 {
+		t.Errorf("Expected 3 events packed in 1 record, got %d records", len(records))
+	}
+}
+
+func TestDeliveryDrainOnShutdown(t *testing.T) {
+	checkLeaks(t)
+	f := newFakeFirehose(t)
+	d := NewDelivery(&DeliveryConfig{
+		StreamEndpoint: f.URL,
+		StreamRegion:   "us-west-2",
+		StreamName:     "test",
+		BatchSize:      2,
+		Registerer:     prometheus.NewRegistry(),
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- d.Process(ctx) }()
+	time.Sleep(50 * time.Millisecond)
+
+	// Messages buffered when cancelled are sent
+	for i := 0; i < 3; i++ {
+		d.Send(context.Background(), SegmentEvent{SegmentMessage: SegmentMessage{Event: "A"}})
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if records := f.put(); len(records) != 3 {
+		t.Errorf("Expected 3 records drained, got %d", len(records))
+	}
+	flushes := func(reason string) float64 {
+		return testutil.ToFloat64(d.metrics.flushes.WithLabelValues("delivery-test", "test", reason))
+	}
+	if flushes(flushReasonShutdown) < 1 || flushes(flushReasonSize)+flushes(flushReasonShutdown) != 2 {
+		t.Errorf("Expected shutdown flush, got %v size %v shutdown", flushes(flushReasonSize), flushes(flushReasonShutdown))
+	}
+	if n := testutil.CollectAndCount(d.metrics.flushBytes); n != 1 {
+		t.Errorf("Expected flush bytes histogram, got %d", n)
+	}
+}
+
+func TestDeliveryOutageRecovery(t *testing.T) {
+	f := newFakeFirehose(t)
+	f.failing = 1
+	reg := prometheus.NewRegistry()
+	d := NewDelivery(&DeliveryConfig{
+		StreamEndpoint: f.URL,
+		StreamRegion:   "us-west-2",
+		StreamName:     "test",
+		BatchSize:      2,
+		FlushInterval:  20 * time.Millisecond,
+		Registerer:     reg,
+	})
+	s := NewSegment(nil, []Destination{d}, nil).
+		WithRegisterer(reg).
+		WithBackoff(BackoffConfig{Min: time.Millisecond, Max: 5 * time.Millisecond}).
+		WithDestinationOptions(d, DestinationOptions{Spool: &SpoolConfig{}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer s.WaitStopped()
+	defer cancel()
+	s.Run(ctx)
+	send := func(event string) {
+		if err := s.send(ctx, SegmentEvent{SegmentMessage: SegmentMessage{Type: "track", Event: event}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	send("A")
+	send("B")
+
+	// The failed put makes the destination unhealthy, so events are spooled until it recovers
+	for deadline := time.Now().Add(time.Second); s.Healthy() && time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if s.Healthy() {
+		t.Fatal("Expected destination unhealthy after the put error")
+	}
+	send("C")
+	send("D")
+
+	for deadline := time.Now().Add(5 * time.Second); len(f.put()) < 4 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	var events []string
+	for _, record := range f.put() {
+		var m SegmentEvent
+		json.Unmarshal(record, &m)
+		events = append(events, m.Event)
+	}
+	if strings.Join(events, "") != "ABCD" {
+		t.Errorf("Expected every event delivered in order, got %v", events)
+	}
+	if n := testutil.ToFloat64(d.metrics.dropped.WithLabelValues(DropDeliveryFailed, "delivery-test")); n != 0 {
+		t.Errorf("Expected no events dropped, got %v", n)
+	}
+}
+
+func TestDeliveryFlushCadence(t *testing.T) {
+	f := newFakeFirehose(t)
+	clock := newTestClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	d := NewDelivery(&DeliveryConfig{
+		StreamEndpoint: f.URL,
+		StreamRegion:   "us-west-2",
+		StreamName:     "test",
+		FlushInterval:  time.Minute,
+		Clock:          clock,
+		Registerer:     prometheus.NewRegistry(),
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- d.Process(ctx) }()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// Steady events don't reset the timer, which starts with the first event of the batch
+	for i := 0; i < 3; i++ {
+		d.Send(ctx, SegmentEvent{SegmentMessage: SegmentMessage{Event: "A"}})
+		clock.waitTimers(t, 1)
+		clock.Advance(20 * time.Second)
+	}
+	deadline := time.Now().Add(time.Second)
+	for len(f.put()) < 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if records := f.put(); len(records) != 3 {
+		t.Errorf("Expected 3 records flushed a minute after the first, got %d", len(records))
+	}
+	if n := testutil.ToFloat64(d.metrics.flushes.WithLabelValues("delivery-test", "test", flushReasonInterval)); n != 1 {
+		t.Errorf("Expected interval flush, got %v", n)
+	}
+}
+
+func TestDeliveryCreateStream(t *testing.T) {
+	f := newFakeFirehose(t)
+	f.missing = true
+	d := NewDelivery(&DeliveryConfig{
+		StreamEndpoint: f.URL,
+		StreamRegion:   "us-west-2",
+		StreamName:     "test",
+		Tags:           map[string]string{"team": "data"},
+		KMSKeyARN:      "arn:kms",
+		Registerer:     prometheus.NewRegistry(),
+	})
+	d.pollInterval = time.Millisecond
+	if err := d.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if f.creating != 0 {
+		t.Errorf("Expected status polled until active, got %d creating", f.creating)
+	}
+
+	var created struct {
+		Tags                                       []struct{ Key, Value string }
+		DeliveryStreamEncryptionConfigurationInput struct{ KeyType, KeyARN string }
+	}
+	json.Unmarshal(f.created, &created)
+	if len(created.Tags) != 1 || created.Tags[0].Key != "team" ||
+		created.DeliveryStreamEncryptionConfigurationInput.KeyARN != "arn:kms" {
+		t.Errorf("Expected stream created with tags and kms key, got %s", f.created)
+	}
+}
+
+func TestDeliveryConnectCancel(t *testing.T) {
+	f := newFakeFirehose(t)
+	f.creating = 1000
+	d := NewDelivery(&DeliveryConfig{
+		StreamEndpoint: f.URL,
+		StreamRegion:   "us-west-2",
+		StreamName:     "test",
+		Registerer:     prometheus.NewRegistry(),
+	})
+	d.pollInterval = 10 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := d.ConnectContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected connect cancelled while creating, got %v", err)
+	}
+}
+
+func TestDeliveryHTTPClient(t *testing.T) {
+	f := newFakeFirehose(t)
+	var requests int
+	retries := 0
+	d := NewDelivery(&DeliveryConfig{
+		StreamEndpoint: f.URL,
+		StreamRegion:   "us-west-2",
+		StreamName:     "test",
+		HTTPClient: &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			requests++
+			return http.DefaultTransport.RoundTrip(r)
+		})},
+		MaxRetries: &retries,
+		Registerer: prometheus.NewRegistry(),
+	})
+	if err := d.Connect(); err != nil || requests != 1 {
+		t.Errorf("Expected connect through custom transport, got %d requests %v", requests, err)
+	}
+}
+
+type roundTripFunc func(r *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestDeliveryThrottlePacing(t *testing.T) {
+	f := newFakeFirehose(t)
+	f.throttle = 3
+	d := NewDelivery(&DeliveryConfig{
+		StreamEndpoint: f.URL,
+		StreamRegion:   "us-west-2",
+		StreamName:     "test",
+		Registerer:     prometheus.NewRegistry(),
+	})
+	d.pacer = newPacer(time.Millisecond, 10*time.Millisecond, nil)
+
+	records := []*firehose.Record{{Data: []byte("1\n")}, {Data: []byte("2\n")}}
+	if err := d.putBatch(context.Background(), records, []int{1, 1}, nil, 2); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.put()) != 2 {
+		t.Errorf("Expected throttled records retried, got %d", len(f.put()))
+	}
+	if n := testutil.ToFloat64(d.metrics.errors.WithLabelValues("delivery-test", "test", "ServiceUnavailableException")); n != 3 {
+		t.Errorf("Expected 3 throttled errors counted, got %v", n)
+	}
+	if d.pacer.delay != time.Millisecond {
+		t.Errorf("Expected pacing halved after success, got %s", d.pacer.delay) // Doubled to 2ms by two throttled puts
+	}
+}
+
+func TestPacer(t *testing.T) {
+	p := newPacer(time.Second, 4*time.Second, nil)
+	for _, expected := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second} {
+		if p.throttled(); p.delay != expected {
+			t.Errorf("Expected delay %s, got %s", expected, p.delay)
+		}
+	}
+	for _, expected := range []time.Duration{2 * time.Second, time.Second, 0} {
+		if p.ok(); p.delay != expected {
+			t.Errorf("Expected delay %s, got %s", expected, p.delay)
+		}
+	}
+}
+
+func TestDeliveryKinesisSource(t *testing.T) {
+	f := newFakeFirehose(t)
+	d := NewDelivery(&DeliveryConfig{
+		StreamEndpoint:      f.URL,
+		StreamRegion:        "us-west-2",
+		StreamName:          "test",
+		KinesisSourceStream: "source",
+		Registerer:          prometheus.NewRegistry(),
+	})
+	if err := d.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	records := []*firehose.Record{{Data: []byte("1\n")}}
+	if err := d.putBatch(context.Background(), records, []int{1}, nil, 1); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.put()) != 1 {
+		t.Errorf("Expected record put to kinesis, got %d", len(f.put()))
+	}
+}
+
+func TestDeliveryPartitionedBatches(t *testing.T) {
+	f := newFakeFirehose(t)
+	f.shards = 2
+	f.hot = "shardId-000000000001"
+	f.throttle = 1
+	reg := prometheus.NewRegistry()
+	d := NewDelivery(&DeliveryConfig{
+		StreamEndpoint:      f.URL,
+		StreamRegion:        "us-west-2",
+		StreamName:          "test",
+		KinesisSourceStream: "source",
+		PartitionKey:        "userId",
+		Registerer:          reg,
+	})
+	if err := d.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	var records []*firehose.Record
+	var keys []string
+	for i := 0; i < 20; i++ {
+		records = append(records, &firehose.Record{Data: []byte(fmt.Sprintf("%d\n", i))})
+		keys = append(keys, fmt.Sprintf("user%d", i))
+	}
+	counts := make([]int, len(records))
+	for i := range counts {
+		counts[i] = 1
+	}
+	if err := d.putPartitioned(context.Background(), records, counts, keys); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each put is for a single shard, and only the throttled record of the hot shard is sent again
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, shards := range f.requests {
+		for _, shard := range shards {
+			if shard != shards[0] {
+				t.Errorf("Expected records for one shard per put, got %v", shards)
+			}
+		}
+	}
+	if len(f.records) != 20 || len(f.requests) != 3 {
+		t.Errorf("Expected 20 records in 3 puts, got %d in %d", len(f.records), len(f.requests))
+	}
+	cold := 0
+	for _, key := range keys {
+		if f.shard(key, "") != f.hot {
+			cold++
+		}
+	}
+	partitions := d.metrics.partitions
+	if got := testutil.ToFloat64(partitions.WithLabelValues("delivery-test", "shardId-000000000000", partitionSuccess)); got != float64(cold) {
+		t.Errorf("Expected %d records for the cold shard, got %v", cold, got)
+	}
+	if got := testutil.ToFloat64(partitions.WithLabelValues("delivery-test", f.hot, partitionThrottled)); got != 1 {
+		t.Errorf("Expected 1 throttled record for the hot shard, got %v", got)
+	}
+}
+
+func TestDeliveryRedshiftStreaming(t *testing.T) {
+	f := newFakeFirehose(t)
+	f.kinesis = true
+	d := NewDelivery(&DeliveryConfig{
+		StreamEndpoint:      f.URL,
+		StreamRegion:        "us-west-2",
+		KinesisSourceStream: "events",
+		PartitionKey:        "userId",
+		RedshiftStreaming:   true,
+		Registerer:          prometheus.NewRegistry(),
+	})
+	d.pollInterval = time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- d.Process(ctx) }()
+	d.Send(ctx, SegmentEvent{SegmentMessage: SegmentMessage{Event: "A", UserId: "u1"}})
+	d.Send(ctx, SegmentEvent{SegmentMessage: SegmentMessage{Event: "B", Properties: map[string]interface{}{"large": strings.Repeat("x", redshiftMaxRecord)}}})
+	d.Send(ctx, SegmentEvent{SegmentMessage: SegmentMessage{Event: "C"}})
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// Kinesis stream is created, and oversized events are dropped
+	records := f.put()
+	if len(records) != 2 || strings.HasSuffix(string(records[0]), "\n") || !json.Valid(records[0]) {
+		t.Fatalf("Expected 2 single json records, got %q", records)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.keys[0] != "u1" || len(f.keys[1]) != 36 {
+		t.Errorf("Expected user partition key, then random, got %v", f.keys)
+	}
+}
@@ -0,0 +1,82 @@
+package segment
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+// FlattenConfig declares the maps flattened into keys joined by a separator, for destinations that don't support
+// nested fields eg Redshift Spectrum
+type FlattenConfig struct {
+	Roots     []string `json:"roots,omitempty"`     // Any of context, properties or traits, defaults to properties and traits
+	Separator string   `json:"separator,omitempty"` // Joins nested keys, defaults to "."
+	Depth     int      `json:"depth,omitempty"`     // Levels of nesting flattened, deeper maps are kept as values, zero for all
+}
+
+// Flatten returns a transform that flattens nested maps within the roots by the config, arrays are kept as values
+func Flatten(config FlattenConfig) (Transform, error) {
+	if len(config.Roots) == 0 {
+		config.Roots = []string{"properties", "traits"}
+	}
+	for _, root := range config.Roots {
+		if _, ok := eventMaps(&SegmentEvent{})[root]; !ok {
+			return nil, fmt.Errorf("Flatten root %q must be context, properties or traits", root)
+		}
+	}
+	if config.Separator == "" {
+		config.Separator = "."
+	}
+	if config.Depth < 0 {
+		return nil, fmt.Errorf("Flatten depth %d is negative", config.Depth)
+	}
+	levels := config.Depth
+	if levels == 0 {
+		levels = -1
+	}
+
+	return func(ctx context.Context, m *SegmentEvent) error {
+		maps := eventMaps(m)
+		for _, root := range config.Roots {
+			if *maps[root] == nil {
+				continue
+			}
+			flat := make(map[string]interface{}, len(*maps[root]))
+			flattenMap(flat, "", config.Separator, levels, *maps[root])
+			*maps[root] = flat
+		}
+		return nil
+	}, nil
+}
+
+// flattenMap adds nested values of m to out with keys joined by sep under prefix, flattening levels of nesting or all
+// if negative.  Keys are added in order with values before nested maps, and a key that collides with one already
+// added is skipped, so eg {"a.b":1,"a":{"b":2}} always flattens to {"a.b":1}.
+func flattenMap(out map[string]interface{}, prefix, sep string, levels int, m map[string]interface{}) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var nested []string
+	for _, k := range keys {
+		if _, ok := m[k].(map[string]interface{}); ok && levels != 0 {
+			nested = append(nested, k)
+			continue
+		}
+		key := k
+		if prefix != "" {
+			key = prefix + sep + k
+		}
+		if _, ok := out[key]; !ok {
+			out[key] = m[k]
+		}
+	}
+	for _, k := range nested {
+		key := k
+		if prefix != "" {
+			key = prefix + sep + k
+		}
+		flattenMap(out, key, sep, levels-1, m[k].(map[string]interface{}))
+	}
+}
@@ -0,0 +1,59 @@
+package segment
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestFlatten(t *testing.T) {
+	nested := func() map[string]interface{} {
+		return map[string]interface{}{
+			"total": 9.99,
+			"order": map[string]interface{}{"id": "o1", "shipping": map[string]interface{}{"city": "Sydney"}},
+			"items": []interface{}{map[string]interface{}{"sku": "42"}},
+		}
+	}
+
+	for _, c := range []struct {
+		config   FlattenConfig
+		expected map[string]interface{}
+	}{
+		{FlattenConfig{}, map[string]interface{}{
+			"total": 9.99, "order.id": "o1", "order.shipping.city": "Sydney", "items": []interface{}{map[string]interface{}{"sku": "42"}},
+		}},
+		{FlattenConfig{Separator: "_", Depth: 1}, map[string]interface{}{
+			"total": 9.99, "order_id": "o1", "order_shipping": map[string]interface{}{"city": "Sydney"}, "items": []interface{}{map[string]interface{}{"sku": "42"}},
+		}},
+	} {
+		flatten, err := Flatten(c.config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		shared := nested()
+		m := &SegmentEvent{SegmentMessage: SegmentMessage{Type: "track", Properties: shared, Context: nested()}}
+		flatten(context.Background(), m)
+		if !reflect.DeepEqual(m.Properties, c.expected) {
+			t.Errorf("Expected %+v flattened %v, got %v", c.config, c.expected, m.Properties)
+		}
+		if !reflect.DeepEqual(shared, nested()) || !reflect.DeepEqual(m.Context, nested()) {
+			t.Errorf("Expected shared properties and context unchanged, got %v %v", shared, m.Context)
+		}
+	}
+
+	// Colliding keys keep the value added first, whatever the map order
+	flatten, _ := Flatten(FlattenConfig{})
+	for i := 0; i < 20; i++ {
+		m := &SegmentEvent{SegmentMessage: SegmentMessage{Type: "track", Properties: map[string]interface{}{
+			"a.b": 1.0, "a": map[string]interface{}{"b": 2.0, "c": 3.0}, "x": map[string]interface{}{"y.z": 4.0}, "x.y": map[string]interface{}{"z": 5.0},
+		}}}
+		flatten(context.Background(), m)
+		if expected := map[string]interface{}{"a.b": 1.0, "a.c": 3.0, "x.y.z": 4.0}; !reflect.DeepEqual(m.Properties, expected) {
+			t.Fatalf("Expected collisions resolved to %v, got %v", expected, m.Properties)
+		}
+	}
+
+	if _, err := Flatten(FlattenConfig{Depth: -1}); err == nil {
+		t.Error("Expected negative depth error")
+	}
+}
@@ -4,64 +4,331 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
+	"text/template"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
-var (
-	// Create a summary to track delivery stream latency
-	forwarderSuccessCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: "forwarder_success_total",
-		Help: "Forwarder success total",
-	}, []string{"endpoint"})
-	forwarderSkipCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: "forwarder_skipped_total",
-		Help: "Forwarder skipped total",
-	}, []string{"endpoint"})
-	forwarderFailureCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: "forwarder_failure_total",
-		Help: "Forwarder failure total",
-	}, []string{"endpoint"})
-	forwarderLatency = prometheus.NewSummaryVec(prometheus.SummaryOpts{
-		Name:       "forwarder_latency_seconds",
-		Help:       "Forwader latency distributions",
-		Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
-	}, []string{"endpoint"})
-)
+// forwarderMetrics track forwarder success, skipped, failures and latency
+type forwarderMetrics struct {
+	success *prometheus.CounterVec
+	skip    *prometheus.CounterVec
+	failure *prometheus.CounterVec
+	latency *prometheus.HistogramVec
+	dropped *prometheus.CounterVec
+	healthy *prometheus.GaugeVec
+}
+
+func newForwarderMetrics(reg prometheus.Registerer) *forwarderMetrics {
+	return &forwarderMetrics{
+		success: newCounterVec(reg, prometheus.CounterOpts{
+			Name: "forwarder_success_total",
+			Help: "Forwarder success total",
+		}, "destination", "endpoint"),
+		skip: newCounterVec(reg, prometheus.CounterOpts{
+			Name: "forwarder_skipped_total",
+			Help: "Forwarder skipped total",
+		}, "destination", "endpoint"),
+		failure: newCounterVec(reg, prometheus.CounterOpts{
+			Name: "forwarder_failure_total",
+			Help: "Forwarder failure total",
+		}, "destination", "endpoint"),
+		latency: newHistogramVec(reg, prometheus.HistogramOpts{
+			Name:    "forwarder_latency_seconds",
+			Help:    "Forwader latency distributions",
+			Buckets: latencyBuckets,
+		}, "destination", "endpoint"),
+		dropped: newDroppedCounter(reg),
+		healthy: newGaugeVec(reg, prometheus.GaugeOpts{
+			Name: "forwarder_endpoint_healthy",
+			Help: "Forwarder endpoint healthy, or zero while failed over",
+		}, "destination", "endpoint"),
+	}
+}
+
+// ForwarderConfig contains configuration parameters for the forwarder
+type ForwarderConfig struct {
+	// Name is the destination label of all metrics, defaults to "forwarder"
+	Name string `json:"name,omitempty"`
+	// Endpoint url, optionally a template over the event for per event routes eg "https://host/hooks/{{.Type}}",
+	// with the json, base64, env and pathescape functions
+	Endpoint string `json:"endpoint"`
+	// HTTP client tuning for the downstream connection limits, zero values use the http.DefaultTransport values
+	MaxIdleConnsPerHost   int           `json:"maxIdleConnsPerHost,omitempty"`
+	IdleConnTimeout       time.Duration `json:"idleConnTimeout,omitempty"` // Idle keep-alive connections are closed after
+	TLSHandshakeTimeout   time.Duration `json:"tlsHandshakeTimeout,omitempty"`
+	ResponseHeaderTimeout time.Duration `json:"responseHeaderTimeout,omitempty"`
+	// DNSRefreshInterval caches the endpoint addresses, re-resolving once the record ttl expires or at most this
+	// interval and closing idle connections if they change, so failover of the downstream dns is picked up without
+	// a restart.  Zero resolves on each new connection.
+	DNSRefreshInterval time.Duration `json:"dnsRefreshInterval,omitempty"`
+	// SigV4 signs requests with AWS credentials eg for an API Gateway or Lambda function url protected by IAM,
+	// sending the writeKey in the body as the Authorization header is used for the signature, optional
+	SigV4 *SigV4Config `json:"sigv4,omitempty"`
+	// OAuth2 sends a bearer token fetched with the client credentials grant, refreshed before it expires, and
+	// sending the writeKey in the body, optional
+	OAuth2 *OAuth2Config `json:"oauth2,omitempty"`
+	// Failover forwards to secondary endpoints while the primary is unavailable, failing back once healthy, optional
+	Failover *FailoverConfig `json:"failover,omitempty"`
+	// BatchSize forwards up to this many events per request, grouped by writeKey, endpoint and context, defaults to 1
+	BatchSize     int           `json:"batchSize,omitempty"`
+	FlushInterval time.Duration `json:"flushInterval,omitempty"` // Flush a partial batch after, defaults to 1 second
+	// MaxBodySize splits requests in half until under the downstream limit, defaults to 500KB as for segment
+	MaxBodySize int `json:"maxBodySize,omitempty"`
+	// Responses stores the status, latency and error body snippet of each request by messageId for auditing, optional
+	Responses ResponseStore `json:"-"`
+	// Registerer for metrics, defaults to the prometheus default registerer
+	Registerer prometheus.Registerer `json:"-"`
+	// Tracer starts a span for each request, with the trace id as an exemplar of the latency metric, optional
+	Tracer Tracer `json:"-"`
+	// Clock for flush intervals, defaults to the system clock
+	Clock Clock `json:"-"`
+}
 
-func init() {
-	// Init prometheus metrics
-	prometheus.MustRegister(forwarderSuccessCounter)
-	prometheus.MustRegister(forwarderSkipCounter)
-	prometheus.MustRegister(forwarderFailureCounter)
-	prometheus.MustRegister(forwarderLatency)
+// SigV4Config contains the region and service to sign forwarder requests for
+type SigV4Config struct {
+	Region  string `json:"region"`
+	Service string `json:"service,omitempty"` // Defaults to "execute-api", or "lambda" for function urls
 }
 
+// Default forwarder batching and segment's max request body size
+const (
+	defaultForwarderFlushInterval = time.Second
+	defaultForwarderMaxBodySize   = 500 * 1024
+)
+
 // Forwarder type
 type Forwarder struct {
-	Logger   *log.Logger // Public logger that caller can override
-	endpoint string
-	messages chan interface{}
+	Logger        *log.Logger // Public logger that caller can override
+	name          string      // Destination name for metrics
+	named         bool
+	endpoint      string
+	pool          *endpointPool
+	failover      *FailoverConfig
+	client        *http.Client
+	dns           *dnsCache
+	signer        *v4.Signer
+	sigv4         SigV4Config
+	oauth         *oauthToken
+	responses     ResponseStore
+	batchSize     int
+	flushInterval time.Duration
+	maxBodySize   int
+	messages      chan interface{}
+	metrics       *forwarderMetrics
+	tracer        Tracer
+	clock         Clock
 }
 
 // NewForwarder creates a new forwarder given endpoint
 func NewForwarder(endpoint string) *Forwarder {
-	if !strings.HasPrefix(endpoint, "http") {
-		log.Fatalf("Expect http(s) endpoint: %q", endpoint)
+	return NewForwarderWithConfig(&ForwarderConfig{Endpoint: endpoint})
+}
+
+// NewForwarderWithConfig creates a new forwarder given configuration
+func NewForwarderWithConfig(config *ForwarderConfig) *Forwarder {
+	if err := config.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	tr := config.transport()
+	metrics := newForwarderMetrics(config.Registerer)
+	endpoints := []string{config.Endpoint}
+	var healthCheckPath string
+	if config.Failover != nil {
+		endpoints = append(endpoints, config.Failover.Endpoints...)
+		healthCheckPath = config.Failover.HealthCheckPath
+	}
+	name := "forwarder"
+	if config.Name != "" {
+		name = config.Name
+	}
+	f := &Forwarder{
+		Logger:        log.New(os.Stderr, "", log.LstdFlags),
+		name:          name,
+		named:         config.Name != "",
+		endpoint:      config.Endpoint,
+		pool:          newEndpointPool(endpoints, healthCheckPath, metrics.healthy.MustCurryWith(prometheus.Labels{"destination": name})),
+		failover:      config.Failover,
+		responses:     config.Responses,
+		client:        &http.Client{Transport: tr},
+		batchSize:     max(config.BatchSize, 1),
+		flushInterval: config.FlushInterval,
+		maxBodySize:   config.MaxBodySize,
+		messages:      make(chan interface{}),
+		metrics:       metrics,
+		tracer:        config.Tracer,
+		clock:         clockOrSystem(config.Clock),
+	}
+	if f.flushInterval <= 0 {
+		f.flushInterval = defaultForwarderFlushInterval
+	}
+	if f.maxBodySize <= 0 {
+		f.maxBodySize = defaultForwarderMaxBodySize
+	}
+	if config.SigV4 != nil {
+		f.sigv4 = *config.SigV4
+		if f.sigv4.Service == "" {
+			f.sigv4.Service = "execute-api"
+		}
+		sess := session.Must(session.NewSession(aws.NewConfig().WithRegion(f.sigv4.Region)))
+		f.signer = v4.NewSigner(sess.Config.Credentials)
+	}
+	if config.OAuth2 != nil {
+		f.oauth = newOAuthToken(*config.OAuth2, f.client)
+	}
+	if config.DNSRefreshInterval > 0 {
+		f.dns = newDNSCache(config.DNSRefreshInterval)
+		f.dns.changed = tr.CloseIdleConnections
+		tr.DialContext = f.dns.dialContext(&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second})
+	}
+	return f
+}
+
+// endpointTemplate parses the endpoint as a template over the event if it contains an action, otherwise nil.  Actions
+// must follow the host, so events can't route requests to another host.
+func endpointTemplate(endpoint string) (*template.Template, error) {
+	if !strings.Contains(endpoint, "{{") {
+		return nil, nil
+	}
+	if _, rest, _ := strings.Cut(endpointPrefix(endpoint), "://"); !strings.Contains(rest, "/") {
+		return nil, fmt.Errorf("Endpoint template actions must follow the host of %s", endpoint)
+	}
+	tmpl, err := template.New("endpoint").Funcs(templateFuncs).Option("missingkey=zero").Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("Endpoint template error -- %v", err)
+	}
+	return tmpl, nil
+}
+
+// endpointPrefix returns the static text of an endpoint template before the first action
+func endpointPrefix(endpoint string) string {
+	prefix, _, _ := strings.Cut(endpoint, "{{")
+	return prefix
+}
+
+// checkRoute checks an endpoint rendered for an event starts with the static prefix of the template, and doesn't
+// traverse out of the prefix path with dot segments eg from an unescaped event name
+func checkRoute(prefix, endpoint string) error {
+	if !strings.HasPrefix(endpoint, prefix) {
+		return fmt.Errorf("Endpoint %s outside of %s", endpoint, prefix)
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return err
 	}
-	return &Forwarder{
-		Logger:   log.New(os.Stderr, "", log.LstdFlags),
-		endpoint: endpoint,
-		messages: make(chan interface{}),
+	for _, segment := range strings.Split(u.Path, "/") {
+		if segment == "." || segment == ".." {
+			return fmt.Errorf("Endpoint %s outside of %s", endpoint, prefix)
+		}
 	}
+	return nil
+}
+
+// baseEndpoint returns the endpoint, or the template executed over an empty event eg to validate the host
+func baseEndpoint(endpoint string) (string, error) {
+	tmpl, err := endpointTemplate(endpoint)
+	if tmpl == nil || err != nil {
+		return endpoint, err
+	}
+	return executeTemplate(tmpl, SegmentEvent{})
+}
+
+// transport returns a keep-alive transport with the configured connection limits and timeouts
+func (config *ForwarderConfig) transport() *http.Transport {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	if config.MaxIdleConnsPerHost > 0 {
+		tr.MaxIdleConnsPerHost = config.MaxIdleConnsPerHost
+	}
+	if config.IdleConnTimeout > 0 {
+		tr.IdleConnTimeout = config.IdleConnTimeout
+	}
+	if config.TLSHandshakeTimeout > 0 {
+		tr.TLSHandshakeTimeout = config.TLSHandshakeTimeout
+	}
+	if config.ResponseHeaderTimeout > 0 {
+		tr.ResponseHeaderTimeout = config.ResponseHeaderTimeout
+	}
+	return tr
+}
+
+// Validate checks the endpoint is an http(s) url, and the SigV4 region is set
+func (config *ForwarderConfig) Validate() error {
+	if config.SigV4 != nil && config.SigV4.Region == "" {
+		return fmt.Errorf("Require SigV4 region")
+	}
+	if config.OAuth2 != nil {
+		if config.SigV4 != nil {
+			return fmt.Errorf("Require either SigV4 or OAuth2")
+		}
+		if err := config.OAuth2.Validate(); err != nil {
+			return err
+		}
+	}
+	if config.Failover != nil {
+		if err := config.Failover.Validate(); err != nil {
+			return err
+		}
+	}
+	endpoint, err := baseEndpoint(config.Endpoint)
+	if err != nil {
+		return err
+	}
+	return validateEndpoint(endpoint)
+}
+
+// Check checks the endpoint is reachable, and resolves AWS credentials for SigV4 or fetches an OAuth2 token
+func (config *ForwarderConfig) Check(ctx context.Context) error {
+	if config.SigV4 != nil {
+		sess, err := session.NewSession(aws.NewConfig().WithRegion(config.SigV4.Region))
+		if err != nil {
+			return fmt.Errorf("AWS session error -- %v", err)
+		}
+		if err := checkCredentials(ctx, sess); err != nil {
+			return err
+		}
+	}
+	if config.OAuth2 != nil {
+		if _, err := newOAuthToken(*config.OAuth2, http.DefaultClient).get(ctx); err != nil {
+			return err
+		}
+	}
+	endpoints := []string{config.Endpoint}
+	if config.Failover != nil {
+		endpoints = append(endpoints, config.Failover.Endpoints...)
+	}
+	for _, endpoint := range endpoints {
+		base, err := baseEndpoint(endpoint)
+		if err != nil {
+			return err
+		}
+		if err := checkEndpoint(ctx, base); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Name returns the configured destination name
+func (f *Forwarder) Name() string {
+	if f.named {
+		return f.name
+	}
+	return ""
 }
 
 // WithLogger initializes with logger
@@ -72,93 +339,233 @@ func (f *Forwarder) WithLogger(logger *log.Logger) Destination {
 	return f
 }
 
-// Process forwards messages
+// Process forwards messages in batches, flushing once full or after the flush interval
 func (f *Forwarder) Process(ctx context.Context) error {
 	log.Println("Started forwarder processing")
+	if f.failover != nil {
+		interval := f.failover.HealthCheckInterval
+		if interval <= 0 {
+			interval = defaultHealthCheckInterval
+		}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			f.pool.healthCheck(ctx, f.client, interval, f.Logger)
+		}()
+		defer func() { <-done }() // Return once the health check has stopped, so reloads don't leak it
+	}
 
+	var batch []SegmentEvent
+	var flushAt <-chan time.Time
 	for {
 		select {
 		case message := <-f.messages:
-			t0 := time.Now()
-			if err := f.send(ctx, message); err != nil {
-				forwarderFailureCounter.WithLabelValues(f.endpoint).Add(float64(1))
-				f.Logger.Println(err)
-			} else {
-				duration := time.Since(t0)
-				forwarderSuccessCounter.WithLabelValues(f.endpoint).Add(float64(1))
-				forwarderLatency.WithLabelValues(f.endpoint).Observe(duration.Seconds())
-				f.Logger.Printf("Forwarded in %s\n", duration)
+			m, ok := message.(SegmentEvent)
+			if !ok {
+				f.metrics.failure.WithLabelValues(f.name, f.endpoint).Add(float64(1))
+				f.metrics.dropped.WithLabelValues(DropForwardFailed, f.name).Inc()
+				f.Logger.Println("Expected Segment Event")
+				continue
+			}
+			batch = append(batch, m)
+			if len(batch) < f.batchSize {
+				if flushAt == nil {
+					flushAt = f.clock.After(f.flushInterval)
+				}
+				continue
 			}
+		case <-flushAt:
 		case <-ctx.Done():
 			f.Logger.Println("Ending forwarder processing")
+			if len(batch) > 0 {
+				flushCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), finalFlushTimeout)
+				f.forward(flushCtx, batch)
+				cancel()
+			}
+			f.client.CloseIdleConnections()
 			return nil
 		}
+		f.forward(ctx, batch)
+		batch, flushAt = nil, nil
+	}
+}
+
+// forward sends a request for each group of events with the same writeKey, endpoint and context
+func (f *Forwarder) forward(ctx context.Context, batch []SegmentEvent) {
+	for _, events := range f.group(batch) {
+		t0 := time.Now()
+		sendCtx, traceId, end := startSpan(f.tracer, ctx, "forward")
+		err := f.send(sendCtx, events...)
+		end(err)
+		if err != nil {
+			f.metrics.failure.WithLabelValues(f.name, f.endpoint).Add(float64(len(events)))
+			f.metrics.dropped.WithLabelValues(DropForwardFailed, f.name).Add(float64(len(events)))
+			f.Logger.Println(err)
+		} else {
+			duration := time.Since(t0)
+			f.metrics.success.WithLabelValues(f.name, f.endpoint).Add(float64(len(events)))
+			observeLatency(f.metrics.latency.WithLabelValues(f.name, f.endpoint), duration, traceId)
+			f.Logger.Printf("Forwarded %d in %s\n", len(events), duration)
+		}
 	}
 }
 
+// group splits the batch into events sharing a request, in order of arrival
+func (f *Forwarder) group(batch []SegmentEvent) [][]SegmentEvent {
+	if len(batch) == 1 {
+		return [][]SegmentEvent{batch}
+	}
+	var groups [][]SegmentEvent
+	index := make(map[string]int)
+	for _, m := range batch {
+		key, _ := json.Marshal(m.Context)
+		if primary := f.pool.primary(); primary.url != nil {
+			endpoint, _ := primary.render(m)
+			key = append(key, endpoint...)
+		}
+		k := m.WriteKey + "\x00" + string(key)
+		i, ok := index[k]
+		if !ok {
+			i = len(groups)
+			index[k] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], m)
+	}
+	return groups
+}
+
 // Send pushes messages onto queue
 func (f *Forwarder) Send(ctx context.Context, message interface{}) error {
 	select {
 	case f.messages <- message:
 	default:
-		forwarderSkipCounter.WithLabelValues(f.endpoint).Add(float64(1))
+		f.metrics.skip.WithLabelValues(f.name, f.endpoint).Add(float64(1))
+		f.metrics.dropped.WithLabelValues(DropForwarderSkip, f.name).Inc()
 	}
 	return nil
 }
 
-func (f *Forwarder) send(ctx context.Context, message interface{}) error {
-	m, ok := message.(SegmentEvent)
-	if !ok {
-		return fmt.Errorf("Expected Segment Event")
-	}
+// send posts the events in a single request, splitting in half while over the max body size
+func (f *Forwarder) send(ctx context.Context, events ...SegmentEvent) error {
+	m := events[0]
 	batch := SegmentBatch{
 		MessageId: m.MessageId,
 		Timestamp: m.Timestamp,
 		SentAt:    m.SentAt,
 		Context:   m.Context,
-		Messages:  []SegmentMessage{m.SegmentMessage},
+		Messages:  make([]SegmentMessage, len(events)),
+	}
+	for i, event := range events {
+		batch.Messages[i] = event.SegmentMessage
+	}
+	if f.signer != nil || f.oauth != nil {
+		batch.WriteKey = m.WriteKey
 	}
 	b, err := json.Marshal(batch)
 	if err != nil {
 		return err
 	}
+	if len(b) > f.maxBodySize {
+		if len(events) == 1 {
+			return fmt.Errorf("Forward error event of %d bytes exceeds max body size %d", len(b), f.maxBodySize)
+		}
+		n := len(events) / 2
+		return errors.Join(f.send(ctx, events[:n]...), f.send(ctx, events[n:]...))
+	}
+
+	return f.post(ctx, events, b)
+}
+
+// post sends the body to the first healthy endpoint, failing over to the next if the endpoint is unavailable
+func (f *Forwarder) post(ctx context.Context, events []SegmentEvent, b []byte) error {
+	var err error
+	for _, e := range f.pool.candidates() {
+		var unavailable bool
+		if unavailable, err = f.request(ctx, e, events, b); !unavailable || ctx.Err() != nil {
+			return err
+		}
+		if f.pool.setHealthy(e, false) {
+			f.Logger.Printf("Forwarder endpoint %s unhealthy, failing over -- %v\n", e.endpoint, err)
+		}
+	}
+	return err
+}
 
-	// Create the request for the specific type
-	req, err := http.NewRequest("POST", f.endpoint, bytes.NewReader(b))
+// request sends the body to the endpoint, returning unavailable for connection errors or server errors
+func (f *Forwarder) request(ctx context.Context, e *forwarderEndpoint, events []SegmentEvent, b []byte) (unavailable bool, err error) {
+	m := events[0]
+
+	// Create the request for the specific type, at the route for the event if templated
+	endpoint, err := e.render(m)
+	if err != nil {
+		return false, fmt.Errorf("Forward error executing endpoint template -- %v", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(b))
 	if err != nil {
-		return fmt.Errorf("error creating request: %s", err)
+		return false, fmt.Errorf("error creating request: %s", err)
 	}
+
+	// Re-resolve the endpoint once the ttl or refresh interval expires, as keep-alive connections don't dial
+	if host := req.URL.Hostname(); f.dns != nil && net.ParseIP(host) == nil {
+		if _, err := f.dns.lookup(ctx, host); err != nil {
+			return true, fmt.Errorf("Forward error resolving %s -- %v", host, err)
+		}
+	}
+
 	req.Header.Add("User-Agent", "brightsparc/segment (version: 1.0)")
 	req.Header.Add("Content-Type", "application/json")
 	req.Header.Add("Content-Length", strconv.Itoa(len(b)))
-	req.SetBasicAuth(m.WriteKey, "")
+	switch {
+	case f.signer != nil:
+		if _, err := f.signer.Sign(req, bytes.NewReader(b), f.sigv4.Service, f.sigv4.Region, time.Now()); err != nil {
+			return false, fmt.Errorf("Forward error signing request -- %v", err)
+		}
+	case f.oauth != nil:
+		token, err := f.oauth.get(ctx)
+		if err != nil {
+			return false, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	default:
+		req.SetBasicAuth(m.WriteKey, "")
+	}
 
-	// Send request
-	return httpDo(ctx, req, func(res *http.Response, err error) error {
+	// Send request, capturing the response status, latency and error body
+	var status int
+	var body []byte
+	t0 := time.Now()
+	err = httpDo(ctx, f.client, req, func(res *http.Response, err error) error {
 		if err != nil {
+			unavailable = true
 			return fmt.Errorf("Forward error sending request %q -- %v", req.URL.RequestURI(), err)
 		}
 		defer res.Body.Close()
+		status = res.StatusCode
 		if res.StatusCode < 400 {
+			io.Copy(io.Discard, res.Body) // Read to the end so the connection is reused
 			return nil
 		}
-		body, err := ioutil.ReadAll(res.Body)
-		if err != nil {
+		if res.StatusCode == http.StatusUnauthorized && f.oauth != nil {
+			f.oauth.invalidate() // Revoked before expiry, so fetch a new token for the next request
+		}
+		unavailable = res.StatusCode >= 500
+		if body, err = ioutil.ReadAll(res.Body); err != nil {
 			return fmt.Errorf("Forward error reading response body: %s", err)
 		}
 		return fmt.Errorf("response %s: %d – %s", res.Status, res.StatusCode, string(body))
 	})
+	f.captureResponse(ctx, endpoint, events, status, time.Since(t0), body, err)
+	return unavailable, err
 }
 
-func httpDo(ctx context.Context, req *http.Request, f func(*http.Response, error) error) error {
-	// Run the HTTP request in a goroutine and pass the response to f.
-	tr := &http.Transport{}
-	client := &http.Client{Transport: tr}
+func httpDo(ctx context.Context, client *http.Client, req *http.Request, f func(*http.Response, error) error) error {
+	// Run the HTTP request in a goroutine and pass the response to f, cancelling the request when ctx is done
+	req = req.WithContext(ctx)
 	c := make(chan error, 1)
 	go func() { c <- f(client.Do(req)) }()
 	select {
 	case <-ctx.Done():
-		tr.CancelRequest(req)
 		<-c // Wait for f to return.
 		return ctx.Err()
 	case err := <-c:
@@ -0,0 +1,166 @@
+package segment
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestForwarderKeepAlive(t *testing.T) {
+	var requests, conns atomic.Int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Write([]byte(`{"success":true}`))
+	}))
+	server.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	config := &ForwarderConfig{
+		Endpoint:              server.URL,
+		MaxIdleConnsPerHost:   4,
+		IdleConnTimeout:       time.Minute,
+		ResponseHeaderTimeout: time.Second,
+		Registerer:            prometheus.NewRegistry(),
+	}
+	if tr := config.transport(); tr.MaxIdleConnsPerHost != 4 || tr.IdleConnTimeout != time.Minute ||
+		tr.ResponseHeaderTimeout != time.Second || tr.TLSHandshakeTimeout == 0 {
+		t.Errorf("Unexpected transport %+v", tr)
+	}
+	f := NewForwarderWithConfig(config)
+	for i := 0; i < 3; i++ {
+		if err := f.send(context.Background(), SegmentEvent{SegmentMessage: SegmentMessage{Type: "track"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if requests.Load() != 3 || conns.Load() != 1 {
+		t.Errorf("Expected 3 requests on 1 connection, got %d on %d", requests.Load(), conns.Load())
+	}
+}
+
+func TestForwarderSigV4(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDTEST")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	dest := &testDestination{}
+	router := mux.NewRouter()
+	NewSegment(func(writeKey string) string { return writeKey }, []Destination{dest}, router)
+	var authorization string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		router.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	f := NewForwarderWithConfig(&ForwarderConfig{
+		Endpoint:   server.URL + "/batch",
+		SigV4:      &SigV4Config{Region: "us-west-2"},
+		Registerer: prometheus.NewRegistry(),
+	})
+	event := SegmentEvent{WriteKey: "web", SegmentMessage: SegmentMessage{Type: "track", Event: "Signed Up"}}
+	if err := f.send(context.Background(), event); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(authorization, "AWS4-HMAC-SHA256 Credential=AKIDTEST/") ||
+		!strings.Contains(authorization, "/us-west-2/execute-api/aws4_request") {
+		t.Errorf("Expected SigV4 authorization, got %q", authorization)
+	}
+	// The writeKey is sent in the body
+	if sent := dest.sent(); len(sent) != 1 || sent[0].(SegmentEvent).ProjectId != "web" {
+		t.Errorf("Expected event for the writeKey, got %v", sent)
+	}
+}
+
+func TestForwarderEndpointTemplate(t *testing.T) {
+	paths := make(chan string, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths <- r.URL.EscapedPath()
+	}))
+	defer server.Close()
+
+	if err := (&ForwarderConfig{Endpoint: server.URL + "/hooks/{{.Type"}).Validate(); err == nil {
+		t.Error("Expected template error")
+	}
+	f := NewForwarderWithConfig(&ForwarderConfig{
+		Endpoint:   server.URL + "/hooks/{{.Type}}/{{pathescape .Event}}",
+		Registerer: prometheus.NewRegistry(),
+	})
+	for _, m := range []SegmentMessage{{Type: "track", Event: "Order Completed"}, {Type: "identify"}} {
+		if err := f.send(context.Background(), SegmentEvent{SegmentMessage: m}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if first, second := <-paths, <-paths; first != "/hooks/track/Order%20Completed" || second != "/hooks/identify/" {
+		t.Errorf("Unexpected paths %q %q", first, second)
+	}
+
+	// Rendered urls can't leave the host or prefix path of the template
+	if err := (&ForwarderConfig{Endpoint: "https://{{.ProjectId}}.example.com/hooks"}).Validate(); err == nil {
+		t.Error("Expected template host error")
+	}
+	f = NewForwarderWithConfig(&ForwarderConfig{
+		Endpoint:   server.URL + "/hooks/{{.Event}}",
+		Registerer: prometheus.NewRegistry(),
+	})
+	for _, event := range []string{"../admin", "x/../../admin"} {
+		if err := f.send(context.Background(), SegmentEvent{SegmentMessage: SegmentMessage{Type: "track", Event: event}}); err == nil {
+			t.Errorf("Expected %q route error", event)
+		}
+	}
+}
+
+func TestForwarderSplitBatch(t *testing.T) {
+	const maxBodySize = 2048
+	var requests, events atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var batch SegmentBatch
+		if r.ContentLength > maxBodySize || json.NewDecoder(r.Body).Decode(&batch) != nil {
+			http.Error(w, "too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		requests.Add(1)
+		events.Add(int32(len(batch.Messages)))
+	}))
+	defer server.Close()
+
+	f := NewForwarderWithConfig(&ForwarderConfig{
+		Endpoint:    server.URL,
+		BatchSize:   10,
+		MaxBodySize: maxBodySize,
+		Registerer:  prometheus.NewRegistry(),
+	})
+	batch := make([]SegmentEvent, 10)
+	for i := range batch {
+		batch[i] = SegmentEvent{WriteKey: "web", SegmentMessage: SegmentMessage{Type: "track", Event: strings.Repeat("x", 400)}}
+	}
+	if err := f.send(context.Background(), batch...); err != nil {
+		t.Fatal(err)
+	}
+	if requests.Load() < 3 || events.Load() != 10 {
+		t.Errorf("Expected split requests, got %d events in %d requests", events.Load(), requests.Load())
+	}
+
+	// An event alone over the limit fails without a request
+	requests.Store(0)
+	large := SegmentEvent{SegmentMessage: SegmentMessage{Type: "track", Event: strings.Repeat("x", maxBodySize)}}
+	if err := f.send(context.Background(), large); err == nil || requests.Load() != 0 {
+		t.Errorf("Expected max body size error, got %v", err)
+	}
+
+	// Events are grouped by writeKey
+	if groups := f.group([]SegmentEvent{batch[0], {WriteKey: "ios"}, batch[1]}); len(groups) != 2 || len(groups[0]) != 2 {
+		t.Errorf("Expected 2 groups, got %v", groups)
+	}
+}
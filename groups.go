@@ -0,0 +1,56 @@
+package segment
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// GroupMembership remembers the latest group of each user from group events,
+// and propagates it as context.groupId on their subsequent events
+type GroupMembership struct {
+	mu    sync.Mutex
+	cache *lruCache[string]
+}
+
+// NewGroupMembership creates a membership cache of up to size users, expiring after ttl if not zero
+func NewGroupMembership(size int, ttl time.Duration) *GroupMembership {
+	return &GroupMembership{cache: newLRUCache[string](size, ttl)}
+}
+
+// Group returns the latest group for a user or anonymous id
+func (g *GroupMembership) Group(projectId, id string) string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	groupId, _ := g.cache.get(traitKey(projectId, id))
+	return groupId
+}
+
+// Transform records group membership, and adds context.groupId to other events if not set
+func (g *GroupMembership) Transform(ctx context.Context, m *SegmentEvent) error {
+	id := m.UserId
+	if id == "" {
+		id = m.AnonymousId
+	}
+	if id == "" {
+		return nil
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	key := traitKey(m.ProjectId, id)
+	if m.Type == "group" || m.Type == "g" {
+		if m.GroupId != "" && !DryRun(ctx) {
+			g.cache.put(key, m.GroupId)
+		}
+		return nil
+	}
+	if _, ok := m.Context["groupId"]; ok {
+		return nil
+	}
+	if groupId, ok := g.cache.get(key); ok {
+		m.Context = cloneMap(m.Context)
+		m.Context["groupId"] = groupId
+	}
+	return nil
+}
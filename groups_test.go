@@ -0,0 +1,39 @@
+package segment
+
+import (
+	"context"
+	"testing"
+)
+
+func TestGroupMembership(t *testing.T) {
+	g := NewGroupMembership(10, 0)
+	ctx := context.Background()
+	g.Transform(ctx, &SegmentEvent{SegmentMessage: SegmentMessage{ProjectId: "p", Type: "group", UserId: "u", GroupId: "acme"}})
+
+	track := &SegmentEvent{SegmentMessage: SegmentMessage{ProjectId: "p", Type: "track", UserId: "u"}}
+	g.Transform(ctx, track)
+	if track.Context["groupId"] != "acme" {
+		t.Errorf("Expected groupId propagated, got %v", track.Context)
+	}
+
+	explicit := &SegmentEvent{SegmentMessage: SegmentMessage{ProjectId: "p", Type: "track", UserId: "u",
+		Context: map[string]interface{}{"groupId": "other"}}}
+	g.Transform(ctx, explicit)
+	if explicit.Context["groupId"] != "other" {
+		t.Errorf("Expected explicit groupId kept, got %v", explicit.Context)
+	}
+}
+
+func TestLRUCacheEviction(t *testing.T) {
+	c := newLRUCache[int](2, 0)
+	c.put("a", 1)
+	c.put("b", 2)
+	c.get("a")
+	c.put("c", 3)
+	if _, ok := c.get("b"); ok {
+		t.Error("Expected least recently used evicted")
+	}
+	if v, ok := c.get("a"); !ok || v != 1 || c.len() != 2 {
+		t.Errorf("Expected recently used kept, got %d", v)
+	}
+}
@@ -0,0 +1,266 @@
+package segment
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// collectorStreamMethod is the full method name in proto/collector.proto
+const collectorStreamMethod = "/segment.collector.Collector/Stream"
+
+// GRPCConfig contains configuration parameters for the gRPC destination
+type GRPCConfig struct {
+	Target   string `json:"target"`
+	Window   int    `json:"window,omitempty"` // Max unacked events in flight, defaults to 100
+	Insecure bool   `json:"insecure,omitempty"`
+	// DialOptions eg transport credentials, appended to defaults
+	DialOptions []grpc.DialOption `json:"-"`
+}
+
+// GRPC is a destination streaming events to a downstream collector with per event acks
+type GRPC struct {
+	Logger   *log.Logger // Public logger that caller can override
+	target   string
+	options  []grpc.DialOption
+	window   int
+	messages chan interface{}
+	mu       sync.Mutex
+	sequence uint64
+	pending  map[uint64][]byte // Unacked payloads resent on reconnect
+}
+
+// NewGRPC creates a new gRPC destination given configuration
+func NewGRPC(config *GRPCConfig) *GRPC {
+	if err := config.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	if config.Window <= 0 {
+		config.Window = 100
+	}
+	var options []grpc.DialOption
+	if config.Insecure {
+		options = append(options, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	}
+	return &GRPC{
+		Logger:   log.New(os.Stderr, "", log.LstdFlags),
+		target:   config.Target,
+		options:  append(options, config.DialOptions...),
+		window:   config.Window,
+		messages: make(chan interface{}, config.Window),
+		pending:  make(map[uint64][]byte),
+	}
+}
+
+// Validate checks the target is set
+func (config *GRPCConfig) Validate() error {
+	if config.Target == "" {
+		return fmt.Errorf("Require gRPC target")
+	}
+	return nil
+}
+
+// WithLogger adds optional logging
+func (g *GRPC) WithLogger(logger *log.Logger) Destination {
+	if logger != nil {
+		g.Logger = logger
+	}
+	return g
+}
+
+// Process streams messages, returning on stream error so unacked events are resent on restart
+func (g *GRPC) Process(ctx context.Context) error {
+	conn, err := grpc.DialContext(ctx, g.target, g.options...)
+	if err != nil {
+		return fmt.Errorf("gRPC dial error -- %v", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := conn.NewStream(ctx, &grpc.StreamDesc{
+		StreamName:    "Stream",
+		ServerStreams: true,
+		ClientStreams: true,
+	}, collectorStreamMethod, grpc.ForceCodec(collectorCodec{}))
+	if err != nil {
+		return fmt.Errorf("gRPC stream error -- %v", err)
+	}
+	g.Logger.Printf("Started gRPC processing to %s\n", g.target)
+
+	// Flow control limits unacked events to the window, including those resent
+	window := make(chan struct{}, g.window)
+	acks := make(chan error, 1)
+	go func() {
+		for {
+			var ack collectorAck
+			if err := stream.RecvMsg(&ack); err != nil {
+				acks <- err
+				return
+			}
+			g.mu.Lock()
+			delete(g.pending, ack.Sequence)
+			g.mu.Unlock()
+			if ack.Error != "" {
+				g.Logger.Printf("gRPC event %d rejected: %s\n", ack.Sequence, ack.Error)
+			}
+			select {
+			case <-window:
+			default: // Ignore duplicate acks
+			}
+		}
+	}()
+
+	send := func(sequence uint64, payload []byte) error {
+		select {
+		case window <- struct{}{}:
+		case err := <-acks:
+			return fmt.Errorf("gRPC receive error -- %v", err)
+		case <-ctx.Done():
+			return nil
+		}
+		if err := stream.SendMsg(&collectorEvent{Sequence: sequence, Payload: payload}); err != nil {
+			return fmt.Errorf("gRPC send error -- %v", err)
+		}
+		return nil
+	}
+
+	for _, sequence := range g.unacked() {
+		g.mu.Lock()
+		payload := g.pending[sequence]
+		g.mu.Unlock()
+		if err := send(sequence, payload); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case message := <-g.messages:
+			payload, err := json.Marshal(message)
+			if err != nil {
+				return fmt.Errorf("Marshal error -- %v", err)
+			}
+			g.mu.Lock()
+			g.sequence++
+			sequence := g.sequence
+			g.pending[sequence] = payload
+			g.mu.Unlock()
+			if err := send(sequence, payload); err != nil {
+				return err
+			}
+		case err := <-acks:
+			return fmt.Errorf("gRPC receive error -- %v", err)
+		case <-ctx.Done():
+			g.Logger.Println("Ending gRPC processing")
+			stream.CloseSend()
+			return nil
+		}
+	}
+}
+
+// unacked returns pending sequences in order
+func (g *GRPC) unacked() []uint64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	sequences := make([]uint64, 0, len(g.pending))
+	for sequence := range g.pending {
+		sequences = append(sequences, sequence)
+	}
+	sort.Slice(sequences, func(i, j int) bool { return sequences[i] < sequences[j] })
+	return sequences
+}
+
+// Send pushes the message onto the queue
+func (g *GRPC) Send(ctx context.Context, message interface{}) error {
+	return enqueue(ctx, g.messages, message)
+}
+
+// collectorEvent is the Event message in proto/collector.proto
+type collectorEvent struct {
+	Sequence uint64
+	Payload  []byte
+}
+
+// collectorAck is the Ack message in proto/collector.proto
+type collectorAck struct {
+	Sequence uint64
+	Error    string
+}
+
+// collectorCodec encodes the collector messages in protobuf wire format without generated code
+type collectorCodec struct{}
+
+func (collectorCodec) Name() string {
+	return "proto"
+}
+
+func (collectorCodec) Marshal(v interface{}) ([]byte, error) {
+	var b []byte
+	switch m := v.(type) {
+	case *collectorEvent:
+		b = protowire.AppendTag(b, 1, protowire.VarintType)
+		b = protowire.AppendVarint(b, m.Sequence)
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendBytes(b, m.Payload)
+	case *collectorAck:
+		b = protowire.AppendTag(b, 1, protowire.VarintType)
+		b = protowire.AppendVarint(b, m.Sequence)
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendString(b, m.Error)
+	default:
+		return nil, fmt.Errorf("Unexpected collector message %T", v)
+	}
+	return b, nil
+}
+
+func (collectorCodec) Unmarshal(b []byte, v interface{}) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			value, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			switch m := v.(type) {
+			case *collectorEvent:
+				m.Sequence = value
+			case *collectorAck:
+				m.Sequence = value
+			}
+			b = b[n:]
+		case num == 2 && typ == protowire.BytesType:
+			value, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			switch m := v.(type) {
+			case *collectorEvent:
+				m.Payload = append([]byte(nil), value...)
+			case *collectorAck:
+				m.Error = string(value)
+			}
+			b = b[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:] // Skip unknown fields
+		}
+	}
+	return nil
+}
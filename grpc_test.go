@@ -0,0 +1,59 @@
+package segment
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+func TestGRPCStream(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan SegmentEvent, 10)
+	server := grpc.NewServer(
+		grpc.ForceServerCodec(collectorCodec{}),
+		grpc.UnknownServiceHandler(func(srv interface{}, stream grpc.ServerStream) error {
+			for {
+				var event collectorEvent
+				if err := stream.RecvMsg(&event); err != nil {
+					return nil
+				}
+				var m SegmentEvent
+				json.Unmarshal(event.Payload, &m)
+				received <- m
+				if err := stream.SendMsg(&collectorAck{Sequence: event.Sequence}); err != nil {
+					return err
+				}
+			}
+		}),
+	)
+	go server.Serve(lis)
+	defer server.Stop()
+
+	g := NewGRPC(&GRPCConfig{Target: lis.Addr().String(), Insecure: true})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go g.Process(ctx)
+
+	if err := g.Send(ctx, SegmentEvent{SegmentMessage: SegmentMessage{MessageId: "1"}}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case m := <-received:
+		if m.MessageId != "1" {
+			t.Errorf("Expected message 1, got %q", m.MessageId)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for event")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := len(g.unacked()); n != 0 {
+		t.Errorf("Expected all events acked, got %d pending", n)
+	}
+}
@@ -0,0 +1,179 @@
+package segment
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// healthyAfter is how long Process must run without error to be considered healthy again
+const healthyAfter = time.Second
+
+// segmentMetrics track destination health, restarts, spooling and dropped events
+type segmentMetrics struct {
+	healthy    *prometheus.GaugeVec
+	restarts   *prometheus.CounterVec
+	dropped    *prometheus.CounterVec
+	spoolBytes *spoolMemory
+}
+
+func newSegmentMetrics(reg prometheus.Registerer, budget func() *MemoryBudget) *segmentMetrics {
+	return &segmentMetrics{
+		healthy: newGaugeVec(reg, prometheus.GaugeOpts{
+			Name: "destination_healthy",
+			Help: "Destination healthy (1) or unhealthy (0)",
+		}, "destination"),
+		restarts: newCounterVec(reg, prometheus.CounterOpts{
+			Name: "destination_restarts_total",
+			Help: "Destination process restarts total",
+		}, "destination"),
+		dropped:    newDroppedCounter(reg),
+		spoolBytes: registerCollector(reg, newSpoolMemory()).(*spoolMemory).add(budget),
+	}
+}
+
+// spoolMemory is a gauge of the bytes used by the memory budgets of every segment registered against a registry,
+// counting a budget shared between segments once
+type spoolMemory struct {
+	desc    *prometheus.Desc
+	mu      sync.Mutex
+	budgets []func() *MemoryBudget
+}
+
+func newSpoolMemory() *spoolMemory {
+	return &spoolMemory{
+		desc: prometheus.NewDesc("spool_memory_bytes", "Bytes of events spooled in memory within the budget", nil, nil),
+	}
+}
+
+// add includes the budget of a segment in the gauge
+func (c *spoolMemory) add(budget func() *MemoryBudget) *spoolMemory {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.budgets = append(c.budgets, budget)
+	return c
+}
+
+// Describe implements prometheus.Collector
+func (c *spoolMemory) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+// Collect implements prometheus.Collector, summing the bytes used by each distinct budget
+func (c *spoolMemory) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	seen := make(map[*MemoryBudget]bool)
+	used := int64(0)
+	for _, budget := range c.budgets {
+		if b := budget(); b != nil && !seen[b] {
+			seen[b] = true
+			used += b.Used()
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(used))
+}
+
+// health tracks whether a destination process is running without error
+type health struct {
+	unhealthy atomic.Bool
+}
+
+// Healthy returns true if the destination process is running without error
+func (h *health) Healthy() bool {
+	return !h.unhealthy.Load()
+}
+
+// supervise runs the destination process until the context is done, restarting with backoff on error
+// up to max attempts if configured, otherwise forever.  The backoff restarts once a process has run healthy.
+func (s *Segment) supervise(ctx context.Context, dest *destination) {
+	s.setHealthy(dest, true)
+	for i := 0; ; i++ {
+		// Guard the timer, so it can't mark the destination healthy once the process has returned
+		var mu sync.Mutex
+		stopped, healthy := false, false
+		recovered := time.AfterFunc(healthyAfter, func() {
+			mu.Lock()
+			defer mu.Unlock()
+			if !stopped {
+				healthy = true
+				s.setHealthy(dest, true)
+			}
+		})
+		err := dest.Process(ctx)
+		mu.Lock()
+		stopped = true
+		mu.Unlock()
+		recovered.Stop()
+		if err == nil || ctx.Err() != nil {
+			return
+		}
+		if healthy {
+			i = 0
+		}
+
+		s.setHealthy(dest, false)
+		if s.backoff.MaxAttempts > 0 && i >= s.backoff.MaxAttempts {
+			s.Logger.Printf("Process %s stopped after %d attempts due to error: %v\n", dest.name, i+1, err)
+			return
+		}
+		s.metrics.restarts.WithLabelValues(dest.name).Inc()
+		s.Logger.Printf("Process %s retrying in %s due to error: %v\n", dest.name, s.backo.Duration(i), err)
+		select {
+		case <-time.After(s.backo.Duration(i)):
+		case <-ctx.Done():
+			return
+		}
+		if i > 16 && s.backoff.MaxAttempts == 0 {
+			i = 16 // Backoff is capped, so avoid overflowing the attempt
+		}
+	}
+}
+
+func (s *Segment) setHealthy(dest *destination, healthy bool) {
+	if wasUnhealthy := dest.unhealthy.Swap(!healthy); wasUnhealthy == healthy && dest != s.monitor.destination() {
+		name := MonitorCircuitOpened
+		if healthy {
+			name = MonitorCircuitClosed
+		}
+		s.monitor.Emit(name, map[string]interface{}{"destination": dest.name})
+	}
+	value := 0.0
+	if healthy {
+		value = 1
+	}
+	s.metrics.healthy.WithLabelValues(dest.name).Set(value)
+}
+
+// Healthy returns true if all destinations are healthy
+func (s *Segment) Healthy() bool {
+	for _, dest := range s.destinations {
+		if !dest.Healthy() {
+			return false
+		}
+	}
+	return true
+}
+
+// HealthHandler returns destination health as json, with 503 status if any are unhealthy
+func (s *Segment) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		destinations := make(map[string]bool, len(s.destinations))
+		for _, dest := range s.destinations {
+			destinations[dest.name] = dest.Healthy()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if !s.Healthy() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"healthy":      s.Healthy(),
+			"destinations": destinations,
+		})
+	})
+}
@@ -0,0 +1,91 @@
+package segment
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// failingDestination fails Process until told to recover
+type failingDestination struct {
+	testDestination
+	recovered atomic.Bool
+	attempts  atomic.Int32
+}
+
+func (d *failingDestination) Process(ctx context.Context) error {
+	d.attempts.Add(1)
+	if !d.recovered.Load() {
+		return errors.New("connect failed")
+	}
+	<-ctx.Done()
+	return nil
+}
+
+func TestSuperviseRestarts(t *testing.T) {
+	dest := &failingDestination{}
+	s := NewSegment(nil, []Destination{dest}, nil).
+		WithRegisterer(prometheus.NewRegistry()).
+		WithBackoff(BackoffConfig{Min: time.Millisecond, Max: 5 * time.Millisecond})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.Run(ctx)
+
+	time.Sleep(50 * time.Millisecond)
+	if s.Healthy() || dest.attempts.Load() < 2 {
+		t.Fatalf("Expected unhealthy destination to be restarted, got %d attempts", dest.attempts.Load())
+	}
+	w := httptest.NewRecorder()
+	s.HealthHandler().ServeHTTP(w, httptest.NewRequest("GET", "/health", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503, got %d", w.Code)
+	}
+
+	dest.recovered.Store(true)
+	time.Sleep(healthyAfter + 50*time.Millisecond)
+	if !s.Healthy() {
+		t.Error("Expected destination to recover")
+	}
+}
+
+// recoveringDestination fails the first Process, runs healthy before failing the second, then runs until done
+type recoveringDestination struct {
+	testDestination
+	attempts atomic.Int32
+}
+
+func (d *recoveringDestination) Process(ctx context.Context) error {
+	switch d.attempts.Add(1) {
+	case 1:
+		return errors.New("connect failed")
+	case 2:
+		time.Sleep(healthyAfter + 50*time.Millisecond)
+		return errors.New("connection reset")
+	}
+	<-ctx.Done()
+	return nil
+}
+
+func TestSuperviseBackoffReset(t *testing.T) {
+	dest := &recoveringDestination{}
+	s := NewSegment(nil, []Destination{dest}, nil).
+		WithRegisterer(prometheus.NewRegistry()).
+		WithBackoff(BackoffConfig{Min: time.Millisecond, Max: 5 * time.Millisecond, MaxAttempts: 1})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.Run(ctx)
+
+	// The second failure is after running healthy, so it doesn't count towards the max attempts
+	time.Sleep(healthyAfter + 200*time.Millisecond)
+	if n := dest.attempts.Load(); n != 3 {
+		t.Errorf("Expected a third attempt after running healthy, got %d attempts", n)
+	}
+}
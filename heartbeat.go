@@ -0,0 +1,160 @@
+package segment
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/xtgo/uuid"
+)
+
+// HeartbeatEvent is the track event name of heartbeats, which also have context.heartbeat true
+const HeartbeatEvent = "Segment Heartbeat"
+
+// HeartbeatConfig contains the interval and project of heartbeat events sent through each destination
+type HeartbeatConfig struct {
+	Interval  time.Duration `json:"interval,omitempty"`  // Defaults to 1 minute
+	ProjectId string        `json:"projectId,omitempty"` // Defaults to "heartbeat"
+	// Registerer for metrics, defaults to the prometheus default registerer
+	Registerer prometheus.Registerer `json:"-"`
+}
+
+// Heartbeats sends a synthetic heartbeat event through each destination every interval, and records heartbeats
+// arriving downstream, for end-to-end pipeline liveness
+type Heartbeats struct {
+	mu       sync.Mutex
+	config   HeartbeatConfig
+	host     string
+	last     map[string]time.Time // Destination to last heartbeat received
+	sent     *prometheus.GaugeVec
+	received *prometheus.GaugeVec
+	lag      *prometheus.GaugeVec
+}
+
+// NewHeartbeats creates heartbeats given config defaults
+func NewHeartbeats(config HeartbeatConfig) *Heartbeats {
+	if config.Interval <= 0 {
+		config.Interval = time.Minute
+	}
+	if config.ProjectId == "" {
+		config.ProjectId = "heartbeat"
+	}
+	host, _ := os.Hostname()
+	return &Heartbeats{
+		config: config,
+		host:   host,
+		last:   make(map[string]time.Time),
+		sent: newGaugeVec(config.Registerer, prometheus.GaugeOpts{
+			Name: "heartbeat_sent_timestamp_seconds",
+			Help: "Unix time of the last heartbeat accepted by destination",
+		}, "destination"),
+		received: newGaugeVec(config.Registerer, prometheus.GaugeOpts{
+			Name: "heartbeat_received_timestamp_seconds",
+			Help: "Unix time of the last heartbeat received downstream by destination",
+		}, "destination"),
+		lag: newGaugeVec(config.Registerer, prometheus.GaugeOpts{
+			Name: "heartbeat_lag_seconds",
+			Help: "Seconds from sending to receiving the last heartbeat by destination",
+		}, "destination"),
+	}
+}
+
+// WithHeartbeats sends heartbeats through each destination while running
+func (s *Segment) WithHeartbeats(heartbeats *Heartbeats) *Segment {
+	s.heartbeats = heartbeats
+	return s
+}
+
+// IsHeartbeat returns true if the event is a heartbeat, so downstream consumers can filter them
+func IsHeartbeat(m SegmentEvent) bool {
+	heartbeat, _ := m.Context["heartbeat"].(bool)
+	return heartbeat && m.Event == HeartbeatEvent
+}
+
+// event returns a heartbeat for the destination
+func (h *Heartbeats) event(destination string, now time.Time) SegmentEvent {
+	return SegmentEvent{SegmentMessage: SegmentMessage{
+		ProjectId:   h.config.ProjectId,
+		MessageId:   uuid.NewRandom().String(),
+		Type:        "track",
+		Event:       HeartbeatEvent,
+		AnonymousId: h.host,
+		Channel:     "server",
+		Timestamp:   now,
+		SentAt:      now,
+		ReceivedAt:  now,
+		Properties:  map[string]interface{}{"destination": destination},
+		Context:     map[string]interface{}{"heartbeat": true, "host": h.host},
+	}}
+}
+
+// runHeartbeats sends a heartbeat through each destination every interval until ctx is done
+func (s *Segment) runHeartbeats(ctx context.Context) {
+	h := s.heartbeats
+	ticker := time.NewTicker(h.config.Interval)
+	defer ticker.Stop()
+	for {
+		for _, dest := range s.destinations {
+			now := time.Now().UTC()
+			if err := dest.send(ctx, h.event(dest.name, now)); err != nil {
+				s.Logger.Printf("Heartbeat %s error -- %v\n", dest.name, err)
+				continue
+			}
+			h.sent.WithLabelValues(dest.name).Set(float64(now.UnixNano()) / 1e9)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Transform records heartbeats arriving downstream eg in a collector consuming a destination stream, and drops
+// them so they aren't delivered further
+func (h *Heartbeats) Transform(ctx context.Context, m *SegmentEvent) error {
+	if !IsHeartbeat(*m) {
+		return nil
+	}
+	destination, _ := m.Properties["destination"].(string)
+	now := time.Now().UTC()
+	if !DryRun(ctx) {
+		h.mu.Lock()
+		h.last[destination] = now
+		h.mu.Unlock()
+		h.received.WithLabelValues(destination).Set(float64(now.UnixNano()) / 1e9)
+		h.lag.WithLabelValues(destination).Set(now.Sub(m.Timestamp).Seconds())
+	}
+	return ErrDropEvent
+}
+
+// Stale returns the destinations whose last heartbeat was received more than maxAge ago
+func (h *Heartbeats) Stale(maxAge time.Duration) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var stale []string
+	for destination, last := range h.last {
+		if time.Since(last) > maxAge {
+			stale = append(stale, destination)
+		}
+	}
+	sort.Strings(stale)
+	return stale
+}
+
+// Handler returns 503 with the stale destinations if heartbeats stopped arriving within maxAge, for alerting
+func (h *Heartbeats) Handler(maxAge time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		stale := h.Stale(maxAge)
+		if len(stale) > 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"healthy": len(stale) == 0, "stale": stale})
+	})
+}
@@ -0,0 +1,53 @@
+package segment
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestHeartbeats(t *testing.T) {
+	dest := &testDestination{}
+	heartbeats := NewHeartbeats(HeartbeatConfig{Interval: 10 * time.Millisecond, Registerer: prometheus.NewRegistry()})
+	s := NewSegment(func(writeKey string) string { return writeKey }, []Destination{dest}, mux.NewRouter()).
+		WithHeartbeats(heartbeats)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go s.runHeartbeats(ctx)
+	time.Sleep(35 * time.Millisecond)
+	cancel()
+
+	sent := dest.sent()
+	if len(sent) < 2 {
+		t.Fatalf("Expected heartbeats, got %d", len(sent))
+	}
+	m := sent[0].(SegmentEvent)
+	if !IsHeartbeat(m) || m.ProjectId != "heartbeat" || m.Properties["destination"] != s.destinations[0].name {
+		t.Fatalf("Unexpected heartbeat %+v", m.SegmentMessage)
+	}
+
+	// Downstream records and drops heartbeats, and passes other events
+	if err := heartbeats.Transform(context.Background(), &m); err != ErrDropEvent {
+		t.Errorf("Expected heartbeat dropped, got %v", err)
+	}
+	other := SegmentEvent{SegmentMessage: SegmentMessage{Type: "track", Event: HeartbeatEvent}}
+	if err := heartbeats.Transform(context.Background(), &other); err != nil {
+		t.Errorf("Expected unmarked event passed, got %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	heartbeats.Handler(time.Minute).ServeHTTP(w, httptest.NewRequest("GET", "/heartbeats", nil))
+	if w.Code != 200 {
+		t.Errorf("Expected healthy, got %d %s", w.Code, w.Body)
+	}
+	time.Sleep(5 * time.Millisecond)
+	w = httptest.NewRecorder()
+	heartbeats.Handler(time.Millisecond).ServeHTTP(w, httptest.NewRequest("GET", "/heartbeats", nil))
+	if w.Code != 503 || heartbeats.Stale(time.Millisecond)[0] != s.destinations[0].name {
+		t.Errorf("Expected stale, got %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,171 @@
+package segment
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// honeycombMaxBatch is the maximum number of events per batch request
+const honeycombMaxBatch = 1000
+
+// HoneycombConfig contains configuration parameters for the honeycomb events destination
+type HoneycombConfig struct {
+	APIKey   string `json:"apiKey"`
+	Endpoint string `json:"endpoint,omitempty"` // Defaults to "https://api.honeycomb.io"
+	// Datasets maps projectId to dataset, otherwise Dataset if set, or the projectId
+	Datasets map[string]string `json:"datasets,omitempty"`
+	Dataset  string            `json:"dataset,omitempty"`
+	BatchConfig
+}
+
+// Honeycomb is a destination sending events with flattened properties to the honeycomb batch events api
+type Honeycomb struct {
+	Logger  *log.Logger // Public logger that caller can override
+	config  HoneycombConfig
+	batcher *batcher
+}
+
+// NewHoneycomb creates a new honeycomb destination given configuration
+func NewHoneycomb(config *HoneycombConfig) *Honeycomb {
+	if err := config.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	if config.Endpoint == "" {
+		config.Endpoint = "https://api.honeycomb.io"
+	}
+	h := &Honeycomb{
+		Logger: log.New(os.Stderr, "", log.LstdFlags),
+		config: *config,
+	}
+	h.batcher = newBatcher("honeycomb", config.BatchConfig, honeycombMaxBatch, h.write)
+	h.batcher.partition = func(m SegmentEvent) string { return h.dataset(m.ProjectId) }
+	return h
+}
+
+// Validate checks the api key is set
+func (config *HoneycombConfig) Validate() error {
+	if config.APIKey == "" {
+		return fmt.Errorf("Require honeycomb api key")
+	}
+	if config.Endpoint != "" {
+		return validateEndpoint(config.Endpoint)
+	}
+	return nil
+}
+
+// Name returns the configured destination name
+func (h *Honeycomb) Name() string {
+	return h.batcher.configuredName()
+}
+
+// WithLogger adds optional logging
+func (h *Honeycomb) WithLogger(logger *log.Logger) Destination {
+	if logger != nil {
+		h.Logger = logger
+	}
+	return h
+}
+
+// Process sends batches of events until ctx is done
+func (h *Honeycomb) Process(ctx context.Context) error {
+	return h.batcher.process(ctx, h.Logger)
+}
+
+// Send pushes the message onto the queue
+func (h *Honeycomb) Send(ctx context.Context, message interface{}) error {
+	return h.batcher.send(ctx, message)
+}
+
+// dataset returns the dataset for a project
+func (h *Honeycomb) dataset(projectId string) string {
+	if dataset, ok := h.config.Datasets[projectId]; ok {
+		return dataset
+	}
+	if h.config.Dataset != "" {
+		return h.config.Dataset
+	}
+	return projectId
+}
+
+// honeycombData returns the event fields with context, properties and traits flattened with dotted keys
+func honeycombData(m SegmentEvent) map[string]interface{} {
+	data := map[string]interface{}{
+		"projectId": m.ProjectId,
+		"messageId": m.MessageId,
+		"type":      m.Type,
+		"name":      eventName(m.SegmentMessage),
+	}
+	for key, value := range map[string]string{"userId": m.UserId, "anonymousId": m.AnonymousId, "channel": m.Channel} {
+		if value != "" {
+			data[key] = value
+		}
+	}
+	flattenMap(data, "context", ".", -1, m.Context)
+	flattenMap(data, "properties", ".", -1, m.Properties)
+	flattenMap(data, "traits", ".", -1, m.Traits)
+	return data
+}
+
+// write posts the batch, returning a partial error with the events that failed or have no status, as the batch
+// api accepts events individually
+func (h *Honeycomb) write(ctx context.Context, batch []SegmentEvent) error {
+	body, err := httpResponse(ctx, h.request, batch)
+	if err != nil {
+		return err
+	}
+	var statuses []struct {
+		Status int    `json:"status"`
+		Error  string `json:"error"`
+	}
+	if err := json.Unmarshal(body, &statuses); err != nil {
+		return fmt.Errorf("Honeycomb response error -- %v", err)
+	}
+	var failed []SegmentEvent
+	var last string
+	for i := range batch {
+		if i >= len(statuses) {
+			failed = append(failed, batch[i:]...)
+			last = "no status"
+			break
+		}
+		if statuses[i].Status < 200 || statuses[i].Status >= 300 {
+			failed = append(failed, batch[i])
+			last = fmt.Sprintf("%d %s", statuses[i].Status, statuses[i].Error)
+		}
+	}
+	if len(failed) > 0 {
+		return &partialError{failed: failed, err: fmt.Errorf("Honeycomb %d of %d events failed -- %s", len(failed), len(batch), last)}
+	}
+	return nil
+}
+
+// request builds the batch request for events in the same dataset
+func (h *Honeycomb) request(ctx context.Context, batch []SegmentEvent) (*http.Request, error) {
+	events := make([]map[string]interface{}, len(batch))
+	for i, m := range batch {
+		events[i] = map[string]interface{}{
+			"time": m.Timestamp.Format(time.RFC3339Nano),
+			"data": honeycombData(m),
+		}
+	}
+	b, err := json.Marshal(events)
+	if err != nil {
+		return nil, fmt.Errorf("Marshal error -- %v", err)
+	}
+	endpoint := strings.TrimSuffix(h.config.Endpoint, "/") + "/1/batch/" + url.PathEscape(h.dataset(batch[0].ProjectId))
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Honeycomb-Team", h.config.APIKey)
+	return req, nil
+}
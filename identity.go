@@ -0,0 +1,176 @@
+package segment
+
+import (
+	"context"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Identity graph operations counted by the identity_graph_errors_total metric
+const (
+	identityLink     = "link"
+	identityIdentify = "identify"
+)
+
+// IdentityGraph keeps an identity resolution service in sync, linking identities eg a previous anonymous id to a user
+// id on alias, and updating the traits of a user on identify
+type IdentityGraph interface {
+	Link(ctx context.Context, projectId, previousId, userId string) error
+	Identify(ctx context.Context, projectId, userId string, traits map[string]interface{}) error
+}
+
+// IdentityGraphFunc adapts a link function to an IdentityGraph that ignores traits
+type IdentityGraphFunc func(ctx context.Context, projectId, previousId, userId string) error
+
+// Link calls f
+func (f IdentityGraphFunc) Link(ctx context.Context, projectId, previousId, userId string) error {
+	return f(ctx, projectId, previousId, userId)
+}
+
+// Identify does nothing
+func (f IdentityGraphFunc) Identify(ctx context.Context, projectId, userId string, traits map[string]interface{}) error {
+	return nil
+}
+
+// IdentityHooks calls an identity graph for alias and identify events.  Graph errors are logged and counted rather
+// than failing the event, so an outage of the identity service doesn't fail ingest.
+type IdentityHooks struct {
+	Logger *log.Logger // Public logger that caller can override
+	graph  IdentityGraph
+	errors *prometheus.CounterVec
+}
+
+// NewIdentityHooks creates hooks for the graph with the error metric registered against reg, or the default if nil
+func NewIdentityHooks(graph IdentityGraph, reg prometheus.Registerer) *IdentityHooks {
+	return &IdentityHooks{
+		Logger: log.New(os.Stderr, "", log.LstdFlags),
+		graph:  graph,
+		errors: newCounterVec(reg, prometheus.CounterOpts{
+			Name: "identity_graph_errors_total",
+			Help: "Identity graph errors total by operation, link or identify",
+		}, "operation"),
+	}
+}
+
+// IdentityHook returns a transform linking previousId to userId for alias events, and anonymousId to userId with the
+// traits of identify events, with the error metric registered against the default registerer
+func IdentityHook(graph IdentityGraph) Transform {
+	return NewIdentityHooks(graph, nil).Transform
+}
+
+// Transform links previousId to userId for alias events, and anonymousId to userId then identifies the user with
+// their traits for identify events, it doesn't modify the event
+func (h *IdentityHooks) Transform(ctx context.Context, m *SegmentEvent) error {
+	if DryRun(ctx) {
+		return nil
+	}
+	switch m.Type {
+	case "alias", "a":
+		if m.PreviousId != "" && m.UserId != "" {
+			h.check(identityLink, h.graph.Link(ctx, m.ProjectId, m.PreviousId, m.UserId))
+		}
+	case "identify", "i":
+		if m.AnonymousId != "" && m.UserId != "" {
+			h.check(identityLink, h.graph.Link(ctx, m.ProjectId, m.AnonymousId, m.UserId))
+		}
+		if m.UserId != "" {
+			h.check(identityIdentify, h.graph.Identify(ctx, m.ProjectId, m.UserId, m.Traits))
+		}
+	}
+	return nil
+}
+
+// check logs and counts a graph error
+func (h *IdentityHooks) check(operation string, err error) {
+	if err != nil {
+		h.Logger.Printf("Identity graph %s error -- %v\n", operation, err)
+		h.errors.WithLabelValues(operation).Inc()
+	}
+}
+
+// MemoryIdentityGraph is an in memory graph resolving linked identities to the latest user id, with their traits
+type MemoryIdentityGraph struct {
+	mu     sync.Mutex
+	parent map[string]string
+	traits map[string]map[string]interface{} // By root
+}
+
+// NewMemoryIdentityGraph creates an empty graph
+func NewMemoryIdentityGraph() *MemoryIdentityGraph {
+	return &MemoryIdentityGraph{parent: make(map[string]string), traits: make(map[string]map[string]interface{})}
+}
+
+// Link merges the identity of previousId into userId, keeping the traits of userId over those of previousId
+func (g *MemoryIdentityGraph) Link(ctx context.Context, projectId, previousId, userId string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	from, to := g.find(projectId+"/"+previousId), g.find(projectId+"/"+userId)
+	if from != to {
+		g.parent[from] = to
+		if traits, ok := g.traits[from]; ok {
+			g.merge(to, traits, false)
+			delete(g.traits, from)
+		}
+	}
+	return nil
+}
+
+// Identify merges the traits into those of the identity of userId
+func (g *MemoryIdentityGraph) Identify(ctx context.Context, projectId, userId string, traits map[string]interface{}) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.merge(g.find(projectId+"/"+userId), traits, true)
+	return nil
+}
+
+// Traits returns a copy of the traits of the identity of id
+func (g *MemoryIdentityGraph) Traits(projectId, id string) map[string]interface{} {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return cloneMap(g.traits[g.find(projectId+"/"+id)])
+}
+
+// merge adds traits to those of root, replacing existing traits if replace
+func (g *MemoryIdentityGraph) merge(root string, traits map[string]interface{}, replace bool) {
+	if len(traits) == 0 {
+		return
+	}
+	merged, ok := g.traits[root]
+	if !ok {
+		merged = make(map[string]interface{}, len(traits))
+		g.traits[root] = merged
+	}
+	for k, v := range traits {
+		if _, exists := merged[k]; replace || !exists {
+			merged[k] = v
+		}
+	}
+}
+
+// Resolve returns the canonical user id for an id, or the id itself if not linked
+func (g *MemoryIdentityGraph) Resolve(projectId, id string) string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.find(projectId + "/" + id)[len(projectId)+1:]
+}
+
+// find returns the root of key, compressing the path
+func (g *MemoryIdentityGraph) find(key string) string {
+	root := key
+	for {
+		parent, ok := g.parent[root]
+		if !ok {
+			break
+		}
+		root = parent
+	}
+	for key != root {
+		next := g.parent[key]
+		g.parent[key] = root
+		key = next
+	}
+	return root
+}
@@ -0,0 +1,46 @@
+package segment
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestIdentityHook(t *testing.T) {
+	graph := NewMemoryIdentityGraph()
+	hook := IdentityHook(graph)
+	ctx := context.Background()
+	hook(ctx, &SegmentEvent{SegmentMessage: SegmentMessage{ProjectId: "p", Type: "identify", AnonymousId: "anon", UserId: "u1",
+		Traits: map[string]interface{}{"plan": "free", "email": "a@example.com"}}})
+	hook(ctx, &SegmentEvent{SegmentMessage: SegmentMessage{ProjectId: "p", Type: "identify", UserId: "u2",
+		Traits: map[string]interface{}{"plan": "pro"}}})
+	hook(ctx, &SegmentEvent{SegmentMessage: SegmentMessage{ProjectId: "p", Type: "alias", PreviousId: "u1", UserId: "u2"}})
+
+	if id := graph.Resolve("p", "anon"); id != "u2" {
+		t.Errorf("Expected anon resolved to u2, got %s", id)
+	}
+	if id := graph.Resolve("other", "anon"); id != "anon" {
+		t.Errorf("Expected unlinked id in other project, got %s", id)
+	}
+	if traits := graph.Traits("p", "anon"); traits["plan"] != "pro" || traits["email"] != "a@example.com" {
+		t.Errorf("Expected merged traits of u2, got %v", traits)
+	}
+}
+
+func TestIdentityHookErrors(t *testing.T) {
+	hooks := NewIdentityHooks(IdentityGraphFunc(func(ctx context.Context, projectId, previousId, userId string) error {
+		return fmt.Errorf("Identity service unavailable")
+	}), prometheus.NewRegistry())
+
+	// Graph errors are counted without failing the event
+	m := &SegmentEvent{SegmentMessage: SegmentMessage{ProjectId: "p", Type: "alias", PreviousId: "anon", UserId: "u1"}}
+	if err := hooks.Transform(context.Background(), m); err != nil {
+		t.Errorf("Expected event to continue, got %v", err)
+	}
+	if n := testutil.ToFloat64(hooks.errors.WithLabelValues(identityLink)); n != 1 {
+		t.Errorf("Expected 1 link error, got %v", n)
+	}
+}
@@ -0,0 +1,184 @@
+//go:build integration
+
+package segment
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/firehose"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// localstackEndpoint returns the LocalStack edge endpoint, overridden by LOCALSTACK_ENDPOINT
+func localstackEndpoint() string {
+	if endpoint := os.Getenv("LOCALSTACK_ENDPOINT"); endpoint != "" {
+		return endpoint
+	}
+	return "http://localhost:4566"
+}
+
+// eventually polls f until it returns true or the timeout elapses
+func eventually(t *testing.T, timeout time.Duration, f func() bool) bool {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !f() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	return true
+}
+
+// TestIntegrationPipeline drives events through the http handlers to a LocalStack firehose stream delivering to
+// S3, and an httptest downstream that fails the first request, with invalid events sent to the quarantine
+func TestIntegrationPipeline(t *testing.T) {
+	checkLeaks(t)
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	endpoint := localstackEndpoint()
+	sess := session.Must(session.NewSession(aws.NewConfig().
+		WithRegion("us-west-2").WithEndpoint(endpoint).WithS3ForcePathStyle(true)))
+	suffix := time.Now().UnixNano()
+	bucket := fmt.Sprintf("segment-integration-%d", suffix)
+	s3c := s3.New(sess)
+	if _, err := s3c.CreateBucket(&s3.CreateBucketInput{Bucket: aws.String(bucket)}); err != nil {
+		t.Fatalf("LocalStack unavailable at %s -- %v", endpoint, err)
+	}
+	registry := prometheus.NewRegistry()
+	delivery := NewDelivery(&DeliveryConfig{
+		StreamEndpoint: endpoint,
+		StreamRegion:   "us-west-2",
+		StreamName:     fmt.Sprintf("segment-integration-%d", suffix),
+		FlushInterval:  time.Second,
+		S3Destination: &firehose.ExtendedS3DestinationConfiguration{
+			BucketARN:      aws.String("arn:aws:s3:::" + bucket),
+			RoleARN:        aws.String("arn:aws:iam::000000000000:role/firehose"),
+			BufferingHints: &firehose.BufferingHints{IntervalInSeconds: aws.Int64(60), SizeInMBs: aws.Int64(1)},
+		},
+		Registerer: registry,
+	})
+
+	// Downstream fails the first request, which is retried
+	var attempts atomic.Int32
+	received := make(chan SegmentEvent, 10)
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) == 1 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		var event SegmentEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		received <- event
+	}))
+	defer downstream.Close()
+	webhook := NewTemplate(&TemplateConfig{
+		Name: "webhook",
+		URL:  downstream.URL,
+		BatchConfig: BatchConfig{
+			BatchSize:     1,
+			FlushInterval: 100 * time.Millisecond,
+			Retry:         BackoffConfig{Min: 10 * time.Millisecond, Max: 100 * time.Millisecond, MaxAttempts: 3},
+			Registerer:    registry,
+		},
+	})
+
+	store := NewLocalArchiveStore(t.TempDir())
+	router := mux.NewRouter()
+	s := NewSegment(func(writeKey string) string { return writeKey }, []Destination{delivery, webhook}, router).
+		WithQuarantine(NewQuarantine(store)).
+		WithTransforms(func(ctx context.Context, m *SegmentEvent) error {
+			if m.Event == "Invalid" {
+				return fmt.Errorf("invalid event")
+			}
+			return nil
+		}).
+		WithRegisterer(registry)
+	ctx, cancel := context.WithCancel(context.Background())
+	s.Run(ctx)
+	defer s.WaitStopped()
+	defer cancel()
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	post := func(body string) {
+		res, err := http.Post(server.URL+"/track", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("Unexpected status %s", res.Status)
+		}
+	}
+	messageId := fmt.Sprintf("integration-%d", suffix)
+	post(`{"writeKey":"web","messageId":"` + messageId + `","event":"Order Completed","userId":"user-1","properties":{"total":42}}`)
+	post(`{"writeKey":"web","messageId":"invalid-1","event":"Invalid","userId":"user-1"}`)
+
+	// Delivered to the downstream after a retry
+	select {
+	case event := <-received:
+		if event.MessageId != messageId || event.ProjectId != "web" || event.Properties["total"] != 42.0 {
+			t.Errorf("Unexpected downstream event %+v", event)
+		}
+		if attempts.Load() < 2 {
+			t.Errorf("Expected retry, got %d attempts", attempts.Load())
+		}
+	case <-time.After(10 * time.Second):
+		t.Error("Expected downstream event")
+	}
+
+	// Invalid event quarantined with the reason
+	keys, err := store.List(context.Background(), "")
+	if err != nil || len(keys) != 1 {
+		t.Fatalf("Expected quarantined event, got %v %v", keys, err)
+	}
+	b, _ := store.Get(context.Background(), keys[0])
+	var q QuarantinedEvent
+	if err := json.Unmarshal(b, &q); err != nil || q.Reason != "invalid event" || q.Event == nil || q.Event.MessageId != "invalid-1" {
+		t.Errorf("Unexpected quarantined event %s", b)
+	}
+
+	// Delivered by firehose to S3 once the buffer interval elapses
+	var payload string
+	if !eventually(t, 2*time.Minute, func() bool {
+		payload = ""
+		list, err := s3c.ListObjectsV2(&s3.ListObjectsV2Input{Bucket: aws.String(bucket)})
+		if err != nil {
+			return false
+		}
+		for _, object := range list.Contents {
+			obj, err := s3c.GetObject(&s3.GetObjectInput{Bucket: aws.String(bucket), Key: object.Key})
+			if err != nil {
+				return false
+			}
+			b, _ := io.ReadAll(obj.Body)
+			obj.Body.Close()
+			payload += string(b)
+		}
+		return strings.Contains(payload, messageId)
+	}) {
+		t.Fatalf("Expected event delivered to s3, got %q", payload)
+	}
+	if strings.Contains(payload, "invalid-1") {
+		t.Error("Expected quarantined event not delivered")
+	}
+}
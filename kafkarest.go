@@ -0,0 +1,272 @@
+package segment
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// kafkaRESTMaxBatch is the maximum number of records per produce request
+const kafkaRESTMaxBatch = 1000
+
+// kafkaRESTContentType is the embedded json format of the v2 produce api
+const kafkaRESTContentType = "application/vnd.kafka.json.v2+json"
+
+// KafkaRESTConfig contains configuration parameters for producing to a topic through a kafka rest proxy
+type KafkaRESTConfig struct {
+	Endpoint string `json:"endpoint"` // Rest proxy url eg "https://kafka-rest:8082"
+	Topic    string `json:"topic"`
+	Key      string `json:"key,omitempty"` // Field or dotted path of the record key, defaults to "anonymousId"
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	// ClusterId produces with the v3 records api of the cluster, which sets event, type and projectId record headers
+	// so consumers can filter without decoding values, as the v2 api doesn't support headers
+	ClusterId string `json:"clusterId,omitempty"`
+	// Attributes are header names to dotted paths eg "plan": "properties.plan" in addition to the defaults
+	Attributes map[string]string `json:"attributes,omitempty"`
+	BatchConfig
+}
+
+// KafkaREST is a destination producing events over http to a kafka rest proxy, where the collector can't
+// connect to the brokers directly
+type KafkaREST struct {
+	Logger     *log.Logger // Public logger that caller can override
+	config     KafkaRESTConfig
+	url        string
+	batcher    *batcher
+	partitions *prometheus.CounterVec
+}
+
+// NewKafkaREST creates a new kafka rest proxy destination given configuration
+func NewKafkaREST(config *KafkaRESTConfig) *KafkaREST {
+	if err := config.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	if config.Key == "" {
+		config.Key = "anonymousId"
+	}
+	k := &KafkaREST{
+		Logger: log.New(os.Stderr, "", log.LstdFlags),
+		config: *config,
+		url:    strings.TrimSuffix(config.Endpoint, "/") + "/topics/" + url.PathEscape(config.Topic),
+	}
+	if config.ClusterId != "" {
+		k.url = strings.TrimSuffix(config.Endpoint, "/") + "/v3/clusters/" + url.PathEscape(config.ClusterId) +
+			"/topics/" + url.PathEscape(config.Topic) + "/records"
+	}
+	k.batcher = newBatcher("kafka-rest", config.BatchConfig, kafkaRESTMaxBatch, k.produce)
+	k.partitions = newPartitionCounter(config.Registerer)
+	return k
+}
+
+// Validate checks the endpoint and topic are set
+func (config *KafkaRESTConfig) Validate() error {
+	if config.Endpoint == "" || config.Topic == "" {
+		return fmt.Errorf("Require kafka rest proxy endpoint and topic")
+	}
+	if len(config.Attributes) > 0 && config.ClusterId == "" {
+		return fmt.Errorf("Require kafka cluster id for record headers")
+	}
+	return validateEndpoint(config.Endpoint)
+}
+
+// Name returns the configured destination name
+func (k *KafkaREST) Name() string {
+	return k.batcher.configuredName()
+}
+
+// WithLogger adds optional logging
+func (k *KafkaREST) WithLogger(logger *log.Logger) Destination {
+	if logger != nil {
+		k.Logger = logger
+	}
+	return k
+}
+
+// Process produces batches of records until ctx is done
+func (k *KafkaREST) Process(ctx context.Context) error {
+	return k.batcher.process(ctx, k.Logger)
+}
+
+// Send pushes the message onto the queue
+func (k *KafkaREST) Send(ctx context.Context, message interface{}) error {
+	return k.batcher.send(ctx, message)
+}
+
+// kafkaRESTRecord is a record in the produce request envelope, with a null key if empty
+type kafkaRESTRecord struct {
+	Key   *string      `json:"key"`
+	Value SegmentEvent `json:"value"`
+}
+
+// kafkaRESTOffsets is the produce response, with an error per record that failed
+type kafkaRESTOffsets struct {
+	Offsets []struct {
+		Partition *int   `json:"partition"`
+		Offset    int64  `json:"offset"`
+		ErrorCode *int   `json:"error_code"`
+		Error     string `json:"error"`
+	} `json:"offsets"`
+}
+
+// kafkaRESTData is a key or value of a v3 record
+type kafkaRESTData struct {
+	Type string      `json:"type"`
+	Data interface{} `json:"data"`
+}
+
+// kafkaRESTHeader is a v3 record header, with the value base64 encoded
+type kafkaRESTHeader struct {
+	Name  string `json:"name"`
+	Value []byte `json:"value"`
+}
+
+// kafkaRESTRecordV3 is a record of the v3 records api, with headers from event attributes
+type kafkaRESTRecordV3 struct {
+	Key     *kafkaRESTData    `json:"key,omitempty"`
+	Value   kafkaRESTData     `json:"value"`
+	Headers []kafkaRESTHeader `json:"headers,omitempty"`
+}
+
+// kafkaRESTResult is the v3 response for each record streamed
+type kafkaRESTResult struct {
+	ErrorCode   int    `json:"error_code"`
+	Message     string `json:"message"`
+	PartitionId *int   `json:"partition_id"`
+}
+
+// produce posts the batch to the v2 or v3 api, returning an error if any record failed
+func (k *KafkaREST) produce(ctx context.Context, batch []SegmentEvent) error {
+	if k.config.ClusterId != "" {
+		return k.produceV3(ctx, batch)
+	}
+	envelope := struct {
+		Records []kafkaRESTRecord `json:"records"`
+	}{Records: make([]kafkaRESTRecord, len(batch))}
+	for i := range batch {
+		envelope.Records[i].Value = batch[i]
+		if key := eventField(&batch[i], k.config.Key); key != "" {
+			envelope.Records[i].Key = &key
+		}
+	}
+	body, err := json.Marshal(envelope)
+	if err != nil {
+		return fmt.Errorf("Marshal error -- %v", err)
+	}
+	data, err := k.post(ctx, body, kafkaRESTContentType, "application/vnd.kafka.v2+json")
+	if err != nil {
+		return err
+	}
+
+	// Records may fail individually, eg a partition leader is unavailable, so the failed records are retried
+	var offsets kafkaRESTOffsets
+	if err := json.Unmarshal(data, &offsets); err != nil {
+		return fmt.Errorf("Kafka rest response error -- %v", err)
+	}
+	results := make([]kafkaRESTResult, len(offsets.Offsets))
+	for i, offset := range offsets.Offsets {
+		results[i] = kafkaRESTResult{ErrorCode: http.StatusOK, PartitionId: offset.Partition}
+		if offset.ErrorCode != nil {
+			results[i] = kafkaRESTResult{ErrorCode: *offset.ErrorCode, Message: offset.Error, PartitionId: offset.Partition}
+		}
+	}
+	return k.results(batch, results)
+}
+
+// results counts the records of each partition, returning a partial error with the events that failed or have no
+// result, so records for other partitions aren't sent again
+func (k *KafkaREST) results(batch []SegmentEvent, results []kafkaRESTResult) error {
+	var failed []SegmentEvent
+	var last string
+	for i := range batch {
+		if i >= len(results) {
+			failed = append(failed, batch[i:]...)
+			last = "no result"
+			break
+		}
+		result := partitionSuccess
+		if results[i].ErrorCode != http.StatusOK {
+			result = partitionFailed
+			failed = append(failed, batch[i])
+			last = fmt.Sprintf("%d %s", results[i].ErrorCode, results[i].Message)
+		}
+		if results[i].PartitionId != nil {
+			k.partitions.WithLabelValues(k.batcher.name, strconv.Itoa(*results[i].PartitionId), result).Inc()
+		}
+	}
+	if len(failed) > 0 {
+		return &partialError{failed: failed, err: fmt.Errorf("Kafka rest %d of %d records failed -- %s", len(failed), len(batch), last)}
+	}
+	return nil
+}
+
+// produceV3 streams the batch as records with headers, which returns a result per record
+func (k *KafkaREST) produceV3(ctx context.Context, batch []SegmentEvent) error {
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for i := range batch {
+		record := kafkaRESTRecordV3{Value: kafkaRESTData{Type: "JSON", Data: batch[i]}}
+		if key := eventField(&batch[i], k.config.Key); key != "" {
+			record.Key = &kafkaRESTData{Type: "JSON", Data: key}
+		}
+		for name, value := range eventAttributes(&batch[i], k.config.Attributes) {
+			record.Headers = append(record.Headers, kafkaRESTHeader{Name: name, Value: []byte(fmt.Sprint(value))})
+		}
+		sort.Slice(record.Headers, func(i, j int) bool { return record.Headers[i].Name < record.Headers[j].Name })
+		if err := encoder.Encode(record); err != nil {
+			return fmt.Errorf("Marshal error -- %v", err)
+		}
+	}
+	data, err := k.post(ctx, body.Bytes(), "application/json", "application/json")
+	if err != nil {
+		return err
+	}
+
+	var results []kafkaRESTResult
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	for decoder.More() {
+		var result kafkaRESTResult
+		if err := decoder.Decode(&result); err != nil {
+			return fmt.Errorf("Kafka rest response error -- %v", err)
+		}
+		results = append(results, result)
+	}
+	return k.results(batch, results)
+}
+
+// post sends the body returning the response, or a status error
+func (k *KafkaREST) post(ctx context.Context, body []byte, contentType, accept string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, k.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Accept", accept)
+	if k.config.Username != "" {
+		req.SetBasicAuth(k.config.Username, k.config.Password)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if res.StatusCode >= 300 {
+		if len(data) > 4096 {
+			data = data[:4096]
+		}
+		return nil, &httpStatusError{StatusCode: res.StatusCode, Body: string(data)}
+	}
+	return data, nil
+}
@@ -0,0 +1,103 @@
+package segment
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestKafkaRESTProduce(t *testing.T) {
+	var mu sync.Mutex
+	var requests int
+	var records []kafkaRESTRecord
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		user, _, _ := r.BasicAuth()
+		if r.URL.Path != "/topics/segment.events" || r.Header.Get("Content-Type") != kafkaRESTContentType || user != "collector" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		requests++
+		var envelope struct{ Records []kafkaRESTRecord }
+		json.NewDecoder(r.Body).Decode(&envelope)
+		records = append(records, envelope.Records...)
+		if requests == 1 {
+			// Fail a record in the first request so only that record is retried
+			io.WriteString(w, `{"offsets":[{"partition":0,"offset":1},{"partition":1,"error_code":50003,"error":"leader not available"}]}`)
+			return
+		}
+		io.WriteString(w, `{"offsets":[{"partition":1,"offset":2}]}`)
+	}))
+	defer server.Close()
+
+	dest := NewKafkaREST(&KafkaRESTConfig{
+		Endpoint: server.URL + "/", Topic: "segment.events", Username: "collector", Password: "secret", BatchConfig: testBatchConfig(),
+	})
+	processBatch(t, dest,
+		SegmentEvent{SegmentMessage: SegmentMessage{MessageId: "1", AnonymousId: "a1"}},
+		SegmentEvent{SegmentMessage: SegmentMessage{MessageId: "2"}},
+	)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if requests != 2 || len(records) != 3 || records[2].Value.MessageId != "2" {
+		t.Fatalf("Expected failed record produced after retry, got %d requests %+v", requests, records)
+	}
+	if records[0].Key == nil || *records[0].Key != "a1" || records[1].Key != nil || records[1].Value.MessageId != "2" {
+		t.Errorf("Expected records keyed by anonymous id, got %+v", records)
+	}
+	if got := testutil.ToFloat64(dest.partitions.WithLabelValues("kafka-rest", "1", partitionFailed)); got != 1 {
+		t.Errorf("Expected 1 failed record for partition 1, got %v", got)
+	}
+}
+
+func TestKafkaRESTHeaders(t *testing.T) {
+	if err := (&KafkaRESTConfig{Endpoint: "http://kafka-rest", Topic: "events", Attributes: map[string]string{"plan": "properties.plan"}}).Validate(); err == nil {
+		t.Error("Expected cluster id required for headers")
+	}
+	var mu sync.Mutex
+	var records []kafkaRESTRecordV3
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v3/clusters/lkc-1/topics/segment.events/records" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		decoder := json.NewDecoder(r.Body)
+		for decoder.More() {
+			var record kafkaRESTRecordV3
+			decoder.Decode(&record)
+			records = append(records, record)
+			io.WriteString(w, `{"error_code":200,"partition_id":0,"offset":1}`)
+		}
+	}))
+	defer server.Close()
+
+	dest := NewKafkaREST(&KafkaRESTConfig{
+		Endpoint: server.URL, Topic: "segment.events", ClusterId: "lkc-1",
+		Attributes: map[string]string{"plan": "properties.plan"}, BatchConfig: testBatchConfig(),
+	})
+	processBatch(t, dest, SegmentEvent{SegmentMessage: SegmentMessage{
+		Type: "track", Event: "Upgraded", ProjectId: "web", AnonymousId: "a1", Properties: map[string]interface{}{"plan": "pro"},
+	}})
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(records) != 1 || records[0].Key == nil || records[0].Key.Data != "a1" {
+		t.Fatalf("Expected keyed record, got %+v", records)
+	}
+	headers := make(map[string]string)
+	for _, header := range records[0].Headers {
+		headers[header.Name] = string(header.Value)
+	}
+	if headers["event"] != "Upgraded" || headers["type"] != "track" || headers["projectId"] != "web" || headers["plan"] != "pro" {
+		t.Errorf("Unexpected headers %v", headers)
+	}
+}
@@ -0,0 +1,76 @@
+package segment
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// lateContextKey is the context flag set on late events
+const lateContextKey = "late"
+
+// LateConfig contains the age beyond which events are late, and an optional backfill destination
+type LateConfig struct {
+	Threshold time.Duration `json:"threshold,omitempty"` // Defaults to 24 hours
+	// Backfill is the only destination sent late events, and is not sent on time events, which must be a segment
+	// destination, nil to send late events to all destinations
+	Backfill Destination `json:"-"`
+	// Registerer for metrics, defaults to the prometheus default registerer
+	Registerer prometheus.Registerer `json:"-"`
+}
+
+// LateEvents flags events whose timestamp is older than the threshold, so they don't corrupt near real-time aggregates
+type LateEvents struct {
+	config LateConfig
+	late   *prometheus.CounterVec
+}
+
+// NewLateEvents creates late event detection given config defaults
+func NewLateEvents(config LateConfig) *LateEvents {
+	if config.Threshold <= 0 {
+		config.Threshold = 24 * time.Hour
+	}
+	return &LateEvents{
+		config: config,
+		late: newCounterVec(config.Registerer, prometheus.CounterOpts{
+			Name: "events_late_total",
+			Help: "Events with a timestamp older than the late threshold total by project",
+		}, "project"),
+	}
+}
+
+// WithLateEvents sets a late context flag on events older than the threshold, and sends them to the backfill
+// destination if configured
+func (s *Segment) WithLateEvents(late *LateEvents) *Segment {
+	if backfill := late.config.Backfill; backfill != nil {
+		found := false
+		for _, d := range s.destinations {
+			found = found || d.Destination == backfill
+		}
+		if !found {
+			s.Logger.Printf("Late backfill %T not found, late events are sent to all destinations\n", backfill)
+			late.config.Backfill = nil
+		}
+	}
+	s.late = late
+	return s
+}
+
+// tag sets the late context flag and returns true if the event timestamp is older than the threshold
+func (l *LateEvents) tag(m *SegmentEvent, now time.Time) bool {
+	if l == nil || m.Timestamp.IsZero() || now.Sub(m.Timestamp) <= l.config.Threshold {
+		return false
+	}
+	m.Context = cloneMap(m.Context) // Shared between events in a batch
+	m.Context[lateContextKey] = true
+	l.late.WithLabelValues(m.ProjectId).Inc()
+	return true
+}
+
+// accepts returns true if the destination is sent late or on time events, only the backfill is sent late events
+func (l *LateEvents) accepts(dest Destination, late bool) bool {
+	if l == nil || l.config.Backfill == nil {
+		return true
+	}
+	return (dest == l.config.Backfill) == late
+}
@@ -0,0 +1,42 @@
+package segment
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestLateEvents(t *testing.T) {
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	shared := map[string]interface{}{"library": "analytics.js"}
+	event := func(age time.Duration, name string) SegmentEvent {
+		return SegmentEvent{SegmentMessage: SegmentMessage{
+			Type: "track", Event: name, ProjectId: "web", Timestamp: now.Add(-age), SentAt: now, Context: shared,
+		}}
+	}
+
+	realtime, backfill := &testDestination{}, &testDestination{}
+	s := NewSegment(func(writeKey string) string { return writeKey }, []Destination{realtime, backfill}, nil).
+		WithClock(newTestClock(now))
+	late := NewLateEvents(LateConfig{Backfill: backfill, Registerer: prometheus.NewRegistry()})
+	s.WithLateEvents(late)
+	for _, m := range []SegmentEvent{event(time.Hour, "On Time"), event(48*time.Hour, "Offline")} {
+		if err := s.send(context.Background(), m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Late events are flagged and only sent to the backfill, without modifying the shared context
+	if sent := realtime.sent(); len(sent) != 1 || sent[0].(SegmentEvent).Event != "On Time" || sent[0].(SegmentEvent).Context["late"] != nil {
+		t.Errorf("Expected on time event sent in real time, got %v", sent)
+	}
+	if sent := backfill.sent(); len(sent) != 1 || sent[0].(SegmentEvent).Context["late"] != true {
+		t.Errorf("Expected late event flagged to backfill, got %v", sent)
+	}
+	if _, ok := shared["late"]; ok || testutil.ToFloat64(late.late.WithLabelValues("web")) != 1 {
+		t.Errorf("Expected 1 late event counted without modifying the context, got %v", shared)
+	}
+}
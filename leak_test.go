@@ -0,0 +1,103 @@
+package segment
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// leakGracePeriod allows goroutines that exit asynchronously on cancel to return before reporting a leak
+const leakGracePeriod = 2 * time.Second
+
+// checkLeaks fails the test if goroutines running package code, started after this is called, are still running
+// once the test and its deferred cleanup have returned
+func checkLeaks(t *testing.T) {
+	t.Helper()
+	before := make(map[string]bool)
+	for _, g := range goroutines() {
+		before[goroutineId(g)] = true
+	}
+	t.Cleanup(func() {
+		deadline := time.Now().Add(leakGracePeriod)
+		for {
+			var leaked []string
+			for _, g := range goroutines() {
+				if !before[goroutineId(g)] && strings.Contains(g, "github.com/brightsparc/segment.") &&
+					!strings.Contains(g, "segment.checkLeaks") {
+					leaked = append(leaked, g)
+				}
+			}
+			if len(leaked) == 0 {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Errorf("Leaked %d goroutines:\n\n%s", len(leaked), strings.Join(leaked, "\n\n"))
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+}
+
+// goroutines returns the stack of each goroutine
+func goroutines() []string {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return strings.Split(string(bytes.TrimSpace(buf[:n])), "\n\n")
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
+
+// goroutineId returns the "goroutine N" prefix of a stack
+func goroutineId(stack string) string {
+	fields := strings.SplitN(stack, " ", 3)
+	if len(fields) < 2 {
+		return stack
+	}
+	return fields[0] + " " + fields[1]
+}
+
+func TestRunStopsProcesses(t *testing.T) {
+	checkLeaks(t)
+	fh := newFakeFirehose(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	registry := prometheus.NewRegistry()
+	delivery := NewDelivery(&DeliveryConfig{
+		StreamEndpoint: fh.URL,
+		StreamRegion:   "us-west-2",
+		StreamName:     "test",
+		Registerer:     registry,
+	})
+	forwarder := NewForwarderWithConfig(&ForwarderConfig{
+		Endpoint:   server.URL,
+		Failover:   &FailoverConfig{Endpoints: []string{server.URL + "/secondary"}},
+		Registerer: registry,
+	})
+	s := NewSegment(func(writeKey string) string { return writeKey }, []Destination{delivery, forwarder}, mux.NewRouter()).
+		WithDestinationOptions(forwarder, DestinationOptions{Spool: &SpoolConfig{MemoryEvents: 10}}).
+		WithHeartbeats(NewHeartbeats(HeartbeatConfig{Registerer: registry})).
+		WithWatchdog(NewWatchdog(WatchdogConfig{Registerer: registry})).
+		WithRegisterer(registry)
+
+	// Each config reload stops the previous segment's processes
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		s.Run(ctx)
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+		s.WaitStopped()
+	}
+}
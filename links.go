@@ -0,0 +1,148 @@
+package segment
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// trackingPixel is a transparent 1x1 gif
+var trackingPixel, _ = base64.StdEncoding.DecodeString("R0lGODlhAQABAIAAAAAAAP///yH5BAEAAAAALAAAAAABAAEAAAIBRAA7")
+
+// Links signs email open pixel and click redirect urls, so events can't be forged and redirects aren't open
+type Links struct {
+	secret []byte
+}
+
+// NewLinks creates link signing with the secret
+func NewLinks(secret string) *Links {
+	return &Links{secret: []byte(secret)}
+}
+
+// sign returns the signature of the path and params, excluding any existing signature
+func (l *Links) sign(path string, params url.Values) string {
+	unsigned := url.Values{}
+	for k, v := range params {
+		if k != "sig" {
+			unsigned[k] = v
+		}
+	}
+	mac := hmac.New(sha256.New, l.secret)
+	mac.Write([]byte(path + "?" + unsigned.Encode())) // Encode sorts by key
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// signedURL returns base url with the path and signed params
+func (l *Links) signedURL(base, path string, params url.Values) string {
+	params.Set("sig", l.sign(path, params))
+	return strings.TrimSuffix(base, "/") + path + "?" + params.Encode()
+}
+
+// linkParams returns the writeKey and properties as params, where userId and anonymousId identify the user
+func linkParams(writeKey string, properties map[string]string) url.Values {
+	params := url.Values{"writeKey": {writeKey}}
+	for k, v := range properties {
+		params.Set(k, v)
+	}
+	return params
+}
+
+// ClickURL returns a signed /r url under base that records an "Email Link Clicked" event and redirects to target
+func (l *Links) ClickURL(base, writeKey, target string, properties map[string]string) string {
+	params := linkParams(writeKey, properties)
+	params.Set("url", target)
+	return l.signedURL(base, "/r", params)
+}
+
+// OpenURL returns a signed /open pixel url under base that records an "Email Opened" event
+func (l *Links) OpenURL(base, writeKey string, properties map[string]string) string {
+	return l.signedURL(base, "/open", linkParams(writeKey, properties))
+}
+
+// verify returns true if the request params are signed for the route path
+func (l *Links) verify(path string, params url.Values) bool {
+	return hmac.Equal([]byte(params.Get("sig")), []byte(l.sign(path, params)))
+}
+
+// MountLinks adds GET /r redirect and /open pixel endpoints for signed links from Links, which record a track event
+func (s *Segment) MountLinks(router *mux.Router, links *Links) *Segment {
+	s.Logger.Println("Adding link tracking handlers")
+	router.HandleFunc("/r", func(w http.ResponseWriter, r *http.Request) {
+		target, err := url.Parse(r.URL.Query().Get("url"))
+		if err != nil || (target.Scheme != "http" && target.Scheme != "https") {
+			writeError(w, http.StatusBadRequest, "invalid_request", "Expected http url")
+			return
+		}
+		if !s.trackLink(r, links, "/r", "Email Link Clicked") {
+			writeError(w, http.StatusForbidden, "invalid_signature", "Invalid link signature")
+			return
+		}
+		http.Redirect(w, r, target.String(), http.StatusFound)
+	}).Methods("GET", "HEAD")
+	router.HandleFunc("/open", func(w http.ResponseWriter, r *http.Request) {
+		if !s.trackLink(r, links, "/open", "Email Opened") {
+			writeError(w, http.StatusForbidden, "invalid_signature", "Invalid link signature")
+			return
+		}
+		w.Header().Set("Content-Type", "image/gif")
+		w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+		w.Write(trackingPixel)
+	}).Methods("GET", "HEAD")
+	return s
+}
+
+// trackLink verifies the link signature and records the event, returning false if the signature is invalid.  The
+// event is best effort once verified, so quota and send errors don't break the redirect or pixel.
+func (s *Segment) trackLink(r *http.Request, links *Links, path, name string) bool {
+	params := r.URL.Query()
+	if !links.verify(path, params) {
+		s.Logger.Printf("Link %s signature invalid\n", path)
+		s.audit.Record(AuditAuthFailure, path, s.clientIP(r), map[string]string{"reason": "link signature"})
+		s.drop(DropUnauthorized, 1)
+		return false
+	}
+	receivedAt := time.Now()
+	projectId := s.projectId(params.Get("writeKey"))
+	if projectId == "" {
+		s.Logger.Printf("Link %s unable to get projectId\n", path)
+		s.drop(DropUnauthorized, 1)
+		return true
+	}
+	if ok, _ := s.quotas.allow(projectId, 1, receivedAt); !ok {
+		s.drop(DropQuotaExceeded, 1)
+		return true
+	}
+
+	event := SegmentEvent{
+		WriteKey: params.Get("writeKey"),
+		SegmentMessage: SegmentMessage{
+			ProjectId:   projectId,
+			Type:        "track",
+			Event:       name,
+			UserId:      params.Get("userId"),
+			AnonymousId: params.Get("anonymousId"),
+			ReceivedAt:  receivedAt,
+			Properties:  make(map[string]interface{}),
+			Context:     s.withClientIP(map[string]interface{}{"userAgent": r.UserAgent()}, r),
+		},
+	}
+	for k := range params {
+		switch k {
+		case "writeKey", "userId", "anonymousId", "sig":
+		default:
+			event.Properties[k] = params.Get(k)
+		}
+	}
+	if err := s.deliver(r, []SegmentEvent{event}); err != nil {
+		s.Logger.Println("Send error", err)
+		return true
+	}
+	s.meter.record(projectId, 1, 0, receivedAt)
+	return true
+}
@@ -0,0 +1,61 @@
+package segment
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestLinks(t *testing.T) {
+	dest := &testDestination{}
+	router := mux.NewRouter()
+	s := NewSegment(func(writeKey string) string { return strings.TrimPrefix(writeKey, "key-") }, []Destination{dest}, nil)
+	links := NewLinks("secret")
+	s.MountLinks(router, links)
+
+	properties := map[string]string{"userId": "u1", "campaign": "launch"}
+	click := links.ClickURL("https://t.example.com/", "key-email", "https://example.com/launch?ref=email", properties)
+	open := links.OpenURL("https://t.example.com", "key-email", properties)
+	forged := links.ClickURL("https://t.example.com", "key-email", "https://evil.example.com", nil)
+	forged = strings.Replace(forged, "evil", "phish", 1)
+
+	for _, test := range []struct {
+		url    string
+		status int
+	}{
+		{click, http.StatusFound},
+		{open, http.StatusOK},
+		{forged, http.StatusForbidden},
+		{strings.Replace(open, "launch", "other", 1), http.StatusForbidden},
+		{strings.Replace(open, "/open", "/r", 1), http.StatusBadRequest}, // No url
+	} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", test.url, nil))
+		if w.Code != test.status {
+			t.Errorf("Expected %d for %s, got %d", test.status, test.url, w.Code)
+		}
+		if test.url == click && w.Header().Get("Location") != "https://example.com/launch?ref=email" {
+			t.Errorf("Unexpected redirect %s", w.Header().Get("Location"))
+		}
+		if test.url == open && (w.Header().Get("Content-Type") != "image/gif" || w.Body.Len() != len(trackingPixel)) {
+			t.Errorf("Expected pixel, got %s", w.Header().Get("Content-Type"))
+		}
+	}
+
+	sent := dest.sent()
+	if len(sent) != 2 {
+		t.Fatalf("Expected 2 events, got %d", len(sent))
+	}
+	for i, name := range []string{"Email Link Clicked", "Email Opened"} {
+		m := sent[i].(SegmentEvent)
+		if m.Event != name || m.UserId != "u1" || m.ProjectId != "email" || m.Properties["campaign"] != "launch" {
+			t.Errorf("Unexpected event %+v", m.SegmentMessage)
+		}
+	}
+	if url := sent[0].(SegmentEvent).Properties["url"]; url != "https://example.com/launch?ref=email" {
+		t.Errorf("Expected clicked url, got %v", url)
+	}
+}
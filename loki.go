@@ -0,0 +1,174 @@
+package segment
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// lokiMaxBatch is the maximum number of events per push request
+const lokiMaxBatch = 5000
+
+// LokiConfig contains configuration parameters for the loki push destination
+type LokiConfig struct {
+	Endpoint string `json:"endpoint"`           // Loki base url eg "http://loki:3100"
+	TenantId string `json:"tenantId,omitempty"` // Sent as X-Scope-OrgID for multi-tenant loki
+	Username string `json:"username,omitempty"` // Basic auth eg for grafana cloud
+	Password string `json:"password,omitempty"`
+	// Labels are label names to event fields, either "projectId", "type", "event" or "channel", or a dotted
+	// path eg "context.library.name".  Defaults to projectId and type, and should be low cardinality.
+	Labels map[string]string `json:"labels,omitempty"`
+	BatchConfig
+}
+
+// Loki is a destination pushing events as json log lines to grafana loki, in streams by label
+type Loki struct {
+	Logger  *log.Logger // Public logger that caller can override
+	config  LokiConfig
+	batcher *batcher
+}
+
+// NewLoki creates a new loki destination given configuration
+func NewLoki(config *LokiConfig) *Loki {
+	if err := config.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	if len(config.Labels) == 0 {
+		config.Labels = map[string]string{"projectId": "projectId", "type": "type"}
+	}
+	l := &Loki{
+		Logger: log.New(os.Stderr, "", log.LstdFlags),
+		config: *config,
+	}
+	l.batcher = newHTTPBatcher("loki", config.BatchConfig, lokiMaxBatch, l.request)
+	return l
+}
+
+// Validate checks the endpoint is an http(s) url
+func (config *LokiConfig) Validate() error {
+	return validateEndpoint(config.Endpoint)
+}
+
+// Check checks the endpoint is reachable
+func (config *LokiConfig) Check(ctx context.Context) error {
+	return checkEndpoint(ctx, config.Endpoint)
+}
+
+// Name returns the configured destination name
+func (l *Loki) Name() string {
+	return l.batcher.configuredName()
+}
+
+// WithLogger adds optional logging
+func (l *Loki) WithLogger(logger *log.Logger) Destination {
+	if logger != nil {
+		l.Logger = logger
+	}
+	return l
+}
+
+// Process pushes batches of events until ctx is done
+func (l *Loki) Process(ctx context.Context) error {
+	return l.batcher.process(ctx, l.Logger)
+}
+
+// Send pushes the message onto the queue
+func (l *Loki) Send(ctx context.Context, message interface{}) error {
+	return l.batcher.send(ctx, message)
+}
+
+// eventField returns a top level field by json name, or the string value at a dotted path
+func eventField(m *SegmentEvent, field string) string {
+	switch field {
+	case "projectId":
+		return m.ProjectId
+	case "type":
+		return m.Type
+	case "event":
+		return eventName(m.SegmentMessage)
+	case "channel":
+		return m.Channel
+	case "messageId":
+		return m.MessageId
+	case "userId":
+		return m.UserId
+	case "anonymousId":
+		return m.AnonymousId
+	case "groupId":
+		return m.GroupId
+	}
+	if value := lookupEventPath(m, field); value != nil {
+		return fmt.Sprint(value)
+	}
+	return ""
+}
+
+// lokiStream is a set of labels with values of timestamp in nanoseconds and log line
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+// request builds the push request with a stream per label set, ordered by timestamp
+func (l *Loki) request(ctx context.Context, batch []SegmentEvent) (*http.Request, error) {
+	streams := make(map[string]*lokiStream)
+	var keys []string
+	for i := range batch {
+		m := &batch[i]
+		labels := make(map[string]string, len(l.config.Labels))
+		for name, field := range l.config.Labels {
+			if value := eventField(m, field); value != "" {
+				labels[name] = value
+			}
+		}
+		b, _ := json.Marshal(labels) // Sorted keys identify the stream
+		key := string(b)
+		stream, ok := streams[key]
+		if !ok {
+			stream = &lokiStream{Stream: labels}
+			streams[key] = stream
+			keys = append(keys, key)
+		}
+		line, err := json.Marshal(m)
+		if err != nil {
+			return nil, fmt.Errorf("Marshal error -- %v", err)
+		}
+		stream.Values = append(stream.Values, [2]string{strconv.FormatInt(m.Timestamp.UnixNano(), 10), string(line)})
+	}
+
+	push := struct {
+		Streams []*lokiStream `json:"streams"`
+	}{}
+	for _, key := range keys {
+		stream := streams[key]
+		sort.SliceStable(stream.Values, func(i, j int) bool {
+			a, _ := strconv.ParseInt(stream.Values[i][0], 10, 64)
+			b, _ := strconv.ParseInt(stream.Values[j][0], 10, 64)
+			return a < b
+		})
+		push.Streams = append(push.Streams, stream)
+	}
+	b, err := json.Marshal(push)
+	if err != nil {
+		return nil, fmt.Errorf("Marshal error -- %v", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", strings.TrimSuffix(l.config.Endpoint, "/")+"/loki/api/v1/push", bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if l.config.TenantId != "" {
+		req.Header.Set("X-Scope-OrgID", l.config.TenantId)
+	}
+	if l.config.Username != "" {
+		req.SetBasicAuth(l.config.Username, l.config.Password)
+	}
+	return req, nil
+}
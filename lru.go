@@ -0,0 +1,68 @@
+package segment
+
+import (
+	"container/list"
+	"time"
+)
+
+// lruCache is a size bounded least recently used cache with optional ttl, it is not safe for concurrent use
+type lruCache[V any] struct {
+	size    int
+	ttl     time.Duration
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+type lruEntry[V any] struct {
+	key     string
+	value   V
+	updated time.Time
+}
+
+func newLRUCache[V any](size int, ttl time.Duration) *lruCache[V] {
+	return &lruCache[V]{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// get returns the value if present and not expired, marking it recently used
+func (c *lruCache[V]) get(key string) (V, bool) {
+	el, ok := c.entries[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	entry := el.Value.(*lruEntry[V])
+	if c.ttl > 0 && time.Since(entry.updated) > c.ttl {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		var zero V
+		return zero, false
+	}
+	c.order.MoveToFront(el)
+	return entry.value, true
+}
+
+// put sets the value, evicting the least recently used beyond size
+func (c *lruCache[V]) put(key string, value V) {
+	if el, ok := c.entries[key]; ok {
+		entry := el.Value.(*lruEntry[V])
+		entry.value, entry.updated = value, time.Now()
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&lruEntry[V]{key: key, value: value, updated: time.Now()})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry[V]).key)
+	}
+}
+
+// len returns the number of entries including any expired
+func (c *lruCache[V]) len() int {
+	return c.order.Len()
+}
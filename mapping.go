@@ -0,0 +1,138 @@
+package segment
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+)
+
+// MappingConfig declares event renames and property mappings, eg to normalize legacy client events
+type MappingConfig struct {
+	Events     map[string]string `json:"events,omitempty"`     // Old event name to new name
+	Properties []PropertyMapping `json:"properties,omitempty"` // Applied in order after events are renamed
+}
+
+// PropertyMapping moves and coerces a value at a dotted path within context, properties or traits
+type PropertyMapping struct {
+	Event string `json:"event,omitempty"` // Only for this event name, empty for all
+	From  string `json:"from"`            // Path of the value eg "properties.total"
+	To    string `json:"to,omitempty"`    // Path to move the value to, empty to keep in place
+	Type  string `json:"type,omitempty"`  // Coerce to "string", "number", "integer" or "boolean"
+}
+
+// Mapping returns a transform that applies the config, coercion failures leave the value unchanged
+func Mapping(config MappingConfig) (Transform, error) {
+	for _, p := range config.Properties {
+		if !validPath(p.From) || (p.To != "" && !validPath(p.To)) {
+			return nil, fmt.Errorf("Mapping paths %q and %q must be within context, properties or traits", p.From, p.To)
+		}
+		switch p.Type {
+		case "", "string", "number", "integer", "boolean":
+		default:
+			return nil, fmt.Errorf("Mapping type %q unknown", p.Type)
+		}
+	}
+
+	return func(ctx context.Context, m *SegmentEvent) error {
+		if name, ok := config.Events[m.Event]; ok && m.Event != "" {
+			m.Event = name
+		}
+		maps := eventMaps(m)
+		for _, p := range config.Properties {
+			if p.Event != "" && p.Event != eventName(m.SegmentMessage) {
+				continue
+			}
+			from := splitPath(p.From)
+			value := lookupEventPath(m, p.From)
+			if value == nil {
+				continue
+			}
+			if p.Type != "" {
+				var ok bool
+				if value, ok = coerce(value, p.Type); !ok {
+					continue
+				}
+			}
+			to := from
+			if p.To != "" {
+				to = splitPath(p.To)
+				*maps[from[0]] = deletePath(*maps[from[0]], from[1:])
+			}
+			*maps[to[0]] = setPath(*maps[to[0]], to[1:], value)
+		}
+		return nil
+	}, nil
+}
+
+// validPath returns true for a path to a field within context, properties or traits
+func validPath(path string) bool {
+	keys := splitPath(path)
+	if len(keys) < 2 {
+		return false
+	}
+	for _, root := range filterRoots {
+		if keys[0] == root {
+			return true
+		}
+	}
+	return false
+}
+
+// setPath returns m with value set at keys, copying maps along the path rather than modifying them
+func setPath(m map[string]interface{}, keys []string, value interface{}) map[string]interface{} {
+	c := cloneMap(m)
+	if len(keys) == 1 {
+		c[keys[0]] = value
+		return c
+	}
+	next, _ := c[keys[0]].(map[string]interface{})
+	c[keys[0]] = setPath(next, keys[1:], value)
+	return c
+}
+
+// coerce converts a json value to the type, returning false if it can't be converted
+func coerce(value interface{}, typ string) (interface{}, bool) {
+	switch typ {
+	case "string":
+		switch v := value.(type) {
+		case string:
+			return v, true
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64), true
+		case bool:
+			return strconv.FormatBool(v), true
+		}
+	case "number", "integer":
+		var f float64
+		switch v := value.(type) {
+		case float64:
+			f = v
+		case string:
+			var err error
+			if f, err = strconv.ParseFloat(v, 64); err != nil {
+				return value, false
+			}
+		case bool:
+			if v {
+				f = 1
+			}
+		default:
+			return value, false
+		}
+		if typ == "integer" {
+			return int64(f), true
+		}
+		return f, true
+	case "boolean":
+		switch v := value.(type) {
+		case bool:
+			return v, true
+		case float64:
+			return v != 0, true
+		case string:
+			b, err := strconv.ParseBool(v)
+			return b, err == nil
+		}
+	}
+	return value, false
+}
@@ -0,0 +1,42 @@
+package segment
+
+import (
+	"context"
+	"testing"
+)
+
+func TestMapping(t *testing.T) {
+	mapping, err := Mapping(MappingConfig{
+		Events: map[string]string{"order_complete": "Order Completed"},
+		Properties: []PropertyMapping{
+			{Event: "Order Completed", From: "properties.total", To: "properties.revenue", Type: "number"},
+			{From: "properties.campaign", To: "context.campaign.name"},
+			{From: "traits.age", Type: "integer"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := &SegmentEvent{SegmentMessage: SegmentMessage{Type: "track", Event: "order_complete",
+		Properties: map[string]interface{}{"total": "9.99", "campaign": "spring"},
+		Traits:     map[string]interface{}{"age": "x"},
+	}}
+	mapping(context.Background(), m)
+	if m.Event != "Order Completed" || m.Properties["revenue"] != 9.99 {
+		t.Errorf("Expected renamed event and coerced revenue, got %q %v", m.Event, m.Properties)
+	}
+	if _, ok := m.Properties["total"]; ok {
+		t.Errorf("Expected total moved, got %v", m.Properties)
+	}
+	if lookupPath(m.Context, "campaign.name") != "spring" {
+		t.Errorf("Expected campaign moved to context, got %v", m.Context)
+	}
+	if m.Traits["age"] != "x" {
+		t.Errorf("Expected failed coercion unchanged, got %v", m.Traits["age"])
+	}
+
+	if _, err := Mapping(MappingConfig{Properties: []PropertyMapping{{From: "userId"}}}); err == nil {
+		t.Error("Expected invalid path error")
+	}
+}
@@ -0,0 +1,112 @@
+package segment
+
+import (
+	"context"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// UsageRecord is the events and bytes accepted for a project in an hour since the last export,
+// so records should be summed by project and hour
+type UsageRecord struct {
+	Type      string    `json:"type"` // Always "usage"
+	ProjectId string    `json:"projectId"`
+	Hour      time.Time `json:"hour"`
+	Events    int64     `json:"events"`
+	Bytes     int64     `json:"bytes"`
+}
+
+type usageKey struct {
+	projectId string
+	hour      time.Time
+}
+
+// Meter counts accepted events and bytes per project per hour, exporting usage records to a destination
+type Meter struct {
+	Logger   *log.Logger // Public logger that caller can override
+	mu       sync.Mutex
+	usage    map[usageKey]*UsageRecord
+	dest     *destination
+	interval time.Duration
+}
+
+// NewMeter creates a meter exporting usage records to dest every interval, defaults to 1 minute
+func NewMeter(dest Destination, interval time.Duration) *Meter {
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	return &Meter{
+		Logger:   log.New(os.Stderr, "", log.LstdFlags),
+		usage:    make(map[usageKey]*UsageRecord),
+		dest:     &destination{Destination: dest, name: "meter"},
+		interval: interval,
+	}
+}
+
+// WithMeter counts accepted events with the meter, which is exported while running
+func (s *Segment) WithMeter(meter *Meter) *Segment {
+	s.meter = meter
+	return s
+}
+
+// record adds accepted events and bytes for the project in the current hour
+func (m *Meter) record(projectId string, events, bytes int, now time.Time) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.add(UsageRecord{Type: "usage", ProjectId: projectId, Hour: now.UTC().Truncate(time.Hour), Events: int64(events), Bytes: int64(bytes)})
+}
+
+func (m *Meter) add(r UsageRecord) {
+	key := usageKey{r.ProjectId, r.Hour}
+	if usage, ok := m.usage[key]; ok {
+		usage.Events += r.Events
+		usage.Bytes += r.Bytes
+		return
+	}
+	m.usage[key] = &r
+}
+
+// export sends usage records since the last export, keeping any that fail to send for the next export
+func (m *Meter) export(ctx context.Context) error {
+	m.mu.Lock()
+	usage := m.usage
+	m.usage = make(map[usageKey]*UsageRecord)
+	m.mu.Unlock()
+
+	var first error
+	for _, r := range usage {
+		if first == nil {
+			if first = m.dest.sendRetry(ctx, *r); first == nil {
+				continue
+			}
+		}
+		m.mu.Lock()
+		m.add(*r)
+		m.mu.Unlock()
+	}
+	return first
+}
+
+// run exports usage every interval until ctx is done, then exports the remainder
+func (m *Meter) run(ctx context.Context) {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := m.export(ctx); err != nil {
+				m.Logger.Printf("Meter export error -- %v\n", err)
+			}
+		case <-ctx.Done():
+			if err := m.export(context.WithoutCancel(ctx)); err != nil {
+				m.Logger.Printf("Meter export error -- %v\n", err)
+			}
+			return
+		}
+	}
+}
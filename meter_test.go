@@ -0,0 +1,37 @@
+package segment
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMeterExport(t *testing.T) {
+	dest := &testDestination{}
+	m := NewMeter(dest, time.Minute)
+	hour := time.Date(2024, 1, 2, 3, 0, 0, 0, time.UTC)
+	m.record("a", 2, 100, hour.Add(time.Minute))
+	m.record("a", 1, 50, hour.Add(2*time.Minute))
+	m.record("b", 1, 10, hour.Add(time.Hour))
+
+	dest.err = errors.New("down")
+	if err := m.export(context.Background()); err == nil {
+		t.Fatal("Expected export error")
+	}
+	dest.err = nil
+	if err := m.export(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	records := dest.sent()
+	if len(records) != 2 {
+		t.Fatalf("Expected 2 usage records kept after failure, got %d", len(records))
+	}
+	for _, message := range records {
+		r := message.(UsageRecord)
+		if r.ProjectId == "a" && (r.Events != 3 || r.Bytes != 150 || !r.Hour.Equal(hour)) {
+			t.Errorf("Expected project a usage summed for the hour, got %+v", r)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package segment
+
+import (
+	"net/http"
+	"strings"
+)
+
+// preflightMaxAge is how long browsers may cache a preflight response, in seconds
+const preflightMaxAge = "86400"
+
+// allowMethods wraps an event route handler serving the methods, answering OPTIONS preflight requests and HEAD
+// without processing an event, and returning 405 with an Allow header for any other method.  Browser requests
+// with an Origin are allowed from any origin, as sdks authenticate with the writeKey rather than cookies.
+func allowMethods(h http.HandlerFunc, methods ...string) http.HandlerFunc {
+	allow := strings.Join(append(methods, http.MethodHead, http.MethodOptions), ", ")
+	return func(w http.ResponseWriter, r *http.Request) {
+		if origin := r.Header.Get("Origin"); origin != "" {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Add("Vary", "Origin")
+		}
+		switch r.Method {
+		case http.MethodOptions:
+			w.Header().Set("Allow", allow)
+			if r.Header.Get("Access-Control-Request-Method") != "" {
+				headers := r.Header.Get("Access-Control-Request-Headers")
+				if headers == "" {
+					headers = "Authorization, Content-Type"
+				}
+				w.Header().Set("Access-Control-Allow-Methods", allow)
+				w.Header().Set("Access-Control-Allow-Headers", headers)
+				w.Header().Set("Access-Control-Max-Age", preflightMaxAge)
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case http.MethodHead:
+			w.Header().Set("Allow", allow)
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		for _, method := range methods {
+			if r.Method == method {
+				h(w, r)
+				return
+			}
+		}
+		w.Header().Set("Allow", allow)
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method "+r.Method+" not allowed")
+	}
+}
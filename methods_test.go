@@ -0,0 +1,46 @@
+package segment
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestAllowMethods(t *testing.T) {
+	dest := &testDestination{}
+	router := mux.NewRouter()
+	NewSegment(func(writeKey string) string { return writeKey }, []Destination{dest}, router)
+
+	for _, test := range []struct {
+		method, path string
+		status       int
+		allow        string
+	}{
+		{"OPTIONS", "/batch", http.StatusNoContent, "POST, HEAD, OPTIONS"},
+		{"HEAD", "/batch", http.StatusOK, "POST, HEAD, OPTIONS"},
+		{"GET", "/batch", http.StatusMethodNotAllowed, "POST, HEAD, OPTIONS"},
+		{"OPTIONS", "/track", http.StatusNoContent, "GET, POST, HEAD, OPTIONS"},
+		{"PUT", "/track", http.StatusMethodNotAllowed, "GET, POST, HEAD, OPTIONS"},
+	} {
+		req := httptest.NewRequest(test.method, test.path, nil)
+		req.Header.Set("Origin", "https://app.example.com")
+		req.Header.Set("Access-Control-Request-Method", "POST")
+		req.Header.Set("Access-Control-Request-Headers", "authorization, content-type")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != test.status || w.Header().Get("Allow") != test.allow {
+			t.Errorf("Expected %d %q for %s %s, got %d %q", test.status, test.allow, test.method, test.path, w.Code, w.Header().Get("Allow"))
+		}
+		if w.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" {
+			t.Errorf("Expected allowed origin for %s %s", test.method, test.path)
+		}
+		if test.method == "OPTIONS" && w.Header().Get("Access-Control-Allow-Headers") != "authorization, content-type" {
+			t.Errorf("Expected allowed headers, got %q", w.Header().Get("Access-Control-Allow-Headers"))
+		}
+	}
+	if sent := dest.sent(); len(sent) != 0 {
+		t.Errorf("Expected no events, got %d", len(sent))
+	}
+}
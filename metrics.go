@@ -0,0 +1,61 @@
+package segment
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// Reasons for events dropped anywhere in the pipeline
+const (
+	DropValidation       = "validation"        // Payload failed to decode or validate
+	DropUnauthorized     = "unauthorized"      // Unknown or missing writeKey
+	DropSendError        = "send_error"        // Destination send returned an error to the client
+	DropSpoolFull        = "spool_full"        // Spool for a down destination is full
+	DropQueueFull        = "queue_full"        // Destination queue didn't accept before the deadline
+	DropForwarderSkip    = "forwarder_skip"    // Forwarder busy so skipped
+	DropForwardFailed    = "forward_failed"    // Forwarder request failed
+	DropDeliveryFailed   = "delivery_failed"   // Firehose rejected the record
+	DropDeadLetter       = "dlq"               // Sent to a dead letter or quarantine destination
+	DropUnrouted         = "unrouted"          // No route matched the event name
+	DropQuotaExceeded    = "quota_exceeded"    // Project exceeded its daily or monthly quota
+	DropBatchFailed      = "batch_failed"      // Batch destination write failed after retries
+	DropExpired          = "expired"           // Event older than the retention TTL without an archive
+	DropInvalidTimestamp = "invalid_timestamp" // Event timestamp in the future or before the epoch rejected
+	DropArchiveFailed    = "archive_failed"    // Archive write failed after retries
+)
+
+// newDroppedCounter returns the single events dropped counter shared across the pipeline, labelled by the
+// destination name or empty if dropped before sending to a destination
+func newDroppedCounter(reg prometheus.Registerer) *prometheus.CounterVec {
+	return newCounterVec(reg, prometheus.CounterOpts{
+		Name: "events_dropped_total",
+		Help: "Events dropped total by reason",
+	}, "reason", "destination")
+}
+
+// registerCollector registers against reg, returning the existing collector if already registered
+func registerCollector(reg prometheus.Registerer, c prometheus.Collector) prometheus.Collector {
+	if reg == nil {
+		reg = prometheus.DefaultRegisterer
+	}
+	if err := reg.Register(c); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return are.ExistingCollector
+		}
+		panic(err)
+	}
+	return c
+}
+
+func newCounterVec(reg prometheus.Registerer, opts prometheus.CounterOpts, labels ...string) *prometheus.CounterVec {
+	return registerCollector(reg, prometheus.NewCounterVec(opts, labels)).(*prometheus.CounterVec)
+}
+
+func newGaugeVec(reg prometheus.Registerer, opts prometheus.GaugeOpts, labels ...string) *prometheus.GaugeVec {
+	return registerCollector(reg, prometheus.NewGaugeVec(opts, labels)).(*prometheus.GaugeVec)
+}
+
+func newHistogramVec(reg prometheus.Registerer, opts prometheus.HistogramOpts, labels ...string) *prometheus.HistogramVec {
+	return registerCollector(reg, prometheus.NewHistogramVec(opts, labels)).(*prometheus.HistogramVec)
+}
+
+func newSummaryVec(reg prometheus.Registerer, opts prometheus.SummaryOpts, labels ...string) *prometheus.SummaryVec {
+	return registerCollector(reg, prometheus.NewSummaryVec(opts, labels)).(*prometheus.SummaryVec)
+}
@@ -0,0 +1,70 @@
+package segment
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetricsRegistration(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m1 := newDeliveryMetrics(reg)
+	m2 := newDeliveryMetrics(reg) // Should not panic on duplicate registration
+	if m1.success != m2.success {
+		t.Error("Expected existing collector to be shared within registry")
+	}
+	m3 := newDeliveryMetrics(prometheus.NewRegistry())
+	if m1.success == m3.success {
+		t.Error("Expected separate collectors for separate registries")
+	}
+}
+
+func TestDestinationNameLabel(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "bad request", http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	reg := prometheus.NewRegistry()
+	named := NewForwarderWithConfig(&ForwarderConfig{Name: "partner", Endpoint: server.URL, Registerer: reg})
+	unnamed := NewForwarderWithConfig(&ForwarderConfig{Endpoint: server.URL, Registerer: reg})
+	s := NewSegment(func(writeKey string) string { return writeKey }, []Destination{named, unnamed}, mux.NewRouter())
+	if s.destinations[0].name != "partner" || s.destinations[1].name != "forwarder-1" {
+		t.Errorf("Unexpected destination names %q %q", s.destinations[0].name, s.destinations[1].name)
+	}
+
+	named.forward(context.Background(), []SegmentEvent{{SegmentMessage: SegmentMessage{Type: "track"}}})
+	if n := testutil.ToFloat64(named.metrics.failure.WithLabelValues("partner", server.URL)); n != 1 {
+		t.Errorf("Expected failure labelled by destination, got %v", n)
+	}
+	if n := testutil.ToFloat64(named.metrics.dropped.WithLabelValues(DropForwardFailed, "partner")); n != 1 {
+		t.Errorf("Expected dropped labelled by destination, got %v", n)
+	}
+}
+
+func TestDeliveryDefaultNames(t *testing.T) {
+	newFakeFirehose(t)
+	reg := prometheus.NewRegistry()
+	var segments []*Segment
+	for _, stream := range []string{"a", "b"} {
+		d := NewDelivery(&DeliveryConfig{StreamRegion: "us-west-2", StreamName: stream, Registerer: reg})
+		segments = append(segments, NewSegment(nil, []Destination{d}, nil).WithRegisterer(reg))
+	}
+	if segments[0].destinations[0].name != "delivery-a" || segments[1].destinations[0].name != "delivery-b" {
+		t.Errorf("Unexpected destination names %q %q", segments[0].destinations[0].name, segments[1].destinations[0].name)
+	}
+
+	// Each segment instance drops against its own series of the shared registry
+	segments[0].dropDestination(segments[0].destinations[0].name, DropQueueFull, 1)
+	segments[1].dropDestination(segments[1].destinations[0].name, DropQueueFull, 2)
+	for name, want := range map[string]float64{"delivery-a": 1, "delivery-b": 2} {
+		if n := testutil.ToFloat64(segments[0].metrics.dropped.WithLabelValues(DropQueueFull, name)); n != want {
+			t.Errorf("Expected %v dropped for %s, got %v", want, name, n)
+		}
+	}
+}
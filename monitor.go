@@ -0,0 +1,136 @@
+package segment
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+
+	"github.com/xtgo/uuid"
+)
+
+// Self-monitoring event names
+const (
+	MonitorBatchFlushed       = "Batch Flushed"       // Destination wrote a batch, or failed after retries
+	MonitorDeadLetter         = "Dead Letter Written" // Event was quarantined
+	MonitorCircuitOpened      = "Circuit Opened"      // Destination process failed and is unhealthy
+	MonitorCircuitClosed      = "Circuit Closed"      // Destination recovered
+	MonitorQuotaExceeded      = "Quota Exceeded"      // Project requests rejected over quota
+	MonitorDestinationStalled = "Destination Stalled" // Destination send blocked beyond the watchdog threshold
+)
+
+// monitorDrainTimeout limits sending queued events on shutdown
+const monitorDrainTimeout = 5 * time.Second
+
+// monitorBuffer is the number of operational events buffered before they are skipped
+const monitorBuffer = 1000
+
+// Monitor emits operational events of the collector as track events to a destination, so ops dashboards are
+// built from the same pipeline.  Events are sent directly to the destination rather than through transforms, and
+// are skipped if the destination falls behind, so the monitor destination shouldn't itself emit to the monitor.
+type Monitor struct {
+	Logger    *log.Logger // Public logger that caller can override
+	projectId string
+	host      string
+	dest      *destination
+	events    chan SegmentEvent
+}
+
+// NewMonitor creates a monitor sending operational events for projectId to dest
+func NewMonitor(dest Destination, projectId string) *Monitor {
+	host, _ := os.Hostname()
+	return &Monitor{
+		Logger:    log.New(os.Stderr, "", log.LstdFlags),
+		projectId: projectId,
+		host:      host,
+		dest:      &destination{Destination: dest, name: "monitor"},
+		events:    make(chan SegmentEvent, monitorBuffer),
+	}
+}
+
+// WithMonitor emits circuit, dead letter and quota events to the monitor, which is sent while running.  Set the
+// Monitor in a BatchConfig or DeliveryConfig for batch flushed events.
+func (s *Segment) WithMonitor(monitor *Monitor) *Segment {
+	s.monitor = monitor
+	return s
+}
+
+// destination returns the monitor destination, or nil
+func (m *Monitor) destination() *destination {
+	if m == nil {
+		return nil
+	}
+	return m.dest
+}
+
+// Emit queues an operational event with properties, skipping it if the queue is full
+func (m *Monitor) Emit(name string, properties map[string]interface{}) {
+	if m == nil {
+		return
+	}
+	now := time.Now().UTC()
+	event := SegmentEvent{SegmentMessage: SegmentMessage{
+		ProjectId:   m.projectId,
+		MessageId:   uuid.NewRandom().String(),
+		Type:        "track",
+		Event:       name,
+		AnonymousId: m.host,
+		Channel:     "server",
+		Timestamp:   now,
+		ReceivedAt:  now,
+		Properties:  properties,
+		Context: map[string]interface{}{
+			"library": map[string]interface{}{"name": "brightsparc/segment"},
+			"host":    m.host,
+		},
+	}}
+	select {
+	case m.events <- event:
+	default:
+		m.Logger.Printf("Monitor queue full, skipping %s\n", name)
+	}
+}
+
+// batchFlushed emits a batch flushed event for a destination write
+func (m *Monitor) batchFlushed(destination string, events int, duration time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	properties := map[string]interface{}{
+		"destination": destination,
+		"events":      events,
+		"durationMs":  duration.Milliseconds(),
+		"success":     err == nil,
+	}
+	if err != nil {
+		properties["error"] = err.Error()
+	}
+	m.Emit(MonitorBatchFlushed, properties)
+}
+
+// run sends queued events to the destination until ctx is done, then sends the remainder
+func (m *Monitor) run(ctx context.Context) {
+	for {
+		select {
+		case event := <-m.events:
+			if err := m.dest.sendRetry(ctx, event); err != nil {
+				m.Logger.Printf("Monitor send error -- %v\n", err)
+			}
+		case <-ctx.Done():
+			// The destination may have stopped, so the remainder is sent within a timeout
+			ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), monitorDrainTimeout)
+			defer cancel()
+			for {
+				select {
+				case event := <-m.events:
+					if err := m.dest.sendRetry(ctx, event); err != nil {
+						m.Logger.Printf("Monitor send error -- %v\n", err)
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package segment
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestMonitor(t *testing.T) {
+	ops := &testDestination{}
+	monitor := NewMonitor(ops, "ops")
+	router := mux.NewRouter()
+	s := NewSegment(func(writeKey string) string { return writeKey }, []Destination{&testDestination{}}, router).
+		WithQuotas(NewQuotas(Quota{Daily: 1}, nil)).
+		WithMonitor(monitor)
+
+	// Batch flushed from a batch destination
+	intake := newFakeIntake(t, 0)
+	config := testBatchConfig()
+	config.Monitor = monitor
+	processBatch(t, NewDatadog(&DatadogConfig{APIKey: "key", Endpoint: intake.URL, BatchConfig: config}),
+		SegmentEvent{SegmentMessage: SegmentMessage{Type: "track", Event: "Signed Up"}})
+
+	// Circuit opened and closed
+	s.setHealthy(s.destinations[0], false)
+	s.setHealthy(s.destinations[0], false)
+	s.setHealthy(s.destinations[0], true)
+
+	// Quota exceeded on the second event
+	for i := 0; i < 2; i++ {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/track", strings.NewReader(`{"writeKey":"web","event":"Clicked"}`)))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		monitor.run(ctx)
+		close(done)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	<-done
+
+	var names []string
+	for _, message := range ops.sent() {
+		m := message.(SegmentEvent)
+		if m.ProjectId != "ops" || m.Type != "track" {
+			t.Errorf("Unexpected monitor event %+v", m.SegmentMessage)
+		}
+		names = append(names, m.Event)
+		if m.Event == MonitorBatchFlushed && (m.Properties["destination"] != "datadog" || m.Properties["events"] != 1) {
+			t.Errorf("Unexpected batch flushed %v", m.Properties)
+		}
+	}
+	expected := []string{MonitorBatchFlushed, MonitorCircuitOpened, MonitorCircuitClosed, MonitorQuotaExceeded}
+	if strings.Join(names, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected %v, got %v", expected, names)
+	}
+}
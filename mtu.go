@@ -0,0 +1,162 @@
+package segment
+
+import (
+	"context"
+	"encoding/json"
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// hllPrecision gives 2^14 registers per sketch, a standard error of about 0.8%
+const hllPrecision = 14
+
+// hyperLogLog is a sketch estimating the number of distinct values added
+type hyperLogLog struct {
+	registers [1 << hllPrecision]uint8
+}
+
+// hash64 returns a well mixed 64 bit hash of s
+func hash64(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	// splitmix64 finalizer, as fnv alone has poor high bit avalanche for short strings
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+func (h *hyperLogLog) add(s string) {
+	x := hash64(s)
+	index := x >> (64 - hllPrecision)
+	rank := uint8(bits.LeadingZeros64(x<<hllPrecision|1<<(hllPrecision-1)) + 1)
+	if rank > h.registers[index] {
+		h.registers[index] = rank
+	}
+}
+
+// estimate returns the approximate distinct count, with linear counting for small cardinalities
+func (h *hyperLogLog) estimate() uint64 {
+	m := float64(len(h.registers))
+	sum, zeros := 0.0, 0
+	for _, r := range h.registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	e := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if e <= 2.5*m && zeros > 0 {
+		e = m * math.Log(m/float64(zeros))
+	}
+	return uint64(e + 0.5)
+}
+
+// MTUEstimator approximates monthly tracked users, the distinct userIds, or anonymousIds of events without
+// a userId, per project each UTC month, keeping the current and previous month
+type MTUEstimator struct {
+	mu     sync.Mutex
+	months map[string]map[string]*hyperLogLog // Month eg "2006-01", projectId to sketch
+	desc   *prometheus.Desc
+}
+
+// NewMTUEstimator creates an estimator with the monthly_tracked_users gauge registered against reg, or the default if nil
+func NewMTUEstimator(reg prometheus.Registerer) *MTUEstimator {
+	e := &MTUEstimator{
+		months: make(map[string]map[string]*hyperLogLog),
+		desc:   prometheus.NewDesc("monthly_tracked_users", "Estimated monthly tracked users by project for the current month", []string{"project"}, nil),
+	}
+	registerCollector(reg, e)
+	return e
+}
+
+// Transform observes the user of each event, it doesn't modify the event
+func (e *MTUEstimator) Transform(ctx context.Context, m *SegmentEvent) error {
+	if DryRun(ctx) {
+		return nil
+	}
+	id := "u:" + m.UserId
+	if m.UserId == "" {
+		if m.AnonymousId == "" {
+			return nil
+		}
+		id = "a:" + m.AnonymousId
+	}
+	e.add(m.ProjectId, id, time.Now())
+	return nil
+}
+
+func (e *MTUEstimator) add(projectId, id string, now time.Time) {
+	month := now.UTC().Format("2006-01")
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	projects, ok := e.months[month]
+	if !ok {
+		projects = make(map[string]*hyperLogLog)
+		e.months[month] = projects
+		previous := now.UTC().AddDate(0, 0, -now.UTC().Day()).Format("2006-01")
+		for m := range e.months {
+			if m != month && m != previous {
+				delete(e.months, m)
+			}
+		}
+	}
+	sketch, ok := projects[projectId]
+	if !ok {
+		sketch = &hyperLogLog{}
+		projects[projectId] = sketch
+	}
+	sketch.add(id)
+}
+
+// Estimates returns the estimated MTU by projectId for a month eg "2006-01"
+func (e *MTUEstimator) Estimates(month string) map[string]uint64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	estimates := make(map[string]uint64)
+	for projectId, sketch := range e.months[month] {
+		estimates[projectId] = sketch.estimate()
+	}
+	return estimates
+}
+
+// Describe implements prometheus.Collector
+func (e *MTUEstimator) Describe(ch chan<- *prometheus.Desc) {
+	ch <- e.desc
+}
+
+// Collect implements prometheus.Collector, estimating the current month when scraped
+func (e *MTUEstimator) Collect(ch chan<- prometheus.Metric) {
+	for projectId, n := range e.Estimates(time.Now().UTC().Format("2006-01")) {
+		ch <- prometheus.MustNewConstMetric(e.desc, prometheus.GaugeValue, float64(n), projectId)
+	}
+}
+
+// MountMTU adds GET /mtu to an admin router, returning estimates by projectId for `month` eg "2006-01",
+// defaulting to the current month
+func (s *Segment) MountMTU(router *mux.Router, auth Authorizer, estimator *MTUEstimator) *Segment {
+	s.Logger.Println("Adding mtu handler")
+	router.Handle("/mtu", s.adminHandler(auth, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		month := r.FormValue("month")
+		if month == "" {
+			month = time.Now().UTC().Format("2006-01")
+		}
+		if _, err := time.Parse("2006-01", month); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_request", "Expected month as YYYY-MM")
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"month": month, "projects": estimator.Estimates(month)})
+	}))).Methods("GET")
+	return s
+}
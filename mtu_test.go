@@ -0,0 +1,41 @@
+package segment
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestHyperLogLogEstimate(t *testing.T) {
+	for _, n := range []int{100, 10000, 200000} {
+		h := &hyperLogLog{}
+		for i := 0; i < n; i++ {
+			h.add(fmt.Sprintf("user-%d", i))
+			h.add(fmt.Sprintf("user-%d", i)) // Duplicates don't count
+		}
+		if e := float64(h.estimate()); math.Abs(e-float64(n))/float64(n) > 0.03 {
+			t.Errorf("Expected estimate within 3%% of %d, got %.0f", n, e)
+		}
+	}
+}
+
+func TestMTUEstimator(t *testing.T) {
+	e := NewMTUEstimator(prometheus.NewRegistry())
+	e.Transform(context.Background(), &SegmentEvent{SegmentMessage: SegmentMessage{ProjectId: "p", UserId: "u"}})
+	e.Transform(context.Background(), &SegmentEvent{SegmentMessage: SegmentMessage{ProjectId: "p", AnonymousId: "a"}})
+	e.Transform(context.Background(), &SegmentEvent{SegmentMessage: SegmentMessage{ProjectId: "p", UserId: "u", AnonymousId: "b"}})
+	if n := e.Estimates(time.Now().UTC().Format("2006-01"))["p"]; n != 2 {
+		t.Errorf("Expected 2 tracked users, got %d", n)
+	}
+
+	// Months before the previous are discarded
+	e.add("p", "u", time.Date(2020, 1, 15, 0, 0, 0, 0, time.UTC))
+	e.add("p", "u", time.Date(2020, 3, 15, 0, 0, 0, 0, time.UTC))
+	if len(e.Estimates("2020-01")) != 0 {
+		t.Error("Expected old month discarded")
+	}
+}
@@ -0,0 +1,99 @@
+package segment
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// oauthExpiryLeeway refreshes tokens before they expire, allowing for clock skew and request latency
+const oauthExpiryLeeway = 30 * time.Second
+
+// OAuth2Config contains the client credentials grant parameters to fetch bearer tokens for forwarder requests
+type OAuth2Config struct {
+	TokenURL     string   `json:"tokenUrl"`
+	ClientId     string   `json:"clientId"`
+	ClientSecret string   `json:"clientSecret"`
+	Scopes       []string `json:"scopes,omitempty"`
+	Audience     string   `json:"audience,omitempty"` // Requested by some providers eg auth0
+}
+
+// Validate checks the token url and client id are set
+func (config *OAuth2Config) Validate() error {
+	if config.ClientId == "" {
+		return fmt.Errorf("Require OAuth2 client id")
+	}
+	return validateEndpoint(config.TokenURL)
+}
+
+// oauthToken fetches and caches a client credentials token until it expires or is invalidated
+type oauthToken struct {
+	mu      sync.Mutex
+	config  OAuth2Config
+	client  *http.Client
+	clock   Clock
+	token   string
+	expires time.Time
+}
+
+func newOAuthToken(config OAuth2Config, client *http.Client) *oauthToken {
+	return &oauthToken{config: config, client: client, clock: SystemClock}
+}
+
+// get returns the cached token, fetching a new token if expired
+func (t *oauthToken) get(ctx context.Context) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.token != "" && t.clock.Now().Before(t.expires.Add(-oauthExpiryLeeway)) {
+		return t.token, nil
+	}
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(t.config.Scopes) > 0 {
+		form.Set("scope", strings.Join(t.config.Scopes, " "))
+	}
+	if t.config.Audience != "" {
+		form.Set("audience", t.config.Audience)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.config.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(t.config.ClientId), url.QueryEscape(t.config.ClientSecret))
+	res, err := t.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("OAuth2 token error -- %v", err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("OAuth2 token error -- %s %s", res.Status, body)
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil || token.AccessToken == "" {
+		return "", fmt.Errorf("OAuth2 token error -- invalid response %s", body)
+	}
+	if token.ExpiresIn <= 0 {
+		token.ExpiresIn = 3600 // Optional in the spec, so assume an hour
+	}
+	t.token = token.AccessToken
+	t.expires = t.clock.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	return t.token, nil
+}
+
+// invalidate clears the token, eg when rejected as unauthorized before it expired
+func (t *oauthToken) invalidate() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.token = ""
+}
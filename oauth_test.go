@@ -0,0 +1,81 @@
+package segment
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestForwarderOAuth2(t *testing.T) {
+	var fetches atomic.Int32
+	tokens := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		if r.FormValue("grant_type") != "client_credentials" || r.FormValue("scope") != "events:write" ||
+			id != "client" || secret != "secret" {
+			http.Error(w, "invalid_client", http.StatusUnauthorized)
+			return
+		}
+		n := fetches.Add(1)
+		fmt.Fprintf(w, `{"access_token":"token%d","token_type":"Bearer","expires_in":120}`, n)
+	}))
+	defer tokens.Close()
+
+	dest := &testDestination{}
+	router := mux.NewRouter()
+	NewSegment(func(writeKey string) string { return writeKey }, []Destination{dest}, router)
+	var revoked atomic.Bool
+	var authorization atomic.Value
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization.Store(r.Header.Get("Authorization"))
+		if revoked.Load() {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		router.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	f := NewForwarderWithConfig(&ForwarderConfig{
+		Endpoint:   server.URL + "/batch",
+		OAuth2:     &OAuth2Config{TokenURL: tokens.URL, ClientId: "client", ClientSecret: "secret", Scopes: []string{"events:write"}},
+		Registerer: prometheus.NewRegistry(),
+	})
+	clock := newTestClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	f.oauth.clock = clock
+	send := func() error {
+		return f.send(context.Background(), SegmentEvent{WriteKey: "web", SegmentMessage: SegmentMessage{Type: "track"}})
+	}
+
+	// Token is cached until near expiry
+	for i := 0; i < 2; i++ {
+		if err := send(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fetches.Load() != 1 || authorization.Load() != "Bearer token1" || len(dest.sent()) != 2 {
+		t.Errorf("Expected cached token, got %d fetches %v", fetches.Load(), authorization.Load())
+	}
+	clock.Advance(100 * time.Second)
+	send()
+	if fetches.Load() != 2 || authorization.Load() != "Bearer token2" {
+		t.Errorf("Expected refreshed token, got %d fetches %v", fetches.Load(), authorization.Load())
+	}
+
+	// Unauthorized invalidates the token
+	revoked.Store(true)
+	if err := send(); err == nil {
+		t.Error("Expected unauthorized error")
+	}
+	revoked.Store(false)
+	send()
+	if fetches.Load() != 3 || authorization.Load() != "Bearer token3" {
+		t.Errorf("Expected new token after unauthorized, got %d fetches %v", fetches.Load(), authorization.Load())
+	}
+}
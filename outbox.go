@@ -0,0 +1,170 @@
+package segment
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// SQLOutboxRelayConfig contains the polling parameters of an outbox relay
+type SQLOutboxRelayConfig struct {
+	BatchSize int           `json:"batchSize,omitempty"` // Pending rows per transaction, defaults to 1000
+	Interval  time.Duration `json:"interval,omitempty"`  // Poll interval once no rows are pending, defaults to 1 second
+	// Clock for the poll interval and delivered timestamps, defaults to the system clock
+	Clock Clock `json:"-"`
+}
+
+// OutboxSender sends an event downstream, returning only once the event is durably accepted eg a synchronous produce
+// or http post.  A destination Send only queues the event, so it would be marked delivered before it is written.
+type OutboxSender func(ctx context.Context, m SegmentEvent) error
+
+// SQLOutboxRelay hands off events written by a SQL destination in outbox mode, marking each event delivered once sent.
+// Events are sent in outbox id order, and an event is only sent again if the relay stops before marking it delivered.
+// Events whose payload can't be decoded are marked failed rather than blocking the outbox.
+type SQLOutboxRelay struct {
+	Logger    *log.Logger // Public logger that caller can override
+	db        *sql.DB
+	table     string
+	dialect   SQLDialect
+	batchSize int
+	interval  time.Duration
+	clock     Clock
+	send      OutboxSender
+}
+
+// NewSQLOutboxRelay creates a relay for the outbox of the destination, calling send for each pending event
+func NewSQLOutboxRelay(dest *SQL, config SQLOutboxRelayConfig, send OutboxSender) *SQLOutboxRelay {
+	if !dest.outbox {
+		log.Fatal(fmt.Errorf("Require sql destination %s in outbox mode", dest.table))
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = 1000
+	}
+	if config.Interval <= 0 {
+		config.Interval = time.Second
+	}
+	return &SQLOutboxRelay{
+		Logger:    log.New(os.Stderr, "", log.LstdFlags),
+		db:        dest.db,
+		table:     dest.table,
+		dialect:   dest.dialect,
+		batchSize: config.BatchSize,
+		interval:  config.Interval,
+		clock:     clockOrSystem(config.Clock),
+		send:      send,
+	}
+}
+
+// Run relays pending events, polling every interval once none are pending, until ctx is done
+func (r *SQLOutboxRelay) Run(ctx context.Context) error {
+	for {
+		n, err := r.relay(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			r.Logger.Printf("Outbox %s relay error -- %v\n", r.table, err)
+		}
+		if n == r.batchSize && err == nil {
+			continue
+		}
+		select {
+		case <-r.clock.After(r.interval):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// relay sends the next batch of pending events, marking those sent delivered in a transaction, and returns the number
+// of pending events read
+func (r *SQLOutboxRelay) relay(ctx context.Context) (int, error) {
+	ids, events, failed, err := r.pending(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if err := r.fail(ctx, failed); err != nil {
+		return len(events) + len(failed), err
+	}
+	var sendErr error
+	sent := 0
+	for ; sent < len(events); sent++ {
+		if sendErr = r.send(ctx, events[sent]); sendErr != nil {
+			break
+		}
+	}
+	if err := r.deliver(ctx, ids[:sent]); err != nil {
+		return len(events) + len(failed), err
+	}
+	if sent > 0 {
+		r.Logger.Printf("Outbox %s relayed %d\n", r.table, sent)
+	}
+	return len(events) + len(failed), sendErr
+}
+
+// pending selects the next batch of pending outbox ids and their events, and the ids whose payload can't be decoded
+func (r *SQLOutboxRelay) pending(ctx context.Context) ([]int64, []SegmentEvent, []int64, error) {
+	rows, err := r.db.QueryContext(ctx, fmt.Sprintf(r.dialect.OutboxSelect, r.table), r.batchSize)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("SQL outbox select error -- %v", err)
+	}
+	defer rows.Close()
+	var ids, failed []int64
+	var events []SegmentEvent
+	for rows.Next() {
+		var id int64
+		var payload string
+		if err := rows.Scan(&id, &payload); err != nil {
+			return nil, nil, nil, fmt.Errorf("SQL outbox scan error -- %v", err)
+		}
+		var m SegmentEvent
+		if err := json.Unmarshal([]byte(payload), &m); err != nil {
+			r.Logger.Printf("Outbox %s decode error at %d -- %v\n", r.table, id, err)
+			failed = append(failed, id)
+			continue
+		}
+		ids = append(ids, id)
+		events = append(events, m)
+	}
+	return ids, events, failed, rows.Err()
+}
+
+// deliver marks the outbox ids delivered in a single transaction
+func (r *SQLOutboxRelay) deliver(ctx context.Context, ids []int64) error {
+	now := r.clock.Now()
+	return r.update(ctx, r.dialect.OutboxDeliver, ids, func(id int64) []interface{} { return []interface{}{now, id} })
+}
+
+// fail marks the outbox ids failed in a single transaction
+func (r *SQLOutboxRelay) fail(ctx context.Context, ids []int64) error {
+	return r.update(ctx, r.dialect.OutboxFail, ids, func(id int64) []interface{} { return []interface{}{id} })
+}
+
+// update executes the outbox statement with the args for each id in a single transaction
+func (r *SQLOutboxRelay) update(ctx context.Context, query string, ids []int64, args func(id int64) []interface{}) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	// Don't cancel the transaction once events are sent, so they aren't sent again
+	ctx = context.WithoutCancel(ctx)
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.PrepareContext(ctx, fmt.Sprintf(query, r.table))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, id := range ids {
+		if _, err := stmt.ExecContext(ctx, args(id)...); err != nil {
+			return fmt.Errorf("SQL outbox update error -- %v", err)
+		}
+	}
+	return tx.Commit()
+}
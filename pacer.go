@@ -0,0 +1,64 @@
+package segment
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// pacer adaptively delays calls to a throttled service, doubling the delay on throttling
+// and halving it on success
+type pacer struct {
+	mu    sync.Mutex
+	delay time.Duration
+	min   time.Duration
+	max   time.Duration
+	gauge prometheus.Gauge
+}
+
+func newPacer(min, max time.Duration, gauge prometheus.Gauge) *pacer {
+	return &pacer{min: min, max: max, gauge: gauge}
+}
+
+// wait blocks for the current delay or until ctx is done
+func (p *pacer) wait(ctx context.Context) error {
+	p.mu.Lock()
+	delay := p.delay
+	p.mu.Unlock()
+	if delay == 0 {
+		return ctx.Err()
+	}
+	select {
+	case <-time.After(delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// throttled increases the delay
+func (p *pacer) throttled() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.set(min(max(p.delay*2, p.min), p.max))
+}
+
+// ok decreases the delay, back to none once below the minimum
+func (p *pacer) ok() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if delay := p.delay / 2; delay >= p.min {
+		p.set(delay)
+	} else {
+		p.set(0)
+	}
+}
+
+func (p *pacer) set(delay time.Duration) {
+	p.delay = delay
+	if p.gauge != nil {
+		p.gauge.Set(delay.Seconds())
+	}
+}
@@ -0,0 +1,101 @@
+package segment
+
+import (
+	"context"
+	"crypto/md5"
+	"fmt"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// shardRefreshInterval between listing the shards of a kinesis stream, so batches follow resharding
+const shardRefreshInterval = time.Minute
+
+// Partition results counted by the destination_partition_records_total metric
+const (
+	partitionSuccess   = "success"
+	partitionThrottled = "throttled"
+	partitionFailed    = "failed"
+)
+
+// newPartitionCounter counts records written to partitioned sinks by partition and result, to find hot partitions
+func newPartitionCounter(reg prometheus.Registerer) *prometheus.CounterVec {
+	return newCounterVec(reg, prometheus.CounterOpts{
+		Name: "destination_partition_records_total",
+		Help: "Records written to partitioned sinks total by partition and result",
+	}, "destination", "partition", "result")
+}
+
+// shardRange is the range of hash keys of an open kinesis shard
+type shardRange struct {
+	id         string
+	start, end *big.Int
+}
+
+// shardMap maps partition keys to the open shards of a kinesis stream, as kinesis does with the md5 hash of the key
+type shardMap struct {
+	mu     sync.Mutex
+	shards []shardRange // Sorted by starting hash key
+	loaded time.Time
+}
+
+// load lists the open shards of the stream, keeping the previous shards on error until the next refresh
+func (sm *shardMap) load(ctx context.Context, client *kinesis.Kinesis, stream string, now time.Time) error {
+	sm.mu.Lock()
+	sm.loaded = now
+	sm.mu.Unlock()
+	var shards []shardRange
+	input := &kinesis.ListShardsInput{StreamName: aws.String(stream)}
+	for {
+		resp, err := client.ListShardsWithContext(ctx, input)
+		if err != nil {
+			return fmt.Errorf("Kinesis shards error -- %v", err)
+		}
+		for _, shard := range resp.Shards {
+			if shard.SequenceNumberRange != nil && shard.SequenceNumberRange.EndingSequenceNumber != nil {
+				continue // Closed by resharding
+			}
+			start, ok1 := new(big.Int).SetString(aws.StringValue(shard.HashKeyRange.StartingHashKey), 10)
+			end, ok2 := new(big.Int).SetString(aws.StringValue(shard.HashKeyRange.EndingHashKey), 10)
+			if !ok1 || !ok2 {
+				return fmt.Errorf("Kinesis shard %s invalid hash key range", aws.StringValue(shard.ShardId))
+			}
+			shards = append(shards, shardRange{id: aws.StringValue(shard.ShardId), start: start, end: end})
+		}
+		if resp.NextToken == nil {
+			break
+		}
+		input = &kinesis.ListShardsInput{NextToken: resp.NextToken}
+	}
+	sort.Slice(shards, func(i, j int) bool { return shards[i].start.Cmp(shards[j].start) < 0 })
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.shards = shards
+	return nil
+}
+
+// stale returns true if the shards should be listed again
+func (sm *shardMap) stale(now time.Time) bool {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return now.Sub(sm.loaded) >= shardRefreshInterval
+}
+
+// shard returns the id of the shard for the partition key, or empty if unknown
+func (sm *shardMap) shard(key string) string {
+	sum := md5.Sum([]byte(key))
+	hash := new(big.Int).SetBytes(sum[:])
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	i := sort.Search(len(sm.shards), func(i int) bool { return sm.shards[i].end.Cmp(hash) >= 0 })
+	if i < len(sm.shards) && sm.shards[i].start.Cmp(hash) <= 0 {
+		return sm.shards[i].id
+	}
+	return ""
+}
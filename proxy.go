@@ -0,0 +1,115 @@
+package segment
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// TrustedProxies are the networks of load balancers and proxies in front of the collector, whose
+// X-Forwarded-For and X-Real-IP headers are trusted for the client ip
+type TrustedProxies struct {
+	networks []*net.IPNet
+}
+
+// NewTrustedProxies parses the CIDRs, or single ips, of trusted proxies eg "10.0.0.0/8"
+func NewTrustedProxies(cidrs ...string) (*TrustedProxies, error) {
+	p := &TrustedProxies{}
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("Trusted proxy ip error -- %s", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				bits = 8 * net.IPv4len
+			}
+			cidr = fmt.Sprintf("%s/%d", cidr, bits)
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("Trusted proxy cidr error -- %v", err)
+		}
+		p.networks = append(p.networks, network)
+	}
+	return p, nil
+}
+
+// trusted returns true if the ip is within a trusted network
+func (p *TrustedProxies) trusted(ip net.IP) bool {
+	if p == nil || ip == nil {
+		return false
+	}
+	for _, network := range p.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the ip of the client, from X-Forwarded-For or X-Real-IP only if the request came through a
+// trusted proxy.  X-Forwarded-For is read right to left, skipping trusted proxies, as clients can prepend any value.
+func (p *TrustedProxies) ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !p.trusted(net.ParseIP(host)) {
+		return host
+	}
+	if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+		// An unparseable hop ends the trusted chain at the last trusted proxy, rather than falling back to X-Real-IP
+		hops := strings.Split(strings.Join(forwarded, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip := net.ParseIP(strings.TrimSpace(hops[i]))
+			if ip == nil {
+				return host
+			}
+			if !p.trusted(ip) || i == 0 {
+				return ip.String()
+			}
+			host = ip.String()
+		}
+	}
+	if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+		return ip.String()
+	}
+	return host
+}
+
+// WithTrustedProxies sets the proxies whose forwarded headers are trusted for the client ip, which otherwise is
+// always the remote address of the connection
+func (s *Segment) WithTrustedProxies(proxies *TrustedProxies) *Segment {
+	s.proxies = proxies
+	return s
+}
+
+// WithContextIP adds the client ip to the event context.ip, unless set by the sdk
+func (s *Segment) WithContextIP(enrich bool) *Segment {
+	s.contextIP = enrich
+	return s
+}
+
+// clientIP returns the client ip of the request, honouring trusted proxies
+func (s *Segment) clientIP(r *http.Request) string {
+	return s.proxies.ClientIP(r)
+}
+
+// withClientIP returns the context with the client ip of the request if enabled, unless already set by the sdk
+func (s *Segment) withClientIP(context map[string]interface{}, r *http.Request) map[string]interface{} {
+	if !s.contextIP {
+		return context
+	}
+	ip := s.clientIP(r)
+	if _, ok := context["ip"]; ok || ip == "" {
+		return context
+	}
+	if context == nil {
+		context = make(map[string]interface{})
+	}
+	context["ip"] = ip
+	return context
+}
@@ -0,0 +1,81 @@
+package segment
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestTrustedProxiesClientIP(t *testing.T) {
+	proxies, err := NewTrustedProxies("10.0.0.0/8", "192.168.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewTrustedProxies("10.0.0.0/33"); err == nil {
+		t.Error("Expected cidr error")
+	}
+
+	for _, test := range []struct {
+		remote, forwarded, real, expected string
+	}{
+		{"203.0.113.9:1234", "1.1.1.1", "", "203.0.113.9"},                   // Untrusted remote, header ignored
+		{"10.0.0.1:1234", "1.1.1.1", "", "1.1.1.1"},                          // Trusted load balancer
+		{"10.0.0.1:1234", "6.6.6.6, 1.1.1.1, 192.168.1.1", "", "1.1.1.1"},    // Spoofed leftmost hop skipped
+		{"10.0.0.1:1234", "10.0.0.2", "", "10.0.0.2"},                        // All hops trusted
+		{"10.0.0.1:1234", "1.1.1.1, bogus, 10.0.0.2", "2.2.2.2", "10.0.0.2"}, // Unparseable hop ends the chain
+		{"192.168.1.1:1234", "", "2.2.2.2", "2.2.2.2"},
+		{"10.0.0.1:1234", "", "", "10.0.0.1"},
+	} {
+		req := httptest.NewRequest("POST", "/track", nil)
+		req.RemoteAddr = test.remote
+		if test.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+		if test.real != "" {
+			req.Header.Set("X-Real-IP", test.real)
+		}
+		if ip := proxies.ClientIP(req); ip != test.expected {
+			t.Errorf("Expected %s for %+v, got %s", test.expected, test, ip)
+		}
+	}
+
+	// Without trusted proxies headers are never trusted
+	req := httptest.NewRequest("POST", "/track", nil)
+	req.Header.Set("X-Forwarded-For", "1.1.1.1")
+	if ip := (*TrustedProxies)(nil).ClientIP(req); ip != "192.0.2.1" {
+		t.Errorf("Expected remote address, got %s", ip)
+	}
+}
+
+func TestTrustedProxiesContextIP(t *testing.T) {
+	dest := &testDestination{}
+	router := mux.NewRouter()
+	proxies, _ := NewTrustedProxies("10.0.0.0/8")
+	s := NewSegment(func(writeKey string) string { return writeKey }, []Destination{dest}, router).WithTrustedProxies(proxies)
+
+	for i, body := range []string{
+		`{"writeKey":"web","event":"Clicked"}`,
+		`{"writeKey":"web","event":"Clicked","context":{"ip":"3.3.3.3"}}`,
+		`{"writeKey":"web","event":"Clicked"}`,
+	} {
+		s.WithContextIP(i < 2)
+		req := httptest.NewRequest("POST", "/track", strings.NewReader(body))
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.Header.Set("X-Forwarded-For", "1.1.1.1")
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	sent := dest.sent()
+	if len(sent) != 3 {
+		t.Fatalf("Expected 3 events, got %d", len(sent))
+	}
+	if _, ok := sent[2].(SegmentEvent).Context["ip"]; ok {
+		t.Errorf("Expected no context ip unless enabled, got %v", sent[2].(SegmentEvent).Context)
+	}
+	for i, expected := range []string{"1.1.1.1", "3.3.3.3"} {
+		if ip := sent[i].(SegmentEvent).Context["ip"]; ip != expected {
+			t.Errorf("Expected context ip %s, got %v", expected, ip)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package segment
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/xtgo/uuid"
+)
+
+// maxQuarantinePayload bounds the raw payload of a decode failure kept in the quarantine
+const maxQuarantinePayload = 64 << 10
+
+// QuarantinedEvent is an event that failed validation with the reason, or the raw payload if it failed to decode
+type QuarantinedEvent struct {
+	Id        string        `json:"id"`
+	Reason    string        `json:"reason"`
+	Time      time.Time     `json:"time"`
+	Event     *SegmentEvent `json:"event,omitempty"`
+	Payload   string        `json:"payload,omitempty"`
+	Truncated bool          `json:"truncated,omitempty"` // Payload truncated to 64KB
+}
+
+// WithQuarantine sends events that fail transforms, and payloads that fail to decode, to a quarantine
+// destination with the reason attached, rather than losing them
+func (s *Segment) WithQuarantine(dest Destination) *Segment {
+	s.quarantine = &destination{Destination: dest, name: "quarantine"}
+	return s
+}
+
+// quarantined sends the event or payload to the quarantine if configured, returning true if sent
+func (s *Segment) quarantined(ctx context.Context, reason error, event *SegmentEvent, payload []byte) bool {
+	if s.quarantine == nil {
+		return false
+	}
+	q := QuarantinedEvent{
+		Id:        uuid.NewRandom().String(),
+		Reason:    reason.Error(),
+		Time:      time.Now().UTC(),
+		Event:     event,
+		Truncated: len(payload) > maxQuarantinePayload,
+	}
+	q.Payload = string(payload[:min(len(payload), maxQuarantinePayload)])
+	if err := s.quarantine.send(ctx, q); err != nil {
+		s.Logger.Printf("Quarantine error -- %v\n", err)
+		return false
+	}
+	s.drop(DropDeadLetter, 1)
+	s.monitor.Emit(MonitorDeadLetter, map[string]interface{}{"reason": q.Reason, "quarantineId": q.Id})
+	return true
+}
+
+// quarantinedPayload quarantines the raw payload of a request that failed to decode, only if authorized with a known
+// writeKey, so unauthenticated clients can't write to the quarantine store
+func (s *Segment) quarantinedPayload(r *http.Request, reason error, payload []byte) bool {
+	if writeKey, _, ok := r.BasicAuth(); !ok || s.projectId(writeKey) == "" {
+		return false
+	}
+	return s.quarantined(r.Context(), reason, nil, payload)
+}
+
+// Quarantine is a destination writing each quarantined event as a json object to a store, so it can be
+// fetched, repaired and replayed
+type Quarantine struct {
+	Logger *log.Logger // Public logger that caller can override
+	store  ArchiveStore
+}
+
+// NewQuarantine creates a quarantine destination given store eg NewLocalArchiveStore or NewS3ArchiveStore
+func NewQuarantine(store ArchiveStore) *Quarantine {
+	return &Quarantine{
+		Logger: log.New(os.Stderr, "", log.LstdFlags),
+		store:  store,
+	}
+}
+
+// WithLogger adds optional logging
+func (q *Quarantine) WithLogger(logger *log.Logger) Destination {
+	if logger != nil {
+		q.Logger = logger
+	}
+	return q
+}
+
+// Process blocks until ctx is done, as events are written on send
+func (q *Quarantine) Process(ctx context.Context) error {
+	<-ctx.Done()
+	return nil
+}
+
+// quarantineKey returns the object key for a quarantined event, partitioned by day
+func quarantineKey(q QuarantinedEvent) string {
+	return "quarantine/" + q.Time.UTC().Format("2006-01-02") + "/" + q.Id + ".json"
+}
+
+// Send writes the quarantined event to the store
+func (q *Quarantine) Send(ctx context.Context, message interface{}) error {
+	m, ok := message.(QuarantinedEvent)
+	if !ok {
+		return fmt.Errorf("Expected Quarantined Event")
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("Quarantine marshal error -- %v", err)
+	}
+	if err := q.store.Put(ctx, quarantineKey(m), b); err != nil {
+		return fmt.Errorf("Quarantine error writing %s -- %w", m.Id, err)
+	}
+	return nil
+}
+
+// repairedKey returns the object key marking a quarantined event as repaired, as the store is immutable
+func repairedKey(id string) string {
+	return "repaired/" + id + ".json"
+}
+
+// List returns the quarantined events not yet repaired, oldest first
+func (q *Quarantine) List(ctx context.Context) ([]QuarantinedEvent, error) {
+	repaired, err := q.store.List(ctx, "repaired/")
+	if err != nil {
+		return nil, err
+	}
+	done := make(map[string]bool, len(repaired))
+	for _, key := range repaired {
+		done[strings.TrimSuffix(strings.TrimPrefix(key, "repaired/"), ".json")] = true
+	}
+	keys, err := q.store.List(ctx, "quarantine/")
+	if err != nil {
+		return nil, err
+	}
+	var events []QuarantinedEvent
+	for _, key := range keys {
+		id := strings.TrimSuffix(key[strings.LastIndex(key, "/")+1:], ".json")
+		if done[id] {
+			continue
+		}
+		m, err := q.get(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, m)
+	}
+	return events, nil
+}
+
+// Get returns the quarantined event by id
+func (q *Quarantine) Get(ctx context.Context, id string) (QuarantinedEvent, error) {
+	keys, err := q.store.List(ctx, "quarantine/")
+	if err != nil {
+		return QuarantinedEvent{}, err
+	}
+	for _, key := range keys {
+		if strings.HasSuffix(key, "/"+id+".json") {
+			return q.get(ctx, key)
+		}
+	}
+	return QuarantinedEvent{}, fmt.Errorf("Quarantined event %q not found", id)
+}
+
+func (q *Quarantine) get(ctx context.Context, key string) (QuarantinedEvent, error) {
+	var m QuarantinedEvent
+	b, err := q.store.Get(ctx, key)
+	if err != nil {
+		return m, fmt.Errorf("Quarantine error reading %s -- %v", key, err)
+	}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return m, fmt.Errorf("Quarantine error decoding %s -- %v", key, err)
+	}
+	return m, nil
+}
+
+// markRepaired records that a quarantined event was replayed with the actor
+func (q *Quarantine) markRepaired(ctx context.Context, id, actor string) error {
+	b, _ := json.Marshal(map[string]interface{}{"id": id, "actor": actor, "time": time.Now().UTC()})
+	return q.store.Put(ctx, repairedKey(id), b)
+}
+
+// repair applies the transform if not nil, and re-injects the event through transforms and delivery
+// without quarantining again, marking it repaired on success
+func (s *Segment) repair(ctx context.Context, q *Quarantine, m QuarantinedEvent, event *SegmentEvent, transform Transform, actor string) error {
+	if event == nil {
+		return fmt.Errorf("Quarantined event %q has no decoded event, an edited payload is required", m.Id)
+	}
+	if transform != nil {
+		if err := transform(ctx, event); err != nil {
+			return err
+		}
+	}
+	if err := s.sendEvent(ctx, *event, nil, false); err != nil {
+		return err
+	}
+	return q.markRepaired(ctx, m.Id, actor)
+}
+
+// MountRepair adds admin endpoints to repair quarantined events:
+// GET /quarantine lists events not yet repaired, GET /quarantine/{id} returns one,
+// POST /quarantine/{id}/replay re-injects one with an edited event in the body if provided, and
+// POST /quarantine/replay re-injects all.  A named repair transform may be applied with `?transform=`.
+func (s *Segment) MountRepair(router *mux.Router, auth Authorizer, q *Quarantine, repairs map[string]Transform) *Segment {
+	s.Logger.Println("Adding repair handlers")
+	repairTransform := func(w http.ResponseWriter, r *http.Request) (Transform, bool) {
+		name := r.FormValue("transform")
+		if name == "" {
+			return nil, true
+		}
+		t, ok := repairs[name]
+		if !ok {
+			writeError(w, http.StatusBadRequest, "invalid_request", fmt.Sprintf("Unknown transform %q", name))
+		}
+		return t, ok
+	}
+
+	router.Handle("/quarantine", s.adminHandler(auth, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		events, err := q.List(r.Context())
+		if err != nil {
+			s.Logger.Println("Quarantine list error", err)
+			writeError(w, http.StatusInternalServerError, "quarantine_error", "Unable to list quarantined events")
+			return
+		}
+		json.NewEncoder(w).Encode(events)
+	}))).Methods("GET")
+
+	router.Handle("/quarantine/replay", s.adminHandler(auth, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		transform, ok := repairTransform(w, r)
+		if !ok {
+			return
+		}
+		events, err := q.List(r.Context())
+		if err != nil {
+			s.Logger.Println("Quarantine list error", err)
+			writeError(w, http.StatusInternalServerError, "quarantine_error", "Unable to list quarantined events")
+			return
+		}
+		actor, _ := auth(r)
+		repaired, failed := 0, 0
+		for _, m := range events {
+			if err := s.repair(r.Context(), q, m, m.Event, transform, actor); err != nil {
+				failed++
+				continue
+			}
+			repaired++
+		}
+		s.audit.Record(AuditRepair, actor, s.clientIP(r), map[string]string{
+			"transform": r.FormValue("transform"),
+			"repaired":  fmt.Sprint(repaired),
+			"failed":    fmt.Sprint(failed),
+		})
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": failed == 0, "repaired": repaired, "failed": failed})
+	}))).Methods("POST")
+
+	router.Handle("/quarantine/{id}", s.adminHandler(auth, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		m, err := q.Get(r.Context(), mux.Vars(r)["id"])
+		if err != nil {
+			writeError(w, http.StatusNotFound, "not_found", err.Error())
+			return
+		}
+		json.NewEncoder(w).Encode(m)
+	}))).Methods("GET")
+
+	router.Handle("/quarantine/{id}/replay", s.adminHandler(auth, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		transform, ok := repairTransform(w, r)
+		if !ok {
+			return
+		}
+		m, err := q.Get(r.Context(), mux.Vars(r)["id"])
+		if err != nil {
+			writeError(w, http.StatusNotFound, "not_found", err.Error())
+			return
+		}
+		event := m.Event
+		if r.ContentLength != 0 {
+			event = &SegmentEvent{}
+			if err := s.decode(r.Body, event); err != nil {
+				writeError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON: "+err.Error())
+				return
+			}
+		}
+		actor, _ := auth(r)
+		err = s.repair(r.Context(), q, m, event, transform, actor)
+		s.audit.Record(AuditRepair, actor, s.clientIP(r), map[string]string{
+			"id":        m.Id,
+			"transform": r.FormValue("transform"),
+			"edited":    fmt.Sprint(event != m.Event),
+			"success":   fmt.Sprint(err == nil),
+		})
+		if err != nil {
+			writeError(w, http.StatusUnprocessableEntity, "repair_failed", err.Error())
+			return
+		}
+		w.Write([]byte(`{ "success": true }`))
+	}))).Methods("POST")
+	return s
+}
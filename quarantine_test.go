@@ -0,0 +1,120 @@
+package segment
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestQuarantine(t *testing.T) {
+	dest, quarantine := &testDestination{}, &testDestination{}
+	router := mux.NewRouter()
+	NewSegment(func(string) string { return "p" }, []Destination{dest}, router).
+		WithQuarantine(quarantine).
+		WithTransforms(func(ctx context.Context, m *SegmentEvent) error {
+			if m.UserId == "" {
+				return errors.New("userId required")
+			}
+			return nil
+		})
+
+	for body, expected := range map[string]int{
+		`{"event":"Signed Up","userId":"u"}`: http.StatusOK,
+		`{"event":"Signed Up"}`:              http.StatusOK,
+		`{"event":`:                          http.StatusBadRequest,
+	} {
+		req := httptest.NewRequest("POST", "/track", strings.NewReader(body))
+		req.SetBasicAuth("key", "")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != expected {
+			t.Errorf("Expected %d for %s, got %d", expected, body, w.Code)
+		}
+	}
+
+	// Payloads without a known writeKey aren't quarantined
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/track", strings.NewReader(`{"event":`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 without writeKey, got %d", w.Code)
+	}
+
+	if len(dest.sent()) != 1 || len(quarantine.sent()) != 2 {
+		t.Fatalf("Expected 1 sent and 2 quarantined, got %d and %d", len(dest.sent()), len(quarantine.sent()))
+	}
+	for _, message := range quarantine.sent() {
+		q := message.(QuarantinedEvent)
+		if q.Event != nil && (q.Reason != "userId required" || q.Event.Event != "Signed Up") {
+			t.Errorf("Expected quarantined event with reason, got %+v", q)
+		}
+		if q.Event == nil && q.Payload != `{"event":` {
+			t.Errorf("Expected quarantined raw payload, got %+v", q)
+		}
+	}
+}
+
+func TestQuarantineStore(t *testing.T) {
+	store := NewLocalArchiveStore(t.TempDir())
+	q := QuarantinedEvent{Id: "1", Reason: "invalid", Event: &SegmentEvent{}}
+	if err := NewQuarantine(store).Send(context.Background(), q); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := store.List(context.Background(), "quarantine/")
+	if err != nil || len(keys) != 1 {
+		t.Errorf("Expected one quarantined object, got %v %v", keys, err)
+	}
+}
+
+func TestRepairReplay(t *testing.T) {
+	dest := &testDestination{}
+	q := NewQuarantine(NewLocalArchiveStore(t.TempDir()))
+	s := NewSegment(func(string) string { return "p" }, []Destination{dest}, nil).
+		WithQuarantine(q).
+		WithTransforms(func(ctx context.Context, m *SegmentEvent) error {
+			if m.UserId == "" {
+				return errors.New("userId required")
+			}
+			return nil
+		})
+	s.send(context.Background(), SegmentEvent{SegmentMessage: SegmentMessage{Type: "track", Event: "A"}})
+	s.send(context.Background(), SegmentEvent{SegmentMessage: SegmentMessage{Type: "track", Event: "B"}})
+	events, err := q.List(context.Background())
+	if err != nil || len(events) != 2 {
+		t.Fatalf("Expected 2 quarantined, got %d %v", len(events), err)
+	}
+
+	router := mux.NewRouter()
+	s.MountRepair(router, BasicAuthorizer("admin", "secret"), q, map[string]Transform{
+		"anonymous": func(ctx context.Context, m *SegmentEvent) error {
+			m.UserId = "anonymous"
+			return nil
+		},
+	})
+	replay := func(path, body string) int {
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		req.SetBasicAuth("admin", "secret")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	id := events[0].Id
+	if code := replay("/quarantine/"+id+"/replay", ""); code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected replay to fail validation again, got %d", code)
+	}
+	if code := replay("/quarantine/"+id+"/replay", `{"type":"track","event":"A","userId":"u"}`); code != http.StatusOK {
+		t.Errorf("Expected edited replay to succeed, got %d", code)
+	}
+	if code := replay("/quarantine/replay?transform=anonymous", ""); code != http.StatusOK {
+		t.Errorf("Expected bulk replay with transform to succeed, got %d", code)
+	}
+
+	if events, _ := q.List(context.Background()); len(events) != 0 || len(dest.sent()) != 2 {
+		t.Errorf("Expected all repaired and sent, got %d quarantined and %d sent", len(events), len(dest.sent()))
+	}
+}
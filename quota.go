@@ -0,0 +1,119 @@
+package segment
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Quota limits the events accepted per project each UTC day and month, zero for unlimited
+type Quota struct {
+	Daily   int64 `json:"daily,omitempty"`
+	Monthly int64 `json:"monthly,omitempty"`
+}
+
+// quotaUsage counts events for the current day and month
+type quotaUsage struct {
+	day     string
+	daily   int64
+	month   string
+	monthly int64
+}
+
+// Quotas enforces per project quotas, counting events accepted by this instance
+type Quotas struct {
+	mu       sync.Mutex
+	quota    Quota
+	projects map[string]Quota
+	usage    map[string]*quotaUsage
+	metric   *prometheus.GaugeVec
+}
+
+// NewQuotas creates quotas with a default for all projects, overridden per projectId
+func NewQuotas(quota Quota, projects map[string]Quota) *Quotas {
+	return &Quotas{
+		quota:    quota,
+		projects: projects,
+		usage:    make(map[string]*quotaUsage),
+		metric: newGaugeVec(nil, prometheus.GaugeOpts{
+			Name: "quota_usage_events",
+			Help: "Events accepted against the quota by project and period",
+		}, "project", "period"),
+	}
+}
+
+// WithQuotas rejects requests with 429 once a project exceeds its quota
+func (s *Segment) WithQuotas(quotas *Quotas) *Segment {
+	s.quotas = quotas
+	return s
+}
+
+// overQuota writes a 429 response with Retry-After if n events would exceed the project quota
+func (s *Segment) overQuota(w http.ResponseWriter, projectId string, n int) bool {
+	now := time.Now()
+	ok, reset := s.quotas.allow(projectId, n, now)
+	if ok {
+		return false
+	}
+	s.Logger.Printf("Project %s exceeded quota\n", projectId)
+	s.drop(DropQuotaExceeded, n)
+	s.monitor.Emit(MonitorQuotaExceeded, map[string]interface{}{"project": projectId, "events": n})
+	w.Header().Set("Retry-After", strconv.Itoa(int(reset.Sub(now).Seconds())+1))
+	writeError(w, http.StatusTooManyRequests, "quota_exceeded", "Project event quota exceeded")
+	return true
+}
+
+// allow counts n events for the project, returning false with the time the quota resets if it would be exceeded
+func (q *Quotas) allow(projectId string, n int, now time.Time) (bool, time.Time) {
+	if q == nil {
+		return true, time.Time{}
+	}
+	quota, ok := q.projects[projectId]
+	if !ok {
+		quota = q.quota
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	usage := q.current(projectId, now)
+	now = now.UTC()
+	if quota.Monthly > 0 && usage.monthly+int64(n) > quota.Monthly {
+		return false, time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	if quota.Daily > 0 && usage.daily+int64(n) > quota.Daily {
+		return false, time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+	}
+	usage.daily += int64(n)
+	usage.monthly += int64(n)
+	q.metric.WithLabelValues(projectId, "daily").Set(float64(usage.daily))
+	q.metric.WithLabelValues(projectId, "monthly").Set(float64(usage.monthly))
+	return true, time.Time{}
+}
+
+// current returns the usage for the project, resetting counts at the start of each day and month
+func (q *Quotas) current(projectId string, now time.Time) *quotaUsage {
+	day, month := now.UTC().Format("2006-01-02"), now.UTC().Format("2006-01")
+	usage, ok := q.usage[projectId]
+	if !ok {
+		usage = &quotaUsage{day: day, month: month}
+		q.usage[projectId] = usage
+	}
+	if usage.day != day {
+		usage.day, usage.daily = day, 0
+	}
+	if usage.month != month {
+		usage.month, usage.monthly = month, 0
+	}
+	return usage
+}
+
+// Usage returns the events accepted for the project today and this month
+func (q *Quotas) Usage(projectId string) (daily, monthly int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	usage := q.current(projectId, time.Now())
+	return usage.daily, usage.monthly
+}
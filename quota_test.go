@@ -0,0 +1,47 @@
+package segment
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestQuotaExceeded(t *testing.T) {
+	router := mux.NewRouter()
+	NewSegment(func(string) string { return "p" }, []Destination{&testDestination{}}, router).
+		WithQuotas(NewQuotas(Quota{Daily: 2}, nil))
+
+	for i, expected := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		req := httptest.NewRequest("POST", "/track", strings.NewReader(`{"event":"A"}`))
+		req.SetBasicAuth("key", "")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != expected {
+			t.Errorf("Expected %d for request %d, got %d", expected, i, w.Code)
+		}
+		if expected == http.StatusTooManyRequests && w.Header().Get("Retry-After") == "" {
+			t.Error("Expected Retry-After header")
+		}
+	}
+}
+
+func TestQuotaReset(t *testing.T) {
+	q := NewQuotas(Quota{Daily: 1, Monthly: 2}, map[string]Quota{"unlimited": {}})
+	day := time.Date(2024, 1, 31, 12, 0, 0, 0, time.UTC)
+	if ok, _ := q.allow("p", 1, day); !ok {
+		t.Error("Expected first event allowed")
+	}
+	if ok, reset := q.allow("p", 1, day); ok || !reset.Equal(time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected daily quota exceeded until next day, got %v", reset)
+	}
+	if ok, _ := q.allow("p", 1, day.Add(24*time.Hour)); !ok {
+		t.Error("Expected quota reset next day and month")
+	}
+	if ok, _ := q.allow("unlimited", 100, day); !ok {
+		t.Error("Expected project override unlimited")
+	}
+}
@@ -0,0 +1,248 @@
+package segment
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// recorderRedacted replaces redacted header and field values
+const recorderRedacted = "REDACTED"
+
+// RecorderConfig captures a sample of raw ingest requests to disk, for reproducing decode failures
+type RecorderConfig struct {
+	Dir         string   `json:"dir"`                   // Directory of hourly ndjson files
+	SampleRate  float64  `json:"sampleRate,omitempty"`  // Fraction of requests recorded, defaults to 1
+	Errors      bool     `json:"errors,omitempty"`      // Only record requests that failed with a 4xx or 5xx
+	MaxBodySize int64    `json:"maxBodySize,omitempty"` // Truncates larger bodies, defaults to 1MB
+	RedactKeys  []string `json:"redactKeys,omitempty"`  // Json keys with string values to redact eg "email", and writeKey
+}
+
+// recorderWriteKey matches a redacted writeKey, replaced with the writeKey on replay
+var recorderWriteKey = regexp.MustCompile(`("writeKey"\s*:\s*)"` + recorderRedacted + `"`)
+
+// RecordedRequest is a captured request, with the Authorization header and redacted keys replaced, including within
+// the base64 data payload of GET requests
+type RecordedRequest struct {
+	Time   time.Time   `json:"time"`
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Header http.Header `json:"header"`
+	Status int         `json:"status"`
+	Body   []byte      `json:"body"` // Raw bytes so invalid json is preserved
+}
+
+// Recorder is an opt-in debug recorder of raw ingest requests
+type Recorder struct {
+	mu     sync.Mutex
+	config RecorderConfig
+	redact *regexp.Regexp
+	hour   string
+	file   *os.File
+}
+
+// NewRecorder creates a recorder writing to the config directory
+func NewRecorder(config RecorderConfig) (*Recorder, error) {
+	if config.Dir == "" {
+		return nil, fmt.Errorf("Recorder requires dir")
+	}
+	if config.SampleRate == 0 {
+		config.SampleRate = 1
+	}
+	if config.MaxBodySize == 0 {
+		config.MaxBodySize = 1 << 20
+	}
+	if err := os.MkdirAll(config.Dir, 0o700); err != nil {
+		return nil, fmt.Errorf("Recorder dir error -- %v", err)
+	}
+	keys := []string{"writeKey"} // Always redacted as a credential
+	for _, key := range config.RedactKeys {
+		keys = append(keys, regexp.QuoteMeta(key))
+	}
+	// Matched on the raw bytes rather than decoded json, so invalid payloads are still redacted, including a value cut
+	// off at the end of a truncated body
+	return &Recorder{
+		config: config,
+		redact: regexp.MustCompile(`("(?:` + strings.Join(keys, "|") + `)"\s*:\s*)"(?:[^"\\]|\\.)*(?:"|\\?$)`),
+	}, nil
+}
+
+// WithRecorder records a sample of ingest requests for debugging
+func (s *Segment) WithRecorder(rec *Recorder) *Segment {
+	s.recorder = rec
+	return s
+}
+
+// statusWriter captures the status code of a response
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// record wraps an ingest handler, capturing the request body and response status if sampled
+func (s *Segment) record(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rec := s.recorder
+		if rec == nil || rand.Float64() >= rec.config.SampleRate {
+			h(w, r)
+			return
+		}
+		// Read up to the max body size up front, as decoding stops at the first error, passing the rest through
+		body, err := io.ReadAll(io.LimitReader(r.Body, rec.config.MaxBodySize+1))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_request", "Unable to read body")
+			return
+		}
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		h(sw, r)
+		if rec.config.Errors && sw.status < http.StatusBadRequest {
+			return
+		}
+		if err := rec.write(r, sw.status, body, time.Now()); err != nil {
+			s.Logger.Println("Recorder error", err)
+		}
+	}
+}
+
+// write appends the redacted request to the file for the hour, redacting before truncating so a truncated value is
+// still redacted
+func (rec *Recorder) write(r *http.Request, status int, body []byte, now time.Time) error {
+	body = rec.redact.ReplaceAll(body, []byte(`${1}"`+recorderRedacted+`"`))
+	if int64(len(body)) > rec.config.MaxBodySize {
+		body = body[:rec.config.MaxBodySize]
+	}
+	header := r.Header.Clone()
+	for _, name := range []string{"Authorization", "Cookie"} {
+		if header.Get(name) != "" {
+			header.Set(name, recorderRedacted)
+		}
+	}
+	line, err := json.Marshal(RecordedRequest{
+		Time:   now.UTC(),
+		Method: r.Method,
+		URL:    mapData(r.URL, func(data []byte) []byte { return rec.redact.ReplaceAll(data, []byte(`${1}"`+recorderRedacted+`"`)) }),
+		Header: header,
+		Status: status,
+		Body:   body,
+	})
+	if err != nil {
+		return err
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	hour := now.UTC().Format("2006-01-02T15")
+	if rec.file == nil || rec.hour != hour {
+		if rec.file != nil {
+			rec.file.Close()
+		}
+		rec.file, err = os.OpenFile(filepath.Join(rec.config.Dir, "requests-"+hour+".ndjson"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+		if err != nil {
+			rec.file = nil
+			return err
+		}
+		rec.hour = hour
+	}
+	_, err = rec.file.Write(append(line, '\n'))
+	return err
+}
+
+// mapData returns the request uri with f applied to the base64 data payload of a GET request, replacing the payload
+// if it isn't valid base64
+func mapData(u *url.URL, f func(data []byte) []byte) string {
+	query := u.Query()
+	if !query.Has("data") {
+		return u.RequestURI()
+	}
+	data, err := base64.StdEncoding.DecodeString(query.Get("data"))
+	if err != nil {
+		query.Set("data", recorderRedacted)
+	} else {
+		query.Set("data", base64.StdEncoding.EncodeToString(f(data)))
+	}
+	c := *u
+	c.RawQuery = query.Encode()
+	return c.RequestURI()
+}
+
+// Close closes the current file
+func (rec *Recorder) Close() error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.file == nil {
+		return nil
+	}
+	err := rec.file.Close()
+	rec.file = nil
+	return err
+}
+
+// ReplayRecording sends recorded requests from r to the target url eg "http://localhost:8080", authenticating with
+// the writeKey as the recorded Authorization header is redacted, and returns the number of requests replayed
+func ReplayRecording(ctx context.Context, r io.Reader, target, writeKey string, client *http.Client) (int, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	n := 0
+	for scanner.Scan() {
+		var recorded RecordedRequest
+		if err := json.Unmarshal(scanner.Bytes(), &recorded); err != nil {
+			return n, fmt.Errorf("Recording decode error -- %v", err)
+		}
+		uri, body := recorded.URL, recorded.Body
+		if writeKey != "" {
+			// Restore the redacted writeKey, which would otherwise take precedence over basic auth
+			quoted, _ := json.Marshal(writeKey)
+			repl := append([]byte("${1}"), bytes.ReplaceAll(quoted, []byte("$"), []byte("$$"))...)
+			replace := func(data []byte) []byte { return recorderWriteKey.ReplaceAll(data, repl) }
+			body = replace(body)
+			if u, err := url.Parse(uri); err == nil {
+				uri = mapData(u, replace)
+			}
+		}
+		req, err := http.NewRequestWithContext(ctx, recorded.Method, strings.TrimSuffix(target, "/")+uri, bytes.NewReader(body))
+		if err != nil {
+			return n, err
+		}
+		for name, values := range recorded.Header {
+			if name != "Authorization" && name != "Cookie" && name != "Content-Length" {
+				req.Header[name] = values
+			}
+		}
+		if writeKey != "" {
+			req.SetBasicAuth(writeKey, "")
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			return n, err
+		}
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+		n++
+	}
+	return n, scanner.Err()
+}
@@ -0,0 +1,116 @@
+package segment
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestRecorderReplay(t *testing.T) {
+	dir := t.TempDir()
+	rec, err := NewRecorder(RecorderConfig{Dir: dir, Errors: true, RedactKeys: []string{"email"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := mux.NewRouter()
+	NewSegment(func(writeKey string) string { return writeKey }, []Destination{&testDestination{}}, router).WithRecorder(rec)
+
+	for _, body := range []string{
+		`{"batch":[{"type":"track","event":"Ok"}]}`,
+		`{"batch":[{"type":"track","traits":{"email":"a@example.com"},"event":` + "\x00" + `}]}`, // Invalid json
+	} {
+		req := httptest.NewRequest("POST", "/batch", strings.NewReader(body))
+		req.SetBasicAuth("web", "")
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	rec.Close()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "requests-*.ndjson"))
+	if len(files) != 1 {
+		t.Fatalf("Expected 1 file, got %v", files)
+	}
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Count(data, []byte("\n")) != 1 {
+		t.Fatalf("Expected only the failed request, got %s", data)
+	}
+	if bytes.Contains(data, []byte("example.com")) || !bytes.Contains(data, []byte(`"Authorization":["REDACTED"]`)) {
+		t.Errorf("Expected redacted recording, got %s", data)
+	}
+
+	// Replay the failed request against another instance
+	target := mux.NewRouter()
+	dest := &testDestination{}
+	NewSegment(func(writeKey string) string { return writeKey }, []Destination{dest}, target)
+	server := httptest.NewServer(target)
+	defer server.Close()
+	n, err := ReplayRecording(context.Background(), bytes.NewReader(data), server.URL, "web", nil)
+	if err != nil || n != 1 {
+		t.Fatalf("Expected 1 replayed, got %d -- %v", n, err)
+	}
+	if sent := dest.sent(); len(sent) != 0 {
+		t.Errorf("Expected replayed decode failure, got %d events", len(sent))
+	}
+}
+
+func TestRecorderRedaction(t *testing.T) {
+	dir := t.TempDir()
+	rec, err := NewRecorder(RecorderConfig{Dir: dir, MaxBodySize: 64, RedactKeys: []string{"email"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := mux.NewRouter()
+	dest := &testDestination{}
+	NewSegment(func(writeKey string) string { return writeKey }, []Destination{dest}, router).WithRecorder(rec)
+
+	// The writeKey is always redacted, within GET data payloads, and a value cut off by truncation
+	data := base64.StdEncoding.EncodeToString([]byte(`{"writeKey":"secret","event":"Get","traits":{"email":"a@example.com"}}`))
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/track?data="+url.QueryEscape(data), nil))
+	body := `{"writeKey":"secret","event":"Post","properties":{"padding":"xxxxxx"},"traits":{"email":"a@example.com"}}`
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/track", strings.NewReader(body)))
+	rec.Close()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "requests-*.ndjson"))
+	recording, _ := os.ReadFile(files[0])
+	for _, line := range bytes.Split(bytes.TrimSpace(recording), []byte("\n")) {
+		var recorded RecordedRequest
+		json.Unmarshal(line, &recorded)
+		u, _ := url.Parse(recorded.URL)
+		payload, _ := base64.StdEncoding.DecodeString(u.Query().Get("data"))
+		for _, b := range [][]byte{recorded.Body, payload} {
+			if bytes.Contains(b, []byte("secret")) || bytes.Contains(b, []byte("a@ex")) {
+				t.Errorf("Expected redacted recording, got %s", b)
+			}
+		}
+		if len(recorded.Body) > 64 {
+			t.Errorf("Expected body truncated to 64 bytes, got %d", len(recorded.Body))
+		}
+	}
+	if sent := dest.sent(); len(sent) != 2 || sent[1].(SegmentEvent).Event != "Post" {
+		t.Fatalf("Expected the whole body beyond the recorded size sent, got %v", sent)
+	}
+
+	// Replay restores the redacted writeKey
+	target := mux.NewRouter()
+	replayed := &testDestination{}
+	NewSegment(func(writeKey string) string { return writeKey }, []Destination{replayed}, target)
+	server := httptest.NewServer(target)
+	defer server.Close()
+	if n, err := ReplayRecording(context.Background(), bytes.NewReader(recording), server.URL, "web", nil); err != nil || n != 2 {
+		t.Fatalf("Expected 2 replayed, got %d -- %v", n, err)
+	}
+	if sent := replayed.sent(); len(sent) != 1 || sent[0].(SegmentEvent).WriteKey != "web" {
+		t.Errorf("Expected GET replayed with the writeKey, got %v", sent)
+	}
+}
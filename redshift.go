@@ -0,0 +1,51 @@
+package segment
+
+import (
+	"fmt"
+	"strings"
+)
+
+// redshiftMaxRecord is the largest kinesis record redshift streaming ingestion loads, larger records are skipped
+const redshiftMaxRecord = 1024000
+
+// RedshiftStreamingConfig contains the names to create a materialized view of events in a kinesis stream
+type RedshiftStreamingConfig struct {
+	Stream  string `json:"stream"`           // Kinesis stream name, the KinesisSourceStream of the delivery
+	IAMRole string `json:"iamRole"`          // Role ARN that redshift assumes to read the stream
+	Schema  string `json:"schema,omitempty"` // External schema for the stream, defaults to "kinesis"
+	View    string `json:"view,omitempty"`   // Materialized view, defaults to "segment_events"
+}
+
+// redshiftColumns are the json fields of events extracted as columns of the view, with the full event as a super payload
+var redshiftColumns = []struct{ column, field, typ string }{
+	{"message_id", "messageId", "VARCHAR(64)"},
+	{"project_id", "projectId", "VARCHAR(64)"},
+	{"type", "type", "VARCHAR(16)"},
+	{"event", "event", "VARCHAR(256)"},
+	{"user_id", "userId", "VARCHAR(256)"},
+	{"anonymous_id", "anonymousId", "VARCHAR(256)"},
+	{"timestamp", "timestamp", "TIMESTAMPTZ"},
+	{"received_at", "receivedAt", "TIMESTAMPTZ"},
+}
+
+// RedshiftStreamingSQL returns the statements to create an external schema for the kinesis stream, and an auto
+// refreshing materialized view extracting event columns, for a delivery with RedshiftStreaming
+func RedshiftStreamingSQL(config RedshiftStreamingConfig) string {
+	if config.Schema == "" {
+		config.Schema = "kinesis"
+	}
+	if config.View == "" {
+		config.View = "segment_events"
+	}
+	var sql strings.Builder
+	fmt.Fprintf(&sql, "CREATE EXTERNAL SCHEMA IF NOT EXISTS %s\nFROM KINESIS\nIAM_ROLE '%s';\n\n",
+		config.Schema, strings.ReplaceAll(config.IAMRole, "'", "''"))
+	fmt.Fprintf(&sql, "CREATE MATERIALIZED VIEW %s AUTO REFRESH YES AS\nSELECT approximate_arrival_timestamp,\n", config.View)
+	sql.WriteString("  partition_key,\n  shard_id,\n  sequence_number,\n")
+	for _, c := range redshiftColumns {
+		fmt.Fprintf(&sql, "  NULLIF(JSON_EXTRACT_PATH_TEXT(FROM_VARBYTE(kinesis_data, 'utf-8'), '%s', true), '')::%s AS %s,\n", c.field, c.typ, c.column)
+	}
+	sql.WriteString("  JSON_PARSE(kinesis_data) AS payload\n")
+	fmt.Fprintf(&sql, "FROM %s.\"%s\"\nWHERE CAN_JSON_PARSE(kinesis_data);\n", config.Schema, config.Stream)
+	return sql.String()
+}
@@ -0,0 +1,20 @@
+package segment
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedshiftStreamingSQL(t *testing.T) {
+	sql := RedshiftStreamingSQL(RedshiftStreamingConfig{Stream: "events", IAMRole: "arn:aws:iam::123:role/redshift"})
+	for _, expected := range []string{
+		"CREATE EXTERNAL SCHEMA IF NOT EXISTS kinesis\nFROM KINESIS\nIAM_ROLE 'arn:aws:iam::123:role/redshift';",
+		"CREATE MATERIALIZED VIEW segment_events AUTO REFRESH YES AS",
+		"NULLIF(JSON_EXTRACT_PATH_TEXT(FROM_VARBYTE(kinesis_data, 'utf-8'), 'messageId', true), '')::VARCHAR(64) AS message_id,",
+		"JSON_PARSE(kinesis_data) AS payload\nFROM kinesis.\"events\"\nWHERE CAN_JSON_PARSE(kinesis_data);",
+	} {
+		if !strings.Contains(sql, expected) {
+			t.Errorf("Expected %q in:\n%s", expected, sql)
+		}
+	}
+}
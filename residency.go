@@ -0,0 +1,125 @@
+package segment
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// RegionFunc returns the region for an event, or empty string for the fallback
+type RegionFunc func(event SegmentEvent) string
+
+// ProjectRegion returns the region mapped to the event projectId
+func ProjectRegion(regions map[string]string) RegionFunc {
+	return func(event SegmentEvent) string {
+		return regions[event.ProjectId]
+	}
+}
+
+// ContextRegion returns the region for a dotted context field eg "location.country",
+// mapped through regions if provided, otherwise the field value is the region
+func ContextRegion(field string, regions map[string]string) RegionFunc {
+	return func(event SegmentEvent) string {
+		value, ok := lookupPath(event.Context, field).(string)
+		if !ok {
+			return ""
+		}
+		if regions == nil {
+			return value
+		}
+		return regions[value]
+	}
+}
+
+// lookupPath returns the value at a dotted path within nested maps
+func lookupPath(m map[string]interface{}, path string) interface{} {
+	var value interface{} = m
+	for _, key := range strings.Split(path, ".") {
+		next, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = next[key]
+	}
+	return value
+}
+
+// Residency is a destination that routes events to region specific destinations
+type Residency struct {
+	Logger   *log.Logger // Public logger that caller can override
+	region   RegionFunc
+	regions  map[string][]Destination
+	fallback []Destination
+}
+
+// NewResidency creates a residency router given region func, destinations by region and fallback
+func NewResidency(region RegionFunc, regions map[string][]Destination, fallback []Destination) *Residency {
+	return &Residency{
+		Logger:   log.New(os.Stderr, "", log.LstdFlags),
+		region:   region,
+		regions:  regions,
+		fallback: fallback,
+	}
+}
+
+// WithLogger propogates the logger down to region destinations
+func (r *Residency) WithLogger(logger *log.Logger) Destination {
+	if logger != nil {
+		for _, dest := range r.destinations() {
+			dest.WithLogger(logger)
+		}
+		r.Logger = logger
+	}
+	return r
+}
+
+// Process runs all region destinations until one returns an error
+func (r *Residency) Process(ctx context.Context) error {
+	return processAll(ctx, r.destinations())
+}
+
+// Send routes the message to the destinations for its region
+func (r *Residency) Send(ctx context.Context, message interface{}) error {
+	m, ok := message.(SegmentEvent)
+	if !ok {
+		return fmt.Errorf("Expected Segment Event")
+	}
+	region := r.region(m)
+	dests, ok := r.regions[region]
+	if !ok {
+		dests = r.fallback
+	}
+	if len(dests) == 0 {
+		return fmt.Errorf("No destination for region %q", region)
+	}
+	for _, dest := range dests {
+		if err := dest.Send(ctx, message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// route returns the region and names of its destinations eg "eu/delivery-mystream", for dry runs
+func (r *Residency) route(m SegmentEvent) []string {
+	region := r.region(m)
+	dests, ok := r.regions[region]
+	if !ok {
+		region, dests = "fallback", r.fallback
+	}
+	names := make([]string, len(dests))
+	for i, dest := range dests {
+		names[i] = region + "/" + destinationName(dest, i)
+	}
+	return names
+}
+
+func (r *Residency) destinations() []Destination {
+	groups := [][]Destination{r.fallback}
+	for _, dests := range r.regions {
+		groups = append(groups, dests)
+	}
+	return uniqueDestinations(groups...)
+}
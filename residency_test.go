@@ -0,0 +1,28 @@
+package segment
+
+import (
+	"context"
+	"testing"
+)
+
+func TestResidencySend(t *testing.T) {
+	eu, us := &testDestination{}, &testDestination{}
+	r := NewResidency(
+		ContextRegion("location.country", map[string]string{"DE": "eu"}),
+		map[string][]Destination{"eu": {eu}},
+		[]Destination{us},
+	)
+
+	de := SegmentEvent{SegmentMessage: SegmentMessage{Context: map[string]interface{}{
+		"location": map[string]interface{}{"country": "DE"},
+	}}}
+	if err := r.Send(context.Background(), de); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Send(context.Background(), SegmentEvent{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(eu.sent()) != 1 || len(us.sent()) != 1 {
+		t.Errorf("Expected one event per region, got eu=%d us=%d", len(eu.sent()), len(us.sent()))
+	}
+}
@@ -0,0 +1,112 @@
+package segment
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Retention actions counted by the events_expired_total metric
+const (
+	retentionDropped  = "dropped"
+	retentionArchived = "archived"
+)
+
+// RetentionConfig contains the TTL of events by timestamp, the first matching event name pattern taking precedence
+// over the project TTL, and the project over the default, with zero for no limit
+type RetentionConfig struct {
+	TTL      time.Duration            `json:"ttl,omitempty"`
+	Projects map[string]time.Duration `json:"projects,omitempty"` // TTL by projectId
+	Events   map[string]time.Duration `json:"events,omitempty"`   // TTL by event name pattern eg "Heartbeat *"
+	// Archive is the only destination sent expired events, which must be a segment destination, nil to drop them
+	Archive Destination `json:"-"`
+	// Registerer for metrics, defaults to the prometheus default registerer
+	Registerer prometheus.Registerer `json:"-"`
+}
+
+// Validate checks the event name patterns
+func (config *RetentionConfig) Validate() error {
+	for pattern := range config.Events {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Retention pattern %q error -- %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// Retention enforces the TTL of events at the collector, so each sink doesn't implement the retention policy
+type Retention struct {
+	config   RetentionConfig
+	patterns []string // Event name patterns sorted for a stable first match
+	expired  *prometheus.CounterVec
+}
+
+// NewRetention creates a retention policy given configuration
+func NewRetention(config RetentionConfig) *Retention {
+	if err := config.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	r := &Retention{
+		config: config,
+		expired: newCounterVec(config.Registerer, prometheus.CounterOpts{
+			Name: "events_expired_total",
+			Help: "Events older than the retention TTL total by project and action, dropped or archived",
+		}, "project", "action"),
+	}
+	for pattern := range config.Events {
+		r.patterns = append(r.patterns, pattern)
+	}
+	sort.Strings(r.patterns)
+	return r
+}
+
+// WithRetention drops events older than their TTL, or sends them only to the archive destination
+func (s *Segment) WithRetention(retention *Retention) *Segment {
+	if archive := retention.config.Archive; archive != nil {
+		found := false
+		for _, d := range s.destinations {
+			found = found || d.Destination == archive
+		}
+		if !found {
+			s.Logger.Printf("Retention archive %T not found, expired events are dropped\n", archive)
+			retention.config.Archive = nil
+		}
+	}
+	s.retention = retention
+	return s
+}
+
+// ttl returns the TTL for the event, or zero for no limit
+func (r *Retention) ttl(m SegmentEvent) time.Duration {
+	name := eventName(m.SegmentMessage)
+	for _, pattern := range r.patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return r.config.Events[pattern]
+		}
+	}
+	if ttl, ok := r.config.Projects[m.ProjectId]; ok {
+		return ttl
+	}
+	return r.config.TTL
+}
+
+// expire returns true if the event timestamp is older than its TTL, counting the event as dropped or archived
+func (r *Retention) expire(m SegmentEvent, now time.Time) bool {
+	if r == nil || m.Timestamp.IsZero() {
+		return false
+	}
+	ttl := r.ttl(m)
+	if ttl <= 0 || now.Sub(m.Timestamp) <= ttl {
+		return false
+	}
+	action := retentionDropped
+	if r.config.Archive != nil {
+		action = retentionArchived
+	}
+	r.expired.WithLabelValues(m.ProjectId, action).Inc()
+	return true
+}
@@ -0,0 +1,64 @@
+package segment
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRetention(t *testing.T) {
+	if err := (&RetentionConfig{Events: map[string]time.Duration{"[": time.Hour}}).Validate(); err == nil {
+		t.Error("Expected pattern error")
+	}
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	old := func(age time.Duration, project, event string) SegmentEvent {
+		return SegmentEvent{SegmentMessage: SegmentMessage{
+			Type: "track", Event: event, ProjectId: project, Timestamp: now.Add(-age), SentAt: now, MessageId: event,
+		}}
+	}
+
+	warehouse, archive := &testDestination{}, &testDestination{}
+	s := NewSegment(func(writeKey string) string { return writeKey }, []Destination{warehouse, archive}, nil).
+		WithClock(newTestClock(now))
+	reg := prometheus.NewRegistry()
+	retention := NewRetention(RetentionConfig{
+		TTL:        30 * 24 * time.Hour,
+		Projects:   map[string]time.Duration{"eu": 7 * 24 * time.Hour},
+		Events:     map[string]time.Duration{"Heartbeat *": time.Hour},
+		Archive:    archive,
+		Registerer: reg,
+	})
+	s.WithRetention(retention)
+	for _, m := range []SegmentEvent{
+		old(24*time.Hour, "web", "Signed Up"),       // Within the default
+		old(40*24*time.Hour, "web", "Old"),          // Beyond the default
+		old(10*24*time.Hour, "eu", "Project"),       // Beyond the project TTL
+		old(2*time.Hour, "web", "Heartbeat Ping"),   // Beyond the event TTL
+		old(10*time.Minute, "eu", "Heartbeat Pong"), // Event TTL takes precedence
+	} {
+		if err := s.send(context.Background(), m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if sent := warehouse.sent(); len(sent) != 2 || sent[0].(SegmentEvent).Event != "Signed Up" || sent[1].(SegmentEvent).Event != "Heartbeat Pong" {
+		t.Errorf("Expected unexpired events sent, got %v", sent)
+	}
+	if sent := archive.sent(); len(sent) != 5 {
+		t.Errorf("Expected all events archived, got %d", len(sent))
+	}
+	if got := testutil.ToFloat64(retention.expired.WithLabelValues("web", retentionArchived)); got != 2 {
+		t.Errorf("Expected 2 web events archived, got %v", got)
+	}
+
+	// An archive that is not a segment destination is ignored, so expired events are dropped
+	dest := &testDestination{}
+	s = NewSegment(func(writeKey string) string { return writeKey }, []Destination{dest}, nil).WithClock(newTestClock(now)).
+		WithRetention(NewRetention(RetentionConfig{TTL: time.Hour, Archive: archive, Registerer: prometheus.NewRegistry()}))
+	s.send(context.Background(), old(2*time.Hour, "web", "Old"))
+	if len(dest.sent()) != 0 || testutil.ToFloat64(s.metrics.dropped.WithLabelValues(DropExpired, "")) != 1 {
+		t.Errorf("Expected expired event dropped, got %v", dest.sent())
+	}
+}
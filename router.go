@@ -0,0 +1,174 @@
+package segment
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Route maps an event name pattern to a subset of named destinations
+type Route struct {
+	Pattern      string   `json:"pattern"`      // Event name with * and ? wildcards, eg "Order *"
+	Destinations []string `json:"destinations"` // Names of destinations to send matching events
+}
+
+// EventRouter is a destination that routes events by name to subsets of destinations,
+// using the first matching route.  Routes can be replaced while running.
+type EventRouter struct {
+	Logger       *log.Logger // Public logger that caller can override
+	destinations map[string]Destination
+	routes       atomic.Pointer[[]Route]
+	dropped      *prometheus.CounterVec
+}
+
+// NewEventRouter creates a router given named destinations and routes
+func NewEventRouter(destinations map[string]Destination, routes []Route) (*EventRouter, error) {
+	r := &EventRouter{
+		Logger:       log.New(os.Stderr, "", log.LstdFlags),
+		destinations: destinations,
+		dropped:      newDroppedCounter(nil),
+	}
+	if err := r.SetRoutes(routes); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// eventName returns the track event name, page or screen name, or otherwise the type
+func eventName(m SegmentMessage) string {
+	if m.Event != "" {
+		return m.Event
+	}
+	if m.Name != "" {
+		return m.Name
+	}
+	return m.Type
+}
+
+// SetRoutes validates and replaces the routes
+func (r *EventRouter) SetRoutes(routes []Route) error {
+	for _, route := range routes {
+		if _, err := path.Match(route.Pattern, ""); err != nil {
+			return fmt.Errorf("Route pattern %q error -- %v", route.Pattern, err)
+		}
+		for _, name := range route.Destinations {
+			if _, ok := r.destinations[name]; !ok {
+				return fmt.Errorf("Route pattern %q has unknown destination %q", route.Pattern, name)
+			}
+		}
+	}
+	routes = append([]Route{}, routes...)
+	r.routes.Store(&routes)
+	return nil
+}
+
+// LoadRoutes reads a json array of routes and replaces the routes
+func (r *EventRouter) LoadRoutes(reader io.Reader) error {
+	var routes []Route
+	if err := json.NewDecoder(reader).Decode(&routes); err != nil {
+		return fmt.Errorf("Route decode error -- %v", err)
+	}
+	return r.SetRoutes(routes)
+}
+
+// WatchRoutes reloads routes from a json file when it is modified, checking every interval until ctx is done
+func (r *EventRouter) WatchRoutes(ctx context.Context, filename string, interval time.Duration) {
+	var modified time.Time
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if info, err := os.Stat(filename); err != nil {
+			r.Logger.Printf("Route watch error -- %v\n", err)
+		} else if info.ModTime() != modified {
+			modified = info.ModTime()
+			if err := r.loadFile(filename); err != nil {
+				r.Logger.Printf("Route reload error, keeping previous routes -- %v\n", err)
+			} else {
+				r.Logger.Printf("Reloaded routes from %s\n", filename)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *EventRouter) loadFile(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return r.LoadRoutes(f)
+}
+
+// WithLogger propogates the logger down to routed destinations
+func (r *EventRouter) WithLogger(logger *log.Logger) Destination {
+	if logger != nil {
+		for _, dest := range r.all() {
+			dest.WithLogger(logger)
+		}
+		r.Logger = logger
+	}
+	return r
+}
+
+// Process runs all routed destinations until one returns an error
+func (r *EventRouter) Process(ctx context.Context) error {
+	return processAll(ctx, r.all())
+}
+
+// Send sends the message to the destinations of the first matching route, unmatched events are dropped
+func (r *EventRouter) Send(ctx context.Context, message interface{}) error {
+	m, ok := message.(SegmentEvent)
+	if !ok {
+		return fmt.Errorf("Expected Segment Event")
+	}
+	names := r.route(m)
+	if names == nil {
+		r.dropped.WithLabelValues(DropUnrouted, "").Inc()
+		return nil
+	}
+	for _, dest := range names {
+		if err := r.destinations[dest].Send(ctx, message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// route returns the destination names of the first matching route, or nil if unrouted
+func (r *EventRouter) route(m SegmentEvent) []string {
+	name := eventName(m.SegmentMessage)
+	for _, route := range *r.routes.Load() {
+		if matched, _ := path.Match(route.Pattern, name); matched {
+			return append([]string{}, route.Destinations...)
+		}
+	}
+	return nil
+}
+
+// all returns every named destination in name order, as any may be routed after a reload
+func (r *EventRouter) all() []Destination {
+	names := make([]string, 0, len(r.destinations))
+	for name := range r.destinations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	dests := make([]Destination, 0, len(names))
+	for _, name := range names {
+		dests = append(dests, r.destinations[name])
+	}
+	return uniqueDestinations(dests)
+}
@@ -0,0 +1,41 @@
+package segment
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestEventRouterSend(t *testing.T) {
+	firehose, webhook := &testDestination{}, &testDestination{}
+	r, err := NewEventRouter(map[string]Destination{"firehose": firehose, "webhook": webhook}, []Route{
+		{Pattern: "Order *", Destinations: []string{"firehose", "webhook"}},
+		{Pattern: "Page Viewed", Destinations: []string{"firehose"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	for _, name := range []string{"Order Completed", "Page Viewed", "Signed Up"} {
+		if err := r.Send(ctx, SegmentEvent{SegmentMessage: SegmentMessage{Type: "track", Event: name}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(firehose.sent()) != 2 || len(webhook.sent()) != 1 {
+		t.Errorf("Expected firehose=2 webhook=1, got firehose=%d webhook=%d", len(firehose.sent()), len(webhook.sent()))
+	}
+
+	// Reload routes so everything goes to the webhook
+	if err := r.LoadRoutes(strings.NewReader(`[{"pattern":"*","destinations":["webhook"]}]`)); err != nil {
+		t.Fatal(err)
+	}
+	r.Send(ctx, SegmentEvent{SegmentMessage: SegmentMessage{Type: "track", Event: "Signed Up"}})
+	if len(webhook.sent()) != 2 {
+		t.Errorf("Expected reloaded route, got webhook=%d", len(webhook.sent()))
+	}
+
+	if err := r.SetRoutes([]Route{{Pattern: "*", Destinations: []string{"missing"}}}); err == nil {
+		t.Error("Expected unknown destination error")
+	}
+}
@@ -0,0 +1,115 @@
+package segment
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Reasons and actions counted by the events_invalid_timestamp_total metric
+const (
+	timestampFuture   = "future"
+	timestampPast     = "past"
+	timestampClamped  = "clamped"
+	timestampRejected = "rejected"
+)
+
+// timestampEpoch is the default earliest sane timestamp, as unset client clocks report 1970
+var timestampEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// TimestampBounds contains the range of sane event timestamps, and whether to reject or clamp those outside it
+type TimestampBounds struct {
+	MaxFuture time.Duration `json:"maxFuture,omitempty"` // Allowed ahead of receivedAt, defaults to 1 hour
+	MinTime   time.Time     `json:"minTime,omitempty"`   // Earliest sane timestamp, defaults to 2000-01-01
+	Reject    bool          `json:"reject,omitempty"`    // Drop invalid events, otherwise clamp the timestamp to receivedAt
+}
+
+// TimestampPolicyConfig contains the default timestamp bounds, and the bounds by projectId taking precedence
+type TimestampPolicyConfig struct {
+	TimestampBounds
+	Projects map[string]TimestampBounds `json:"projects,omitempty"`
+	// Registerer for metrics, defaults to the prometheus default registerer
+	Registerer prometheus.Registerer `json:"-"`
+}
+
+// Validate checks the bounds
+func (config *TimestampPolicyConfig) Validate() error {
+	if config.MaxFuture < 0 {
+		return fmt.Errorf("Timestamp maxFuture %v is negative", config.MaxFuture)
+	}
+	for projectId, bounds := range config.Projects {
+		if bounds.MaxFuture < 0 {
+			return fmt.Errorf("Timestamp project %s maxFuture %v is negative", projectId, bounds.MaxFuture)
+		}
+	}
+	return nil
+}
+
+// TimestampPolicy clamps or rejects events with timestamps in the future or before a sane epoch, so client clock bugs
+// don't write garbage partitions to sinks
+type TimestampPolicy struct {
+	config  TimestampPolicyConfig
+	invalid *prometheus.CounterVec
+}
+
+// NewTimestampPolicy creates a timestamp policy given config defaults
+func NewTimestampPolicy(config TimestampPolicyConfig) *TimestampPolicy {
+	if err := config.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	return &TimestampPolicy{
+		config: config,
+		invalid: newCounterVec(config.Registerer, prometheus.CounterOpts{
+			Name: "events_invalid_timestamp_total",
+			Help: "Events with a timestamp in the future or before the epoch total by project, reason and action",
+		}, "project", "reason", "action"),
+	}
+}
+
+// WithTimestampPolicy clamps or rejects events with invalid timestamps before they are sent to destinations
+func (s *Segment) WithTimestampPolicy(policy *TimestampPolicy) *Segment {
+	s.timestamps = policy
+	return s
+}
+
+// bounds returns the bounds for the project with defaults
+func (p *TimestampPolicy) bounds(projectId string) TimestampBounds {
+	bounds, ok := p.config.Projects[projectId]
+	if !ok {
+		bounds = p.config.TimestampBounds
+	}
+	if bounds.MaxFuture == 0 {
+		bounds.MaxFuture = time.Hour
+	}
+	if bounds.MinTime.IsZero() {
+		bounds.MinTime = timestampEpoch
+	}
+	return bounds
+}
+
+// sanitize clamps an invalid event timestamp to receivedAt, keeping the originalTimestamp, and returns false if the
+// event should be rejected instead
+func (p *TimestampPolicy) sanitize(m *SegmentEvent) bool {
+	if p == nil || m.Timestamp.IsZero() {
+		return true
+	}
+	bounds := p.bounds(m.ProjectId)
+	reason := ""
+	switch {
+	case m.Timestamp.After(m.ReceivedAt.Add(bounds.MaxFuture)):
+		reason = timestampFuture
+	case m.Timestamp.Before(bounds.MinTime):
+		reason = timestampPast
+	default:
+		return true
+	}
+	if bounds.Reject {
+		p.invalid.WithLabelValues(m.ProjectId, reason, timestampRejected).Inc()
+		return false
+	}
+	p.invalid.WithLabelValues(m.ProjectId, reason, timestampClamped).Inc()
+	m.Timestamp = m.ReceivedAt
+	return true
+}
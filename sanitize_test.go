@@ -0,0 +1,66 @@
+package segment
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestTimestampPolicy(t *testing.T) {
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	event := func(projectId, name string, timestamp time.Time) SegmentEvent {
+		return SegmentEvent{WriteKey: projectId, SegmentMessage: SegmentMessage{
+			Type: "track", Event: name, ProjectId: projectId, Timestamp: timestamp, SentAt: now,
+		}}
+	}
+
+	dest := &testDestination{}
+	s := NewSegment(func(writeKey string) string { return writeKey }, []Destination{dest}, nil).
+		WithClock(newTestClock(now))
+	policy := NewTimestampPolicy(TimestampPolicyConfig{
+		Projects:   map[string]TimestampBounds{"iot": {Reject: true}},
+		Registerer: prometheus.NewRegistry(),
+	})
+	s.WithTimestampPolicy(policy)
+	for _, m := range []SegmentEvent{
+		event("web", "Valid", now.Add(-time.Hour)),
+		event("web", "Future", now.Add(48*time.Hour)),
+		event("web", "Epoch", time.Unix(0, 0)),
+		event("iot", "Rejected", now.Add(48*time.Hour)),
+	} {
+		if err := s.send(context.Background(), m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Invalid timestamps are clamped to receivedAt by default, keeping the original, and rejected by project
+	sent := dest.sent()
+	if len(sent) != 3 {
+		t.Fatalf("Expected 3 events sent, got %d", len(sent))
+	}
+	for i, expected := range []time.Time{now.Add(-time.Hour), now, now} {
+		if m := sent[i].(SegmentEvent); !m.Timestamp.Equal(expected) {
+			t.Errorf("Expected %s timestamp %v, got %v", m.Event, expected, m.Timestamp)
+		}
+	}
+	if m := sent[1].(SegmentEvent); !m.OriginalTimestamp.Equal(now.Add(48 * time.Hour)) {
+		t.Errorf("Expected original timestamp kept, got %v", m.OriginalTimestamp)
+	}
+	for _, c := range []struct {
+		project, reason, action string
+	}{
+		{"web", timestampFuture, timestampClamped},
+		{"web", timestampPast, timestampClamped},
+		{"iot", timestampFuture, timestampRejected},
+	} {
+		if n := testutil.ToFloat64(policy.invalid.WithLabelValues(c.project, c.reason, c.action)); n != 1 {
+			t.Errorf("Expected 1 %s %s %s, got %v", c.project, c.reason, c.action, n)
+		}
+	}
+	if err := (&TimestampPolicyConfig{TimestampBounds: TimestampBounds{MaxFuture: -time.Hour}}).Validate(); err == nil {
+		t.Error("Expected negative maxFuture error")
+	}
+}
@@ -0,0 +1,235 @@
+package segment
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Schema drift changes
+const (
+	DriftNewField   = "new_field"   // Property not seen before for the event
+	DriftTypeChange = "type_change" // Property seen with a different type
+)
+
+// maxDrift is the number of most recent drift changes kept for the report
+const maxDrift = 1000
+
+// Limits on the schemas tracked, so high cardinality event names or properties don't grow the registry unbounded
+const (
+	maxSchemaEvents     = 1000 // Most recently seen event names per project
+	maxSchemaProperties = 500  // Properties per event
+)
+
+// Schema overflows counted by the schema_overflow_total metric
+const (
+	schemaOverflowEvent    = "event"    // Least recently seen event name evicted
+	schemaOverflowProperty = "property" // Property beyond the limit not tracked
+)
+
+// SchemaDrift is a change to the observed schema of an event
+type SchemaDrift struct {
+	ProjectId string    `json:"projectId"`
+	Event     string    `json:"event"`
+	Property  string    `json:"property"`
+	Change    string    `json:"change"`
+	Previous  string    `json:"previous,omitempty"`
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+}
+
+// SchemaRegistry tracks the property names and types observed per project and event name,
+// reporting drift once an event has been seen
+type SchemaRegistry struct {
+	mu            sync.Mutex
+	schemas       map[string]*lruCache[map[string]string] // projectId, event, property to type
+	drift         []SchemaDrift
+	maxEvents     int
+	maxProperties int
+	metric        *prometheus.CounterVec
+	overflow      *prometheus.CounterVec
+}
+
+// NewSchemaRegistry creates a registry with the drift metric registered against reg, or the default if nil
+func NewSchemaRegistry(reg prometheus.Registerer) *SchemaRegistry {
+	return &SchemaRegistry{
+		schemas:       make(map[string]*lruCache[map[string]string]),
+		maxEvents:     maxSchemaEvents,
+		maxProperties: maxSchemaProperties,
+		metric: newCounterVec(reg, prometheus.CounterOpts{
+			Name: "schema_drift_total",
+			Help: "Schema drift total by change",
+		}, "change"),
+		overflow: newCounterVec(reg, prometheus.CounterOpts{
+			Name: "schema_overflow_total",
+			Help: "Schema event names evicted or properties not tracked total by limit",
+		}, "limit"),
+	}
+}
+
+// jsonType returns the json type name of a decoded value
+func jsonType(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64, int, int64, json.Number:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return "unknown"
+}
+
+// observeTypes adds the types of nested fields in m by dotted path
+func observeTypes(types map[string]string, prefix string, m map[string]interface{}) {
+	for k, v := range m {
+		path := prefix + "." + k
+		if nested, ok := v.(map[string]interface{}); ok {
+			observeTypes(types, path, nested)
+			continue
+		}
+		if v != nil {
+			types[path] = jsonType(v)
+		}
+	}
+}
+
+// Transform observes the properties and traits of each event, it doesn't modify the event
+func (r *SchemaRegistry) Transform(ctx context.Context, m *SegmentEvent) error {
+	if DryRun(ctx) {
+		return nil
+	}
+	types := make(map[string]string)
+	observeTypes(types, "properties", m.Properties)
+	observeTypes(types, "traits", m.Traits)
+	name := eventName(m.SegmentMessage)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	events, ok := r.schemas[m.ProjectId]
+	if !ok {
+		events = newLRUCache[map[string]string](r.maxEvents, 0)
+		r.schemas[m.ProjectId] = events
+	}
+	paths := make([]string, 0, len(types))
+	for path := range types {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths) // Properties beyond the limit are the same for every event
+	schema, seen := events.get(name)
+	if !seen {
+		if events.len() >= r.maxEvents {
+			r.overflow.WithLabelValues(schemaOverflowEvent).Inc()
+		}
+		schema = make(map[string]string)
+		for _, path := range paths {
+			if len(schema) >= r.maxProperties {
+				r.overflow.WithLabelValues(schemaOverflowProperty).Inc()
+				continue
+			}
+			schema[path] = types[path]
+		}
+		events.put(name, schema) // First sighting is the baseline
+		return nil
+	}
+	for _, path := range paths {
+		typ := types[path]
+		previous, ok := schema[path]
+		if ok && previous == typ {
+			continue
+		}
+		if !ok && len(schema) >= r.maxProperties {
+			r.overflow.WithLabelValues(schemaOverflowProperty).Inc()
+			continue
+		}
+		change := DriftNewField
+		if ok {
+			change = DriftTypeChange
+		}
+		schema[path] = typ
+		r.metric.WithLabelValues(change).Inc()
+		r.drift = append(r.drift, SchemaDrift{
+			ProjectId: m.ProjectId,
+			Event:     name,
+			Property:  path,
+			Change:    change,
+			Previous:  previous,
+			Type:      typ,
+			Time:      time.Now().UTC(),
+		})
+		if len(r.drift) > maxDrift {
+			r.drift = r.drift[len(r.drift)-maxDrift:]
+		}
+	}
+	return nil
+}
+
+// Schemas returns a copy of the observed property types by projectId and event name
+func (r *SchemaRegistry) Schemas() map[string]map[string]map[string]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c := make(map[string]map[string]map[string]string, len(r.schemas))
+	for projectId, events := range r.schemas {
+		c[projectId] = make(map[string]map[string]string, events.len())
+		for el := events.order.Front(); el != nil; el = el.Next() {
+			entry := el.Value.(*lruEntry[map[string]string])
+			c[projectId][entry.key] = cloneTypes(entry.value)
+		}
+	}
+	return c
+}
+
+// cloneTypes returns a copy of the property types of a schema
+func cloneTypes(schema map[string]string) map[string]string {
+	c := make(map[string]string, len(schema))
+	for path, typ := range schema {
+		c[path] = typ
+	}
+	return c
+}
+
+// Drift returns the most recent drift changes, oldest first
+func (r *SchemaRegistry) Drift() []SchemaDrift {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]SchemaDrift{}, r.drift...)
+}
+
+// ClearDrift removes drift changes once they have been reviewed
+func (r *SchemaRegistry) ClearDrift() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.drift = nil
+}
+
+// MountSchema adds GET /schema with observed schemas, and GET or DELETE /schema/drift to report
+// or clear drift, to an admin router
+func (s *Segment) MountSchema(router *mux.Router, auth Authorizer, registry *SchemaRegistry) *Segment {
+	s.Logger.Println("Adding schema handlers")
+	router.Handle("/schema", s.adminHandler(auth, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(registry.Schemas())
+	}))).Methods("GET")
+	router.Handle("/schema/drift", s.adminHandler(auth, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == "DELETE" {
+			registry.ClearDrift()
+			w.Write([]byte(`{ "success": true }`))
+			return
+		}
+		json.NewEncoder(w).Encode(registry.Drift())
+	}))).Methods("GET", "DELETE")
+	return s
+}
@@ -0,0 +1,70 @@
+package segment
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSchemaDrift(t *testing.T) {
+	registry := NewSchemaRegistry(prometheus.NewRegistry())
+	ctx := context.Background()
+	registry.Transform(ctx, &SegmentEvent{SegmentMessage: SegmentMessage{ProjectId: "p", Event: "Order Completed",
+		Properties: map[string]interface{}{"revenue": 9.99}}})
+	registry.Transform(ctx, &SegmentEvent{SegmentMessage: SegmentMessage{ProjectId: "p", Event: "Order Completed",
+		Properties: map[string]interface{}{"revenue": "9.99", "coupon": map[string]interface{}{"code": "X"}}}})
+
+	router := mux.NewRouter()
+	NewSegment(nil, nil, nil).MountSchema(router, BasicAuthorizer("admin", "secret"), registry)
+	req := httptest.NewRequest("GET", "/schema/drift", nil)
+	req.SetBasicAuth("admin", "secret")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	var drift []SchemaDrift
+	if err := json.NewDecoder(w.Body).Decode(&drift); err != nil {
+		t.Fatal(err)
+	}
+	changes := make(map[string]string)
+	for _, d := range drift {
+		changes[d.Property] = d.Change
+	}
+	if len(drift) != 2 || changes["properties.revenue"] != DriftTypeChange || changes["properties.coupon.code"] != DriftNewField {
+		t.Errorf("Expected type change and new field, got %+v", drift)
+	}
+
+	registry.ClearDrift()
+	if len(registry.Drift()) != 0 {
+		t.Error("Expected drift cleared")
+	}
+}
+
+func TestSchemaLimits(t *testing.T) {
+	registry := NewSchemaRegistry(prometheus.NewRegistry())
+	registry.maxEvents, registry.maxProperties = 2, 2
+	ctx := context.Background()
+	for _, name := range []string{"a", "b", "a", "c"} {
+		registry.Transform(ctx, &SegmentEvent{SegmentMessage: SegmentMessage{ProjectId: "p", Event: name,
+			Properties: map[string]interface{}{"x": 1.0, "y": 1.0, "z": 1.0}}})
+	}
+
+	// The least recently seen event is evicted, and properties beyond the limit are not tracked
+	schemas := registry.Schemas()["p"]
+	if _, ok := schemas["b"]; ok || len(schemas) != 2 {
+		t.Errorf("Expected b evicted, got %v", schemas)
+	}
+	if schema := schemas["a"]; len(schema) != 2 || schema["properties.x"] != "number" || schema["properties.y"] != "number" {
+		t.Errorf("Expected first 2 properties tracked, got %v", schema)
+	}
+	if n := testutil.ToFloat64(registry.overflow.WithLabelValues(schemaOverflowEvent)); n != 1 {
+		t.Errorf("Expected 1 event evicted, got %v", n)
+	}
+	if n := testutil.ToFloat64(registry.overflow.WithLabelValues(schemaOverflowProperty)); n != 4 {
+		t.Errorf("Expected 4 properties not tracked, got %v", n)
+	}
+}
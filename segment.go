@@ -5,14 +5,18 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/segmentio/backo-go"
 	"github.com/xtgo/uuid"
 )
@@ -24,28 +28,98 @@ type ProjectId func(writeKey string) string
 type Segment struct {
 	Logger       *log.Logger
 	projectId    ProjectId
-	destinations []Destination
+	destinations []*destination
+	backoff      BackoffConfig
 	backo        *backo.Backo
-	backoRetry   int
+	metrics      *segmentMetrics
+	budget       *MemoryBudget
+	audit        *AuditLog
+	timeouts     TimeoutPolicy
+	async        bool
+	inflight     sync.WaitGroup
+	running      sync.WaitGroup // Goroutines started by Run
+	warmUp       *WarmUpConfig
+	notReady     atomic.Bool
+	decodeMode   DecodeMode
+	transforms   []Transform
+	quarantine   *destination
+	quotas       *Quotas
+	meter        *Meter
+	proxies      *TrustedProxies
+	contextIP    bool
+	recorder     *Recorder
+	debugger     *Debugger
+	monitor      *Monitor
+	heartbeats   *Heartbeats
+	watchdog     *Watchdog
+	retention    *Retention
+	late         *LateEvents
+	timestamps   *TimestampPolicy
+	clock        Clock
+	concurrency  *ConcurrencyLimit
 }
 
-// NewSegment create new segment handler given project and delivery config
+// TimeoutPolicy controls the context deadline for processing a request
+type TimeoutPolicy struct {
+	Default        time.Duration // Applied when no client timeout, zero for none
+	Max            time.Duration // Caps any timeout, zero for no cap
+	AllowClient    bool          // Honour the client `?timeout=` parameter
+	RequestContext bool          // Derive from the request context so cancellation propagates
+}
+
+// DefaultTimeoutPolicy returns the default policy of a 10 second server timeout capped at 30 seconds, the server write
+// timeout, derived from the request context, ignoring the client timeout
+func DefaultTimeoutPolicy() TimeoutPolicy {
+	return TimeoutPolicy{
+		Default:        time.Second * 10,
+		Max:            time.Second * 30,
+		RequestContext: true,
+	}
+}
+
+// NewSegment create new segment handler given project and delivery config, mounting on router if not nil
 func NewSegment(projectId ProjectId, destinations []Destination, router *mux.Router) *Segment {
 	s := &Segment{
-		Logger:       log.New(os.Stderr, "", log.LstdFlags),
-		projectId:    projectId,
-		destinations: destinations,
-		backo:        backo.DefaultBacko(), // 100 milliseconds, up to 10 seconds
-		backoRetry:   10,
+		Logger:    log.New(os.Stderr, "", log.LstdFlags),
+		projectId: projectId,
+		backoff:   DefaultBackoff(),
+		backo:     DefaultBackoff().backo(),
+		timeouts:  DefaultTimeoutPolicy(),
+		clock:     SystemClock,
 	}
+	s.metrics = newSegmentMetrics(nil, s.memoryBudget)
 
-	s.Logger.Println("Adding Segment handlers")
-	router.HandleFunc("/batch", s.handleBatch).Methods("POST")
-	router.HandleFunc("/{event:p|page|i|identify|t|track|a|alias|g|group|screen}", s.handleEvent)
+	for i, dest := range destinations {
+		s.destinations = append(s.destinations, &destination{Destination: dest, name: destinationName(dest, i), version: negotiateVersion(dest)})
+	}
+	if router != nil {
+		s.Mount(router, "")
+	}
 
 	return s
 }
 
+// Mount adds the segment handlers to router under optional prefix eg "/collect/v1",
+// and may be called for multiple independent segment instances on one router
+func (s *Segment) Mount(router *mux.Router, prefix string) *Segment {
+	if prefix != "" {
+		router = router.PathPrefix(prefix).Subrouter()
+	}
+
+	s.Logger.Printf("Adding Segment handlers at %q\n", prefix)
+	// Limit before recording, so sampled request bodies are only buffered once admitted
+	router.HandleFunc("/batch", allowMethods(s.limit(s.record(s.handleBatch)), http.MethodPost))
+	router.HandleFunc("/{event:p|page|i|identify|t|track|a|alias|g|group|screen}", allowMethods(s.limit(s.record(s.handleEvent)), http.MethodGet, http.MethodPost))
+
+	return s
+}
+
+// WithClock sets the clock of received timestamps, defaults to the system clock
+func (s *Segment) WithClock(clock Clock) *Segment {
+	s.clock = clockOrSystem(clock)
+	return s
+}
+
 // WithLogger propogates the logger down to destinations
 func (s *Segment) WithLogger(logger *log.Logger) *Segment {
 	if logger != nil {
@@ -57,47 +131,193 @@ func (s *Segment) WithLogger(logger *log.Logger) *Segment {
 	return s
 }
 
+// WithBackoff sets the backoff for restarting destination processes
+func (s *Segment) WithBackoff(backoff BackoffConfig) *Segment {
+	s.backoff = backoff
+	s.backo = backoff.backo()
+	return s
+}
+
+// WithRegisterer registers segment metrics against reg instead of the default registerer
+func (s *Segment) WithRegisterer(reg prometheus.Registerer) *Segment {
+	s.metrics = newSegmentMetrics(reg, s.memoryBudget)
+	return s
+}
+
+// WithMemoryBudget limits bytes of events spooled in memory across destinations,
+// beyond which events spill to disk if configured or are shed
+func (s *Segment) WithMemoryBudget(budget *MemoryBudget) *Segment {
+	s.budget = budget
+	for _, dest := range s.destinations {
+		if dest.spool != nil {
+			dest.spool.budget = budget
+		}
+	}
+	return s
+}
+
+func (s *Segment) memoryBudget() *MemoryBudget {
+	return s.budget
+}
+
+// WithAudit records auth failures and administrative actions to the audit log
+func (s *Segment) WithAudit(audit *AuditLog) *Segment {
+	s.audit = audit
+	return s
+}
+
+// WithTimeoutPolicy sets the server side timeout policy for requests
+func (s *Segment) WithTimeoutPolicy(policy TimeoutPolicy) *Segment {
+	s.timeouts = policy
+	return s
+}
+
+// WithDestinationOptions sets the options for a destination passed to NewSegment
+func (s *Segment) WithDestinationOptions(dest Destination, options DestinationOptions) *Segment {
+	for _, d := range s.destinations {
+		if d.Destination == dest {
+			d.DestinationOptions = options
+			d.spool = nil
+			if options.Spool != nil {
+				sp, err := newSpool(*options.Spool, d.name, s.budget)
+				if err != nil {
+					s.Logger.Printf("Destination %s spool disabled -- %v\n", d.name, err)
+				}
+				d.spool = sp
+			}
+			s.audit.Record(AuditDestinationChange, "", "", map[string]string{
+				"destination": fmt.Sprintf("%T", dest),
+				"options":     fmt.Sprintf("%+v", options),
+			})
+			return s
+		}
+	}
+	s.Logger.Printf("Destination %T not found for options\n", dest)
+	return s
+}
+
+// WithAsync responds to clients before sending to destinations (fire-and-forget)
+func (s *Segment) WithAsync(async bool) *Segment {
+	s.async = async
+	return s
+}
+
+// Wait blocks until background async deliveries have completed
+func (s *Segment) Wait() {
+	s.inflight.Wait()
+}
+
+// WaitStopped blocks until the processes started by Run have returned after its context is done, so an embedder
+// reloading config can wait for the previous segment to release its destinations before starting the next
+func (s *Segment) WaitStopped() {
+	s.running.Wait()
+}
+
+// errorResponse is a segment style error response body
+type errorResponse struct {
+	Success bool           `json:"success"`
+	Code    string         `json:"code"`
+	Message string         `json:"message"`
+	Errors  []messageError `json:"errors,omitempty"` // Failed messages of a batch
+}
+
+// messageError is the error of a message in a batch by index
+type messageError struct {
+	Index   int    `json:"index"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// writeError writes a segment style json error response
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeErrors(w, status, code, message, nil)
+}
+
+// writeErrors writes a segment style json error response with the errors of failed messages
+func writeErrors(w http.ResponseWriter, status int, code, message string, errs []messageError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorResponse{Code: code, Message: message, Errors: errs})
+}
+
 func (s *Segment) handleBatch(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
+	if !s.Ready() {
+		writeError(w, http.StatusServiceUnavailable, "not_ready", "Server is not ready")
+		return
+	}
 
 	var batch SegmentBatch
-	decoder := json.NewDecoder(r.Body)
-	err := decoder.Decode(&batch)
+	var raw bytes.Buffer
+	err := s.decode(io.TeeReader(r.Body, &raw), &batch)
 	if err != nil {
 		s.Logger.Println("Batch decode error", err)
-		http.Error(w, `{ "success": false }`, http.StatusBadRequest)
+		if !s.quarantinedPayload(r, err, raw.Bytes()) {
+			s.drop(DropValidation, 1)
+		}
+		writeError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON: "+err.Error())
 		return
 	}
 
-	// Get writeKey as Basic auth user
+	// Get writeKey as Basic auth user, or from the body
 	writeKey, _, ok := r.BasicAuth()
+	if !ok && batch.WriteKey != "" {
+		writeKey, ok = batch.WriteKey, true
+	}
 	if !ok {
 		s.Logger.Println("Basic Authorization expected")
-		http.Error(w, `{ "success": false }`, http.StatusUnauthorized)
+		s.audit.Record(AuditAuthFailure, "", s.clientIP(r), map[string]string{"reason": "missing basic auth"})
+		s.drop(DropUnauthorized, len(batch.Messages))
+		writeError(w, http.StatusUnauthorized, "unauthorized", "Basic authorization with writeKey expected")
 		return
 	}
 	projectId := s.projectId(writeKey)
 	if projectId == "" {
 		s.Logger.Printf("Unable to get projectId for writeKey: %s\n", writeKey)
-		http.Error(w, `{ "success": false }`, http.StatusUnauthorized)
+		s.audit.Record(AuditAuthFailure, auditKey(writeKey), s.clientIP(r), map[string]string{"reason": "unknown writeKey"})
+		s.drop(DropUnauthorized, len(batch.Messages))
+		writeError(w, http.StatusUnauthorized, "unauthorized", "Invalid writeKey")
 		return
 	}
-
 	// Push each of these Segment updating the context
-	ctx, cancel := contextTimeout(r)
-	defer cancel()
-	for _, m := range batch.Messages {
+	receivedAt := s.clock.Now()
+	batch.Context = s.withClientIP(batch.Context, r)
+	events := make([]SegmentEvent, len(batch.Messages))
+	for i, m := range batch.Messages {
 		event := SegmentEvent{
 			WriteKey:       writeKey,
 			SegmentMessage: m,
 		}
 		event.ProjectId = projectId
 		event.Context = batch.Context
-		if err := s.send(ctx, event); err != nil {
-			s.Logger.Println("Send error", err)
-			http.Error(w, `{ "success": false }`, http.StatusInternalServerError)
-			return
+		if event.SentAt.IsZero() {
+			event.SentAt = batch.SentAt
+		}
+		event.ReceivedAt = receivedAt
+		events[i] = event
+	}
+	if isDryRun(r) {
+		s.writeDryRun(w, r, events)
+		return
+	}
+	if s.overQuota(w, projectId, len(events)) {
+		return
+	}
+	errs := s.deliverBatch(r, events)
+	if accepted := len(events) - len(errs); accepted > 0 {
+		s.meter.record(projectId, accepted, raw.Len(), receivedAt)
+	}
+	if len(errs) > 0 {
+		s.Logger.Printf("Batch errors for %d of %d messages\n", len(errs), len(events))
+		// Clients only retry batches with messages that failed to send, rather than invalid messages
+		status, code := http.StatusBadRequest, "invalid_messages"
+		for _, e := range errs {
+			if e.Code != "invalid_event" {
+				status, code = http.StatusInternalServerError, "send_error"
+			}
 		}
+		writeErrors(w, status, code, fmt.Sprintf("Unable to send %d of %d messages", len(errs), len(events)), errs)
+		return
 	}
 
 	fmt.Fprintf(w, `{ "success": true }`)
@@ -105,6 +325,10 @@ func (s *Segment) handleBatch(w http.ResponseWriter, r *http.Request) {
 
 func (s *Segment) handleEvent(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
+	if !s.Ready() {
+		writeError(w, http.StatusServiceUnavailable, "not_ready", "Server is not ready")
+		return
+	}
 
 	// Support GET method with base64 encoded `data` payload
 	var body io.Reader
@@ -113,7 +337,8 @@ func (s *Segment) handleEvent(w http.ResponseWriter, r *http.Request) {
 		data, err := base64.StdEncoding.DecodeString(payload)
 		if err != nil {
 			s.Logger.Printf("Expected base64 bayload: %s -- %v\n", payload, err)
-			http.Error(w, `{ "success": false }`, http.StatusBadRequest)
+			s.drop(DropValidation, 1)
+			writeError(w, http.StatusBadRequest, "invalid_payload", "Expected base64 data payload")
 			return
 		}
 		body = bytes.NewReader(data)
@@ -125,78 +350,282 @@ func (s *Segment) handleEvent(w http.ResponseWriter, r *http.Request) {
 	writeKey, _, _ := r.BasicAuth()
 	vars := mux.Vars(r)
 	event := SegmentEvent{writeKey, SegmentMessage{Type: vars["event"]}}
-	decoder := json.NewDecoder(body)
-	err := decoder.Decode(&event)
+	var raw bytes.Buffer
+	err := s.decode(io.TeeReader(body, &raw), &event)
 	if err != nil {
 		s.Logger.Println("Event decode error", err)
-		http.Error(w, `{ "success": false }`, http.StatusBadRequest)
+		if !s.quarantinedPayload(r, err, raw.Bytes()) {
+			s.drop(DropValidation, 1)
+		}
+		writeError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON: "+err.Error())
 		return
 	}
 
+	event.ReceivedAt = s.clock.Now()
+	event.Context = s.withClientIP(event.Context, r)
+
 	// Set the project key
 	event.ProjectId = s.projectId(event.WriteKey)
 	if event.ProjectId == "" {
 		s.Logger.Printf("Unable to get projectId for writeKey: %s \n", event.WriteKey)
-		http.Error(w, `{ "success": false }`, http.StatusBadRequest)
+		s.audit.Record(AuditAuthFailure, auditKey(event.WriteKey), s.clientIP(r), map[string]string{"reason": "unknown writeKey"})
+		s.drop(DropUnauthorized, 1)
+		writeError(w, http.StatusUnauthorized, "unauthorized", "Invalid writeKey")
+		return
+	}
+	if isDryRun(r) {
+		s.writeDryRun(w, r, []SegmentEvent{event})
+		return
+	}
+	if s.overQuota(w, event.ProjectId, 1) {
 		return
 	}
 
-	// Get context timeout
-	ctx, cancel := contextTimeout(r)
-	defer cancel()
-	if err = s.send(ctx, event); err != nil {
+	if err = s.deliver(r, []SegmentEvent{event}); err != nil {
 		s.Logger.Println("Send error", err)
-		http.Error(w, `{ "success": false }`, http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, "send_error", "Unable to send event")
 		return
 	}
+	s.meter.record(event.ProjectId, 1, raw.Len(), event.ReceivedAt)
 
 	fmt.Fprintf(w, `{ "success": true }`)
 }
 
-func contextTimeout(r *http.Request) (context.Context, context.CancelFunc) {
-	timeout, err := time.ParseDuration(r.FormValue("timeout"))
-	if err == nil {
-		return context.WithTimeout(context.Background(), timeout)
-	} else {
-		return context.WithCancel(context.Background()) // No timeout
+// deliver sends events within the request context, or in the background on a detached context when async
+func (s *Segment) deliver(r *http.Request, events []SegmentEvent) error {
+	if s.async {
+		ctx, cancel := s.contextTimeout(r, true)
+		s.inflight.Add(1)
+		go func() {
+			defer s.inflight.Done()
+			defer cancel()
+			for _, event := range events {
+				if err := s.send(ctx, event); err != nil {
+					s.Logger.Println("Async send error", err)
+					return
+				}
+			}
+		}()
+		return nil
+	}
+
+	ctx, cancel := s.contextTimeout(r, false)
+	defer cancel()
+	for _, event := range events {
+		if err := s.send(ctx, event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deliverBatch sends every event, returning the errors of events that failed by index, or sends in the background
+// when async
+func (s *Segment) deliverBatch(r *http.Request, events []SegmentEvent) []messageError {
+	if s.async {
+		s.deliver(r, events)
+		return nil
+	}
+
+	ctx, cancel := s.contextTimeout(r, false)
+	defer cancel()
+	var errs []messageError
+	for i, event := range events {
+		if err := s.send(ctx, event); err != nil {
+			code := "send_error"
+			var invalid invalidEvent
+			if errors.As(err, &invalid) {
+				code = "invalid_event"
+			}
+			errs = append(errs, messageError{Index: i, Code: code, Message: err.Error()})
+		}
+	}
+	return errs
+}
+
+// contextTimeout returns the context for processing a request, detached from request cancellation if required
+func (s *Segment) contextTimeout(r *http.Request, detached bool) (context.Context, context.CancelFunc) {
+	parent := context.Background()
+	if s.timeouts.RequestContext {
+		parent = r.Context()
+		if detached {
+			parent = context.WithoutCancel(parent)
+		}
+	}
+
+	timeout := s.timeouts.Default
+	if s.timeouts.AllowClient {
+		if t, err := time.ParseDuration(r.FormValue("timeout")); err == nil && t > 0 {
+			timeout = t
+		}
 	}
+	if s.timeouts.Max > 0 && (timeout == 0 || timeout > s.timeouts.Max) {
+		timeout = s.timeouts.Max
+	}
+
+	if timeout > 0 {
+		return context.WithTimeout(parent, timeout)
+	}
+	return context.WithCancel(parent) // No timeout
+}
+
+// invalidEvent wraps the error of an event that failed transforms, rather than failed to send
+type invalidEvent struct {
+	error
+}
+
+func (e invalidEvent) Unwrap() error {
+	return e.error
 }
 
 func (s *Segment) send(ctx context.Context, m SegmentEvent) error {
-	if m.Timestamp == (time.Time{}) {
-		m.Timestamp = time.Now()
+	return s.sendExcept(ctx, m, nil)
+}
+
+// sendExcept sends to all destinations except skip, eg to replay without archiving again
+func (s *Segment) sendExcept(ctx context.Context, m SegmentEvent, skip Destination) error {
+	return s.sendEvent(ctx, m, skip, true)
+}
+
+// sendEvent sends to all destinations except skip, quarantining events that fail transforms if quarantine
+func (s *Segment) sendEvent(ctx context.Context, m SegmentEvent, skip Destination, quarantine bool) (err error) {
+	s.enrich(&m)
+	original := m
+	var outcomes []DebugOutcome
+	if s.debugger != nil && !DryRun(ctx) {
+		defer func() { s.debugger.record(m, outcomes, err) }()
 	}
-	m.SentAt = time.Now()
-	if m.MessageId == "" {
-		m.MessageId = uuid.NewRandom().String()
+	if !s.timestamps.sanitize(&m) {
+		s.drop(DropInvalidTimestamp, 1)
+		return nil
+	}
+	if ok, err := s.transform(ctx, &m); err != nil {
+		if quarantine && s.quarantined(ctx, err, &original, nil) {
+			outcomes = append(outcomes, DebugOutcome{Destination: s.quarantine.name, Status: DebugQuarantined, Error: err.Error()})
+			return nil
+		}
+		s.drop(DropValidation, 1)
+		return invalidEvent{err}
+	} else if !ok {
+		return nil
 	}
 
+	// Expired events are only sent to the retention archive if any, and late events to the backfill if any
+	now := s.clock.Now()
+	expired := s.retention.expire(m, now)
+	if expired && s.retention.config.Archive == nil {
+		s.drop(DropExpired, 1)
+		return nil
+	}
+	late := !expired && s.late.tag(&m, now)
+
 	// Call destination send, breaking on first error respecting timeout
 	for _, dest := range s.destinations {
-		if err := dest.Send(ctx, m); err != nil {
+		if (skip != nil && dest.Destination == skip) || (expired && dest.Destination != s.retention.config.Archive) ||
+			(!expired && !s.late.accepts(dest.Destination, late)) {
+			continue
+		}
+		if err := dest.send(ctx, m); err != nil {
+			outcomes = append(outcomes, DebugOutcome{Destination: dest.name, Status: DebugError, Error: err.Error()})
+			switch {
+			case errors.Is(err, ErrSpoolFull):
+				s.dropDestination(dest.name, DropSpoolFull, 1)
+			case errors.Is(err, ErrQueueFull):
+				s.dropDestination(dest.name, DropQueueFull, 1)
+			default:
+				s.dropDestination(dest.name, DropSendError, 1)
+			}
 			return err
 		}
+		outcomes = append(outcomes, DebugOutcome{Destination: dest.name, Status: DebugSent})
 	}
 
 	return nil
 }
 
-// Run this as go-routine to processes the messages, and optionally send updates
-func (s *Segment) Run(ctx context.Context) {
+// enrich sets the received timestamps, channel and messageId if missing before transforms
+func (s *Segment) enrich(m *SegmentEvent) {
+	stampReceived(m, s.clock.Now())
+	if m.Channel == "" {
+		m.Channel = InferChannel(m.SegmentMessage)
+	}
+	if m.MessageId == "" {
+		m.MessageId = uuid.NewRandom().String()
+	}
+}
+
+// stampReceived sets receivedAt if not already, preserving the client timestamp as originalTimestamp
+// and correcting the timestamp for client clock skew using sentAt, as per the segment spec
+func stampReceived(m *SegmentEvent, now time.Time) {
+	if m.ReceivedAt.IsZero() {
+		m.ReceivedAt = now
+	}
+	if m.OriginalTimestamp.IsZero() {
+		m.OriginalTimestamp = m.Timestamp
+	}
+	switch {
+	case !m.OriginalTimestamp.IsZero() && !m.SentAt.IsZero():
+		m.Timestamp = m.ReceivedAt.Add(m.OriginalTimestamp.Sub(m.SentAt))
+	case !m.OriginalTimestamp.IsZero():
+		m.Timestamp = m.OriginalTimestamp
+	default:
+		m.Timestamp = m.ReceivedAt
+	}
+	if m.SentAt.IsZero() {
+		m.SentAt = m.ReceivedAt
+	}
+}
+
+// drop counts events dropped for reason before sending to a destination
+func (s *Segment) drop(reason string, n int) {
+	s.dropDestination("", reason, n)
+}
+
+// dropDestination counts events dropped for reason by the named destination
+func (s *Segment) dropDestination(name, reason string, n int) {
+	s.metrics.dropped.WithLabelValues(reason, name).Add(float64(n))
+}
+
+// Run starts processing the messages, restarting destinations that fail until ctx is done.  If warm up is
+// configured destinations are connected first, returning the error without starting them if fail fast.
+func (s *Segment) Run(ctx context.Context) error {
+	if s.warmUp != nil {
+		if err := s.WarmUp(ctx); err != nil {
+			return err
+		}
+	}
 	for _, dest := range s.destinations {
-		go func(dest Destination) {
-			var err error
-			for i := 0; i < s.backoRetry; i++ {
-				if err = dest.Process(ctx); err == nil {
-					break
-				}
-				s.Logger.Printf("Process retrying in %s due to error: %v\n", s.backo.Duration(i), err)
-				s.backo.Sleep(i)
-			}
-			// Quit if still error after 3 retries
-			if err != nil {
-				s.Logger.Fatal(err)
-			}
-		}(dest)
+		dest := dest
+		s.spawn(func() { s.supervise(ctx, dest) })
+		if dest.spool != nil {
+			s.spawn(func() { dest.replay(ctx, s.Logger) })
+		}
+	}
+	if s.quarantine != nil {
+		s.spawn(func() { s.supervise(ctx, s.quarantine) })
+	}
+	if s.meter != nil {
+		s.spawn(func() { s.supervise(ctx, s.meter.dest) })
+		s.spawn(func() { s.meter.run(ctx) })
+	}
+	if s.monitor != nil {
+		s.spawn(func() { s.supervise(ctx, s.monitor.dest) })
+		s.spawn(func() { s.monitor.run(ctx) })
 	}
+	if s.heartbeats != nil {
+		s.spawn(func() { s.runHeartbeats(ctx) })
+	}
+	if s.watchdog != nil {
+		s.spawn(func() { s.runWatchdog(ctx) })
+	}
+	return nil
+}
+
+// spawn runs f in a goroutine tracked for WaitStopped
+func (s *Segment) spawn(f func()) {
+	s.running.Add(1)
+	go func() {
+		defer s.running.Done()
+		f()
+	}()
 }
@@ -4,24 +4,30 @@ import "time"
 
 // SegmentMessage fields common to all.
 type SegmentMessage struct {
-	MessageId    string                 `json:"messageId"`
-	Timestamp    time.Time              `json:"timestamp"`
-	SentAt       time.Time              `json:"sentAt,omitempty"`
-	ProjectId    string                 `json:"projectId"`
-	Type         string                 `json:"type"`
-	Context      map[string]interface{} `json:"context,omitempty"` // Duplicate here for batch
-	Properties   map[string]interface{} `json:"properties,omitempty"`
-	Traits       map[string]interface{} `json:"traits,omitempty"`
-	Integrations map[string]interface{} `json:"integrations,omitempty"` // Probably won't use
-	AnonymousId  string                 `json:"anonymousId,omitempty"`
-	UserId       string                 `json:"userId,omitempty"`
-	Event        string                 `json:"event,omitempty"`    // Track only
-	Category     string                 `json:"category,omitempty"` // Page only
-	Name         string                 `json:"name,omitempty"`     // Page only
+	MessageId         string                 `json:"messageId"`
+	Timestamp         time.Time              `json:"timestamp"`
+	SentAt            time.Time              `json:"sentAt,omitempty"`
+	ReceivedAt        time.Time              `json:"receivedAt,omitempty"`        // Set by server on receipt
+	OriginalTimestamp time.Time              `json:"originalTimestamp,omitempty"` // Client timestamp before skew correction
+	ProjectId         string                 `json:"projectId"`
+	Type              string                 `json:"type"`
+	Channel           string                 `json:"channel,omitempty"` // Inferred if not provided
+	Context           map[string]interface{} `json:"context,omitempty"` // Duplicate here for batch
+	Properties        map[string]interface{} `json:"properties,omitempty"`
+	Traits            map[string]interface{} `json:"traits,omitempty"`
+	Integrations      map[string]interface{} `json:"integrations,omitempty"` // Probably won't use
+	AnonymousId       string                 `json:"anonymousId,omitempty"`
+	UserId            string                 `json:"userId,omitempty"`
+	PreviousId        string                 `json:"previousId,omitempty"` // Alias only
+	GroupId           string                 `json:"groupId,omitempty"`    // Group only
+	Event             string                 `json:"event,omitempty"`      // Track only
+	Category          string                 `json:"category,omitempty"`   // Page only
+	Name              string                 `json:"name,omitempty"`       // Page only
 }
 
 // SegmentBatch contains batch of messages
 type SegmentBatch struct {
+	WriteKey  string                 `json:"writeKey,omitempty"` // If not in Basic auth eg when signed with SigV4
 	MessageId string                 `json:"messageId,omitempty"`
 	Timestamp time.Time              `json:"timestamp,omitempty"`
 	SentAt    time.Time              `json:"sentAt,omitempty"`
@@ -0,0 +1,179 @@
+package segment
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/net/http2"
+)
+
+func TestMountPrefix(t *testing.T) {
+	staging, prod := &testDestination{}, &testDestination{}
+	projectId := func(writeKey string) string { return writeKey }
+	router := mux.NewRouter()
+	NewSegment(projectId, []Destination{staging}, nil).Mount(router, "/staging/v1")
+	NewSegment(projectId, []Destination{prod}, nil).Mount(router, "/collect/v1")
+
+	req := httptest.NewRequest("POST", "/collect/v1/track", strings.NewReader(`{"writeKey":"key","event":"Test"}`))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if len(prod.sent()) != 1 || len(staging.sent()) != 0 {
+		t.Errorf("Expected event only on prod, got prod=%d staging=%d", len(prod.sent()), len(staging.sent()))
+	}
+}
+
+func TestContextTimeout(t *testing.T) {
+	// The client timeout is ignored by default
+	ctx, cancel := NewSegment(nil, nil, nil).contextTimeout(httptest.NewRequest("POST", "/track?timeout=1h", nil), false)
+	deadline, _ := ctx.Deadline()
+	cancel()
+	if d := time.Until(deadline); d > 10*time.Second || d < 9*time.Second {
+		t.Errorf("Expected default timeout 10s, got %s", d)
+	}
+
+	s := NewSegment(nil, nil, nil).WithTimeoutPolicy(TimeoutPolicy{
+		Default:     time.Second,
+		Max:         time.Minute,
+		AllowClient: true,
+	})
+	for query, expected := range map[string]time.Duration{
+		"":              time.Second,
+		"?timeout=5s":   5 * time.Second,
+		"?timeout=1h":   time.Minute,
+		"?timeout=junk": time.Second,
+	} {
+		ctx, cancel := s.contextTimeout(httptest.NewRequest("POST", "/track"+query, nil), false)
+		deadline, ok := ctx.Deadline()
+		cancel()
+		if !ok {
+			t.Fatalf("Expected deadline for %q", query)
+		}
+		if d := time.Until(deadline); d > expected || d < expected-time.Second {
+			t.Errorf("Expected timeout %s for %q, got %s", expected, query, d)
+		}
+	}
+}
+
+func TestAsyncDetachedContext(t *testing.T) {
+	dest := &testDestination{}
+	projectId := func(writeKey string) string { return writeKey }
+	router := mux.NewRouter()
+	s := NewSegment(projectId, []Destination{dest}, router).WithAsync(true)
+
+	// Cancel the request context before the background send completes
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest("POST", "/track", strings.NewReader(`{"writeKey":"key","event":"Test"}`)).WithContext(ctx)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	cancel()
+	s.Wait()
+	if w.Code != http.StatusOK || len(dest.sent()) != 1 {
+		t.Errorf("Expected async event delivered, got %d with %d sent", w.Code, len(dest.sent()))
+	}
+}
+
+func TestServerH2C(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Proto)
+	})
+	ts := httptest.NewServer(NewServer(handler, &ServerConfig{H2C: true}).Handler)
+	defer ts.Close()
+
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+	res, err := client.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	if string(body) != "HTTP/2.0" {
+		t.Errorf("Expected HTTP/2.0, got %s", body)
+	}
+}
+
+func TestErrorResponse(t *testing.T) {
+	router := mux.NewRouter()
+	NewSegment(func(string) string { return "" }, nil, router)
+
+	for body, want := range map[string]struct {
+		status int
+		code   string
+	}{
+		`{ not json`:         {http.StatusBadRequest, "invalid_json"},
+		`{"writeKey":"bad"}`: {http.StatusUnauthorized, "unauthorized"},
+	} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/track", strings.NewReader(body)))
+		var res errorResponse
+		if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != want.status || res.Success || res.Code != want.code || res.Message == "" {
+			t.Errorf("Expected %d %s, got %d %+v", want.status, want.code, w.Code, res)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Expected json content type, got %s", ct)
+		}
+	}
+}
+
+func TestBatchMessageErrors(t *testing.T) {
+	dest := &testDestination{}
+	router := mux.NewRouter()
+	NewSegment(func(writeKey string) string { return writeKey }, []Destination{dest}, router).
+		WithTransforms(func(ctx context.Context, m *SegmentEvent) error {
+			if m.Event == "Bad" {
+				return fmt.Errorf("Event %s not allowed", m.Event)
+			}
+			return nil
+		})
+
+	body := `{"writeKey":"web","batch":[{"type":"track","event":"Bad"},{"type":"track","event":"Good"},{"type":"track","event":"Bad"}]}`
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/batch", strings.NewReader(body)))
+	var res errorResponse
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every message is sent, and the invalid messages are reported by index
+	if w.Code != http.StatusBadRequest || res.Code != "invalid_messages" || len(res.Errors) != 2 {
+		t.Fatalf("Expected 400 with 2 message errors, got %d %+v", w.Code, res)
+	}
+	for i, index := range []int{0, 2} {
+		if e := res.Errors[i]; e.Index != index || e.Code != "invalid_event" || e.Message != "Event Bad not allowed" {
+			t.Errorf("Expected invalid message %d, got %+v", index, e)
+		}
+	}
+	if sent := dest.sent(); len(sent) != 1 || sent[0].(SegmentEvent).Event != "Good" {
+		t.Errorf("Expected the valid message sent, got %v", sent)
+	}
+
+	// Messages that fail to send are retryable
+	dest.err = fmt.Errorf("Down")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/batch", strings.NewReader(body)))
+	res = errorResponse{}
+	json.NewDecoder(w.Body).Decode(&res)
+	if w.Code != http.StatusInternalServerError || res.Code != "send_error" || len(res.Errors) != 3 || res.Errors[1].Code != "send_error" {
+		t.Errorf("Expected 500 with send error, got %d %+v", w.Code, res)
+	}
+}
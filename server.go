@@ -0,0 +1,62 @@
+package segment
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// ServerConfig contains http server timeouts and protocol options, zero values use defaults
+type ServerConfig struct {
+	Addr                 string        `json:"addr"`
+	ReadHeaderTimeout    time.Duration `json:"readHeaderTimeout,omitempty"` // Defaults to 5 seconds
+	ReadTimeout          time.Duration `json:"readTimeout,omitempty"`       // Defaults to 30 seconds
+	WriteTimeout         time.Duration `json:"writeTimeout,omitempty"`      // Defaults to 30 seconds
+	IdleTimeout          time.Duration `json:"idleTimeout,omitempty"`       // Defaults to 2 minutes
+	MaxHeaderBytes       int           `json:"maxHeaderBytes,omitempty"`    // Defaults to 1MB
+	H2C                  bool          `json:"h2c,omitempty"`               // Serve HTTP/2 without TLS eg behind a load balancer
+	MaxConcurrentStreams uint32        `json:"maxConcurrentStreams,omitempty"`
+}
+
+// NewServer creates an http server for handler with tuned timeouts, supporting HTTP/2 over TLS and optionally h2c
+func NewServer(handler http.Handler, config *ServerConfig) *http.Server {
+	if config.ReadHeaderTimeout <= 0 {
+		config.ReadHeaderTimeout = time.Second * 5
+	}
+	if config.ReadTimeout <= 0 {
+		config.ReadTimeout = time.Second * 30
+	}
+	if config.WriteTimeout <= 0 {
+		config.WriteTimeout = time.Second * 30
+	}
+	if config.IdleTimeout <= 0 {
+		config.IdleTimeout = time.Minute * 2
+	}
+	if config.MaxHeaderBytes <= 0 {
+		config.MaxHeaderBytes = 1 << 20
+	}
+
+	h2s := &http2.Server{
+		MaxConcurrentStreams: config.MaxConcurrentStreams,
+		IdleTimeout:          config.IdleTimeout,
+	}
+	if config.H2C {
+		handler = h2c.NewHandler(handler, h2s)
+	}
+	server := &http.Server{
+		Addr:              config.Addr,
+		Handler:           handler,
+		ReadHeaderTimeout: config.ReadHeaderTimeout,
+		ReadTimeout:       config.ReadTimeout,
+		WriteTimeout:      config.WriteTimeout,
+		IdleTimeout:       config.IdleTimeout,
+		MaxHeaderBytes:    config.MaxHeaderBytes,
+	}
+	if err := http2.ConfigureServer(server, h2s); err != nil {
+		log.Printf("HTTP/2 configure error -- %v\n", err)
+	}
+	return server
+}
@@ -0,0 +1,83 @@
+package segment
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"text/template"
+
+	"github.com/gorilla/mux"
+)
+
+// snippetVersion is the analytics.js version reported by the loader
+const snippetVersion = "4.1.0-collector"
+
+//go:embed snippet/analytics.js
+var snippetSource string
+
+// snippetTemplate is the loader with the settings of the writeKey inlined
+var snippetTemplate = template.Must(template.New("analytics.js").Funcs(templateFuncs).Parse(snippetSource))
+
+// SnippetConfig contains the settings served to browsers by the analytics.js loader
+type SnippetConfig struct {
+	APIHost string `json:"apiHost"` // Url that events are posted to eg "https://collect.example.com/v1"
+	// Settings returns additional settings merged for a writeKey eg "integrations" or "plan", optional
+	Settings func(writeKey string) map[string]interface{} `json:"-"`
+}
+
+// MountSnippet adds the analytics.js loader at GET /analytics.js/v1/{writeKey}/analytics.min.js and settings at
+// GET /v1/projects/{writeKey}/settings, so the standard snippet can load from the collector instead of a cdn
+func (s *Segment) MountSnippet(router *mux.Router, config SnippetConfig) *Segment {
+	s.Logger.Println("Adding analytics.js snippet handlers")
+	router.HandleFunc("/analytics.js/v1/{writeKey}/analytics.min.js", func(w http.ResponseWriter, r *http.Request) {
+		settings, ok := s.snippetSettings(w, r, config)
+		if !ok {
+			return
+		}
+		w.Header().Set("Content-Type", "application/javascript")
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		if err := snippetTemplate.Execute(w, map[string]interface{}{"Settings": settings}); err != nil {
+			s.Logger.Println("Snippet template error", err)
+		}
+	}).Methods("GET")
+	router.HandleFunc("/v1/projects/{writeKey}/settings", func(w http.ResponseWriter, r *http.Request) {
+		settings, ok := s.snippetSettings(w, r, config)
+		if !ok {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		json.NewEncoder(w).Encode(settings)
+	}).Methods("GET")
+	return s
+}
+
+// snippetSettings returns the settings of the writeKey in the request, writing a 404 if the writeKey is unknown
+func (s *Segment) snippetSettings(w http.ResponseWriter, r *http.Request, config SnippetConfig) (map[string]interface{}, bool) {
+	writeKey := mux.Vars(r)["writeKey"]
+	if s.projectId(writeKey) == "" {
+		s.Logger.Printf("Unable to get projectId for snippet writeKey: %s\n", writeKey)
+		writeError(w, http.StatusNotFound, "not_found", "Unknown writeKey")
+		return nil, false
+	}
+	settings := map[string]interface{}{
+		"integrations": map[string]interface{}{},
+		"version":      snippetVersion,
+	}
+	if config.Settings != nil {
+		for k, v := range config.Settings(writeKey) {
+			settings[k] = v
+		}
+	}
+	integrations, ok := settings["integrations"].(map[string]interface{})
+	if !ok {
+		integrations = map[string]interface{}{}
+		settings["integrations"] = integrations
+	}
+	integrations["Segment.io"] = map[string]interface{}{
+		"apiKey":  writeKey,
+		"apiHost": strings.TrimSuffix(config.APIHost, "/"),
+	}
+	return settings, true
+}
@@ -0,0 +1,127 @@
+/* Minimal analytics.js compatible loader served by the collector */
+(function () {
+  var settings = {{json .Settings}};
+  var config = settings.integrations["Segment.io"];
+  var analytics = window.analytics = window.analytics || [];
+  var queued = Array.isArray(analytics) ? analytics.slice() : [];
+
+  function store(key, value) {
+    try {
+      if (value === undefined) return window.localStorage.getItem(key);
+      if (value === null) window.localStorage.removeItem(key);
+      else window.localStorage.setItem(key, value);
+    } catch (e) {}
+  }
+
+  function uuid() {
+    if (window.crypto && window.crypto.randomUUID) return window.crypto.randomUUID();
+    return "xxxxxxxx-xxxx-4xxx-yxxx-xxxxxxxxxxxx".replace(/[xy]/g, function (c) {
+      var r = (Math.random() * 16) | 0;
+      return (c === "x" ? r : (r & 0x3) | 0x8).toString(16);
+    });
+  }
+
+  function anonymousId() {
+    var id = store("ajs_anonymous_id");
+    if (!id) {
+      id = uuid();
+      store("ajs_anonymous_id", id);
+    }
+    return id;
+  }
+
+  function page() {
+    return {
+      path: location.pathname,
+      referrer: document.referrer,
+      search: location.search,
+      title: document.title,
+      url: location.href
+    };
+  }
+
+  function send(type, message) {
+    message.type = type;
+    message.writeKey = config.apiKey;
+    message.messageId = "ajs-" + uuid();
+    message.anonymousId = anonymousId();
+    message.userId = message.userId || store("ajs_user_id") || undefined;
+    message.timestamp = message.sentAt = new Date().toISOString();
+    message.context = Object.assign({
+      library: { name: "analytics.js", version: settings.version },
+      page: page(),
+      userAgent: navigator.userAgent
+    }, message.context);
+    var body = JSON.stringify(message);
+    var url = config.apiHost + "/" + type;
+    if (window.fetch) {
+      return fetch(url, { method: "POST", body: body, keepalive: true, headers: { "Content-Type": "text/plain" } })
+        .catch(function () {});
+    }
+    var xhr = new XMLHttpRequest();
+    xhr.open("POST", url);
+    xhr.send(body);
+  }
+
+  var methods = {
+    track: function (event, properties, options) {
+      return send("track", { event: event, properties: properties || {}, context: options && options.context });
+    },
+    page: function (category, name, properties, options) {
+      if (typeof category === "object") {
+        properties = category;
+        category = name = undefined;
+      } else if (typeof name === "object") {
+        properties = name;
+        name = category;
+        category = undefined;
+      }
+      return send("page", {
+        category: category,
+        name: name,
+        properties: Object.assign(page(), properties),
+        context: options && options.context
+      });
+    },
+    identify: function (userId, traits, options) {
+      if (typeof userId === "object") {
+        traits = userId;
+        userId = undefined;
+      }
+      if (userId) store("ajs_user_id", String(userId));
+      return send("identify", { userId: userId, traits: traits || {}, context: options && options.context });
+    },
+    group: function (groupId, traits, options) {
+      return send("group", { groupId: groupId, traits: traits || {}, context: options && options.context });
+    },
+    alias: function (userId, previousId) {
+      var message = send("alias", { userId: userId, previousId: previousId || store("ajs_user_id") || anonymousId() });
+      store("ajs_user_id", String(userId));
+      return message;
+    },
+    screen: function (name, properties) {
+      return send("screen", { name: name, properties: properties || {} });
+    },
+    reset: function () {
+      store("ajs_user_id", null);
+      store("ajs_anonymous_id", null);
+    },
+    ready: function (callback) {
+      if (typeof callback === "function") setTimeout(callback, 0);
+    },
+    user: function () {
+      return {
+        id: function () { return store("ajs_user_id"); },
+        anonymousId: function () { return anonymousId(); }
+      };
+    }
+  };
+
+  window.analytics = methods;
+  methods.initialized = true;
+  methods.VERSION = settings.version;
+  for (var i = 0; i < queued.length; i++) {
+    var call = queued[i];
+    if (Array.isArray(call) && methods[call[0]]) methods[call[0]].apply(methods, call.slice(1));
+  }
+})();
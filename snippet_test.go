@@ -0,0 +1,58 @@
+package segment
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestSnippet(t *testing.T) {
+	router := mux.NewRouter()
+	s := NewSegment(func(writeKey string) string {
+		if writeKey == "key-web" {
+			return "web"
+		}
+		return ""
+	}, nil, nil)
+	s.MountSnippet(router, SnippetConfig{
+		APIHost: "https://collect.example.com/v1/",
+		Settings: func(writeKey string) map[string]interface{} {
+			return map[string]interface{}{"plan": map[string]interface{}{"track": map[string]interface{}{}}}
+		},
+	})
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/v1/projects/key-web/settings", nil))
+	var settings struct {
+		Integrations map[string]struct {
+			APIKey  string `json:"apiKey"`
+			APIHost string `json:"apiHost"`
+		} `json:"integrations"`
+		Plan map[string]interface{} `json:"plan"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &settings); err != nil {
+		t.Fatal(err)
+	}
+	if io := settings.Integrations["Segment.io"]; io.APIKey != "key-web" || io.APIHost != "https://collect.example.com/v1" || settings.Plan == nil {
+		t.Errorf("Unexpected settings %s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/analytics.js/v1/key-web/analytics.min.js", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/javascript" {
+		t.Fatalf("Expected javascript, got %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(w.Body.String(), `"apiHost":"https://collect.example.com/v1"`) {
+		t.Errorf("Expected inlined settings, got %s", w.Body.String()[:200])
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/analytics.js/v1/unknown/analytics.min.js", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for unknown writeKey, got %d", w.Code)
+	}
+}
@@ -0,0 +1,285 @@
+package segment
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// snowflakeMaxBatch is the maximum number of rows per append request
+const snowflakeMaxBatch = 10000
+
+// snowflakeJWTLifetime is the lifetime of key pair tokens, which snowflake limits to an hour
+const snowflakeJWTLifetime = 59 * time.Minute
+
+// SnowflakeConfig contains configuration parameters for the snowpipe streaming destination
+type SnowflakeConfig struct {
+	Account    string `json:"account"`            // Account identifier eg "myorg-myaccount"
+	User       string `json:"user"`               // User with the public key assigned
+	PrivateKey string `json:"privateKey"`         // PEM encoded unencrypted RSA private key
+	Endpoint   string `json:"endpoint,omitempty"` // Overrides the account url
+	Database   string `json:"database"`
+	Schema     string `json:"schema"`
+	Pipe       string `json:"pipe"`              // Streaming pipe mapping event json to table columns
+	Channel    string `json:"channel,omitempty"` // Defaults to "segment", unique per collector instance
+	BatchConfig
+}
+
+// Snowflake is a destination appending events to a snowpipe streaming channel, landing in a table within seconds
+type Snowflake struct {
+	Logger    *log.Logger // Public logger that caller can override
+	config    SnowflakeConfig
+	key       *rsa.PrivateKey
+	issuer    string
+	subject   string
+	batcher   *batcher
+	mu        sync.Mutex
+	token     string
+	expires   time.Time
+	ingest    string // Ingest host url
+	channel   string // Channel url
+	continued string // Continuation token for the next append
+	offset    int64
+}
+
+// NewSnowflake creates a new snowpipe streaming destination given configuration
+func NewSnowflake(config *SnowflakeConfig) *Snowflake {
+	if err := config.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	key, _ := parseRSAPrivateKey(config.PrivateKey)
+	if config.Endpoint == "" {
+		config.Endpoint = "https://" + strings.ToLower(config.Account) + ".snowflakecomputing.com"
+	}
+	if config.Channel == "" {
+		config.Channel = "segment"
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		log.Fatalf("Snowflake public key error -- %v", err)
+	}
+	fingerprint := sha256.Sum256(der)
+	account := strings.ToUpper(strings.SplitN(config.Account, ".", 2)[0])
+	subject := account + "." + strings.ToUpper(config.User)
+	s := &Snowflake{
+		Logger:  log.New(os.Stderr, "", log.LstdFlags),
+		config:  *config,
+		key:     key,
+		issuer:  subject + ".SHA256:" + base64.StdEncoding.EncodeToString(fingerprint[:]),
+		subject: subject,
+		offset:  time.Now().UnixNano(),
+	}
+	s.batcher = newBatcher("snowflake", config.BatchConfig, snowflakeMaxBatch, s.append)
+	return s
+}
+
+// parseRSAPrivateKey parses a PKCS8 or PKCS1 PEM encoded RSA key
+func parseRSAPrivateKey(data string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, fmt.Errorf("expected PEM encoded key")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("expected RSA key")
+	}
+	return rsaKey, nil
+}
+
+// Validate checks the account, user, database, schema and pipe are set and the private key parses
+func (config *SnowflakeConfig) Validate() error {
+	if config.Account == "" || config.User == "" || config.Database == "" || config.Schema == "" || config.Pipe == "" {
+		return fmt.Errorf("Require snowflake account, user, database, schema and pipe")
+	}
+	if _, err := parseRSAPrivateKey(config.PrivateKey); err != nil {
+		return fmt.Errorf("Snowflake private key error -- %v", err)
+	}
+	if config.Endpoint != "" {
+		return validateEndpoint(config.Endpoint)
+	}
+	return nil
+}
+
+// Name returns the configured destination name
+func (s *Snowflake) Name() string {
+	return s.batcher.configuredName()
+}
+
+// WithLogger adds optional logging
+func (s *Snowflake) WithLogger(logger *log.Logger) Destination {
+	if logger != nil {
+		s.Logger = logger
+	}
+	return s
+}
+
+// jwt returns a key pair token signed with RS256, renewed before it expires
+func (s *Snowflake) jwt(now time.Time) (string, error) {
+	if s.token != "" && now.Before(s.expires.Add(-time.Minute)) {
+		return s.token, nil
+	}
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss": s.issuer,
+		"sub": s.subject,
+		"iat": now.Unix(),
+		"exp": now.Add(snowflakeJWTLifetime).Unix(),
+	})
+	unsigned := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(nil, s.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	s.token = unsigned + "." + base64.RawURLEncoding.EncodeToString(sig)
+	s.expires = now.Add(snowflakeJWTLifetime)
+	return s.token, nil
+}
+
+// do sends an authorized request, decoding a json response into out if not nil
+func (s *Snowflake) do(ctx context.Context, method, u string, body []byte, out interface{}) error {
+	token, err := s.jwt(time.Now())
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("X-Snowflake-Authorization-Token-Type", "KEYPAIR_JWT")
+	req.Header.Set("Accept", "application/json")
+	if method != http.MethodGet {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if res.StatusCode >= 300 {
+		if len(data) > 4096 {
+			data = data[:4096]
+		}
+		return &httpStatusError{StatusCode: res.StatusCode, Body: string(data)}
+	}
+	if out == nil {
+		return nil
+	}
+	if text, ok := out.(*string); ok {
+		*text = strings.TrimSpace(string(data))
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+// Connect opens the streaming channel
+func (s *Snowflake) Connect() error {
+	return s.ConnectContext(context.Background())
+}
+
+// ConnectContext discovers the ingest host and opens the streaming channel until ctx is done
+func (s *Snowflake) ConnectContext(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.open(ctx); err != nil {
+		return fmt.Errorf("Snowflake channel error -- %v", err)
+	}
+	s.Logger.Printf("Opened channel: %s\n", s.config.Channel)
+	return nil
+}
+
+// open discovers the ingest host if required, and opens the channel for a new continuation token
+func (s *Snowflake) open(ctx context.Context) error {
+	if s.ingest == "" {
+		var host string
+		if err := s.do(ctx, http.MethodGet, s.config.Endpoint+"/v2/streaming/hostname", nil, &host); err != nil {
+			return err
+		}
+		scheme := "https://"
+		if strings.HasPrefix(s.config.Endpoint, "http://") {
+			scheme = "http://"
+		}
+		s.ingest = scheme + strings.ReplaceAll(host, "_", "-")
+	}
+	s.channel = fmt.Sprintf("/v2/streaming/databases/%s/schemas/%s/pipes/%s/channels/%s",
+		url.PathEscape(s.config.Database), url.PathEscape(s.config.Schema), url.PathEscape(s.config.Pipe), url.PathEscape(s.config.Channel))
+	var res struct {
+		NextContinuationToken string `json:"next_continuation_token"`
+	}
+	if err := s.do(ctx, http.MethodPut, s.ingest+s.channel, []byte("{}"), &res); err != nil {
+		return err
+	}
+	s.continued = res.NextContinuationToken
+	return nil
+}
+
+// Process opens the channel, and appends batches of events until ctx is done
+func (s *Snowflake) Process(ctx context.Context) error {
+	if err := s.ConnectContext(ctx); err != nil {
+		return err
+	}
+	return s.batcher.process(ctx, s.Logger)
+}
+
+// Send pushes the message onto the queue
+func (s *Snowflake) Send(ctx context.Context, message interface{}) error {
+	return s.batcher.send(ctx, message)
+}
+
+// append posts the batch as newline delimited rows, reopening the channel if the continuation token is rejected
+func (s *Snowflake) append(ctx context.Context, batch []SegmentEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.continued == "" {
+		if err := s.open(ctx); err != nil {
+			return err
+		}
+	}
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, m := range batch {
+		if err := encoder.Encode(m); err != nil {
+			return fmt.Errorf("Marshal error -- %v", err)
+		}
+	}
+	s.offset++
+	query := url.Values{"continuationToken": {s.continued}, "offsetToken": {strconv.FormatInt(s.offset, 10)}}
+	var res struct {
+		NextContinuationToken string `json:"next_continuation_token"`
+	}
+	err := s.do(ctx, http.MethodPost, s.ingest+"/v2/streaming/data"+strings.TrimPrefix(s.channel, "/v2/streaming")+"/rows?"+query.Encode(), buf.Bytes(), &res)
+	if status, ok := err.(*httpStatusError); ok && status.StatusCode >= 400 && status.StatusCode < 500 && status.StatusCode != http.StatusTooManyRequests {
+		s.continued = "" // Invalidated channel is reopened on retry
+		return fmt.Errorf("Snowflake append rejected -- %v", status)
+	}
+	if err != nil {
+		return err
+	}
+	s.continued = res.NextContinuationToken
+	return nil
+}
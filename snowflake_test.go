@@ -0,0 +1,86 @@
+package segment
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSnowflakeAppendsRows(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateKey := string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}))
+
+	var mu sync.Mutex
+	var opened int
+	var rows []string
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		// Verify the key pair token signature and claims
+		parts := strings.Split(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "), ".")
+		sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		claims, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		if rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], sig) != nil ||
+			!strings.HasPrefix(string(claims), `{"exp":`) || !strings.Contains(string(claims), `"sub":"MYORG-ACCT.LOADER"`) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		channel := "/v2/streaming/databases/DB/schemas/PUBLIC/pipes/EVENTS_PIPE/channels/segment"
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/v2/streaming/hostname":
+			io.WriteString(w, strings.TrimPrefix(server.URL, "http://"))
+		case r.Method == "PUT" && r.URL.Path == channel:
+			opened++
+			json.NewEncoder(w).Encode(map[string]string{"next_continuation_token": "c0"})
+		case r.Method == "POST" && r.URL.Path == "/v2/streaming/data/databases/DB/schemas/PUBLIC/pipes/EVENTS_PIPE/channels/segment/rows":
+			if len(rows) == 0 && opened == 1 {
+				w.WriteHeader(http.StatusBadRequest) // Reject the first append to reopen the channel
+				return
+			}
+			if r.URL.Query().Get("continuationToken") != "c0" || r.URL.Query().Get("offsetToken") == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			body, _ := io.ReadAll(r.Body)
+			rows = append(rows, strings.Split(strings.TrimSpace(string(body)), "\n")...)
+			json.NewEncoder(w).Encode(map[string]string{"next_continuation_token": "c1"})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	dest := NewSnowflake(&SnowflakeConfig{
+		Account: "myorg-acct", User: "loader", PrivateKey: privateKey, Endpoint: server.URL,
+		Database: "DB", Schema: "PUBLIC", Pipe: "EVENTS_PIPE", BatchConfig: testBatchConfig(),
+	})
+	processBatch(t, dest,
+		SegmentEvent{SegmentMessage: SegmentMessage{MessageId: "1", ProjectId: "p1", Type: "track", Event: "Signed Up"}},
+		SegmentEvent{SegmentMessage: SegmentMessage{MessageId: "2", ProjectId: "p1", Type: "track", Event: "Upgraded"}},
+	)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if opened != 2 {
+		t.Errorf("Expected channel reopened after rejected append, got %d opens", opened)
+	}
+	if len(rows) != 2 || !strings.Contains(rows[1], `"event":"Upgraded"`) {
+		t.Errorf("Expected 2 rows appended, got %v", rows)
+	}
+}
@@ -0,0 +1,175 @@
+package segment
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sns"
+)
+
+// snsMaxAttributes is the maximum number of message attributes SNS accepts per message
+const snsMaxAttributes = 10
+
+// SNSConfig contains configuration parameters including optional endpoint
+type SNSConfig struct {
+	Endpoint string `json:"endpoint,omitempty"`
+	Region   string `json:"region"`
+	TopicARN string `json:"topicArn"`
+	// Events are event name patterns with * and ? wildcards to publish, eg "Subscription *", empty for all
+	Events []string `json:"events,omitempty"`
+	// Attributes are message attribute names to dotted paths eg "plan": "properties.plan", in addition
+	// to the event, type and projectId attributes, up to 10 in total
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+// SNS is a destination publishing selected events to an SNS topic with message attributes for filtering
+type SNS struct {
+	Logger     *log.Logger // Public logger that caller can override
+	sns        *sns.SNS
+	topicARN   string
+	events     []string
+	attributes map[string]string
+}
+
+// NewSNS creates a new SNS destination given configuration
+func NewSNS(config *SNSConfig) *SNS {
+	if err := config.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	cfg := aws.NewConfig().WithRegion(config.Region)
+	if config.Endpoint != "" {
+		cfg.WithEndpoint(config.Endpoint)
+	}
+	sess := session.Must(session.NewSession(cfg))
+	return &SNS{
+		Logger:     log.New(os.Stderr, "", log.LstdFlags),
+		sns:        sns.New(sess, cfg),
+		topicARN:   config.TopicARN,
+		events:     config.Events,
+		attributes: config.Attributes,
+	}
+}
+
+// Validate checks the region and topic are set
+func (config *SNSConfig) Validate() error {
+	if config.Region == "" || config.TopicARN == "" {
+		return fmt.Errorf("Require SNS region and topic")
+	}
+	names := map[string]bool{"event": true, "type": true, "projectId": true}
+	for name := range config.Attributes {
+		names[name] = true
+	}
+	if len(names) > snsMaxAttributes {
+		return fmt.Errorf("SNS allows at most %d message attributes including event, type and projectId, got %d", snsMaxAttributes, len(names))
+	}
+	if config.Endpoint != "" {
+		return validateEndpoint(config.Endpoint)
+	}
+	return nil
+}
+
+// Check resolves AWS credentials and checks the topic exists
+func (config *SNSConfig) Check(ctx context.Context) error {
+	cfg := aws.NewConfig().WithRegion(config.Region)
+	if config.Endpoint != "" {
+		cfg.WithEndpoint(config.Endpoint)
+	}
+	sess, err := session.NewSession(cfg)
+	if err != nil {
+		return fmt.Errorf("AWS session error -- %v", err)
+	}
+	if err := checkCredentials(ctx, sess); err != nil {
+		return err
+	}
+	if _, err := sns.New(sess, cfg).GetTopicAttributesWithContext(ctx, &sns.GetTopicAttributesInput{
+		TopicArn: aws.String(config.TopicARN),
+	}); err != nil {
+		return fmt.Errorf("SNS topic error -- %v", err)
+	}
+	return nil
+}
+
+// WithLogger adds optional logging
+func (s *SNS) WithLogger(logger *log.Logger) Destination {
+	if logger != nil {
+		s.Logger = logger
+	}
+	return s
+}
+
+// Connect checks the topic exists
+func (s *SNS) Connect() error {
+	return s.ConnectContext(context.Background())
+}
+
+// ConnectContext checks the topic exists until ctx is done
+func (s *SNS) ConnectContext(ctx context.Context) error {
+	if _, err := s.sns.GetTopicAttributesWithContext(ctx, &sns.GetTopicAttributesInput{
+		TopicArn: aws.String(s.topicARN),
+	}); err != nil {
+		return fmt.Errorf("SNS topic error -- %v", err)
+	}
+	s.Logger.Printf("Found topic: %s\n", s.topicARN)
+	return nil
+}
+
+// Process blocks until ctx is done, as events are published on send
+func (s *SNS) Process(ctx context.Context) error {
+	<-ctx.Done()
+	return nil
+}
+
+// selected returns true if the event name matches a pattern, or there are none
+func (s *SNS) selected(name string) bool {
+	if len(s.events) == 0 {
+		return true
+	}
+	for _, pattern := range s.events {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// messageAttributes returns the event, type and projectId attributes, and configured attributes present in the event
+func (s *SNS) messageAttributes(m SegmentEvent) map[string]*sns.MessageAttributeValue {
+	attributes := make(map[string]*sns.MessageAttributeValue)
+	for name, value := range eventAttributes(&m, s.attributes) {
+		dataType := "String"
+		if _, ok := value.(float64); ok {
+			dataType = "Number"
+		}
+		attributes[name] = &sns.MessageAttributeValue{DataType: aws.String(dataType), StringValue: aws.String(fmt.Sprint(value))}
+	}
+	return attributes
+}
+
+// Send publishes the event as json if selected, other events are ignored
+func (s *SNS) Send(ctx context.Context, message interface{}) error {
+	m, ok := message.(SegmentEvent)
+	if !ok {
+		return fmt.Errorf("Expected Segment Event")
+	}
+	if !s.selected(eventName(m.SegmentMessage)) {
+		return nil
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("Marshal error -- %v", err)
+	}
+	if _, err := s.sns.PublishWithContext(ctx, &sns.PublishInput{
+		TopicArn:          aws.String(s.topicARN),
+		Message:           aws.String(string(b)),
+		MessageAttributes: s.messageAttributes(m),
+	}); err != nil {
+		return fmt.Errorf("SNS publish error -- %w", err)
+	}
+	return nil
+}
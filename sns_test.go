@@ -0,0 +1,61 @@
+package segment
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestSNSPublish(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	var mu sync.Mutex
+	var published []map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		mu.Lock()
+		published = append(published, map[string]string{
+			"name":  r.Form.Get("MessageAttributes.entry.1.Name"),
+			"count": r.Form.Get("MessageAttributes.entry.4.Name"),
+		})
+		mu.Unlock()
+		w.Write([]byte(`<PublishResponse><PublishResult><MessageId>1</MessageId></PublishResult></PublishResponse>`))
+	}))
+	defer server.Close()
+
+	s := NewSNS(&SNSConfig{
+		Endpoint:   server.URL,
+		Region:     "us-west-2",
+		TopicARN:   "arn:topic",
+		Events:     []string{"Subscription *"},
+		Attributes: map[string]string{"plan": "properties.plan"},
+	})
+	ctx := context.Background()
+	for _, name := range []string{"Subscription Cancelled", "Page Viewed"} {
+		m := SegmentEvent{SegmentMessage: SegmentMessage{Type: "track", Event: name, ProjectId: "p",
+			Properties: map[string]interface{}{"plan": "pro"}}}
+		if err := s.Send(ctx, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(published) != 1 || published[0]["name"] == "" || published[0]["count"] == "" {
+		t.Errorf("Expected selected event published with 4 attributes, got %v", published)
+	}
+}
+
+func TestSNSValidateAttributes(t *testing.T) {
+	config := SNSConfig{Region: "us-west-2", TopicARN: "arn:topic", Attributes: map[string]string{"type": "properties.kind"}}
+	for i := 0; i < 7; i++ {
+		config.Attributes[fmt.Sprintf("a%d", i)] = "properties.a"
+	}
+	if err := config.Validate(); err != nil {
+		t.Errorf("Expected 10 attributes including the overridden type valid, got %v", err)
+	}
+	config.Attributes["a7"] = "properties.a"
+	if err := config.Validate(); err == nil {
+		t.Error("Expected more than 10 attributes rejected")
+	}
+}
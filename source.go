@@ -0,0 +1,112 @@
+package segment
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// commitEvery is the number of events consumed between commits
+const commitEvery = 100
+
+// finalCommitTimeout bounds the commit on return, which isn't cancelled with the consume context
+const finalCommitTimeout = 10 * time.Second
+
+// Offset is an opaque position within a source, empty for the beginning
+type Offset string
+
+// Source reads events from an external system with resumable offsets, eg Kafka, SQS or S3
+type Source interface {
+	// Start reads events after offset, calling handle for each until ctx is done or the source is exhausted
+	Start(ctx context.Context, from Offset, handle func(event SegmentEvent, offset Offset) error) error
+	// Commit acknowledges events up to and including offset
+	Commit(ctx context.Context, offset Offset) error
+	Close() error
+}
+
+// CheckpointStore persists source offsets across restarts
+type CheckpointStore interface {
+	Load(name string) (Offset, error)
+	Save(name string, offset Offset) error
+}
+
+// FileCheckpointStore persists offsets as files in a directory
+type FileCheckpointStore struct {
+	dir string
+}
+
+// NewFileCheckpointStore creates a checkpoint store in dir
+func NewFileCheckpointStore(dir string) *FileCheckpointStore {
+	return &FileCheckpointStore{dir: dir}
+}
+
+// Load returns the saved offset for name, or empty if none
+func (s *FileCheckpointStore) Load(name string) (Offset, error) {
+	b, err := os.ReadFile(filepath.Join(s.dir, name+".offset"))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return Offset(strings.TrimSpace(string(b))), err
+}
+
+// Save atomically writes the offset for name
+func (s *FileCheckpointStore) Save(name string, offset Offset) error {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+	tmp := filepath.Join(s.dir, name+".offset.tmp")
+	if err := os.WriteFile(tmp, []byte(offset), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(s.dir, name+".offset"))
+}
+
+// Consume reads events from source through the pipeline, resuming from the checkpoint for name,
+// and committing then checkpointing the offset periodically and on return
+func (s *Segment) Consume(ctx context.Context, name string, src Source, checkpoints CheckpointStore) error {
+	defer src.Close()
+
+	from, err := checkpoints.Load(name)
+	if err != nil {
+		return fmt.Errorf("Source %s error loading checkpoint -- %v", name, err)
+	}
+	s.Logger.Printf("Source %s consuming from %q\n", name, from)
+
+	var last Offset
+	pending := 0
+	commit := func(ctx context.Context) error {
+		if pending == 0 {
+			return nil
+		}
+		if err := src.Commit(ctx, last); err != nil {
+			return fmt.Errorf("Source %s error committing %q -- %v", name, last, err)
+		}
+		if err := checkpoints.Save(name, last); err != nil {
+			return fmt.Errorf("Source %s error saving checkpoint %q -- %v", name, last, err)
+		}
+		pending = 0
+		return nil
+	}
+
+	err = src.Start(ctx, from, func(event SegmentEvent, offset Offset) error {
+		if err := s.send(ctx, event); err != nil {
+			return err
+		}
+		last = offset
+		if pending++; pending >= commitEvery {
+			return commit(ctx)
+		}
+		return nil
+	})
+
+	// Commit the last offsets even once ctx is cancelled, so they aren't read again after a restart
+	commitCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), finalCommitTimeout)
+	defer cancel()
+	if cerr := commit(commitCtx); err == nil {
+		err = cerr
+	}
+	return err
+}
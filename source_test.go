@@ -0,0 +1,111 @@
+package segment
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// testSource reads and records n events with offsets "1" to "n", blocking once exhausted until ctx is done if follow is set
+type testSource struct {
+	mu      sync.Mutex
+	n       int
+	follow  bool
+	read    []Offset
+	commits []Offset
+}
+
+func (s *testSource) Start(ctx context.Context, from Offset, handle func(event SegmentEvent, offset Offset) error) error {
+	start := 0
+	if from != "" {
+		start, _ = strconv.Atoi(string(from))
+	}
+	for i := start + 1; i <= s.n; i++ {
+		offset := Offset(strconv.Itoa(i))
+		if err := handle(SegmentEvent{SegmentMessage: SegmentMessage{Type: "track", MessageId: string(offset)}}, offset); err != nil {
+			return err
+		}
+		s.mu.Lock()
+		s.read = append(s.read, offset)
+		s.mu.Unlock()
+	}
+	if s.follow {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return nil
+}
+
+func (s *testSource) Commit(ctx context.Context, offset Offset) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.commits = append(s.commits, offset)
+	return nil
+}
+
+func (s *testSource) Close() error { return nil }
+
+func TestConsumeCheckpoints(t *testing.T) {
+	dest := &testDestination{}
+	s := NewSegment(nil, []Destination{dest}, nil).WithRegisterer(prometheus.NewRegistry())
+	checkpoints := NewFileCheckpointStore(t.TempDir())
+
+	// Offsets are committed and saved periodically and on return
+	src := &testSource{n: 250}
+	if err := s.Consume(context.Background(), "test", src, checkpoints); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(src.commits) != "[100 200 250]" {
+		t.Errorf("Expected periodic and final commits, got %v", src.commits)
+	}
+	if offset, _ := checkpoints.Load("test"); offset != "250" {
+		t.Errorf("Expected checkpoint 250, got %q", offset)
+	}
+
+	// Consuming again resumes after the checkpoint
+	src = &testSource{n: 260}
+	if err := s.Consume(context.Background(), "test", src, checkpoints); err != nil {
+		t.Fatal(err)
+	}
+	if len(src.read) != 10 || src.read[0] != "251" {
+		t.Errorf("Expected resume from 251, got %v", src.read)
+	}
+	if len(dest.sent()) != 260 {
+		t.Errorf("Expected each event consumed once, got %d", len(dest.sent()))
+	}
+}
+
+func TestConsumeCommitOnShutdown(t *testing.T) {
+	s := NewSegment(nil, []Destination{&testDestination{}}, nil).WithRegisterer(prometheus.NewRegistry())
+	checkpoints := NewFileCheckpointStore(t.TempDir())
+	src := &testSource{n: 42, follow: true}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- s.Consume(ctx, "test", src, checkpoints) }()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		src.mu.Lock()
+		read := len(src.read)
+		src.mu.Unlock()
+		if read == 42 {
+			break
+		}
+	}
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("Expected cancelled, got %v", err)
+	}
+
+	// The last offset is committed with the consume context already cancelled
+	if offset, _ := checkpoints.Load("test"); offset != "42" || fmt.Sprint(src.commits) != "[42]" {
+		t.Errorf("Expected checkpoint 42 committed on shutdown, got %q %v", offset, src.commits)
+	}
+}
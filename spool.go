@@ -0,0 +1,250 @@
+package segment
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrSpoolFull is returned when an event can't be buffered within the spool budget
+var ErrSpoolFull = errors.New("Spool full")
+
+// spoolDrainInterval is how often a healthy destination replays spooled events
+const spoolDrainInterval = time.Second
+
+// SpoolConfig buffers events while a destination is down, in memory and then spilled to disk
+type SpoolConfig struct {
+	MemoryEvents int    `json:"memoryEvents,omitempty"` // Events held in memory, defaults to 1000
+	Dir          string `json:"dir,omitempty"`          // Directory to spill events, empty for memory only
+	MaxDiskBytes int64  `json:"maxDiskBytes,omitempty"` // Spill budget on disk, zero for unlimited
+}
+
+// MemoryBudget limits the bytes of events buffered in memory across destination spools.  Events queued in a
+// destination channel eg the Delivery messages buffer are not counted, as they are bounded by the channel size.
+type MemoryBudget struct {
+	limit int64
+	used  atomic.Int64
+}
+
+// NewMemoryBudget creates a budget of limit bytes
+func NewMemoryBudget(limit int64) *MemoryBudget {
+	return &MemoryBudget{limit: limit}
+}
+
+// Used returns the bytes currently reserved
+func (b *MemoryBudget) Used() int64 {
+	if b == nil {
+		return 0
+	}
+	return b.used.Load()
+}
+
+// reserve returns false if n bytes would exceed the budget, it always succeeds on a nil budget
+func (b *MemoryBudget) reserve(n int64) bool {
+	if b == nil {
+		return true
+	}
+	if b.used.Add(n) > b.limit {
+		b.used.Add(-n)
+		return false
+	}
+	return true
+}
+
+func (b *MemoryBudget) release(n int64) {
+	if b != nil {
+		b.used.Add(-n)
+	}
+}
+
+// spoolEntry is an event in memory with the bytes reserved from the budget
+type spoolEntry struct {
+	event SegmentEvent
+	size  int64
+}
+
+// spool is a fifo of events in memory, followed by segment files on disk
+type spool struct {
+	mu        sync.Mutex
+	config    SpoolConfig
+	budget    *MemoryBudget
+	memory    []spoolEntry
+	segments  []string // Oldest first, the last is being written
+	writer    *os.File
+	written   int
+	diskBytes int64
+}
+
+// newSpool creates a spool within the memory budget, recovering segments left on disk by a previous run
+func newSpool(config SpoolConfig, name string, budget *MemoryBudget) (*spool, error) {
+	if config.MemoryEvents <= 0 {
+		config.MemoryEvents = 1000
+	}
+	sp := &spool{config: config, budget: budget}
+	if config.Dir == "" {
+		return sp, nil
+	}
+
+	sp.config.Dir = filepath.Join(config.Dir, name)
+	if err := os.MkdirAll(sp.config.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("Spool error creating %s -- %v", sp.config.Dir, err)
+	}
+	segments, err := filepath.Glob(filepath.Join(sp.config.Dir, "spool-*.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(segments)
+	for _, segment := range segments {
+		if info, err := os.Stat(segment); err == nil {
+			sp.diskBytes += info.Size()
+		}
+	}
+	sp.segments = segments
+	return sp, nil
+}
+
+// Len returns the number of events in memory, and whether there are events on disk
+func (sp *spool) Len() (int, bool) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	return len(sp.memory), len(sp.segments) > 0
+}
+
+// empty returns true if there are no spooled events
+func (sp *spool) empty() bool {
+	n, disk := sp.Len()
+	return n == 0 && !disk
+}
+
+// push adds an event to memory, or spills to disk once memory or the budget is full
+func (sp *spool) push(event SegmentEvent) error {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	b, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	if len(sp.segments) == 0 && len(sp.memory) < sp.config.MemoryEvents && sp.budget.reserve(int64(len(b))) {
+		sp.memory = append(sp.memory, spoolEntry{event, int64(len(b))})
+		return nil
+	}
+	if sp.config.Dir == "" {
+		return ErrSpoolFull
+	}
+
+	if sp.config.MaxDiskBytes > 0 && sp.diskBytes+int64(len(b)) > sp.config.MaxDiskBytes {
+		return ErrSpoolFull
+	}
+	if sp.writer == nil || sp.written >= sp.config.MemoryEvents {
+		if err := sp.rotate(); err != nil {
+			return err
+		}
+	}
+	if _, err := sp.writer.Write(b); err != nil {
+		return fmt.Errorf("Spool error writing %s -- %v", sp.writer.Name(), err)
+	}
+	sp.written++
+	sp.diskBytes += int64(len(b))
+	return nil
+}
+
+// rotate closes the current segment and opens a new one sized to fit in memory
+func (sp *spool) rotate() error {
+	if sp.writer != nil {
+		sp.writer.Close()
+	}
+	name := filepath.Join(sp.config.Dir, fmt.Sprintf("spool-%020d.jsonl", time.Now().UnixNano()))
+	f, err := os.Create(name)
+	if err != nil {
+		return fmt.Errorf("Spool error creating %s -- %v", name, err)
+	}
+	sp.writer = f
+	sp.written = 0
+	sp.segments = append(sp.segments, name)
+	return nil
+}
+
+// front returns the oldest event, loading the oldest segment from disk if memory is empty
+func (sp *spool) front() (SegmentEvent, bool, error) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	if len(sp.memory) == 0 && len(sp.segments) > 0 {
+		if err := sp.load(); err != nil {
+			return SegmentEvent{}, false, err
+		}
+	}
+	if len(sp.memory) == 0 {
+		return SegmentEvent{}, false, nil
+	}
+	return sp.memory[0].event, true, nil
+}
+
+// load reads the oldest segment into memory and removes it from disk
+func (sp *spool) load() error {
+	name := sp.segments[0]
+	if sp.writer != nil && sp.writer.Name() == name {
+		sp.writer.Close()
+		sp.writer = nil
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return fmt.Errorf("Spool error reading %s -- %v", name, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 32*1024*1024)
+	for scanner.Scan() {
+		var event SegmentEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return fmt.Errorf("Spool error decoding %s -- %v", name, err)
+		}
+		sp.memory = append(sp.memory, spoolEntry{event: event}) // Bounded by segment size, not the budget
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("Spool error reading %s -- %v", name, err)
+	}
+	if info, err := f.Stat(); err == nil {
+		sp.diskBytes -= info.Size()
+	}
+	sp.segments = sp.segments[1:]
+	return os.Remove(name)
+}
+
+// pop removes the oldest event returned by front
+func (sp *spool) pop() {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if len(sp.memory) > 0 {
+		sp.budget.release(sp.memory[0].size)
+		sp.memory[0] = spoolEntry{}
+		sp.memory = sp.memory[1:]
+	}
+}
+
+// drain replays spooled events in order, stopping on the first send error
+func (sp *spool) drain(ctx context.Context, send func(ctx context.Context, event SegmentEvent) error) error {
+	for ctx.Err() == nil {
+		event, ok, err := sp.front()
+		if err != nil || !ok {
+			return err
+		}
+		if err := send(ctx, event); err != nil {
+			return err
+		}
+		sp.pop()
+	}
+	return ctx.Err()
+}
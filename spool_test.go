@@ -0,0 +1,91 @@
+package segment
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSpoolSpill(t *testing.T) {
+	dir := t.TempDir()
+	sp, err := newSpool(SpoolConfig{MemoryEvents: 2, Dir: dir}, "test-0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := sp.push(SegmentEvent{SegmentMessage: SegmentMessage{MessageId: fmt.Sprint(i)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Recover spilled segments from disk after the memory events
+	recovered, err := newSpool(SpoolConfig{MemoryEvents: 2, Dir: dir}, "test-0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, disk := recovered.Len(); !disk {
+		t.Error("Expected spilled segments to be recovered")
+	}
+
+	var ids []string
+	if err := sp.drain(context.Background(), func(ctx context.Context, event SegmentEvent) error {
+		ids = append(ids, event.MessageId)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(ids) != "[0 1 2 3 4]" {
+		t.Errorf("Expected events in order, got %v", ids)
+	}
+	if !sp.empty() {
+		t.Error("Expected spool empty after drain")
+	}
+}
+
+func TestSpoolFull(t *testing.T) {
+	sp, _ := newSpool(SpoolConfig{MemoryEvents: 1}, "test-0", nil)
+	sp.push(SegmentEvent{})
+	if err := sp.push(SegmentEvent{}); err != ErrSpoolFull {
+		t.Errorf("Expected spool full, got %v", err)
+	}
+}
+
+func TestSpoolMemoryBudget(t *testing.T) {
+	budget := NewMemoryBudget(200)
+	sp1, _ := newSpool(SpoolConfig{}, "test-0", budget)
+	sp2, _ := newSpool(SpoolConfig{Dir: t.TempDir()}, "test-1", budget)
+	if err := sp1.push(SegmentEvent{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sp1.push(SegmentEvent{}); err != ErrSpoolFull {
+		t.Errorf("Expected shedding beyond budget, got %v", err)
+	}
+	if err := sp2.push(SegmentEvent{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, disk := sp2.Len(); !disk {
+		t.Error("Expected spill to disk beyond budget")
+	}
+	sp1.pop()
+	if budget.Used() != 0 {
+		t.Errorf("Expected budget released, got %d", budget.Used())
+	}
+}
+
+func TestSpoolMemoryMetric(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	shared, other := NewMemoryBudget(1000), NewMemoryBudget(1000)
+	shared.reserve(100)
+	other.reserve(10)
+	s1 := NewSegment(nil, nil, nil).WithMemoryBudget(shared).WithRegisterer(reg)
+	NewSegment(nil, nil, nil).WithMemoryBudget(shared).WithRegisterer(reg)
+	NewSegment(nil, nil, nil).WithMemoryBudget(other).WithRegisterer(reg)
+
+	// Each distinct budget of the segments registered is counted once
+	if used := testutil.ToFloat64(s1.metrics.spoolBytes); used != 110 {
+		t.Errorf("Expected 110 bytes used, got %v", used)
+	}
+}
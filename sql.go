@@ -0,0 +1,511 @@
+package segment
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sqlMaxBatch is the maximum number of events inserted per transaction
+const sqlMaxBatch = 10000
+
+// SQLDialect contains the statements to store events in a database, formatted with the table name
+type SQLDialect struct {
+	Setup        []string // Statements run on connect eg pragmas
+	Create       []string // Creates the table if not exists with an increasing id and the columns
+	Columns      []string // Columns inserted in order, see sqlValue
+	Insert       string   // Inserts the columns, ignoring duplicate message ids
+	Select       string   // Selects id and payload after an id, ordered by id with a limit
+	Delete       string   // Deletes up to and including an id
+	MaxOpenConns int      // Zero for unlimited
+	// Outbox statements create the status table, insert a pending row for each event in the same transaction, select
+	// pending ids and payloads in id order with a limit, mark an id delivered at a time, and mark an id failed whose
+	// payload can't be decoded
+	OutboxCreate  []string
+	OutboxInsert  string
+	OutboxSelect  string
+	OutboxDeliver string
+	OutboxFail    string
+}
+
+// SQLiteDialect stores events in a SQLite database in WAL mode, with a single connection for writes
+var SQLiteDialect = SQLDialect{
+	Setup: []string{
+		"PRAGMA journal_mode=WAL",
+		"PRAGMA synchronous=NORMAL",
+		"PRAGMA busy_timeout=5000",
+	},
+	Create: []string{`CREATE TABLE IF NOT EXISTS %s (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		message_id TEXT NOT NULL UNIQUE,
+		project_id TEXT NOT NULL,
+		type TEXT NOT NULL,
+		event TEXT,
+		user_id TEXT,
+		anonymous_id TEXT,
+		timestamp TIMESTAMP,
+		received_at TIMESTAMP,
+		payload TEXT NOT NULL)`},
+	Columns:      []string{"message_id", "project_id", "type", "event", "user_id", "anonymous_id", "timestamp", "received_at", "payload"},
+	Insert:       "INSERT OR IGNORE INTO %s (message_id, project_id, type, event, user_id, anonymous_id, timestamp, received_at, payload) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+	Select:       "SELECT id, payload FROM %s WHERE id > ? ORDER BY id LIMIT ?",
+	Delete:       "DELETE FROM %s WHERE id <= ?",
+	MaxOpenConns: 1,
+	OutboxCreate: []string{`CREATE TABLE IF NOT EXISTS %[1]s_outbox (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		message_id TEXT NOT NULL UNIQUE,
+		status TEXT NOT NULL DEFAULT 'pending',
+		created_at TIMESTAMP NOT NULL,
+		delivered_at TIMESTAMP)`,
+		"CREATE INDEX IF NOT EXISTS %[1]s_outbox_status ON %[1]s_outbox (status, id)"},
+	OutboxInsert: "INSERT OR IGNORE INTO %s_outbox (message_id, created_at) VALUES (?, ?)",
+	OutboxSelect: `SELECT o.id, e.payload FROM %[1]s_outbox o JOIN %[1]s e ON e.message_id = o.message_id
+		WHERE o.status = 'pending' ORDER BY o.id LIMIT ?`,
+	OutboxDeliver: "UPDATE %s_outbox SET status = 'delivered', delivered_at = ? WHERE id = ?",
+	OutboxFail:    "UPDATE %s_outbox SET status = 'failed' WHERE id = ?",
+}
+
+// DuckDBDialect appends events into a DuckDB file with typed columns from the message schema, for local analysis
+var DuckDBDialect = SQLDialect{
+	Create: []string{
+		"CREATE SEQUENCE IF NOT EXISTS %s_id_seq",
+		`CREATE TABLE IF NOT EXISTS %[1]s (
+		id BIGINT PRIMARY KEY DEFAULT nextval('%[1]s_id_seq'),
+		message_id VARCHAR NOT NULL UNIQUE,
+		project_id VARCHAR NOT NULL,
+		type VARCHAR NOT NULL,
+		channel VARCHAR,
+		event VARCHAR,
+		category VARCHAR,
+		name VARCHAR,
+		user_id VARCHAR,
+		anonymous_id VARCHAR,
+		previous_id VARCHAR,
+		group_id VARCHAR,
+		timestamp TIMESTAMPTZ,
+		original_timestamp TIMESTAMPTZ,
+		sent_at TIMESTAMPTZ,
+		received_at TIMESTAMPTZ,
+		context JSON,
+		properties JSON,
+		traits JSON,
+		payload JSON NOT NULL)`,
+	},
+	Columns: []string{"message_id", "project_id", "type", "channel", "event", "category", "name", "user_id", "anonymous_id",
+		"previous_id", "group_id", "timestamp", "original_timestamp", "sent_at", "received_at", "context", "properties", "traits", "payload"},
+	Insert: `INSERT OR IGNORE INTO %s (message_id, project_id, type, channel, event, category, name, user_id, anonymous_id,
+		previous_id, group_id, timestamp, original_timestamp, sent_at, received_at, context, properties, traits, payload)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+	Select:       "SELECT id, CAST(payload AS VARCHAR) FROM %s WHERE id > ? ORDER BY id LIMIT ?",
+	Delete:       "DELETE FROM %s WHERE id <= ?",
+	MaxOpenConns: 1,
+	OutboxCreate: []string{
+		"CREATE SEQUENCE IF NOT EXISTS %s_outbox_id_seq",
+		`CREATE TABLE IF NOT EXISTS %[1]s_outbox (
+		id BIGINT PRIMARY KEY DEFAULT nextval('%[1]s_outbox_id_seq'),
+		message_id VARCHAR NOT NULL UNIQUE,
+		status VARCHAR NOT NULL DEFAULT 'pending',
+		created_at TIMESTAMPTZ NOT NULL,
+		delivered_at TIMESTAMPTZ)`,
+	},
+	OutboxInsert: "INSERT OR IGNORE INTO %s_outbox (message_id, created_at) VALUES (?, ?)",
+	OutboxSelect: `SELECT o.id, CAST(e.payload AS VARCHAR) FROM %[1]s_outbox o JOIN %[1]s e ON e.message_id = o.message_id
+		WHERE o.status = 'pending' ORDER BY o.id LIMIT ?`,
+	OutboxDeliver: "UPDATE %s_outbox SET status = 'delivered', delivered_at = ? WHERE id = ?",
+	OutboxFail:    "UPDATE %s_outbox SET status = 'failed' WHERE id = ?",
+}
+
+// postgresColumns are the typed columns inserted for postgres wire databases
+var postgresColumns = []string{"message_id", "project_id", "type", "channel", "event", "user_id", "anonymous_id", "group_id",
+	"timestamp", "received_at", "context", "properties", "traits", "payload"}
+
+// PostgresDialect stores events in a postgres table with typed columns and jsonb, ignoring duplicate message ids
+var PostgresDialect = SQLDialect{
+	Create: []string{`CREATE TABLE IF NOT EXISTS %s (
+		id BIGSERIAL PRIMARY KEY,
+		message_id TEXT NOT NULL UNIQUE,
+		project_id TEXT NOT NULL,
+		type TEXT NOT NULL,
+		channel TEXT,
+		event TEXT,
+		user_id TEXT,
+		anonymous_id TEXT,
+		group_id TEXT,
+		timestamp TIMESTAMPTZ,
+		received_at TIMESTAMPTZ,
+		context JSONB,
+		properties JSONB,
+		traits JSONB,
+		payload JSONB NOT NULL)`},
+	Columns: postgresColumns,
+	Insert: `INSERT INTO %s (message_id, project_id, type, channel, event, user_id, anonymous_id, group_id,
+		timestamp, received_at, context, properties, traits, payload)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14) ON CONFLICT (message_id) DO NOTHING`,
+	Select: "SELECT id, payload::text FROM %s WHERE id > $1 ORDER BY id LIMIT $2",
+	Delete: "DELETE FROM %s WHERE id <= $1",
+	OutboxCreate: []string{`CREATE TABLE IF NOT EXISTS %[1]s_outbox (
+		id BIGSERIAL PRIMARY KEY,
+		message_id TEXT NOT NULL UNIQUE,
+		status TEXT NOT NULL DEFAULT 'pending',
+		created_at TIMESTAMPTZ NOT NULL,
+		delivered_at TIMESTAMPTZ)`,
+		"CREATE INDEX IF NOT EXISTS %[1]s_outbox_status ON %[1]s_outbox (status, id)"},
+	OutboxInsert: "INSERT INTO %s_outbox (message_id, created_at) VALUES ($1, $2) ON CONFLICT (message_id) DO NOTHING",
+	OutboxSelect: `SELECT o.id, e.payload::text FROM %[1]s_outbox o JOIN %[1]s e ON e.message_id = o.message_id
+		WHERE o.status = 'pending' ORDER BY o.id LIMIT $1`,
+	OutboxDeliver: "UPDATE %s_outbox SET status = 'delivered', delivered_at = $1 WHERE id = $2",
+	OutboxFail:    "UPDATE %s_outbox SET status = 'failed' WHERE id = $1",
+}
+
+// MaterializeDialect inserts events into a materialize or other streaming sql table over the postgres wire
+// protocol, to compute real-time metrics with materialized views.  Tables have no keys or sequences, so
+// duplicates are not ignored, and they can't be read by a SQLSource.
+var MaterializeDialect = SQLDialect{
+	Create: []string{`CREATE TABLE IF NOT EXISTS %s (
+		message_id TEXT NOT NULL,
+		project_id TEXT NOT NULL,
+		type TEXT NOT NULL,
+		channel TEXT,
+		event TEXT,
+		user_id TEXT,
+		anonymous_id TEXT,
+		group_id TEXT,
+		timestamp TIMESTAMPTZ,
+		received_at TIMESTAMPTZ,
+		context JSONB,
+		properties JSONB,
+		traits JSONB,
+		payload JSONB NOT NULL)`},
+	Columns: postgresColumns,
+	Insert: `INSERT INTO %s (message_id, project_id, type, channel, event, user_id, anonymous_id, group_id,
+		timestamp, received_at, context, properties, traits, payload)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)`,
+}
+
+// sqlDialects are the dialects by name
+var sqlDialects = map[string]SQLDialect{
+	"sqlite":      SQLiteDialect,
+	"sqlite3":     SQLiteDialect,
+	"duckdb":      DuckDBDialect,
+	"postgres":    PostgresDialect,
+	"pgx":         PostgresDialect,
+	"materialize": MaterializeDialect,
+}
+
+// sqlValue returns the value of a column for the event, with maps as json and zero times as null
+func sqlValue(m SegmentEvent, column string) (interface{}, error) {
+	var value interface{}
+	switch column {
+	case "message_id":
+		return m.MessageId, nil
+	case "project_id":
+		return m.ProjectId, nil
+	case "type":
+		return m.Type, nil
+	case "channel":
+		return m.Channel, nil
+	case "event":
+		return eventName(m.SegmentMessage), nil
+	case "category":
+		return m.Category, nil
+	case "name":
+		return m.Name, nil
+	case "user_id":
+		return m.UserId, nil
+	case "anonymous_id":
+		return m.AnonymousId, nil
+	case "previous_id":
+		return m.PreviousId, nil
+	case "group_id":
+		return m.GroupId, nil
+	case "timestamp":
+		return sqlTime(m.Timestamp), nil
+	case "original_timestamp":
+		return sqlTime(m.OriginalTimestamp), nil
+	case "sent_at":
+		return sqlTime(m.SentAt), nil
+	case "received_at":
+		return sqlTime(m.ReceivedAt), nil
+	case "context":
+		value = m.Context
+	case "properties":
+		value = m.Properties
+	case "traits":
+		value = m.Traits
+	case "payload":
+		value = m
+	default:
+		return nil, fmt.Errorf("Unknown sql column: %s", column)
+	}
+	if v, ok := value.(map[string]interface{}); ok && v == nil {
+		return nil, nil
+	}
+	b, err := json.Marshal(value)
+	if err != nil {
+		return nil, fmt.Errorf("Marshal error -- %v", err)
+	}
+	return string(b), nil
+}
+
+// sqlTime returns nil for a zero time
+func sqlTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
+
+// SQLConfig contains configuration parameters for a database/sql destination, the caller must import the driver
+type SQLConfig struct {
+	Driver  string `json:"driver"` // Registered driver name eg "sqlite3"
+	DSN     string `json:"dsn"`
+	Table   string `json:"table,omitempty"`   // Defaults to "events"
+	Dialect string `json:"dialect,omitempty"` // Defaults to the driver name
+	// Outbox inserts a pending row for each event into the "<table>_outbox" table in the same transaction, for a
+	// SQLOutboxRelay or change data capture pipeline to hand off exactly once
+	Outbox bool `json:"outbox,omitempty"`
+	BatchConfig
+}
+
+// SQL is a destination inserting batches of events into a database in a transaction
+type SQL struct {
+	Logger  *log.Logger // Public logger that caller can override
+	db      *sql.DB
+	table   string
+	dialect SQLDialect
+	outbox  bool
+	batcher *batcher
+}
+
+// Validate checks the dialect, or driver if not set, is supported
+func (config *SQLConfig) Validate() error {
+	dialect := config.Dialect
+	if dialect == "" {
+		dialect = config.Driver
+	}
+	d, ok := sqlDialects[dialect]
+	if !ok {
+		return fmt.Errorf("Unsupported sql dialect: %s", dialect)
+	}
+	if config.Outbox && d.OutboxInsert == "" {
+		return fmt.Errorf("Outbox not supported for sql dialect: %s", dialect)
+	}
+	return nil
+}
+
+// NewSQL creates a new database/sql destination given configuration
+func NewSQL(config *SQLConfig) *SQL {
+	if config.Dialect == "" {
+		config.Dialect = config.Driver
+	}
+	if err := config.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	dialect := sqlDialects[config.Dialect]
+	if config.Table == "" {
+		config.Table = "events"
+	}
+	db, err := sql.Open(config.Driver, config.DSN)
+	if err != nil {
+		log.Fatal(err)
+	}
+	db.SetMaxOpenConns(dialect.MaxOpenConns)
+	s := &SQL{
+		Logger:  log.New(os.Stderr, "", log.LstdFlags),
+		db:      db,
+		table:   config.Table,
+		dialect: dialect,
+		outbox:  config.Outbox,
+	}
+	s.batcher = newBatcher(config.Driver, config.BatchConfig, sqlMaxBatch, s.insert)
+	return s
+}
+
+// Name returns the configured destination name
+func (s *SQL) Name() string {
+	return s.batcher.configuredName()
+}
+
+// WithLogger adds optional logging
+func (s *SQL) WithLogger(logger *log.Logger) Destination {
+	if logger != nil {
+		s.Logger = logger
+	}
+	return s
+}
+
+// Connect runs the setup statements and creates the table
+func (s *SQL) Connect() error {
+	return s.ConnectContext(context.Background())
+}
+
+// ConnectContext runs the setup statements and creates the table until ctx is done
+func (s *SQL) ConnectContext(ctx context.Context) error {
+	for _, stmt := range s.dialect.Setup {
+		if _, err := s.db.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("SQL setup error -- %v", err)
+		}
+	}
+	create := s.dialect.Create
+	if s.outbox {
+		create = append(append([]string{}, create...), s.dialect.OutboxCreate...)
+	}
+	for _, stmt := range create {
+		if _, err := s.db.ExecContext(ctx, fmt.Sprintf(stmt, s.table)); err != nil {
+			return fmt.Errorf("SQL create table error -- %v", err)
+		}
+	}
+	s.Logger.Printf("Created table: %s\n", s.table)
+	return nil
+}
+
+// Process connects, and inserts batches of events until ctx is done
+func (s *SQL) Process(ctx context.Context) error {
+	if err := s.ConnectContext(ctx); err != nil {
+		return err
+	}
+	return s.batcher.process(ctx, s.Logger)
+}
+
+// Send pushes the message onto the queue
+func (s *SQL) Send(ctx context.Context, message interface{}) error {
+	return s.batcher.send(ctx, message)
+}
+
+// Close closes the database
+func (s *SQL) Close() error {
+	return s.db.Close()
+}
+
+// insert writes the batch in a single transaction with the outbox rows if configured, rolled back on error
+func (s *SQL) insert(ctx context.Context, batch []SegmentEvent) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.PrepareContext(ctx, fmt.Sprintf(s.dialect.Insert, s.table))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	var outbox *sql.Stmt
+	if s.outbox {
+		if outbox, err = tx.PrepareContext(ctx, fmt.Sprintf(s.dialect.OutboxInsert, s.table)); err != nil {
+			return err
+		}
+		defer outbox.Close()
+	}
+	now := s.batcher.clock.Now()
+	values := make([]interface{}, len(s.dialect.Columns))
+	for _, m := range batch {
+		for i, column := range s.dialect.Columns {
+			if values[i], err = sqlValue(m, column); err != nil {
+				return err
+			}
+		}
+		if _, err := stmt.ExecContext(ctx, values...); err != nil {
+			return err
+		}
+		if outbox != nil {
+			if _, err := outbox.ExecContext(ctx, m.MessageId, now); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// SQLSource reads events stored by a SQL destination in id order, eg to sync an edge database to the cloud
+type SQLSource struct {
+	db        *sql.DB
+	table     string
+	dialect   SQLDialect
+	batchSize int
+	prune     bool
+}
+
+// NewSQLSource creates a source for the events in the destination table, deleting committed events if prune is set
+func NewSQLSource(dest *SQL, batchSize int, prune bool) *SQLSource {
+	if batchSize <= 0 {
+		batchSize = 1000
+	}
+	return &SQLSource{db: dest.db, table: dest.table, dialect: dest.dialect, batchSize: batchSize, prune: prune}
+}
+
+// Start reads events after the offset id until exhausted
+func (s *SQLSource) Start(ctx context.Context, from Offset, handle func(SegmentEvent, Offset) error) error {
+	if s.dialect.Select == "" {
+		return fmt.Errorf("SQL source not supported for table %s", s.table)
+	}
+	var last int64
+	if from != "" {
+		var err error
+		if last, err = strconv.ParseInt(string(from), 10, 64); err != nil {
+			return fmt.Errorf("SQL source offset error -- %v", err)
+		}
+	}
+	for {
+		events, ids, err := s.read(ctx, last)
+		if err != nil {
+			return err
+		}
+		for i, m := range events {
+			if err := handle(m, Offset(strconv.FormatInt(ids[i], 10))); err != nil {
+				return err
+			}
+			last = ids[i]
+		}
+		if len(events) < s.batchSize {
+			return nil
+		}
+	}
+}
+
+// read selects the next batch of events after id
+func (s *SQLSource) read(ctx context.Context, after int64) ([]SegmentEvent, []int64, error) {
+	rows, err := s.db.QueryContext(ctx, fmt.Sprintf(s.dialect.Select, s.table), after, s.batchSize)
+	if err != nil {
+		return nil, nil, fmt.Errorf("SQL source select error -- %v", err)
+	}
+	defer rows.Close()
+	var events []SegmentEvent
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		var payload string
+		if err := rows.Scan(&id, &payload); err != nil {
+			return nil, nil, fmt.Errorf("SQL source scan error -- %v", err)
+		}
+		var m SegmentEvent
+		if err := json.Unmarshal([]byte(payload), &m); err != nil {
+			return nil, nil, fmt.Errorf("SQL source decode error at %d -- %v", id, err)
+		}
+		events = append(events, m)
+		ids = append(ids, id)
+	}
+	return events, ids, rows.Err()
+}
+
+// Commit deletes events up to and including offset if pruning
+func (s *SQLSource) Commit(ctx context.Context, offset Offset) error {
+	if !s.prune {
+		return nil
+	}
+	id, err := strconv.ParseInt(string(offset), 10, 64)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, fmt.Sprintf(s.dialect.Delete, s.table), id)
+	return err
+}
+
+// Close is a no-op as the database is closed by the destination
+func (s *SQLSource) Close() error {
+	return nil
+}
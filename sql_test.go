@@ -0,0 +1,357 @@
+package segment
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDB is an in memory table for the fake sql driver, interpreting statements by prefix
+type fakeDB struct {
+	mu       sync.Mutex
+	stmts    []string
+	rows     [][]driver.Value // id followed by the dialect columns
+	nextId   int64
+	failures int              // Fail this many transaction commits
+	outbox   [][]driver.Value // id, message_id, created_at and delivered_at or "failed", nil while pending
+}
+
+var (
+	fakeDBs   = make(map[string]*fakeDB)
+	fakeDBsMu sync.Mutex
+)
+
+func init() {
+	sql.Register("fakesql", fakeDriver{})
+	sqlDialects["fakesql"] = SQLiteDialect
+}
+
+// newFakeDB returns a dsn for a new fake database
+func newFakeDB(t *testing.T, failures int) (string, *fakeDB) {
+	fakeDBsMu.Lock()
+	defer fakeDBsMu.Unlock()
+	db := &fakeDB{failures: failures}
+	fakeDBs[t.Name()] = db
+	return t.Name(), db
+}
+
+func (db *fakeDB) executed() []string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return append([]string{}, db.stmts...)
+}
+
+func (db *fakeDB) count() int {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return len(db.rows)
+}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(dsn string) (driver.Conn, error) {
+	fakeDBsMu.Lock()
+	defer fakeDBsMu.Unlock()
+	return &fakeConn{db: fakeDBs[dsn]}, nil
+}
+
+type fakeConn struct {
+	db      *fakeDB
+	pending [][]driver.Value // Rows inserted in the open transaction
+	outbox  [][]driver.Value // Outbox rows inserted in the open transaction
+	tx      bool
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) { return &fakeStmt{c, query}, nil }
+func (c *fakeConn) Close() error                              { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	c.tx = true
+	return c, nil
+}
+
+func (c *fakeConn) Commit() error {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	c.tx = false
+	rows, outbox := c.pending, c.outbox
+	c.pending, c.outbox = nil, nil
+	if c.db.failures > 0 {
+		c.db.failures--
+		return fmt.Errorf("database is locked")
+	}
+	for _, row := range outbox {
+		exists := false
+		for _, r := range c.db.outbox {
+			exists = exists || r[1] == row[0]
+		}
+		if !exists {
+			c.db.outbox = append(c.db.outbox, []driver.Value{int64(len(c.db.outbox) + 1), row[0], row[1], nil})
+		}
+	}
+	for _, row := range rows {
+		exists := false
+		for _, r := range c.db.rows {
+			exists = exists || r[1] == row[0]
+		}
+		if !exists {
+			c.db.nextId++
+			c.db.rows = append(c.db.rows, append([]driver.Value{c.db.nextId}, row...))
+		}
+	}
+	return nil
+}
+
+func (c *fakeConn) Rollback() error {
+	c.tx = false
+	c.pending, c.outbox = nil, nil
+	return nil
+}
+
+type fakeStmt struct {
+	c     *fakeConn
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	db := s.c.db
+	if strings.HasPrefix(s.query, "INSERT") && strings.Contains(s.query, "_outbox") && s.c.tx {
+		s.c.outbox = append(s.c.outbox, args)
+		return driver.RowsAffected(1), nil
+	}
+	if strings.HasPrefix(s.query, "INSERT") && s.c.tx {
+		s.c.pending = append(s.c.pending, args)
+		return driver.RowsAffected(1), nil
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if strings.HasPrefix(s.query, "UPDATE") && strings.Contains(s.query, "'failed'") {
+		for _, r := range db.outbox {
+			if r[0] == args[0] {
+				r[3] = "failed"
+			}
+		}
+		return driver.RowsAffected(1), nil
+	}
+	if strings.HasPrefix(s.query, "UPDATE") {
+		for _, r := range db.outbox {
+			if r[0] == args[1] {
+				r[3] = args[0]
+			}
+		}
+		return driver.RowsAffected(1), nil
+	}
+	db.stmts = append(db.stmts, s.query)
+	if strings.HasPrefix(s.query, "DELETE") {
+		var rows [][]driver.Value
+		for _, r := range db.rows {
+			if r[0].(int64) > args[0].(int64) {
+				rows = append(rows, r)
+			}
+		}
+		db.rows = rows
+	}
+	return driver.RowsAffected(0), nil
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	db := s.c.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	rows := &fakeRows{}
+	if strings.Contains(s.query, "_outbox") {
+		for _, o := range db.outbox {
+			for _, r := range db.rows {
+				if o[3] == nil && r[1] == o[1] && int64(len(rows.rows)) < args[0].(int64) {
+					rows.rows = append(rows.rows, []driver.Value{o[0], r[len(r)-1]})
+				}
+			}
+		}
+		return rows, nil
+	}
+	for _, r := range db.rows {
+		if r[0].(int64) > args[0].(int64) && int64(len(rows.rows)) < args[1].(int64) {
+			rows.rows = append(rows.rows, []driver.Value{r[0], r[len(r)-1]})
+		}
+	}
+	return rows, nil
+}
+
+type fakeRows struct {
+	rows [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return []string{"id", "payload"} }
+func (r *fakeRows) Close() error      { return nil }
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+func testSQL(t *testing.T, failures int) (*SQL, *fakeDB) {
+	dsn, db := newFakeDB(t, failures)
+	dest := NewSQL(&SQLConfig{Driver: "fakesql", DSN: dsn, BatchConfig: testBatchConfig()})
+	t.Cleanup(func() { dest.Close() })
+	return dest, db
+}
+
+func TestSQLInsertsBatchInTransaction(t *testing.T) {
+	dest, db := testSQL(t, 1)
+	processBatch(t, dest,
+		SegmentEvent{SegmentMessage: SegmentMessage{MessageId: "1", ProjectId: "p1", Type: "track", Event: "Signed Up"}},
+		SegmentEvent{SegmentMessage: SegmentMessage{MessageId: "2", ProjectId: "p1", Type: "page", Name: "Home"}},
+		SegmentEvent{SegmentMessage: SegmentMessage{MessageId: "1", ProjectId: "p1", Type: "track", Event: "Signed Up"}},
+	)
+
+	stmts := db.executed()
+	if len(stmts) < 4 || stmts[0] != "PRAGMA journal_mode=WAL" || !strings.HasPrefix(stmts[3], "CREATE TABLE IF NOT EXISTS events") {
+		t.Fatalf("Expected WAL pragma and create table, got %v", stmts)
+	}
+	// First commit fails and the batch is retried, with the duplicate message ignored
+	if db.count() != 2 {
+		t.Fatalf("Expected 2 rows, got %d", db.count())
+	}
+	if db.rows[1][4] != "Home" {
+		t.Errorf("Expected page name as event, got %v", db.rows[1][4])
+	}
+}
+
+func TestSQLDuckDBTypedColumns(t *testing.T) {
+	dsn, db := newFakeDB(t, 0)
+	dest := NewSQL(&SQLConfig{Driver: "fakesql", DSN: dsn, Dialect: "duckdb", BatchConfig: testBatchConfig()})
+	defer dest.Close()
+	ts := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	processBatch(t, dest, SegmentEvent{SegmentMessage: SegmentMessage{
+		MessageId: "1", ProjectId: "p1", Type: "track", Event: "Order Completed", Timestamp: ts,
+		Properties: map[string]interface{}{"revenue": 9.99},
+	}})
+
+	stmts := db.executed()
+	if len(stmts) != 2 || stmts[0] != "CREATE SEQUENCE IF NOT EXISTS events_id_seq" || !strings.Contains(stmts[1], "nextval('events_id_seq')") {
+		t.Fatalf("Expected sequence and table created, got %v", stmts)
+	}
+	if db.count() != 1 {
+		t.Fatalf("Expected 1 row, got %d", db.count())
+	}
+	row := map[string]driver.Value{}
+	for i, column := range DuckDBDialect.Columns {
+		row[column] = db.rows[0][i+1]
+	}
+	if row["event"] != "Order Completed" || row["timestamp"] != ts || row["sent_at"] != nil || row["traits"] != nil {
+		t.Errorf("Unexpected typed columns %v", row)
+	}
+	if row["properties"] != `{"revenue":9.99}` {
+		t.Errorf("Expected properties json, got %v", row["properties"])
+	}
+}
+
+func TestSQLSourceSyncs(t *testing.T) {
+	dest, db := testSQL(t, 0)
+	var events []SegmentEvent
+	for i := 0; i < 5; i++ {
+		events = append(events, SegmentEvent{SegmentMessage: SegmentMessage{
+			MessageId: fmt.Sprint(i), ProjectId: "p1", Type: "track", Event: "Clicked", Timestamp: time.Now().UTC(),
+		}})
+	}
+	processBatch(t, dest, events...)
+
+	src := NewSQLSource(dest, 2, true)
+	var received []string
+	var last Offset
+	err := src.Start(context.Background(), "2", func(m SegmentEvent, offset Offset) error {
+		received = append(received, m.MessageId)
+		last = offset
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(received, ",") != "2,3,4" || last != "5" {
+		t.Fatalf("Expected events 2-4 after offset 2, got %v at %q", received, last)
+	}
+	if err := src.Commit(context.Background(), last); err != nil {
+		t.Fatal(err)
+	}
+	if db.count() != 0 {
+		t.Errorf("Expected synced rows pruned, got %d", db.count())
+	}
+}
+
+func TestSQLMaterializeInserts(t *testing.T) {
+	dsn, db := newFakeDB(t, 0)
+	dest := NewSQL(&SQLConfig{Driver: "fakesql", DSN: dsn, Dialect: "materialize", BatchConfig: testBatchConfig()})
+	defer dest.Close()
+	processBatch(t, dest,
+		SegmentEvent{SegmentMessage: SegmentMessage{MessageId: "1", ProjectId: "p1", Type: "track", Event: "Signed Up", UserId: "u1"}},
+		SegmentEvent{SegmentMessage: SegmentMessage{MessageId: "2", ProjectId: "p1", Type: "identify", UserId: "u1", Traits: map[string]interface{}{"plan": "pro"}}},
+	)
+
+	stmts := db.executed()
+	if len(stmts) != 1 || strings.Contains(stmts[0], "UNIQUE") {
+		t.Fatalf("Expected table created without keys, got %v", stmts)
+	}
+	if db.count() != 2 || db.rows[1][13] != `{"plan":"pro"}` {
+		t.Fatalf("Expected 2 rows with traits, got %v", db.rows)
+	}
+	if err := NewSQLSource(dest, 0, false).Start(context.Background(), "", nil); err == nil {
+		t.Errorf("Expected source unsupported without ids")
+	}
+}
+
+func TestSQLOutboxRelay(t *testing.T) {
+	dsn, db := newFakeDB(t, 0)
+	dest := NewSQL(&SQLConfig{Driver: "fakesql", DSN: dsn, Outbox: true, BatchConfig: testBatchConfig()})
+	defer dest.Close()
+	if err := (&SQLConfig{Driver: "fakesql", Dialect: "materialize", Outbox: true}).Validate(); err == nil {
+		t.Error("Expected outbox not supported error")
+	}
+	processBatch(t, dest,
+		SegmentEvent{SegmentMessage: SegmentMessage{MessageId: "1", ProjectId: "p1", Type: "track", Event: "Signed Up"}},
+		SegmentEvent{SegmentMessage: SegmentMessage{MessageId: "2", ProjectId: "p1", Type: "track", Event: "Upgraded"}},
+		SegmentEvent{SegmentMessage: SegmentMessage{MessageId: "1", ProjectId: "p1", Type: "track", Event: "Signed Up"}},
+		SegmentEvent{SegmentMessage: SegmentMessage{MessageId: "3", ProjectId: "p1", Type: "track", Event: "Corrupt"}},
+	)
+	db.rows[2][len(db.rows[2])-1] = "{"
+	if stmts := db.executed(); !strings.HasPrefix(stmts[len(stmts)-2], "CREATE TABLE IF NOT EXISTS events_outbox") {
+		t.Fatalf("Expected outbox table created, got %v", stmts)
+	}
+	if db.count() != 3 || len(db.outbox) != 3 {
+		t.Fatalf("Expected a pending outbox row for each event, got %d rows %d outbox", db.count(), len(db.outbox))
+	}
+
+	// The first send fails, so only the events sent before are marked delivered
+	down := &testDestination{err: fmt.Errorf("unavailable")}
+	relay := NewSQLOutboxRelay(dest, SQLOutboxRelayConfig{BatchSize: 10}, func(ctx context.Context, m SegmentEvent) error {
+		return down.Send(ctx, m)
+	})
+	if _, err := relay.relay(context.Background()); err == nil {
+		t.Error("Expected send error")
+	}
+	down.err = nil
+	for i := 0; i < 2; i++ {
+		if _, err := relay.relay(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sent := down.sent()
+	if len(sent) != 2 || sent[0].(SegmentEvent).MessageId != "1" || sent[1].(SegmentEvent).MessageId != "2" {
+		t.Errorf("Expected each event relayed once in order, got %v", sent)
+	}
+	for _, o := range db.outbox {
+		if o[3] == nil || (o[1] == "3") != (o[3] == "failed") {
+			t.Errorf("Expected outbox row %v delivered, or failed if the payload can't be decoded", o)
+		}
+	}
+}
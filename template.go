@@ -0,0 +1,177 @@
+package segment
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// templateMaxBatch is the maximum number of events per request when batching
+const templateMaxBatch = 1000
+
+// templateFuncs are the functions available to request templates in addition to the text/template builtins
+var templateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"base64": func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	},
+	"env":        os.Getenv,
+	"pathescape": url.PathEscape,
+}
+
+// TemplateConfig contains the go templates for the request of a generic json api destination.  Templates
+// are executed over each event, or the slice of events when batching, with json, base64, env and pathescape
+// functions eg:
+//
+//	URL:  "https://api.keen.io/3.0/projects/{{env \"KEEN_PROJECT\"}}/events/{{pathescape .Event}}"
+//	Body: "{{json .Properties}}"
+type TemplateConfig struct {
+	Name    string            `json:"name,omitempty"`   // Destination name for metrics, defaults to "template"
+	URL     string            `json:"url"`              // Request url template
+	Method  string            `json:"method,omitempty"` // Request method template, defaults to POST
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body,omitempty"`  // Request body template, defaults to the json event or events
+	Batch   bool              `json:"batch,omitempty"` // Send batches of events in a request, otherwise a request per event
+	BatchConfig
+}
+
+// Template is a destination sending http requests built from go templates, to configure simple integrations
+type Template struct {
+	Logger  *log.Logger // Public logger that caller can override
+	url     *template.Template
+	method  *template.Template
+	headers map[string]*template.Template
+	body    *template.Template
+	batch   bool
+	batcher *batcher
+}
+
+// NewTemplate creates a new templated http destination given configuration
+func NewTemplate(config *TemplateConfig) *Template {
+	if err := config.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	config.BatchConfig.Name = config.Name // Shadowed by the template name
+	if config.Name == "" {
+		config.Name = "template"
+	}
+	if config.Method == "" {
+		config.Method = http.MethodPost
+	}
+	if config.Body == "" {
+		config.Body = "{{json .}}"
+	}
+	parse := func(name, text string) *template.Template {
+		return template.Must(template.New(name).Funcs(templateFuncs).Option("missingkey=zero").Parse(text))
+	}
+	t := &Template{
+		Logger:  log.New(os.Stderr, "", log.LstdFlags),
+		url:     parse("url", config.URL),
+		method:  parse("method", config.Method),
+		headers: make(map[string]*template.Template),
+		body:    parse("body", config.Body),
+		batch:   config.Batch,
+	}
+	for name, text := range config.Headers {
+		t.headers[name] = parse(name, text)
+	}
+	maxSize := 1
+	if config.Batch {
+		maxSize = templateMaxBatch
+	}
+	t.batcher = newHTTPBatcher(config.Name, config.BatchConfig, maxSize, t.request)
+	return t
+}
+
+// Validate checks the url is set and the templates parse
+func (config *TemplateConfig) Validate() error {
+	if config.URL == "" {
+		return fmt.Errorf("Require template url")
+	}
+	texts := map[string]string{"url": config.URL, "method": config.Method, "body": config.Body}
+	for name, text := range config.Headers {
+		texts[name] = text
+	}
+	for name, text := range texts {
+		if _, err := template.New(name).Funcs(templateFuncs).Parse(text); err != nil {
+			return fmt.Errorf("Template %s error -- %v", name, err)
+		}
+	}
+	return nil
+}
+
+// Name returns the configured destination name
+func (t *Template) Name() string {
+	return t.batcher.configuredName()
+}
+
+// WithLogger adds optional logging
+func (t *Template) WithLogger(logger *log.Logger) Destination {
+	if logger != nil {
+		t.Logger = logger
+	}
+	return t
+}
+
+// Process sends requests for events until ctx is done
+func (t *Template) Process(ctx context.Context) error {
+	return t.batcher.process(ctx, t.Logger)
+}
+
+// Send pushes the message onto the queue
+func (t *Template) Send(ctx context.Context, message interface{}) error {
+	return t.batcher.send(ctx, message)
+}
+
+// executeTemplate returns the template output for data
+func executeTemplate(tmpl *template.Template, data interface{}) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// request builds the request from the templates over the event, or batch of events
+func (t *Template) request(ctx context.Context, batch []SegmentEvent) (*http.Request, error) {
+	var data interface{} = batch
+	if !t.batch {
+		data = batch[0]
+	}
+	u, err := executeTemplate(t.url, data)
+	if err != nil {
+		return nil, err
+	}
+	method, err := executeTemplate(t.method, data)
+	if err != nil {
+		return nil, err
+	}
+	body, err := executeTemplate(t.body, data)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, strings.ToUpper(strings.TrimSpace(method)), strings.TrimSpace(u), strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, tmpl := range t.headers {
+		value, err := executeTemplate(tmpl, data)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set(name, value)
+	}
+	return req, nil
+}
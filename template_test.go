@@ -0,0 +1,52 @@
+package segment
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestTemplateRequestPerEvent(t *testing.T) {
+	intake := newFakeIntake(t, 1)
+	t.Setenv("TEMPLATE_KEY", "secret")
+	config := &TemplateConfig{
+		URL:         intake.URL + "/events/{{pathescape .Event}}?project={{.ProjectId}}",
+		Method:      "put",
+		Headers:     map[string]string{"Authorization": `Basic {{base64 (env "TEMPLATE_KEY")}}`},
+		Body:        `{"name":{{json .Event}},"plan":{{json .Properties.plan}}}`,
+		BatchConfig: testBatchConfig(),
+	}
+	processBatch(t, NewTemplate(config),
+		SegmentEvent{SegmentMessage: SegmentMessage{ProjectId: "p1", Event: "Order Completed", Properties: map[string]interface{}{"plan": "pro"}}},
+		SegmentEvent{SegmentMessage: SegmentMessage{ProjectId: "p1", Event: "Signed Up"}},
+	)
+
+	requests, bodies := intake.received()
+	if len(requests) != 2 {
+		t.Fatalf("Expected a request per event after retry, got %d", len(requests))
+	}
+	if requests[0].Method != "PUT" || requests[0].URL.Path != "/events/Order Completed" || requests[0].URL.Query().Get("project") != "p1" {
+		t.Errorf("Unexpected request %s %s", requests[0].Method, requests[0].URL)
+	}
+	if requests[0].Header.Get("Authorization") != "Basic c2VjcmV0" {
+		t.Errorf("Expected templated header, got %q", requests[0].Header.Get("Authorization"))
+	}
+	var body map[string]interface{}
+	if err := json.Unmarshal(bodies[1], &body); err != nil || body["name"] != "Signed Up" || body["plan"] != nil {
+		t.Errorf("Unexpected body %s", bodies[1])
+	}
+}
+
+func TestTemplateBatch(t *testing.T) {
+	intake := newFakeIntake(t, 0)
+	config := &TemplateConfig{URL: intake.URL + "/batch", Batch: true, BatchConfig: testBatchConfig()}
+	processBatch(t, NewTemplate(config),
+		SegmentEvent{SegmentMessage: SegmentMessage{MessageId: "1"}},
+		SegmentEvent{SegmentMessage: SegmentMessage{MessageId: "2"}},
+	)
+
+	_, bodies := intake.received()
+	var events []SegmentEvent
+	if len(bodies) != 1 || json.Unmarshal(bodies[0], &events) != nil || len(events) != 2 {
+		t.Errorf("Expected json events in one request, got %q", bodies)
+	}
+}
@@ -0,0 +1,151 @@
+package segment
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// timestampLayouts are accepted in addition to RFC3339, without a zone are UTC
+var timestampLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999Z0700",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999Z0700",
+	"2006-01-02 15:04:05.999999999",
+	time.RFC1123Z,
+	time.RFC1123,
+	"2006-01-02",
+}
+
+// ParseTimestamp parses RFC3339 and common ISO 8601 variants in UTC, numeric strings are not parsed as unix timestamps
+// as they are ambiguous eg "2024"
+func ParseTimestamp(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	for _, layout := range timestampLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("Unable to parse timestamp %q", value)
+}
+
+// unixTimestamp returns the time for unix seconds, or milliseconds if too large for seconds
+func unixTimestamp(f float64) time.Time {
+	if math.Abs(f) >= 1e11 {
+		return time.UnixMilli(int64(f)).UTC()
+	}
+	sec, frac := math.Modf(f)
+	return time.Unix(int64(sec), int64(frac*1e9)).UTC()
+}
+
+// timestamp decodes a json string with ParseTimestamp, or a number of unix seconds or milliseconds, in UTC
+type timestamp time.Time
+
+// UnmarshalJSON decodes the timestamp, leaving it unchanged if null
+func (t *timestamp) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		parsed, err := ParseTimestamp(s)
+		if err != nil {
+			return err
+		}
+		*t = timestamp(parsed)
+		return nil
+	}
+	f, err := strconv.ParseFloat(string(b), 64)
+	if err != nil {
+		return fmt.Errorf("Unable to parse timestamp %s", b)
+	}
+	*t = timestamp(unixTimestamp(f))
+	return nil
+}
+
+// message is a SegmentMessage without methods, embedded by the wire types so their timestamp fields take precedence
+type message SegmentMessage
+
+// wireMessage decodes a message with flexible timestamps
+type wireMessage struct {
+	*message
+	Timestamp         *timestamp `json:"timestamp"`
+	SentAt            *timestamp `json:"sentAt"`
+	ReceivedAt        *timestamp `json:"receivedAt"`
+	OriginalTimestamp *timestamp `json:"originalTimestamp"`
+}
+
+// newWireMessage returns a wire message decoding into m
+func newWireMessage(m *SegmentMessage) wireMessage {
+	return wireMessage{
+		message:           (*message)(m),
+		Timestamp:         (*timestamp)(&m.Timestamp),
+		SentAt:            (*timestamp)(&m.SentAt),
+		ReceivedAt:        (*timestamp)(&m.ReceivedAt),
+		OriginalTimestamp: (*timestamp)(&m.OriginalTimestamp),
+	}
+}
+
+// wireEvent decodes an event with flexible timestamps
+type wireEvent struct {
+	WriteKey *string `json:"writeKey"`
+	wireMessage
+}
+
+// wireMessages decodes the messages of a batch with flexible timestamps, rejecting unknown fields if strict
+type wireMessages struct {
+	messages *[]SegmentMessage
+	strict   bool
+}
+
+func (w wireMessages) UnmarshalJSON(b []byte) error {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil || raw == nil {
+		return err
+	}
+	*w.messages = make([]SegmentMessage, len(raw))
+	for i := range raw {
+		decoder := json.NewDecoder(bytes.NewReader(raw[i]))
+		if w.strict {
+			decoder.DisallowUnknownFields()
+		}
+		m := newWireMessage(&(*w.messages)[i])
+		if err := decoder.Decode(&m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// batch is a SegmentBatch without methods
+type batch SegmentBatch
+
+// wireBatch decodes a batch with flexible timestamps
+type wireBatch struct {
+	*batch
+	Timestamp *timestamp   `json:"timestamp"`
+	SentAt    *timestamp   `json:"sentAt"`
+	Messages  wireMessages `json:"batch"`
+}
+
+// wire returns the value decoding into v with flexible timestamps, or v if it has no timestamps
+func wire(v interface{}, strict bool) interface{} {
+	switch v := v.(type) {
+	case *SegmentEvent:
+		return &wireEvent{WriteKey: &v.WriteKey, wireMessage: newWireMessage(&v.SegmentMessage)}
+	case *SegmentBatch:
+		return &wireBatch{
+			batch:     (*batch)(v),
+			Timestamp: (*timestamp)(&v.Timestamp),
+			SentAt:    (*timestamp)(&v.SentAt),
+			Messages:  wireMessages{messages: &v.Messages, strict: strict},
+		}
+	}
+	return v
+}
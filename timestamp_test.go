@@ -0,0 +1,85 @@
+package segment
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTimestamp(t *testing.T) {
+	expected := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, value := range []string{
+		"2024-01-02T03:04:05Z",
+		"2024-01-02T03:04:05",
+		"2024-01-02 03:04:05",
+		"2024-01-02T13:04:05+1000",
+	} {
+		ts, err := ParseTimestamp(value)
+		if err != nil {
+			t.Errorf("Unexpected error for %q -- %v", value, err)
+		} else if !ts.Equal(expected) || ts.Location() != time.UTC {
+			t.Errorf("Expected %s for %q, got %s", expected, value, ts)
+		}
+	}
+	for _, value := range []string{"yesterday", "2024", "1704164645"} {
+		if _, err := ParseTimestamp(value); err == nil {
+			t.Errorf("Expected error for %q", value)
+		}
+	}
+}
+
+func TestDecodeFlexibleTimestamps(t *testing.T) {
+	s := NewSegment(nil, nil, nil).WithDecodeMode(DecodeStrict)
+	var batch SegmentBatch
+	body := `{"sentAt":1704164645,"batch":[{"timestamp":"2024-01-02 03:04:05","event":"Test"},{"timestamp":"2024-01-02T13:04:05+10:00"}]}`
+	if err := s.decode(strings.NewReader(body), &batch); err != nil {
+		t.Fatal(err)
+	}
+	expected := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	if !batch.SentAt.Equal(expected) || !batch.Messages[0].Timestamp.Equal(expected) {
+		t.Errorf("Expected timestamps %s, got %s and %s", expected, batch.SentAt, batch.Messages[0].Timestamp)
+	}
+	if ts := batch.Messages[1].Timestamp; ts != expected {
+		t.Errorf("Expected offset converted to UTC, got %s", ts)
+	}
+
+	// Events keep the writeKey and prefilled fields, and reject unknown fields and numeric strings when strict
+	event := SegmentEvent{SegmentMessage: SegmentMessage{Type: "track"}}
+	if err := s.decode(strings.NewReader(`{"writeKey":"web","timestamp":1704164645000}`), &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.WriteKey != "web" || event.Type != "track" || event.Timestamp != expected {
+		t.Errorf("Expected decoded event, got %+v", event)
+	}
+	for _, body := range []string{
+		`{"timestamp":"2024"}`,
+		`{"batch":[{"timestamp":"2024-01-02","unknown":1}]}`,
+	} {
+		if err := s.decode(strings.NewReader(body), &SegmentBatch{}); err == nil {
+			t.Errorf("Expected error decoding %s", body)
+		}
+	}
+}
+
+func TestStampReceived(t *testing.T) {
+	received := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	clientSkew := time.Hour // Client clock is an hour fast
+	m := SegmentEvent{SegmentMessage: SegmentMessage{
+		Timestamp: received.Add(clientSkew - time.Minute), // Event a minute before sending
+		SentAt:    received.Add(clientSkew),
+	}}
+	original := m.Timestamp
+	stampReceived(&m, received)
+	if !m.ReceivedAt.Equal(received) || !m.OriginalTimestamp.Equal(original) {
+		t.Errorf("Expected receivedAt and originalTimestamp preserved, got %s and %s", m.ReceivedAt, m.OriginalTimestamp)
+	}
+	if expected := received.Add(-time.Minute); !m.Timestamp.Equal(expected) {
+		t.Errorf("Expected skew corrected timestamp %s, got %s", expected, m.Timestamp)
+	}
+
+	// Stamping again eg on replay is idempotent
+	stampReceived(&m, received.Add(time.Hour))
+	if expected := received.Add(-time.Minute); !m.Timestamp.Equal(expected) || !m.ReceivedAt.Equal(received) {
+		t.Errorf("Expected stamping to be idempotent, got %s", m.Timestamp)
+	}
+}
@@ -0,0 +1,42 @@
+package segment
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// latencyBuckets are the latency histogram buckets from 5ms to 40s
+var latencyBuckets = prometheus.ExponentialBuckets(0.005, 2, 14)
+
+// Tracer starts a span for a destination write eg with OpenTelemetry, returning the span context, the trace id
+// attached as an exemplar to the latency metric, and a func to end the span with the write error:
+//
+//	func(ctx context.Context, name string) (context.Context, string, func(error)) {
+//		ctx, span := otel.Tracer("segment").Start(ctx, name)
+//		return ctx, span.SpanContext().TraceID().String(), func(err error) {
+//			if err != nil {
+//				span.RecordError(err)
+//			}
+//			span.End()
+//		}
+//	}
+type Tracer func(ctx context.Context, name string) (context.Context, string, func(error))
+
+// startSpan starts a span with the tracer, or returns ctx with no trace id if tracer is nil
+func startSpan(tracer Tracer, ctx context.Context, name string) (context.Context, string, func(error)) {
+	if tracer == nil {
+		return ctx, "", func(error) {}
+	}
+	return tracer(ctx, name)
+}
+
+// observeLatency observes the duration, with the trace id as an exemplar if set
+func observeLatency(observer prometheus.Observer, duration time.Duration, traceId string) {
+	if eo, ok := observer.(prometheus.ExemplarObserver); ok && traceId != "" {
+		eo.ObserveWithExemplar(duration.Seconds(), prometheus.Labels{"trace_id": traceId})
+		return
+	}
+	observer.Observe(duration.Seconds())
+}
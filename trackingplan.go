@@ -0,0 +1,303 @@
+package segment
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Tracking plan violation types
+const (
+	ViolationUnplanned = "unplanned_event"  // Event name not in the plan
+	ViolationMissing   = "missing_property" // Required property not set
+	ViolationType      = "type_mismatch"    // Property has a different json type
+)
+
+// PlanProperty is the json type of a property or trait eg "string", empty for any, and whether it is required
+type PlanProperty struct {
+	Type     string `json:"type,omitempty"`
+	Required bool   `json:"required,omitempty"`
+}
+
+// PlanEvent is an allowed event name, or page name or type eg "identify", with the properties, or traits for
+// identify and group, by dotted path
+type PlanEvent struct {
+	Name       string                  `json:"name"`
+	Properties map[string]PlanProperty `json:"properties,omitempty"`
+}
+
+// TrackingPlan is a version of the allowed events for a project
+type TrackingPlan struct {
+	ProjectId      string      `json:"projectId"`
+	Version        int         `json:"version"` // Assigned on upload
+	Created        time.Time   `json:"created"`
+	Author         string      `json:"author,omitempty"`
+	Events         []PlanEvent `json:"events"`
+	AllowUnplanned bool        `json:"allowUnplanned,omitempty"` // Allow events not in the plan
+	// Block returns violations as errors, so events are quarantined or dropped, otherwise they are added to
+	// context.violations and the event is sent
+	Block bool `json:"block,omitempty"`
+}
+
+// PlanViolation is a difference between an event and its tracking plan
+type PlanViolation struct {
+	Type     string `json:"type"`
+	Event    string `json:"event"`
+	Property string `json:"property,omitempty"`
+	Expected string `json:"expected,omitempty"`
+	Actual   string `json:"actual,omitempty"`
+}
+
+// TrackingPlans stores versioned tracking plans per project, and validates events against the latest version
+type TrackingPlans struct {
+	mu     sync.Mutex
+	store  ArchiveStore
+	latest map[string]*TrackingPlan // projectId to latest plan, nil if none
+	metric *prometheus.CounterVec
+}
+
+// NewTrackingPlans creates tracking plans kept in store, with the violation metric registered against reg, or the
+// default if nil
+func NewTrackingPlans(store ArchiveStore, reg prometheus.Registerer) *TrackingPlans {
+	return &TrackingPlans{
+		store:  store,
+		latest: make(map[string]*TrackingPlan),
+		metric: newCounterVec(reg, prometheus.CounterOpts{
+			Name: "tracking_plan_violations_total",
+			Help: "Tracking plan violations total by type",
+		}, "type"),
+	}
+}
+
+// planKey returns the store key of a plan version, zero padded so keys list in version order
+func planKey(projectId string, version int) string {
+	return fmt.Sprintf("plans/%s/%08d.json", projectId, version)
+}
+
+// Versions returns every version of the plans for a project in order
+func (p *TrackingPlans) Versions(ctx context.Context, projectId string) ([]TrackingPlan, error) {
+	keys, err := p.store.List(ctx, "plans/"+projectId+"/")
+	if err != nil {
+		return nil, fmt.Errorf("Tracking plan list error -- %v", err)
+	}
+	plans := make([]TrackingPlan, 0, len(keys))
+	for _, key := range keys {
+		data, err := p.store.Get(ctx, key)
+		if err != nil {
+			return nil, fmt.Errorf("Tracking plan get error -- %v", err)
+		}
+		var plan TrackingPlan
+		if err := json.Unmarshal(data, &plan); err != nil {
+			return nil, fmt.Errorf("Tracking plan %s decode error -- %v", key, err)
+		}
+		plans = append(plans, plan)
+	}
+	return plans, nil
+}
+
+// Get returns a version of the plan for a project, or the latest if version is zero
+func (p *TrackingPlans) Get(ctx context.Context, projectId string, version int) (*TrackingPlan, error) {
+	plans, err := p.Versions(ctx, projectId)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(plans) - 1; i >= 0; i-- {
+		if version == 0 || plans[i].Version == version {
+			return &plans[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// Put stores the plan as the next version for its project, which is then used for validation
+func (p *TrackingPlans) Put(ctx context.Context, plan TrackingPlan) (*TrackingPlan, error) {
+	if plan.ProjectId == "" || strings.ContainsAny(plan.ProjectId, "/.") {
+		return nil, fmt.Errorf("Tracking plan requires valid projectId")
+	}
+	for _, event := range plan.Events {
+		if event.Name == "" {
+			return nil, fmt.Errorf("Tracking plan event requires name")
+		}
+		for path, property := range event.Properties {
+			switch property.Type {
+			case "", "string", "number", "boolean", "array", "object", "null":
+			default:
+				return nil, fmt.Errorf("Tracking plan event %s property %s unknown type %s", event.Name, path, property.Type)
+			}
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	latest, err := p.Get(ctx, plan.ProjectId, 0)
+	if err != nil {
+		return nil, err
+	}
+	plan.Version = 1
+	if latest != nil {
+		plan.Version = latest.Version + 1
+	}
+	plan.Created = time.Now().UTC()
+	data, err := json.Marshal(plan)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.store.Put(ctx, planKey(plan.ProjectId, plan.Version), data); err != nil {
+		return nil, fmt.Errorf("Tracking plan put error -- %v", err)
+	}
+	p.latest[plan.ProjectId] = &plan
+	return &plan, nil
+}
+
+// plan returns the cached latest plan for a project, loading it from the store on first use
+func (p *TrackingPlans) plan(ctx context.Context, projectId string) (*TrackingPlan, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if plan, ok := p.latest[projectId]; ok {
+		return plan, nil
+	}
+	plan, err := p.Get(ctx, projectId, 0)
+	if err != nil {
+		return nil, err
+	}
+	p.latest[projectId] = plan
+	return plan, nil
+}
+
+// Validate returns the violations of the event against a plan
+func (plan *TrackingPlan) Validate(m *SegmentEvent) []PlanViolation {
+	name := eventName(m.SegmentMessage)
+	var event *PlanEvent
+	for i := range plan.Events {
+		if plan.Events[i].Name == name {
+			event = &plan.Events[i]
+			break
+		}
+	}
+	if event == nil {
+		if plan.AllowUnplanned {
+			return nil
+		}
+		return []PlanViolation{{Type: ViolationUnplanned, Event: name}}
+	}
+
+	properties := m.Properties
+	if m.Type == "identify" || m.Type == "i" || m.Type == "group" || m.Type == "g" {
+		properties = m.Traits
+	}
+	var violations []PlanViolation
+	for path, property := range event.Properties {
+		value := lookupPath(properties, path)
+		switch {
+		case value == nil && property.Required:
+			violations = append(violations, PlanViolation{Type: ViolationMissing, Event: name, Property: path})
+		case value != nil && property.Type != "" && jsonType(value) != property.Type:
+			violations = append(violations, PlanViolation{
+				Type:     ViolationType,
+				Event:    name,
+				Property: path,
+				Expected: property.Type,
+				Actual:   jsonType(value),
+			})
+		}
+	}
+	return violations
+}
+
+// Transform validates events against the latest plan for their project, returning an error for violations if
+// the plan blocks, or otherwise adding them to context.violations.  Projects without a plan aren't validated.
+func (p *TrackingPlans) Transform(ctx context.Context, m *SegmentEvent) error {
+	plan, err := p.plan(ctx, m.ProjectId)
+	if err != nil || plan == nil {
+		return err
+	}
+	violations := plan.Validate(m)
+	if len(violations) == 0 {
+		return nil
+	}
+	if !DryRun(ctx) {
+		for _, v := range violations {
+			p.metric.WithLabelValues(v.Type).Inc()
+		}
+	}
+	if plan.Block {
+		v := violations[0]
+		return fmt.Errorf("Tracking plan v%d violation -- %s %s %s", plan.Version, v.Type, v.Event, v.Property)
+	}
+	list := make([]interface{}, len(violations))
+	for i, v := range violations {
+		list[i] = map[string]interface{}{"type": v.Type, "event": v.Event, "property": v.Property}
+	}
+	m.Context = cloneMap(m.Context)
+	m.Context["violations"] = list
+	return nil
+}
+
+// MountTrackingPlans adds GET and POST /plans/{projectId} to list or upload versions of tracking plans, and
+// GET /plans/{projectId}/{version} for a version or "latest", to an admin router
+func (s *Segment) MountTrackingPlans(router *mux.Router, auth Authorizer, plans *TrackingPlans) *Segment {
+	s.Logger.Println("Adding tracking plan handlers")
+	router.Handle("/plans/{projectId}", s.adminHandler(auth, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		projectId := mux.Vars(r)["projectId"]
+		if r.Method == "GET" {
+			versions, err := plans.Versions(r.Context(), projectId)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, "store_error", err.Error())
+				return
+			}
+			json.NewEncoder(w).Encode(versions)
+			return
+		}
+
+		var plan TrackingPlan
+		if err := json.NewDecoder(r.Body).Decode(&plan); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON: "+err.Error())
+			return
+		}
+		plan.ProjectId = projectId
+		plan.Author, _ = auth(r)
+		saved, err := plans.Put(r.Context(), plan)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_plan", err.Error())
+			return
+		}
+		s.audit.Record(AuditTrackingPlan, plan.Author, s.clientIP(r), map[string]string{
+			"projectId": projectId,
+			"version":   strconv.Itoa(saved.Version),
+		})
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(saved)
+	}))).Methods("GET", "POST")
+	router.Handle("/plans/{projectId}/{version}", s.adminHandler(auth, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		vars := mux.Vars(r)
+		version := 0
+		if vars["version"] != "latest" {
+			var err error
+			if version, err = strconv.Atoi(vars["version"]); err != nil || version < 1 {
+				writeError(w, http.StatusBadRequest, "invalid_request", "Expected version number or latest")
+				return
+			}
+		}
+		plan, err := plans.Get(r.Context(), vars["projectId"], version)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "store_error", err.Error())
+			return
+		}
+		if plan == nil {
+			writeError(w, http.StatusNotFound, "not_found", "Tracking plan not found")
+			return
+		}
+		json.NewEncoder(w).Encode(plan)
+	}))).Methods("GET")
+	return s
+}
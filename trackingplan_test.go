@@ -0,0 +1,86 @@
+package segment
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestTrackingPlans(t *testing.T) {
+	plans := NewTrackingPlans(NewLocalArchiveStore(t.TempDir()), nil)
+	dest := &testDestination{}
+	router := mux.NewRouter()
+	s := NewSegment(func(writeKey string) string { return writeKey }, []Destination{dest}, router).WithTransforms(plans.Transform)
+	admin := router.PathPrefix("/admin").Subrouter()
+	s.MountTrackingPlans(admin, BasicAuthorizer("admin", "secret"), plans)
+
+	upload := func(plan string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/admin/plans/web", strings.NewReader(plan))
+		req.SetBasicAuth("admin", "secret")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	track := func(body string) int {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/track", strings.NewReader(body)))
+		return w.Code
+	}
+
+	// Report violations in context with the first version
+	if w := upload(`{"events":[{"name":"Order Completed","properties":{"total":{"type":"number","required":true}}}]}`); w.Code != http.StatusCreated {
+		t.Fatalf("Expected plan created, got %d %s", w.Code, w.Body.String())
+	}
+	if code := track(`{"writeKey":"web","event":"Order Completed","properties":{"total":"10"}}`); code != http.StatusOK {
+		t.Errorf("Expected reported violation sent, got %d", code)
+	}
+	sent := dest.sent()
+	if len(sent) != 1 {
+		t.Fatalf("Expected 1 event, got %d", len(sent))
+	}
+	violations, _ := sent[0].(SegmentEvent).Context["violations"].([]interface{})
+	if len(violations) != 1 || violations[0].(map[string]interface{})["type"] != ViolationType {
+		t.Errorf("Expected type violation, got %v", sent[0].(SegmentEvent).Context)
+	}
+
+	// Block violations with the second version
+	if w := upload(`{"block":true,"events":[{"name":"Order Completed","properties":{"total":{"type":"number","required":true}}}]}`); w.Code != http.StatusCreated {
+		t.Fatalf("Expected plan created, got %d", w.Code)
+	}
+	for body, expected := range map[string]int{
+		`{"writeKey":"web","event":"Order Completed","properties":{"total":10}}`: http.StatusOK,
+		`{"writeKey":"web","event":"Order Completed","properties":{}}`:           http.StatusInternalServerError,
+		`{"writeKey":"web","event":"Unplanned"}`:                                 http.StatusInternalServerError,
+		`{"writeKey":"other","event":"Unplanned"}`:                               http.StatusOK, // No plan
+	} {
+		if code := track(body); code != expected {
+			t.Errorf("Expected %d for %s, got %d", expected, body, code)
+		}
+	}
+
+	// List versions, and get a version
+	req := httptest.NewRequest("GET", "/admin/plans/web", nil)
+	req.SetBasicAuth("admin", "secret")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	var versions []TrackingPlan
+	if err := json.Unmarshal(w.Body.Bytes(), &versions); err != nil || len(versions) != 2 || versions[1].Version != 2 || versions[1].Author != "admin" {
+		t.Errorf("Expected 2 versions, got %s", w.Body.String())
+	}
+	req = httptest.NewRequest("GET", "/admin/plans/web/1", nil)
+	req.SetBasicAuth("admin", "secret")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	var plan TrackingPlan
+	if err := json.Unmarshal(w.Body.Bytes(), &plan); err != nil || plan.Version != 1 || plan.Block {
+		t.Errorf("Expected version 1, got %s", w.Body.String())
+	}
+
+	if w := upload(`{"events":[{"name":"Bad","properties":{"x":{"type":"integer"}}}]}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected invalid plan rejected, got %d", w.Code)
+	}
+}
@@ -0,0 +1,96 @@
+package segment
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// TraitCache merges identify traits per user, so identify events carry all known traits
+// and other events carry them in context.traits
+type TraitCache struct {
+	mu    sync.Mutex
+	cache *lruCache[map[string]interface{}]
+}
+
+// NewTraitCache creates a cache of up to size users, expiring traits after ttl if not zero
+func NewTraitCache(size int, ttl time.Duration) *TraitCache {
+	return &TraitCache{cache: newLRUCache[map[string]interface{}](size, ttl)}
+}
+
+func traitKey(projectId, id string) string {
+	return projectId + "/" + id
+}
+
+// Traits returns a copy of the cached traits for a user or anonymous id
+func (c *TraitCache) Traits(projectId, id string) map[string]interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if traits, ok := c.cache.get(traitKey(projectId, id)); ok {
+		return cloneMap(traits)
+	}
+	return nil
+}
+
+// merge adds traits for key, and returns the merged copy
+func (c *TraitCache) merge(key string, traits map[string]interface{}) map[string]interface{} {
+	merged, ok := c.cache.get(key)
+	if !ok {
+		merged = make(map[string]interface{})
+	}
+	for k, v := range traits {
+		merged[k] = v
+	}
+	c.cache.put(key, merged)
+	return cloneMap(merged)
+}
+
+// Transform merges identify traits into the cache, and adds cached traits to other events
+func (c *TraitCache) Transform(ctx context.Context, m *SegmentEvent) error {
+	id := m.UserId
+	if id == "" {
+		id = m.AnonymousId
+	}
+	if id == "" {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := traitKey(m.ProjectId, id)
+	if m.Type == "identify" || m.Type == "i" {
+		if DryRun(ctx) {
+			// Show the merged traits without updating the cache
+			if cached, ok := c.cache.get(key); ok {
+				traits := cloneMap(cached)
+				for k, v := range m.Traits {
+					traits[k] = v
+				}
+				m.Traits = traits
+			}
+			return nil
+		}
+		// Carry over anonymous traits when the user is identified
+		if m.UserId != "" && m.AnonymousId != "" {
+			if anon, ok := c.cache.get(traitKey(m.ProjectId, m.AnonymousId)); ok {
+				c.merge(key, anon)
+			}
+		}
+		m.Traits = c.merge(key, m.Traits)
+		return nil
+	}
+
+	cached, ok := c.cache.get(key)
+	if !ok {
+		return nil
+	}
+	traits := cloneMap(cached)
+	if existing, ok := m.Context["traits"].(map[string]interface{}); ok {
+		for k, v := range existing {
+			traits[k] = v // Event context traits take precedence
+		}
+	}
+	m.Context = cloneMap(m.Context)
+	m.Context["traits"] = traits
+	return nil
+}
@@ -0,0 +1,27 @@
+package segment
+
+import (
+	"context"
+	"testing"
+)
+
+func TestTraitCache(t *testing.T) {
+	c := NewTraitCache(10, 0)
+	ctx := context.Background()
+	identify := func(traits map[string]interface{}) *SegmentEvent {
+		return &SegmentEvent{SegmentMessage: SegmentMessage{ProjectId: "p", Type: "identify", UserId: "u", Traits: traits}}
+	}
+
+	c.Transform(ctx, identify(map[string]interface{}{"name": "Ann", "plan": "free"}))
+	m := identify(map[string]interface{}{"plan": "pro"})
+	c.Transform(ctx, m)
+	if m.Traits["name"] != "Ann" || m.Traits["plan"] != "pro" {
+		t.Errorf("Expected merged traits, got %v", m.Traits)
+	}
+
+	track := &SegmentEvent{SegmentMessage: SegmentMessage{ProjectId: "p", Type: "track", UserId: "u"}}
+	c.Transform(ctx, track)
+	if traits, _ := track.Context["traits"].(map[string]interface{}); traits["plan"] != "pro" {
+		t.Errorf("Expected context traits on track, got %v", track.Context)
+	}
+}
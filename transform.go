@@ -0,0 +1,46 @@
+package segment
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrDropEvent is returned by a transform to drop an event without error
+var ErrDropEvent = errors.New("Drop event")
+
+// Transform modifies an event before it is sent to destinations, returning ErrDropEvent to drop it.
+// Maps may be shared between events in a batch, so transforms should copy before modifying.
+type Transform func(ctx context.Context, event *SegmentEvent) error
+
+// WithTransforms appends transforms applied in order to every event
+func (s *Segment) WithTransforms(transforms ...Transform) *Segment {
+	s.transforms = append(s.transforms, transforms...)
+	return s
+}
+
+// transform applies the transforms in order, returning false if the event was dropped
+func (s *Segment) transform(ctx context.Context, m *SegmentEvent) (bool, error) {
+	return applyTransforms(ctx, s.transforms, m)
+}
+
+// applyTransforms applies transforms in order, returning false if the event was dropped
+func applyTransforms(ctx context.Context, transforms []Transform, m *SegmentEvent) (bool, error) {
+	for _, t := range transforms {
+		if err := t(ctx, m); err != nil {
+			if errors.Is(err, ErrDropEvent) {
+				return false, nil
+			}
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// cloneMap returns a shallow copy of m, or an empty map if nil
+func cloneMap(m map[string]interface{}) map[string]interface{} {
+	c := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
@@ -0,0 +1,92 @@
+package segment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// checkTimeout bounds each config check, eg resolving credentials or reaching an endpoint
+const checkTimeout = 10 * time.Second
+
+// AWS stream names, firehose names are limited to 64 characters and kinesis to 128
+var (
+	firehoseStreamName = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,64}$`)
+	kinesisStreamName  = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,128}$`)
+)
+
+// ConfigValidator is a config that can be validated without creating a destination, which would log.Fatal
+type ConfigValidator interface {
+	Validate() error
+}
+
+// ConfigChecker is a config that can also check its dependencies eg credentials resolve and endpoints are reachable
+type ConfigChecker interface {
+	Check(ctx context.Context) error
+}
+
+// ValidateConfig validates each config, and if check is true checks the dependencies of valid configs, returning
+// all errors, so a deploy with bad config fails in CI rather than at startup
+func ValidateConfig(ctx context.Context, check bool, configs ...ConfigValidator) error {
+	var errs []error
+	for _, config := range configs {
+		name := fmt.Sprintf("%T", config)
+		if err := config.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("%s invalid -- %v", name, err))
+			continue
+		}
+		if checker, ok := config.(ConfigChecker); ok && check {
+			ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+			err := checker.Check(ctx)
+			cancel()
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s check failed -- %v", name, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// validateEndpoint returns an error unless endpoint is an http(s) url
+func validateEndpoint(endpoint string) error {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("Expect http(s) endpoint: %q", endpoint)
+	}
+	return nil
+}
+
+// checkEndpoint returns an error if the endpoint can't be reached, any response is considered reachable
+func checkEndpoint(ctx context.Context, endpoint string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("Endpoint unreachable -- %v", err)
+	}
+	res.Body.Close()
+	return nil
+}
+
+// checkCredentials returns an error if the session credentials can't be resolved
+func checkCredentials(ctx context.Context, sess *session.Session) error {
+	if _, err := sess.Config.Credentials.GetWithContext(ctx); err != nil {
+		return fmt.Errorf("AWS credentials error -- %v", err)
+	}
+	return nil
+}
+
+// resourceNotFound returns true if the AWS error is a missing resource
+func resourceNotFound(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == "ResourceNotFoundException"
+}
@@ -0,0 +1,54 @@
+package segment
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestValidateConfig(t *testing.T) {
+	err := ValidateConfig(context.Background(), false,
+		&DeliveryConfig{StreamRegion: "us-west-2", StreamName: "events"},
+		&DeliveryConfig{StreamRegion: "us-west-2"},
+		&DeliveryConfig{StreamRegion: "us-west-2", StreamName: "bad name"},
+		&DeliveryConfig{StreamRegion: "us-west-2", RedshiftStreaming: true, KinesisSourceStream: "events", PackRecords: true},
+		&ForwarderConfig{Endpoint: "tcp://localhost"},
+		&TemplateConfig{URL: "http://localhost/{{.Event"},
+		&SQLConfig{Driver: "unknown"},
+		&DatadogConfig{APIKey: "key"},
+	)
+	if err == nil {
+		t.Fatal("Expected errors")
+	}
+	errs := strings.Split(err.Error(), "\n")
+	if len(errs) != 6 {
+		t.Fatalf("Expected 6 errors, got %v", errs)
+	}
+	for i, expected := range []string{"region and name", "Invalid firehose stream name", "redshift streaming",
+		"http(s) endpoint", "Template url error", "Unsupported sql dialect"} {
+		if !strings.Contains(errs[i], expected) {
+			t.Errorf("Expected %q, got %q", expected, errs[i])
+		}
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	f := newFakeFirehose(t)
+	f.missing = true
+
+	// Missing firehose stream is created on connect, but the kinesis source must exist
+	f.kinesis = true
+	err := ValidateConfig(context.Background(), true,
+		&DeliveryConfig{StreamEndpoint: f.URL, StreamRegion: "us-west-2", StreamName: "events"},
+		&DeliveryConfig{StreamEndpoint: f.URL, StreamRegion: "us-west-2", StreamName: "events", KinesisSourceStream: "source"},
+		&ForwarderConfig{Endpoint: f.URL},
+		&ForwarderConfig{Endpoint: "http://127.0.0.1:1"},
+	)
+	if err == nil {
+		t.Fatal("Expected errors")
+	}
+	errs := strings.Split(err.Error(), "\n")
+	if len(errs) != 2 || !strings.Contains(errs[0], "Kinesis stream error") || !strings.Contains(errs[1], "unreachable") {
+		t.Errorf("Unexpected errors %v", errs)
+	}
+}
@@ -0,0 +1,91 @@
+package segment
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Connector is implemented by destinations that connect before processing
+type Connector interface {
+	Connect() error
+}
+
+// ContextConnector is implemented by destinations whose connect can be cancelled, and is preferred to Connect
+type ContextConnector interface {
+	ConnectContext(ctx context.Context) error
+}
+
+// WarmUpConfig controls connecting destinations before accepting traffic
+type WarmUpConfig struct {
+	Timeout  time.Duration `json:"timeout,omitempty"`  // Defaults to 30 seconds
+	FailFast bool          `json:"failFast,omitempty"` // Return error rather than accept traffic in degraded mode
+}
+
+// WithWarmUp gates the routes until destinations have connected in Run
+func (s *Segment) WithWarmUp(config WarmUpConfig) *Segment {
+	if config.Timeout <= 0 {
+		config.Timeout = time.Second * 30
+	}
+	s.warmUp = &config
+	s.notReady.Store(true)
+	return s
+}
+
+// Ready returns true once warm up has completed and routes accept traffic
+func (s *Segment) Ready() bool {
+	return !s.notReady.Load()
+}
+
+// WarmUp connects all destinations in parallel within the timeout, and then marks the routes ready.
+// Unless FailFast is set, connect errors are logged and traffic is accepted in degraded mode.
+func (s *Segment) WarmUp(ctx context.Context) error {
+	config := WarmUpConfig{Timeout: time.Second * 30}
+	if s.warmUp != nil {
+		config = *s.warmUp
+	}
+	ctx, cancel := context.WithTimeout(ctx, config.Timeout)
+	defer cancel()
+
+	errs := make(chan error, len(s.destinations))
+	for _, dest := range s.destinations {
+		go func(dest *destination) {
+			done := make(chan error, 1)
+			if connector, ok := dest.Destination.(ContextConnector); ok {
+				go func() { done <- connector.ConnectContext(ctx) }()
+			} else if connector, ok := dest.Destination.(Connector); ok {
+				go func() { done <- connector.Connect() }()
+			} else {
+				errs <- nil
+				return
+			}
+			select {
+			case err := <-done:
+				if err != nil {
+					err = fmt.Errorf("Warm up %s error -- %v", dest.name, err)
+				}
+				errs <- err
+			case <-ctx.Done():
+				errs <- fmt.Errorf("Warm up %s timeout -- %v", dest.name, ctx.Err())
+			}
+		}(dest)
+	}
+
+	var first error
+	for range s.destinations {
+		if err := <-errs; err != nil {
+			s.Logger.Println(err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	if first != nil && config.FailFast {
+		return first
+	}
+	if first != nil {
+		s.Logger.Println("Warm up incomplete, accepting traffic in degraded mode")
+	}
+	s.notReady.Store(false)
+	return nil
+}
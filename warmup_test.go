@@ -0,0 +1,41 @@
+package segment
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// connectDestination fails to connect with err
+type connectDestination struct {
+	testDestination
+	connectErr error
+}
+
+func (d *connectDestination) Connect() error {
+	return d.connectErr
+}
+
+func TestWarmUpFailFast(t *testing.T) {
+	router := mux.NewRouter()
+	dest := &connectDestination{connectErr: errors.New("Unreachable")}
+	s := NewSegment(func(writeKey string) string { return writeKey }, []Destination{dest}, router).
+		WithWarmUp(WarmUpConfig{Timeout: time.Second, FailFast: true})
+
+	// The connect error is returned to the caller rather than exiting, and routes are not ready
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := s.Run(ctx); err == nil {
+		t.Fatal("Expected warm up error")
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/track", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 not ready, got %d", w.Code)
+	}
+}
@@ -0,0 +1,150 @@
+package segment
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// WatchdogConfig contains the threshold a destination send may block for before it is reported as stalled
+type WatchdogConfig struct {
+	Threshold time.Duration `json:"threshold,omitempty"` // Defaults to 10 seconds
+	Interval  time.Duration `json:"interval,omitempty"`  // Check interval, defaults to 1 second
+	// TripBreaker marks a stalled destination unhealthy until its sends complete, so events are spooled
+	TripBreaker bool `json:"tripBreaker,omitempty"`
+	// DumpStacks logs the goroutine stacks when a destination first stalls, to diagnose where it blocked
+	DumpStacks bool `json:"dumpStacks,omitempty"`
+	// Registerer for metrics, defaults to the prometheus default registerer
+	Registerer prometheus.Registerer `json:"-"`
+}
+
+// Watchdog measures how long each destination send has blocked, reporting destinations stalled beyond the
+// threshold.  A Process that stops consuming shows up as sends blocked on its full queue.
+type Watchdog struct {
+	mu      sync.Mutex
+	config  WatchdogConfig
+	stalled map[*destination]bool // Destinations reported stalled, until their sends complete
+	tripped map[*destination]bool // Destinations marked unhealthy by the watchdog
+	stall   *prometheus.GaugeVec
+	stalls  *prometheus.CounterVec
+}
+
+// NewWatchdog creates a watchdog given config defaults
+func NewWatchdog(config WatchdogConfig) *Watchdog {
+	if config.Threshold <= 0 {
+		config.Threshold = 10 * time.Second
+	}
+	if config.Interval <= 0 {
+		config.Interval = time.Second
+	}
+	return &Watchdog{
+		config:  config,
+		stalled: make(map[*destination]bool),
+		tripped: make(map[*destination]bool),
+		stall: newGaugeVec(config.Registerer, prometheus.GaugeOpts{
+			Name: "destination_stall_seconds",
+			Help: "Seconds the longest send in progress has blocked by destination",
+		}, "destination"),
+		stalls: newCounterVec(config.Registerer, prometheus.CounterOpts{
+			Name: "destination_stalls_total",
+			Help: "Destination sends blocked beyond the watchdog threshold total",
+		}, "destination"),
+	}
+}
+
+// WithWatchdog checks destinations for stalled sends while running
+func (s *Segment) WithWatchdog(watchdog *Watchdog) *Segment {
+	s.watchdog = watchdog
+	return s
+}
+
+// inflight tracks the start of sends in progress, to measure how long a destination has blocked
+type inflight struct {
+	mu     sync.Mutex
+	next   uint64
+	starts map[uint64]time.Time
+}
+
+// start records a send starting at now, returning a func to call when it completes
+func (f *inflight) start(now time.Time) func() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.starts == nil {
+		f.starts = make(map[uint64]time.Time)
+	}
+	id := f.next
+	f.next++
+	f.starts[id] = now
+	return func() {
+		f.mu.Lock()
+		delete(f.starts, id)
+		f.mu.Unlock()
+	}
+}
+
+// oldest returns the start of the longest send in progress, or false if none
+func (f *inflight) oldest() (time.Time, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var oldest time.Time
+	for _, start := range f.starts {
+		if oldest.IsZero() || start.Before(oldest) {
+			oldest = start
+		}
+	}
+	return oldest, !oldest.IsZero()
+}
+
+// runWatchdog checks for stalled destinations every interval until ctx is done
+func (s *Segment) runWatchdog(ctx context.Context) {
+	ticker := time.NewTicker(s.watchdog.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.checkStalls(s.clock.Now())
+		}
+	}
+}
+
+// checkStalls reports destinations whose longest send in progress exceeds the threshold, tripping the breaker if
+// configured, and restores them once their sends complete
+func (s *Segment) checkStalls(now time.Time) {
+	w := s.watchdog
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, dest := range s.destinations {
+		var stall time.Duration
+		if start, ok := dest.inflight.oldest(); ok {
+			stall = now.Sub(start)
+		}
+		w.stall.WithLabelValues(dest.name).Set(stall.Seconds())
+		switch {
+		case stall > w.config.Threshold && !w.stalled[dest]:
+			w.stalled[dest] = true
+			w.stalls.WithLabelValues(dest.name).Inc()
+			s.Logger.Printf("Destination %s stalled, send blocked for %s\n", dest.name, stall)
+			s.monitor.Emit(MonitorDestinationStalled, map[string]interface{}{"destination": dest.name, "stallSeconds": stall.Seconds()})
+			if w.config.DumpStacks {
+				buf := make([]byte, 1<<20)
+				s.Logger.Printf("Goroutine stacks:\n%s\n", buf[:runtime.Stack(buf, true)])
+			}
+			if w.config.TripBreaker && dest.Healthy() {
+				w.tripped[dest] = true
+				s.setHealthy(dest, false)
+			}
+		case stall <= w.config.Threshold && w.stalled[dest]:
+			delete(w.stalled, dest)
+			s.Logger.Printf("Destination %s recovered from stall\n", dest.name)
+			if w.tripped[dest] {
+				delete(w.tripped, dest)
+				s.setHealthy(dest, true)
+			}
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package segment
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestWatchdogStall(t *testing.T) {
+	dest := &blockingDestination{started: make(chan struct{}, 1), release: make(chan struct{})}
+	watchdog := NewWatchdog(WatchdogConfig{Threshold: time.Second, TripBreaker: true, Registerer: prometheus.NewRegistry()})
+	router := mux.NewRouter()
+	s := NewSegment(func(writeKey string) string { return writeKey }, []Destination{dest}, router).
+		WithWatchdog(watchdog)
+
+	done := make(chan struct{})
+	go func() {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/track", strings.NewReader(`{"writeKey":"web","event":"Clicked"}`)))
+		close(done)
+	}()
+	<-dest.started
+
+	// Within the threshold the destination isn't stalled
+	s.checkStalls(time.Now())
+	if n := testutil.ToFloat64(watchdog.stalls.WithLabelValues("blockingdestination-0")); n != 0 || !s.Healthy() {
+		t.Errorf("Expected no stall, got %v", n)
+	}
+
+	// Beyond the threshold the stall is counted once, and the breaker tripped
+	for i := 0; i < 2; i++ {
+		s.checkStalls(time.Now().Add(2 * time.Second))
+	}
+	if n := testutil.ToFloat64(watchdog.stalls.WithLabelValues("blockingdestination-0")); n != 1 || s.Healthy() {
+		t.Errorf("Expected one stall and unhealthy, got %v", n)
+	}
+	if stall := testutil.ToFloat64(watchdog.stall.WithLabelValues("blockingdestination-0")); stall < 2 {
+		t.Errorf("Expected stall seconds, got %v", stall)
+	}
+
+	// Healthy again once the send completes
+	close(dest.release)
+	<-done
+	s.checkStalls(time.Now())
+	if !s.Healthy() || testutil.ToFloat64(watchdog.stall.WithLabelValues("blockingdestination-0")) != 0 {
+		t.Error("Expected recovered from stall")
+	}
+}
@@ -0,0 +1,268 @@
+package segment
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// webhookTolerance is the maximum age of a timestamped signature, to prevent replays
+const webhookTolerance = 5 * time.Minute
+
+// Webhook signature schemes
+const (
+	SignatureHMAC   = "hmac-sha256" // Hex HMAC-SHA256 of the body, with an optional "sha256=" prefix
+	SignatureStripe = "stripe"      // Stripe-Signature header of "t=<unix>,v1=<hex HMAC-SHA256 of t.body>"
+)
+
+// WebhookConfig maps third-party payloads posted to /webhooks/{name} into track events.  The fields are
+// templates over the decoded json payload, and a json array payload is a batch of payloads.
+type WebhookConfig struct {
+	Name        string `json:"name"`     // Route name eg "stripe"
+	WriteKey    string `json:"writeKey"` // Write key of the project to send events to
+	Event       string `json:"event"`    // Event name template eg "Stripe {{.type}}"
+	MessageId   string `json:"messageId,omitempty"`
+	UserId      string `json:"userId,omitempty"`
+	AnonymousId string `json:"anonymousId,omitempty"`
+	Timestamp   string `json:"timestamp,omitempty"` // Template of RFC3339 or unix seconds, defaults to received
+	// Signature scheme to verify with the Secret, defaults to SignatureHMAC if a secret is set
+	Signature       string `json:"signature,omitempty"`
+	SignatureHeader string `json:"signatureHeader,omitempty"` // Header for SignatureHMAC
+	Secret          string `json:"secret,omitempty"`
+	// Transform is applied to each event eg to map properties, in addition to the segment transforms
+	Transform Transform `json:"-"`
+}
+
+// webhook is a configured webhook with parsed templates
+type webhook struct {
+	config    WebhookConfig
+	templates map[string]*template.Template // Event field name to template
+}
+
+// newWebhook parses the templates of the config
+func newWebhook(config WebhookConfig) (*webhook, error) {
+	if config.Name == "" || config.WriteKey == "" || config.Event == "" {
+		return nil, fmt.Errorf("Webhook requires name, writeKey and event")
+	}
+	if config.Signature == "" && config.Secret != "" {
+		config.Signature = SignatureHMAC
+	}
+	switch config.Signature {
+	case "":
+	case SignatureStripe:
+	case SignatureHMAC:
+		if config.SignatureHeader == "" {
+			return nil, fmt.Errorf("Webhook %s requires signature header", config.Name)
+		}
+	default:
+		return nil, fmt.Errorf("Webhook %s unknown signature %s", config.Name, config.Signature)
+	}
+	wh := &webhook{config: config, templates: make(map[string]*template.Template)}
+	for field, text := range map[string]string{
+		"event":       config.Event,
+		"messageId":   config.MessageId,
+		"userId":      config.UserId,
+		"anonymousId": config.AnonymousId,
+		"timestamp":   config.Timestamp,
+	} {
+		if text == "" {
+			continue
+		}
+		tmpl, err := template.New(field).Funcs(templateFuncs).Option("missingkey=zero").Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("Webhook %s %s template error -- %v", config.Name, field, err)
+		}
+		wh.templates[field] = tmpl
+	}
+	return wh, nil
+}
+
+// verify checks the signature of the body for the scheme
+func (wh *webhook) verify(r *http.Request, body []byte, now time.Time) bool {
+	mac := hmac.New(sha256.New, []byte(wh.config.Secret))
+	switch wh.config.Signature {
+	case SignatureHMAC:
+		signature := strings.TrimPrefix(r.Header.Get(wh.config.SignatureHeader), "sha256=")
+		mac.Write(body)
+		expected, err := hex.DecodeString(signature)
+		return err == nil && hmac.Equal(mac.Sum(nil), expected)
+	case SignatureStripe:
+		var timestamp string
+		var signatures [][]byte
+		for _, part := range strings.Split(r.Header.Get("Stripe-Signature"), ",") {
+			key, value, _ := strings.Cut(part, "=")
+			switch key {
+			case "t":
+				timestamp = value
+			case "v1":
+				if sig, err := hex.DecodeString(value); err == nil {
+					signatures = append(signatures, sig)
+				}
+			}
+		}
+		t, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil || now.Sub(time.Unix(t, 0)).Abs() > webhookTolerance {
+			return false
+		}
+		mac.Write([]byte(timestamp + "."))
+		mac.Write(body)
+		expected := mac.Sum(nil)
+		for _, sig := range signatures {
+			if hmac.Equal(expected, sig) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// event maps a payload to a track event with the payload as properties
+func (wh *webhook) event(payload map[string]interface{}, receivedAt time.Time) (SegmentEvent, error) {
+	fields := make(map[string]string)
+	for field, tmpl := range wh.templates {
+		value, err := executeTemplate(tmpl, payload)
+		if err != nil {
+			return SegmentEvent{}, fmt.Errorf("Webhook %s %s template error -- %v", wh.config.Name, field, err)
+		}
+		fields[field] = strings.TrimSpace(value)
+	}
+	event := SegmentEvent{
+		WriteKey: wh.config.WriteKey,
+		SegmentMessage: SegmentMessage{
+			Type:        "track",
+			Event:       fields["event"],
+			MessageId:   fields["messageId"],
+			UserId:      fields["userId"],
+			AnonymousId: fields["anonymousId"],
+			ReceivedAt:  receivedAt,
+			Properties:  payload,
+			Context:     map[string]interface{}{"integration": map[string]interface{}{"name": wh.config.Name}},
+		},
+	}
+	if ts := fields["timestamp"]; ts != "" {
+		if t, err := time.Parse(time.RFC3339, ts); err == nil {
+			event.Timestamp = t
+		} else if unix, err := strconv.ParseFloat(ts, 64); err == nil {
+			event.Timestamp = time.Unix(0, int64(unix*float64(time.Second)))
+		}
+	}
+	if event.Event == "" {
+		return SegmentEvent{}, fmt.Errorf("Webhook %s event name is empty", wh.config.Name)
+	}
+	return event, nil
+}
+
+// MountWebhooks adds POST /webhooks/{name} routes that map third-party payloads into track events
+// through the pipeline, returning an error if a config is invalid
+func (s *Segment) MountWebhooks(router *mux.Router, configs ...WebhookConfig) (*Segment, error) {
+	webhooks := make(map[string]*webhook)
+	for _, config := range configs {
+		wh, err := newWebhook(config)
+		if err != nil {
+			return s, err
+		}
+		webhooks[config.Name] = wh
+	}
+	s.Logger.Printf("Adding %d webhook handlers\n", len(webhooks))
+	router.HandleFunc("/webhooks/{name}", allowMethods(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		wh, ok := webhooks[mux.Vars(r)["name"]]
+		if !ok {
+			writeError(w, http.StatusNotFound, "not_found", "Unknown webhook")
+			return
+		}
+		if !s.Ready() {
+			writeError(w, http.StatusServiceUnavailable, "not_ready", "Server is not ready")
+			return
+		}
+		s.handleWebhook(w, r, wh)
+	}, http.MethodPost))
+	return s, nil
+}
+
+// handleWebhook verifies and decodes the payload, or array of payloads, delivering an event for each
+func (s *Segment) handleWebhook(w http.ResponseWriter, r *http.Request, wh *webhook) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", "Unable to read body")
+		return
+	}
+	receivedAt := time.Now()
+	if !wh.verify(r, body, receivedAt) {
+		s.Logger.Printf("Webhook %s signature invalid\n", wh.config.Name)
+		s.audit.Record(AuditAuthFailure, wh.config.Name, s.clientIP(r), map[string]string{"reason": "webhook signature"})
+		s.drop(DropUnauthorized, 1)
+		writeError(w, http.StatusUnauthorized, "unauthorized", "Invalid webhook signature")
+		return
+	}
+
+	var payloads []map[string]interface{}
+	if bytes.HasPrefix(bytes.TrimSpace(body), []byte("[")) {
+		err = json.Unmarshal(body, &payloads)
+	} else {
+		var payload map[string]interface{}
+		err = json.Unmarshal(body, &payload)
+		payloads = append(payloads, payload)
+	}
+	if err != nil {
+		s.Logger.Printf("Webhook %s decode error -- %v\n", wh.config.Name, err)
+		if !s.quarantined(r.Context(), err, nil, body) {
+			s.drop(DropValidation, 1)
+		}
+		writeError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON: "+err.Error())
+		return
+	}
+
+	projectId := s.projectId(wh.config.WriteKey)
+	if projectId == "" {
+		s.Logger.Printf("Webhook %s unable to get projectId\n", wh.config.Name)
+		s.drop(DropUnauthorized, len(payloads))
+		writeError(w, http.StatusInternalServerError, "unauthorized", "Invalid webhook writeKey")
+		return
+	}
+	if s.overQuota(w, projectId, len(payloads)) {
+		return
+	}
+
+	events := make([]SegmentEvent, 0, len(payloads))
+	for _, payload := range payloads {
+		event, err := wh.event(payload, receivedAt)
+		if err == nil && wh.config.Transform != nil {
+			err = wh.config.Transform(r.Context(), &event)
+		}
+		if errors.Is(err, ErrDropEvent) {
+			continue
+		}
+		if err != nil {
+			s.Logger.Println(err)
+			if !s.quarantined(r.Context(), err, nil, body) {
+				s.drop(DropValidation, 1)
+			}
+			writeError(w, http.StatusBadRequest, "invalid_payload", err.Error())
+			return
+		}
+		event.ProjectId = projectId
+		events = append(events, event)
+	}
+	if err := s.deliver(r, events); err != nil {
+		s.Logger.Println("Send error", err)
+		writeError(w, http.StatusInternalServerError, "send_error", "Unable to send events")
+		return
+	}
+	s.meter.record(projectId, len(events), len(body), receivedAt)
+
+	fmt.Fprintf(w, `{ "success": true }`)
+}
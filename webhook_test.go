@@ -0,0 +1,100 @@
+package segment
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func testWebhooks(t *testing.T, configs ...WebhookConfig) (*mux.Router, *testDestination) {
+	dest := &testDestination{}
+	router := mux.NewRouter()
+	s := NewSegment(func(writeKey string) string { return strings.TrimPrefix(writeKey, "key-") }, []Destination{dest}, nil)
+	if _, err := s.MountWebhooks(router, configs...); err != nil {
+		t.Fatal(err)
+	}
+	return router, dest
+}
+
+func TestWebhookStripeSignature(t *testing.T) {
+	router, dest := testWebhooks(t, WebhookConfig{
+		Name:      "stripe",
+		WriteKey:  "key-billing",
+		Event:     "Stripe {{.type}}",
+		MessageId: "{{.id}}",
+		UserId:    "{{.data.object.metadata.userId}}",
+		Timestamp: "{{.created}}",
+		Signature: SignatureStripe,
+		Secret:    "whsec",
+	})
+	body := `{"id":"evt_1","type":"invoice.paid","created":1700000000,"data":{"object":{"metadata":{"userId":"u1"}}}}`
+	sign := func(ts int64, secret string) string {
+		mac := hmac.New(sha256.New, []byte(secret))
+		fmt.Fprintf(mac, "%d.%s", ts, body)
+		return fmt.Sprintf("t=%d,v1=%s", ts, hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	now := time.Now().Unix()
+	for signature, expected := range map[string]int{
+		sign(now, "whsec"):      http.StatusOK,
+		sign(now, "wrong"):      http.StatusUnauthorized,
+		sign(now-3600, "whsec"): http.StatusUnauthorized, // Replayed
+	} {
+		req := httptest.NewRequest("POST", "/webhooks/stripe", strings.NewReader(body))
+		req.Header.Set("Stripe-Signature", signature)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != expected {
+			t.Errorf("Expected %d for %s, got %d", expected, signature, w.Code)
+		}
+	}
+
+	sent := dest.sent()
+	if len(sent) != 1 {
+		t.Fatalf("Expected 1 event, got %d", len(sent))
+	}
+	m := sent[0].(SegmentEvent)
+	if m.Event != "Stripe invoice.paid" || m.MessageId != "evt_1" || m.UserId != "u1" || m.ProjectId != "billing" || m.Timestamp.Unix() != 1700000000 {
+		t.Errorf("Unexpected event %+v", m.SegmentMessage)
+	}
+}
+
+func TestWebhookBatch(t *testing.T) {
+	router, dest := testWebhooks(t, WebhookConfig{
+		Name:            "sendgrid",
+		WriteKey:        "key-email",
+		Event:           `Email {{.event}}`,
+		UserId:          "{{.email}}",
+		SignatureHeader: "X-Signature",
+		Secret:          "secret",
+	})
+	body := `[{"email":"a@example.com","event":"open"},{"email":"b@example.com","event":"click"}]`
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(body))
+
+	req := httptest.NewRequest("POST", "/webhooks/sendgrid", strings.NewReader(body))
+	req.Header.Set("X-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d %s", w.Code, w.Body)
+	}
+	sent := dest.sent()
+	if len(sent) != 2 || sent[1].(SegmentEvent).Event != "Email click" || sent[1].(SegmentEvent).Properties["email"] != "b@example.com" {
+		t.Errorf("Expected an event per payload, got %v", sent)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/webhooks/unknown", strings.NewReader(body)))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for unknown webhook, got %d", w.Code)
+	}
+}